@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"gioui.org/layout"
+	"gioui.org/unit"
+	"gioui.org/widget"
+	"gioui.org/widget/material"
+	materials "gioui.org/x/component"
+	"git.sr.ht/~whereswaldon/forest-go/fields"
+	"git.sr.ht/~whereswaldon/sprig/core"
+)
+
+// AuditView runs the store integrity audit and offers repairs for the
+// problems it finds.
+type AuditView struct {
+	manager ViewManager
+
+	core.App
+
+	widget.List
+	StartButton widget.Clickable
+	// Problems holds the controls for each node with problems, keyed by
+	// the node's ID
+	Problems map[string]*AuditProblemControls
+
+	// statusLock guards Status, which is set when repairs finish
+	statusLock sync.Mutex
+	Status     string
+}
+
+// AuditProblemControls holds the UI state for repairing a single node.
+type AuditProblemControls struct {
+	ID                          *fields.QualifiedHash
+	Quarantine, Delete, Refetch widget.Clickable
+}
+
+var _ View = &AuditView{}
+
+func NewAuditView(app core.App) View {
+	c := &AuditView{
+		App:      app,
+		Problems: make(map[string]*AuditProblemControls),
+	}
+	c.List.Axis = layout.Vertical
+	return c
+}
+
+func (c *AuditView) HandleIntent(intent Intent) {}
+
+func (c *AuditView) BecomeVisible() {
+	c.setStatus("")
+}
+
+func (c *AuditView) NavItem() *materials.NavItem {
+	return nil
+}
+
+func (c *AuditView) AppBarData() (bool, string, []materials.AppBarAction, []materials.OverflowAction) {
+	return true, "Store Audit", nil, nil
+}
+
+func (c *AuditView) SetManager(mgr ViewManager) {
+	c.manager = mgr
+}
+
+func (c *AuditView) setStatus(status string) {
+	c.statusLock.Lock()
+	defer c.statusLock.Unlock()
+	c.Status = status
+}
+
+func (c *AuditView) status() string {
+	c.statusLock.Lock()
+	defer c.statusLock.Unlock()
+	return c.Status
+}
+
+// repair runs a repair of the node in the background, as fetching from
+// relays can take a while.
+func (c *AuditView) repair(id *fields.QualifiedHash, verb string, action func(*fields.QualifiedHash) error) {
+	c.setStatus(fmt.Sprintf("%s %s...", verb, id))
+	go func() {
+		if err := action(id); err != nil {
+			c.setStatus(fmt.Sprintf("%s %s failed: %v", verb, id, err))
+		} else {
+			c.setStatus(fmt.Sprintf("%s %s succeeded", verb, id))
+		}
+		c.Invalidate()
+	}()
+}
+
+// controls returns the repair controls for a node, creating them if
+// needed.
+func (c *AuditView) controls(id *fields.QualifiedHash) *AuditProblemControls {
+	key := id.String()
+	controls, ok := c.Problems[key]
+	if !ok {
+		controls = &AuditProblemControls{ID: id}
+		c.Problems[key] = controls
+	}
+	return controls
+}
+
+func (c *AuditView) Update(gtx layout.Context) {
+	if c.StartButton.Clicked(gtx) {
+		c.Problems = make(map[string]*AuditProblemControls)
+		c.setStatus("")
+		c.Audit().Start()
+	}
+	for _, controls := range c.Problems {
+		if controls.Quarantine.Clicked(gtx) {
+			c.repair(controls.ID, "Quarantining", c.Audit().Quarantine)
+		}
+		if controls.Delete.Clicked(gtx) {
+			c.repair(controls.ID, "Deleting", c.Audit().Delete)
+		}
+		if controls.Refetch.Clicked(gtx) {
+			c.repair(controls.ID, "Fetching", c.Audit().Refetch)
+		}
+	}
+}
+
+// auditSummary describes the progress or outcome of an audit.
+func auditSummary(report core.AuditReport) string {
+	switch {
+	case report.Running:
+		return fmt.Sprintf("Checked %d of %d messages, %d problems so far.", report.Checked, report.Total, len(report.Problems))
+	case report.Started.IsZero():
+		return "The audit checks that every stored message is intact and correctly signed, and that the messages it refers to are stored. It runs in the background once a day."
+	case report.Err != nil:
+		return fmt.Sprintf("Audit incomplete: %v", report.Err)
+	default:
+		return fmt.Sprintf("Checked %d messages in %v and found %d problems.",
+			report.Checked, report.Finished.Sub(report.Started).Round(time.Millisecond), len(report.Problems))
+	}
+}
+
+func (c *AuditView) Layout(gtx layout.Context) layout.Dimensions {
+	theme := c.Theme().Current().Theme
+	report := c.Audit().Report()
+	items := []layout.Widget{
+		func(gtx C) D {
+			return itemInset.Layout(gtx, material.Body1(theme, auditSummary(report)).Layout)
+		},
+		func(gtx C) D {
+			if report.Running {
+				return D{}
+			}
+			label := "Start audit"
+			if !report.Started.IsZero() {
+				label = "Audit again"
+			}
+			return itemInset.Layout(gtx, material.Button(theme, &c.StartButton, label).Layout)
+		},
+		func(gtx C) D {
+			status := c.status()
+			if status == "" {
+				return D{}
+			}
+			return itemInset.Layout(gtx, material.Body2(theme, status).Layout)
+		},
+	}
+	if len(report.Problems) > 0 {
+		items = append(items, func(gtx C) D {
+			return itemInset.Layout(gtx, material.Caption(theme, "Quarantined messages are kept in "+c.Audit().QuarantineDir()+". Removing a message also removes replies to it until they are fetched again by resyncing with a relay.").Layout)
+		})
+	}
+	for _, problems := range groupAuditProblems(report.Problems) {
+		items = append(items, c.layoutProblems(theme, problems))
+	}
+	return material.List(theme, &c.List).Layout(gtx, len(items), func(gtx C, index int) D {
+		return layout.UniformInset(unit.Dp(4)).Layout(gtx, items[index])
+	})
+}
+
+// groupAuditProblems collects the problems with each node, keeping the
+// order in which the nodes were audited.
+func groupAuditProblems(problems []core.AuditProblem) [][]core.AuditProblem {
+	var groups [][]core.AuditProblem
+	index := make(map[string]int)
+	for _, problem := range problems {
+		key := problem.ID.String()
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], problem)
+	}
+	return groups
+}
+
+// layoutProblems returns a widget describing the problems with a single
+// node alongside the repairs that apply to it.
+func (c *AuditView) layoutProblems(theme *material.Theme, problems []core.AuditProblem) layout.Widget {
+	id := problems[0].ID
+	controls := c.controls(id)
+	resolved, missingOnly := true, true
+	lines := make([]layout.FlexChild, 0, len(problems)+2)
+	lines = append(lines, layout.Rigid(func(gtx C) D {
+		return itemInset.Layout(gtx, material.Body1(theme, id.String()).Layout)
+	}))
+	for _, problem := range problems {
+		text := problem.Kind.String() + ": " + problem.Detail
+		if problem.Resolution != "" {
+			text += " (" + problem.Resolution + ")"
+		} else {
+			resolved = false
+			missingOnly = missingOnly && problem.Kind.Missing()
+		}
+		lines = append(lines, layout.Rigid(func(gtx C) D {
+			return itemInset.Layout(gtx, material.Body2(theme, text).Layout)
+		}))
+	}
+	button := func(b *widget.Clickable, label string) layout.FlexChild {
+		return layout.Rigid(func(gtx C) D {
+			return itemInset.Layout(gtx, material.Button(theme, b, label).Layout)
+		})
+	}
+	refetch := "Re-fetch"
+	if missingOnly {
+		refetch = "Fetch missing"
+	}
+	if !resolved {
+		lines = append(lines, layout.Rigid(func(gtx C) D {
+			return layout.Flex{Alignment: layout.Middle}.Layout(gtx,
+				button(&controls.Refetch, refetch),
+				button(&controls.Quarantine, "Quarantine"),
+				button(&controls.Delete, "Delete"),
+			)
+		}))
+	}
+	return func(gtx C) D {
+		return layout.Flex{Axis: layout.Vertical}.Layout(gtx, lines...)
+	}
+}
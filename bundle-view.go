@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"gioui.org/layout"
+	"gioui.org/unit"
+	"gioui.org/widget"
+	"gioui.org/widget/material"
+	materials "gioui.org/x/component"
+	"git.sr.ht/~whereswaldon/forest-go"
+	"git.sr.ht/~whereswaldon/forest-go/fields"
+	"git.sr.ht/~whereswaldon/sprig/core"
+)
+
+// BundleView writes chosen communities to a node bundle and imports
+// bundles written elsewhere, for carrying messages between machines that
+// cannot reach a relay.
+type BundleView struct {
+	manager ViewManager
+
+	core.App
+
+	widget.List
+	// Communities holds the checkbox of each community, keyed by its ID
+	Communities                map[string]*widget.Bool
+	Since                      materials.TextField
+	ExportPath, ImportPath     materials.TextField
+	ExportButton, ImportButton widget.Clickable
+
+	// statusLock guards the fields below, which are set when an export or
+	// import finishes
+	statusLock sync.Mutex
+	Status     string
+	Report     *core.BundleReport
+	busy       bool
+}
+
+var _ View = &BundleView{}
+
+func NewBundleView(app core.App) View {
+	c := &BundleView{
+		App:         app,
+		Communities: make(map[string]*widget.Bool),
+	}
+	c.List.Axis = layout.Vertical
+	for _, field := range []*materials.TextField{&c.Since, &c.ExportPath, &c.ImportPath} {
+		field.SingleLine = true
+	}
+	return c
+}
+
+func (c *BundleView) HandleIntent(intent Intent) {}
+
+func (c *BundleView) BecomeVisible() {
+	c.setStatus("", nil)
+	dir, err := os.UserHomeDir()
+	if err != nil {
+		dir = ""
+	}
+	path := filepath.Join(dir, "messages"+core.BundleExtension)
+	c.ExportPath.SetText(path)
+	if c.ImportPath.Text() == "" {
+		c.ImportPath.SetText(path)
+	}
+}
+
+func (c *BundleView) NavItem() *materials.NavItem {
+	return nil
+}
+
+func (c *BundleView) AppBarData() (bool, string, []materials.AppBarAction, []materials.OverflowAction) {
+	return true, "Offline Sync", nil, nil
+}
+
+func (c *BundleView) SetManager(mgr ViewManager) {
+	c.manager = mgr
+}
+
+func (c *BundleView) setStatus(status string, report *core.BundleReport) {
+	c.statusLock.Lock()
+	defer c.statusLock.Unlock()
+	c.Status = status
+	c.Report = report
+}
+
+// run performs a bundle operation in the background unless one is already
+// running. The operation returns the status to display.
+func (c *BundleView) run(status string, operation func() (string, *core.BundleReport)) {
+	c.statusLock.Lock()
+	if c.busy {
+		c.statusLock.Unlock()
+		return
+	}
+	c.busy = true
+	c.Status = status
+	c.Report = nil
+	c.statusLock.Unlock()
+	go func() {
+		status, report := operation()
+		c.statusLock.Lock()
+		c.busy = false
+		c.Status = status
+		c.Report = report
+		c.statusLock.Unlock()
+		c.Invalidate()
+	}()
+}
+
+// selection returns the chosen communities and date.
+func (c *BundleView) selection() (core.BundleSelection, error) {
+	var selection core.BundleSelection
+	for key, box := range c.Communities {
+		if !box.Value {
+			continue
+		}
+		id := &fields.QualifiedHash{}
+		if err := id.UnmarshalText([]byte(key)); err != nil {
+			return selection, fmt.Errorf("invalid community: %w", err)
+		}
+		selection.Roots = append(selection.Roots, id)
+	}
+	if len(selection.Roots) == 0 {
+		return selection, fmt.Errorf("choose at least one community")
+	}
+	var err error
+	selection.Since, err = parseSearchDate(c.Since.Text(), false)
+	return selection, err
+}
+
+func (c *BundleView) Update(gtx layout.Context) {
+	if c.ExportButton.Clicked(gtx) {
+		if selection, err := c.selection(); err != nil {
+			c.setStatus("Failed: "+err.Error(), nil)
+		} else {
+			path := c.ExportPath.Text()
+			c.run("Writing bundle...", func() (string, *core.BundleReport) {
+				count, err := core.WriteBundleFile(c.Arbor().Store(), selection, path)
+				if err != nil {
+					return "Failed: " + err.Error(), nil
+				}
+				return fmt.Sprintf("Wrote %d nodes to %s", count, path), nil
+			})
+		}
+	}
+	if c.ImportButton.Clicked(gtx) {
+		path := c.ImportPath.Text()
+		c.run("Importing bundle...", func() (string, *core.BundleReport) {
+			report, err := core.ImportBundleFile(c.Arbor().Store(), path)
+			status := "Imported " + path + ": " + report.String()
+			if err != nil {
+				status = fmt.Sprintf("Import stopped early (%v): %s", err, report.String())
+			}
+			return status, &report
+		})
+	}
+}
+
+func (c *BundleView) Layout(gtx layout.Context) layout.Dimensions {
+	theme := c.Theme().Current().Theme
+	text := func(style func(*material.Theme, string) material.LabelStyle, s string) layout.Widget {
+		return func(gtx C) D {
+			return itemInset.Layout(gtx, style(theme, s).Layout)
+		}
+	}
+	field := func(f *materials.TextField, hint string) layout.Widget {
+		return func(gtx C) D {
+			return itemInset.Layout(gtx, func(gtx C) D {
+				return f.Layout(gtx, theme, hint)
+			})
+		}
+	}
+	button := func(b *widget.Clickable, label string) layout.Widget {
+		return func(gtx C) D {
+			return itemInset.Layout(gtx, material.Button(theme, b, label).Layout)
+		}
+	}
+	c.statusLock.Lock()
+	status, report, busy := c.Status, c.Report, c.busy
+	c.statusLock.Unlock()
+
+	items := []layout.Widget{
+		text(material.H6, "Write a bundle"),
+		text(material.Body2, "Choose the communities to include. Their authors are included too, so the bundle can be imported on a machine that has none of these messages."),
+	}
+	c.Arbor().Communities().WithCommunities(func(communities []*forest.Community) {
+		for _, community := range communities {
+			name := string(community.Name.Blob)
+			key := community.ID().String()
+			box, ok := c.Communities[key]
+			if !ok {
+				box = new(widget.Bool)
+				c.Communities[key] = box
+			}
+			items = append(items, func(gtx C) D {
+				return itemInset.Layout(gtx, material.CheckBox(theme, box, name).Layout)
+			})
+		}
+	})
+	items = append(items,
+		field(&c.Since, "Only messages since ("+searchDateLayout+", optional)"),
+		field(&c.ExportPath, "Bundle file"),
+	)
+	if !busy {
+		items = append(items, button(&c.ExportButton, "Write bundle"))
+	}
+	items = append(items,
+		text(material.H6, "Import a bundle"),
+		text(material.Body2, "Every message is checked for a valid signature and a known parent before it is stored."),
+		field(&c.ImportPath, "Bundle file"),
+	)
+	if !busy {
+		items = append(items, button(&c.ImportButton, "Import bundle"))
+	}
+	if status != "" {
+		items = append(items, text(material.Body1, status))
+	}
+	if report != nil {
+		for _, rejection := range report.Rejected {
+			node := fmt.Sprintf("node %d", rejection.Index+1)
+			if rejection.ID != nil {
+				node = rejection.ID.String()
+			}
+			items = append(items, text(material.Body2, "Rejected "+node+": "+rejection.Reason))
+		}
+	}
+	return material.List(theme, &c.List).Layout(gtx, len(items), func(gtx C, index int) D {
+		return layout.UniformInset(unit.Dp(4)).Layout(gtx, items[index])
+	})
+}
@@ -0,0 +1,915 @@
+// Command sprig-cli is a headless client for the Arbor chat system. It shares
+// its settings, keys, and message store with the sprig GUI, so it can be
+// used to script against the same identity.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"git.sr.ht/~whereswaldon/forest-go"
+	"git.sr.ht/~whereswaldon/forest-go/fields"
+	"git.sr.ht/~whereswaldon/sprig/core"
+	"golang.org/x/term"
+)
+
+// passphraseEnv names the environment variable that supplies the private
+// key passphrase to scripts.
+const passphraseEnv = "SPRIG_PASSPHRASE"
+
+const usage = `usage: sprig-cli [flags] <command> [args]
+
+commands:
+  communities                      list communities known locally and to connected relays
+  tail [-n N] <community>          print recent messages in a community and follow new ones
+  post <community|parent-id> <text>
+                                   post a message as the active identity
+  subscribe <community>            subscribe to a community
+  export [-format F] [-since DATE] [-until DATE] [-o FILE] [community|reply-id]
+                                   write stored messages as markdown, html, or json;
+                                   a reply ID exports the replies beneath it, and no
+                                   argument exports every community
+  bundle export [-since DATE] <file> <community|id>...
+                                   write communities, replies, or identities and
+                                   the nodes they depend on to a node bundle
+  bundle import <file>             validate and store the nodes in a node bundle
+  identity show                    print the active identity
+  identity list                    list local identities; * marks the active one
+  identity use <id|name>           make a local identity the active one
+  identity create [-algorithm ALG | -key FILE | -gpg KEYID] <name>
+                                   create an identity and make it active; -algorithm
+                                   picks the generated key (rsa2048, rsa3072, or
+                                   rsa4096), -key uses an armored OpenPGP secret key,
+                                   and -gpg signs with a key held by the gpg agent
+  identity passphrase              encrypt the active identity's private key or
+                                   change its passphrase
+  identity export [-plain] <file>  back up the active identity; -plain leaves the
+                                   private key in the backup unencrypted
+  identity import <file>           restore an identity backup and make it active
+
+Communities may be given by ID or by name. If the private key is encrypted,
+the passphrase is read from the SPRIG_PASSPHRASE environment variable or
+prompted for on the terminal.
+
+flags:
+`
+
+func main() {
+	dataDir, err := os.UserConfigDir()
+	if err == nil {
+		dataDir = filepath.Join(dataDir, "sprig")
+	}
+	var (
+		timeout      time.Duration
+		verbose      bool
+		migrateStore string
+	)
+	flag.StringVar(&dataDir, "data-dir", dataDir, "application state directory (shared with sprig)")
+	flag.DurationVar(&timeout, "timeout", 15*time.Second, "how long to wait for relays to connect and sync")
+	flag.BoolVar(&verbose, "v", false, "log diagnostic information to stderr")
+	flag.StringVar(&migrateStore, "migrate-store", "", "copy stored messages into the `store` (grove or orchard) and select it; sprig must not be running")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if !verbose {
+		log.SetOutput(io.Discard)
+	}
+	if migrateStore != "" {
+		if err := migrate(dataDir, core.StoreKind(migrateStore)); err != nil {
+			fmt.Fprintf(os.Stderr, "sprig-cli: %v\n", err)
+			os.Exit(1)
+		}
+		if flag.NArg() < 1 {
+			return
+		}
+	}
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	app, err := core.NewApp(dataDir, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sprig-cli: %v\n", err)
+		os.Exit(1)
+	}
+	if err := app.Arbor().StoreError(); err != nil {
+		fmt.Fprintf(os.Stderr, "sprig-cli: warning: messages will not be saved: %v\n", err)
+	}
+	c := &client{App: app, timeout: timeout}
+
+	command, args := flag.Arg(0), flag.Args()[1:]
+	switch command {
+	case "communities":
+		err = c.communities(args)
+	case "tail":
+		err = c.tail(args)
+	case "post":
+		err = c.post(args)
+	case "subscribe":
+		err = c.subscribe(args)
+	case "identity":
+		err = c.identity(args)
+	case "export":
+		err = c.export(args)
+	case "bundle":
+		err = c.bundle(args)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sprig-cli %s: %v\n", command, err)
+		os.Exit(1)
+	}
+}
+
+// migrate copies the stored messages into the store of the given kind,
+// printing progress to stderr.
+func migrate(dataDir string, to core.StoreKind) error {
+	if to != core.GroveStore && to != core.OrchardStore {
+		return fmt.Errorf("unknown store %q; use %s or %s", string(to), string(core.GroveStore), string(core.OrchardStore))
+	}
+	var (
+		last    core.StoreMigrationProgress
+		printed bool
+	)
+	err := core.MigrateStore(dataDir, to, func(progress core.StoreMigrationProgress) {
+		last, printed = progress, true
+		if progress.Verifying {
+			fmt.Fprintf(os.Stderr, "\rverifying %d nodes in %s...        ", progress.Copied-progress.Skipped, progress.To)
+		} else {
+			fmt.Fprintf(os.Stderr, "\rcopying from %s to %s: %d/%d", progress.From, progress.To, progress.Copied, progress.Total)
+		}
+	})
+	if printed {
+		fmt.Fprintln(os.Stderr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed migrating store: %w", err)
+	}
+	if last.Skipped > 0 {
+		fmt.Fprintf(os.Stderr, "skipped %d unreadable nodes\n", last.Skipped)
+	}
+	fmt.Fprintf(os.Stderr, "using the %s store\n", to)
+	return nil
+}
+
+// client implements the subcommands on top of the core services.
+type client struct {
+	core.App
+	timeout time.Duration
+}
+
+// readPassphrase prompts for a passphrase on the terminal without echoing
+// it.
+func readPassphrase(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", fmt.Errorf("cannot prompt for a passphrase: standard input is not a terminal")
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	passphrase, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("failed reading passphrase: %w", err)
+	}
+	return string(passphrase), nil
+}
+
+// unlock makes the private key of the active identity usable for signing,
+// asking for its passphrase if it is encrypted.
+func (c *client) unlock() error {
+	if !c.Settings().KeyLocked() {
+		return nil
+	}
+	passphrase, err := lookupPassphrase("Passphrase: ")
+	if err != nil {
+		return err
+	}
+	return c.Settings().UnlockKey(passphrase)
+}
+
+// lookupPassphrase returns the passphrase from the environment, or prompts
+// for it if it is not set.
+func lookupPassphrase(prompt string) (string, error) {
+	if passphrase, ok := os.LookupEnv(passphraseEnv); ok {
+		return passphrase, nil
+	}
+	passphrase, err := readPassphrase(prompt)
+	if err != nil {
+		return "", fmt.Errorf("%w (or set %s)", err, passphraseEnv)
+	}
+	return passphrase, nil
+}
+
+// waitForRelays blocks until every configured relay has finished
+// connecting and synchronizing, or until the timeout. It returns the
+// addresses of the relays that are connected.
+func (c *client) waitForRelays() []string {
+	changed := make(chan struct{}, 1)
+	id := c.Sprout().SubscribeToStateChanges(func(core.RelayStatus) {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	})
+	defer c.Sprout().UnsubscribeFromStateChanges(id)
+	deadline := time.After(c.timeout)
+	for {
+		pending := false
+		var connected []string
+		for _, addr := range c.Settings().Addresses() {
+			switch c.Sprout().State(addr).State {
+			case core.Connected:
+				connected = append(connected, addr)
+			case core.Connecting, core.Syncing:
+				pending = true
+			}
+		}
+		if !pending {
+			return connected
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return connected
+		}
+	}
+}
+
+// communities prints the communities in the local store and on the
+// connected relays.
+func (c *client) communities(args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected arguments: %v", args)
+	}
+	c.fetchCommunities(c.waitForRelays())
+	communities, err := c.knownCommunities()
+	if err != nil {
+		return err
+	}
+	subscribed := map[string]bool{}
+	for _, id := range c.Settings().Subscriptions() {
+		subscribed[id] = true
+	}
+	for _, community := range communities {
+		marker := " "
+		if subscribed[community.ID().String()] {
+			marker = "*"
+		}
+		fmt.Printf("%s %s %s\n", marker, community.ID(), community.Name.Blob)
+	}
+	return nil
+}
+
+// fetchCommunities adds the communities hosted by the given relays to the
+// local store.
+func (c *client) fetchCommunities(relays []string) {
+	for _, addr := range relays {
+		worker := c.Sprout().WorkerFor(addr)
+		if worker == nil {
+			continue
+		}
+		response, err := worker.SendList(fields.NodeTypeCommunity, 1024, time.After(c.timeout))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed listing communities on %s: %v\n", addr, err)
+			continue
+		}
+		for _, node := range response.Nodes {
+			if err := worker.IngestNode(node); err != nil {
+				log.Printf("failed ingesting community %s: %v", node.ID(), err)
+			}
+		}
+	}
+}
+
+// knownCommunities returns the communities in the local store sorted by
+// name.
+func (c *client) knownCommunities() ([]*forest.Community, error) {
+	nodes, err := c.Arbor().Store().Recent(fields.NodeTypeCommunity, 1024)
+	if err != nil && len(nodes) < 1 {
+		return nil, fmt.Errorf("failed listing communities: %w", err)
+	}
+	communities := make([]*forest.Community, 0, len(nodes))
+	for _, node := range nodes {
+		if community, ok := node.(*forest.Community); ok {
+			communities = append(communities, community)
+		}
+	}
+	sort.Slice(communities, func(i, j int) bool {
+		return string(communities[i].Name.Blob) < string(communities[j].Name.Blob)
+	})
+	return communities, nil
+}
+
+// findCommunity resolves a community ID or name.
+func (c *client) findCommunity(idOrName string) (*forest.Community, error) {
+	communities, err := c.knownCommunities()
+	if err != nil {
+		return nil, err
+	}
+	var matches []*forest.Community
+	for _, community := range communities {
+		if community.ID().String() == idOrName {
+			return community, nil
+		}
+		if strings.EqualFold(string(community.Name.Blob), idOrName) {
+			matches = append(matches, community)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no known community %q (try the communities command)", idOrName)
+	case 1:
+		return matches[0], nil
+	default:
+		return nil, fmt.Errorf("%d communities are named %q; use an ID instead", len(matches), idOrName)
+	}
+}
+
+// tail prints recent replies in a community and then new ones as they
+// arrive, until interrupted.
+func (c *client) tail(args []string) error {
+	flags := flag.NewFlagSet("tail", flag.ContinueOnError)
+	count := flags.Int("n", 20, "number of recent messages to print")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("expected a community")
+	}
+	if *count < 0 {
+		return fmt.Errorf("-n must not be negative")
+	}
+	connected := c.waitForRelays()
+	c.fetchCommunities(connected)
+	community, err := c.findCommunity(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	// follow the community on every relay even if it is not subscribed
+	for _, addr := range connected {
+		if err := c.Sprout().Synchronize(addr, []string{community.ID().String()}); err != nil {
+			fmt.Fprintf(os.Stderr, "failed synchronizing with %s: %v\n", addr, err)
+		}
+	}
+
+	s := c.Arbor().Store()
+	nodes, err := s.Recent(fields.NodeTypeReply, 4096)
+	if err != nil && len(nodes) < 1 {
+		return fmt.Errorf("failed listing replies: %w", err)
+	}
+	var replies []*forest.Reply
+	for _, node := range nodes {
+		if reply, ok := node.(*forest.Reply); ok && reply.CommunityID.Equals(community.ID()) {
+			replies = append(replies, reply)
+		}
+	}
+	sort.Slice(replies, func(i, j int) bool {
+		return replies[i].CreatedAt().Before(replies[j].CreatedAt())
+	})
+	if len(replies) > *count {
+		replies = replies[len(replies)-*count:]
+	}
+	for _, reply := range replies {
+		c.printReply(reply)
+	}
+
+	incoming := make(chan *forest.Reply, 16)
+	subscription := s.SubscribeToNewMessages(func(node forest.Node) {
+		if reply, ok := node.(*forest.Reply); ok && reply.CommunityID.Equals(community.ID()) {
+			incoming <- reply
+		}
+	})
+	defer s.UnsubscribeToNewMessages(subscription)
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	for {
+		select {
+		case reply := <-incoming:
+			c.printReply(reply)
+		case <-interrupt:
+			return nil
+		}
+	}
+}
+
+// printReply writes a single reply to stdout.
+func (c *client) printReply(reply *forest.Reply) {
+	author := "???"
+	if node, has, err := c.Arbor().Store().GetIdentity(&reply.Author); err == nil && has {
+		author = string(node.(*forest.Identity).Name.Blob)
+	}
+	fmt.Printf("%s %s %s: %s\n", reply.CreatedAt().Local().Format("2006-01-02 15:04"), reply.ID(), author, reply.Content.Blob)
+}
+
+// exportDateLayout is the format of the export command's date flags.
+const exportDateLayout = "2006-01-02"
+
+// export writes stored messages to a file or to stdout without contacting
+// any relays.
+func (c *client) export(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := flags.String("format", string(core.MarkdownExport), "output `format`: markdown, html, or json")
+	since := flags.String("since", "", "export messages from this `date` (YYYY-MM-DD)")
+	until := flags.String("until", "", "export messages until the end of this `date` (YYYY-MM-DD)")
+	output := flags.String("o", "", "write to `file` instead of stdout")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 1 {
+		return fmt.Errorf("expected at most one community or reply ID")
+	}
+	var scope core.ExportScope
+	var err error
+	if *since != "" {
+		if scope.Since, err = time.ParseInLocation(exportDateLayout, *since, time.Local); err != nil {
+			return fmt.Errorf("invalid -since date: %w", err)
+		}
+	}
+	if *until != "" {
+		if scope.Until, err = time.ParseInLocation(exportDateLayout, *until, time.Local); err != nil {
+			return fmt.Errorf("invalid -until date: %w", err)
+		}
+		scope.Until = scope.Until.AddDate(0, 0, 1).Add(-time.Millisecond)
+	}
+	if flags.NArg() == 1 {
+		if scope.Root, err = c.findExportRoot(flags.Arg(0)); err != nil {
+			return err
+		}
+	}
+	exportFormat := core.ExportFormat(*format)
+	if *output != "" {
+		count, err := core.ExportToFile(c.Arbor().Store(), scope, exportFormat, *output)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "wrote %d messages to %s\n", count, *output)
+		return nil
+	}
+	export, err := core.NewExport(c.Arbor().Store(), scope)
+	if err != nil {
+		return err
+	}
+	return export.Write(os.Stdout, exportFormat)
+}
+
+// findExportRoot resolves the ID of a stored reply, or a community ID or
+// name.
+func (c *client) findExportRoot(arg string) (*fields.QualifiedHash, error) {
+	id := &fields.QualifiedHash{}
+	if err := id.UnmarshalText([]byte(arg)); err == nil {
+		if node, has, err := c.Arbor().Store().Get(id); err == nil && has {
+			if _, ok := node.(*forest.Reply); ok {
+				return id, nil
+			}
+		}
+	}
+	community, err := c.findCommunity(arg)
+	if err != nil {
+		return nil, err
+	}
+	return community.ID(), nil
+}
+
+// bundle dispatches the node bundle subcommands.
+func (c *client) bundle(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("expected export or import")
+	}
+	switch args[0] {
+	case "export":
+		return c.exportBundle(args[1:])
+	case "import":
+		return c.importBundle(args[1:])
+	default:
+		return fmt.Errorf("unknown bundle command %q", args[0])
+	}
+}
+
+// exportBundle writes the given nodes and everything they depend on to a
+// bundle file.
+func (c *client) exportBundle(args []string) error {
+	flags := flag.NewFlagSet("bundle export", flag.ContinueOnError)
+	since := flags.String("since", "", "only bundle replies from this `date` (YYYY-MM-DD)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() < 2 {
+		return fmt.Errorf("expected a bundle file and at least one community or node ID")
+	}
+	var selection core.BundleSelection
+	if *since != "" {
+		var err error
+		if selection.Since, err = time.ParseInLocation(exportDateLayout, *since, time.Local); err != nil {
+			return fmt.Errorf("invalid -since date: %w", err)
+		}
+	}
+	for _, arg := range flags.Args()[1:] {
+		id := &fields.QualifiedHash{}
+		if err := id.UnmarshalText([]byte(arg)); err == nil {
+			if _, has, err := c.Arbor().Store().Get(id); err == nil && has {
+				selection.Roots = append(selection.Roots, id)
+				continue
+			}
+		}
+		community, err := c.findCommunity(arg)
+		if err != nil {
+			return err
+		}
+		selection.Roots = append(selection.Roots, community.ID())
+	}
+	count, err := core.WriteBundleFile(c.Arbor().Store(), selection, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("wrote %d nodes to %s\n", count, flags.Arg(0))
+	return nil
+}
+
+// importBundle stores the valid nodes in a bundle file and reports on each
+// node that was rejected.
+func (c *client) importBundle(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected a bundle file")
+	}
+	report, err := core.ImportBundleFile(c.Arbor().Store(), args[0])
+	for _, rejection := range report.Rejected {
+		node := fmt.Sprintf("node %d", rejection.Index+1)
+		if rejection.ID != nil {
+			node = rejection.ID.String()
+		}
+		fmt.Printf("rejected %s: %s\n", node, rejection.Reason)
+	}
+	fmt.Println(report)
+	return err
+}
+
+// post sends a reply to a community or to an existing reply. Blank lines
+// separate the text into a chain of replies, as in the GUI.
+func (c *client) post(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("expected a community or parent ID and the message text")
+	}
+	text := strings.TrimSpace(strings.Join(args[1:], " "))
+	if text == "" {
+		return fmt.Errorf("message text is empty")
+	}
+	var parent forest.Node
+	id := &fields.QualifiedHash{}
+	if err := id.UnmarshalText([]byte(args[0])); err == nil {
+		node, has, err := c.Arbor().Store().Get(id)
+		if err != nil {
+			return fmt.Errorf("failed looking up %s: %w", id, err)
+		}
+		if has {
+			parent = node
+		}
+	}
+	if parent == nil {
+		community, err := c.findCommunity(args[0])
+		if err != nil {
+			return err
+		}
+		parent = community
+	}
+	if err := c.unlock(); err != nil {
+		return err
+	}
+	builder, err := c.Settings().Builder()
+	if err != nil {
+		return fmt.Errorf("failed acquiring node builder: %w", err)
+	}
+	var replies []*forest.Reply
+	for _, paragraph := range strings.Split(text, "\n\n") {
+		if paragraph = strings.TrimSpace(paragraph); paragraph == "" {
+			continue
+		}
+		reply, err := builder.NewReply(parent, paragraph, []byte{})
+		if err != nil {
+			return fmt.Errorf("failed creating reply: %w", err)
+		}
+		replies = append(replies, reply)
+		parent = reply
+	}
+
+	last := replies[len(replies)-1].ID()
+	delivered := make(chan core.Delivery, 1)
+	subscription := c.Outbox().SubscribeToDeliveryChanges(func(d core.Delivery) {
+		if d.ID.Equals(last) && d.State != core.Queued {
+			select {
+			case delivered <- d:
+			default:
+			}
+		}
+	})
+	defer c.Outbox().UnsubscribeFromDeliveryChanges(subscription)
+	if err := c.Outbox().Post(builder.User, replies...); err != nil {
+		return err
+	}
+	select {
+	case d := <-delivered:
+		if d.State == core.Failed {
+			return fmt.Errorf("%s %s", last, d.Description())
+		}
+		fmt.Printf("%s %s\n", last, d.Description())
+	case <-time.After(c.timeout):
+		fmt.Printf("%s queued; it will be sent the next time sprig connects to a relay\n", last)
+	}
+	return nil
+}
+
+// subscribe adds a community to the subscriptions shared with the GUI and
+// fetches its history.
+func (c *client) subscribe(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected a community")
+	}
+	connected := c.waitForRelays()
+	c.fetchCommunities(connected)
+	community, err := c.findCommunity(args[0])
+	if err != nil {
+		return err
+	}
+	id := community.ID().String()
+	c.Settings().AddSubscription(id)
+	if err := c.Settings().Persist(); err != nil {
+		return fmt.Errorf("failed saving subscription: %w", err)
+	}
+	for _, addr := range connected {
+		if err := c.Sprout().Synchronize(addr, []string{id}); err != nil {
+			fmt.Fprintf(os.Stderr, "failed synchronizing with %s: %v\n", addr, err)
+		}
+	}
+	fmt.Printf("subscribed to %s %s\n", id, community.Name.Blob)
+	return nil
+}
+
+// identity prints and changes the active identity.
+func (c *client) identity(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("expected \"show\", \"list\", \"use\", \"create\", \"passphrase\", \"export\", or \"import\"")
+	}
+	switch args[0] {
+	case "show":
+		id, err := c.Settings().Identity()
+		if err != nil {
+			return fmt.Errorf("%w (create one with identity create)", err)
+		}
+		fmt.Printf("name: %s\nid:   %s\n", id.Name.Blob, id.ID())
+		identities, err := c.Settings().Identities()
+		if err != nil {
+			return err
+		}
+		for _, identity := range identities {
+			if identity.Active {
+				fmt.Printf("key:  %s %s\n", identity.Algorithm, identity.Fingerprint)
+			}
+		}
+		return nil
+	case "list":
+		identities, err := c.Settings().Identities()
+		if err != nil {
+			return err
+		}
+		for _, identity := range identities {
+			marker := " "
+			if identity.Active {
+				marker = "*"
+			} else if identity.Archived {
+				marker = "a"
+			}
+			fmt.Printf("%s %s %s [%s %s]\n", marker, identity.ID, identity.Name, identity.Algorithm, identity.Fingerprint)
+		}
+		return nil
+	case "use":
+		if len(args) != 2 {
+			return fmt.Errorf("expected an identity")
+		}
+		identities, err := c.Settings().Identities()
+		if err != nil {
+			return err
+		}
+		var matches []core.IdentityInfo
+		for _, identity := range identities {
+			if identity.Archived {
+				continue
+			}
+			if identity.ID.String() == args[1] {
+				matches = []core.IdentityInfo{identity}
+				break
+			}
+			if strings.EqualFold(identity.Name, args[1]) {
+				matches = append(matches, identity)
+			}
+		}
+		switch len(matches) {
+		case 0:
+			return fmt.Errorf("no local identity %q (try identity list)", args[1])
+		case 1:
+		default:
+			return fmt.Errorf("%d identities are named %q; use an ID instead", len(matches), args[1])
+		}
+		if err := c.Settings().SwitchIdentity(matches[0].ID); err != nil {
+			return err
+		}
+		fmt.Printf("now posting as %s %s\n", matches[0].Name, matches[0].ID)
+		return nil
+	case "create":
+		return c.createIdentity(args[1:])
+	case "passphrase":
+		return c.changePassphrase()
+	case "export":
+		return c.exportIdentity(args[1:])
+	case "import":
+		return c.importIdentity(args[1:])
+	default:
+		return fmt.Errorf("unknown identity command %q", args[0])
+	}
+}
+
+// createIdentity creates an identity with a new key, an existing secret
+// key, or a gpg key, and makes it active.
+func (c *client) createIdentity(args []string) error {
+	flags := flag.NewFlagSet("identity create", flag.ContinueOnError)
+	algorithm := flags.String("algorithm", string(core.DefaultKeyAlgorithm), "algorithm of the generated key")
+	keyFile := flags.String("key", "", "armored OpenPGP secret key to use")
+	gpgKey := flags.String("gpg", "", "ID, fingerprint, or email of the gpg key to sign with")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("expected a username")
+	}
+	name := flags.Arg(0)
+	var err error
+	switch {
+	case *keyFile != "" && *gpgKey != "":
+		return fmt.Errorf("-key and -gpg cannot be combined")
+	case *gpgKey != "":
+		err = c.Settings().CreateGPGIdentity(name, *gpgKey)
+	case *keyFile != "":
+		armored, readErr := ioutil.ReadFile(*keyFile)
+		if readErr != nil {
+			return fmt.Errorf("failed reading secret key: %w", readErr)
+		}
+		passphrase, passErr := lookupPassphrase("Key passphrase: ")
+		if passErr != nil {
+			return passErr
+		}
+		err = c.Settings().ImportSecretKey(name, armored, passphrase)
+	default:
+		passphrase, passErr := newPassphrase()
+		if passErr != nil {
+			return passErr
+		}
+		err = c.Settings().CreateIdentity(name, passphrase, core.KeyAlgorithm(*algorithm))
+	}
+	if err != nil {
+		return err
+	}
+	identity, err := c.Settings().Identity()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("now posting as %s %s\n", identity.Name.Blob, identity.ID())
+	return nil
+}
+
+// newPassphrase returns the passphrase from the environment, or prompts for
+// a new one twice if it is not set.
+func newPassphrase() (string, error) {
+	if passphrase, ok := os.LookupEnv(passphraseEnv); ok {
+		return passphrase, nil
+	}
+	passphrase, err := readPassphrase("New passphrase: ")
+	if err != nil {
+		return "", fmt.Errorf("%w (or set %s)", err, passphraseEnv)
+	}
+	if passphrase == "" {
+		return "", fmt.Errorf("the new passphrase is empty")
+	}
+	confirm, err := readPassphrase("Confirm new passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if passphrase != confirm {
+		return "", fmt.Errorf("the passphrases do not match")
+	}
+	return passphrase, nil
+}
+
+// changePassphrase encrypts the active identity's private key with a new
+// passphrase, replacing the old one if it was already encrypted.
+func (c *client) changePassphrase() error {
+	var (
+		old string
+		err error
+	)
+	if c.Settings().UsesExternalKey() {
+		return core.ErrExternalKey
+	}
+	if c.Settings().KeyEncrypted() {
+		if old, err = readPassphrase("Current passphrase: "); err != nil {
+			return err
+		}
+	}
+	passphrase, err := readPassphrase("New passphrase: ")
+	if err != nil {
+		return err
+	}
+	if passphrase == "" {
+		return fmt.Errorf("the new passphrase is empty")
+	}
+	confirm, err := readPassphrase("Confirm new passphrase: ")
+	if err != nil {
+		return err
+	}
+	if passphrase != confirm {
+		return fmt.Errorf("the passphrases do not match")
+	}
+	if err := c.Settings().ChangePassphrase(old, passphrase); err != nil {
+		return err
+	}
+	fmt.Println("private key encrypted with the new passphrase")
+	return nil
+}
+
+// exportIdentity writes a backup of the active identity to a file.
+func (c *client) exportIdentity(args []string) error {
+	flags := flag.NewFlagSet("identity export", flag.ContinueOnError)
+	plain := flags.Bool("plain", false, "do not encrypt the private key in the backup")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("expected a file to write the backup to")
+	}
+	if err := c.unlock(); err != nil {
+		return err
+	}
+	var passphrase string
+	if !*plain {
+		var err error
+		if passphrase, err = readPassphrase("Backup passphrase: "); err != nil {
+			return err
+		}
+		if passphrase == "" {
+			return fmt.Errorf("the backup passphrase is empty; use -plain to export without one")
+		}
+		confirm, err := readPassphrase("Confirm backup passphrase: ")
+		if err != nil {
+			return err
+		}
+		if passphrase != confirm {
+			return fmt.Errorf("the passphrases do not match")
+		}
+	}
+	bundle, err := c.Settings().ExportIdentity(passphrase)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(flags.Arg(0), bundle, 0600); err != nil {
+		return fmt.Errorf("failed writing backup: %w", err)
+	}
+	fmt.Printf("wrote backup to %s\n", flags.Arg(0))
+	return nil
+}
+
+// importIdentity restores an identity backup and makes it active. The
+// private key is stored encrypted with the backup's passphrase.
+func (c *client) importIdentity(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected a backup file")
+	}
+	bundle, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return fmt.Errorf("failed reading backup: %w", err)
+	}
+	passphrase, err := lookupPassphrase("Backup passphrase: ")
+	if err != nil {
+		return err
+	}
+	id, err := c.Settings().ImportIdentity(bundle, passphrase)
+	if err != nil {
+		return err
+	}
+	identity, err := c.Settings().Identity()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("now posting as %s %s\n", identity.Name.Blob, id)
+	return nil
+}
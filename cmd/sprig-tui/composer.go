@@ -0,0 +1,103 @@
+package main
+
+import (
+	"github.com/gdamore/tcell/v2"
+
+	"git.sr.ht/~whereswaldon/sprig/ds"
+)
+
+// composerEvent describes the result of a key press in the composer.
+type composerEvent uint8
+
+const (
+	composerNone composerEvent = iota
+	composerSubmitted
+	composerCancelled
+)
+
+// composer is a minimal multi-line text editor for writing replies.
+type composer struct {
+	// active is whether a message is being written.
+	active bool
+	// replyingTo is the reply being answered, or nil when starting a
+	// conversation.
+	replyingTo *ds.ReplyData
+	text       []rune
+	cursor     int
+}
+
+// StartReply begins composing a reply to the given message.
+func (c *composer) StartReply(to ds.ReplyData) {
+	c.Reset()
+	c.active = true
+	c.replyingTo = &to
+}
+
+// StartConversation begins composing a new conversation.
+func (c *composer) StartConversation() {
+	c.Reset()
+	c.active = true
+}
+
+// Reset discards the message being written.
+func (c *composer) Reset() {
+	c.active = false
+	c.replyingTo = nil
+	c.text = c.text[:0]
+	c.cursor = 0
+}
+
+// Text returns the message being written.
+func (c *composer) Text() string {
+	return string(c.text)
+}
+
+// insert adds runes at the cursor.
+func (c *composer) insert(r ...rune) {
+	c.text = append(c.text[:c.cursor], append(r, c.text[c.cursor:]...)...)
+	c.cursor += len(r)
+}
+
+// HandleKey applies a key press to the message being written. Enter submits
+// the message and Alt+Enter or Ctrl+J starts a new line. Blank lines
+// separate the message into a chain of replies, as in the GUI.
+func (c *composer) HandleKey(event *tcell.EventKey) composerEvent {
+	switch event.Key() {
+	case tcell.KeyEscape:
+		return composerCancelled
+	case tcell.KeyEnter:
+		if event.Modifiers()&tcell.ModAlt == 0 {
+			return composerSubmitted
+		}
+		c.insert('\n')
+	case tcell.KeyCtrlJ:
+		c.insert('\n')
+	case tcell.KeyBackspace, tcell.KeyBackspace2:
+		if c.cursor > 0 {
+			c.text = append(c.text[:c.cursor-1], c.text[c.cursor:]...)
+			c.cursor--
+		}
+	case tcell.KeyDelete, tcell.KeyCtrlD:
+		if c.cursor < len(c.text) {
+			c.text = append(c.text[:c.cursor], c.text[c.cursor+1:]...)
+		}
+	case tcell.KeyLeft, tcell.KeyCtrlB:
+		if c.cursor > 0 {
+			c.cursor--
+		}
+	case tcell.KeyRight, tcell.KeyCtrlF:
+		if c.cursor < len(c.text) {
+			c.cursor++
+		}
+	case tcell.KeyHome, tcell.KeyCtrlA:
+		c.cursor = 0
+	case tcell.KeyEnd, tcell.KeyCtrlE:
+		c.cursor = len(c.text)
+	case tcell.KeyCtrlU:
+		c.text = c.text[:0]
+		c.cursor = 0
+	case tcell.KeyRune:
+		c.insert(event.Rune())
+	}
+	return composerNone
+}
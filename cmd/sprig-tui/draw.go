@@ -0,0 +1,339 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/mattn/go-runewidth"
+
+	"git.sr.ht/~whereswaldon/sprig/core"
+	"git.sr.ht/~whereswaldon/sprig/ds"
+)
+
+const (
+	// communityPaneWidth is the widest the community list will be.
+	communityPaneWidth = 24
+	// composerLines is the number of lines of text shown while composing.
+	composerLines = 4
+)
+
+var (
+	baseStyle    = tcell.StyleDefault
+	dimStyle     = baseStyle.Dim(true)
+	boldStyle    = baseStyle.Bold(true)
+	barStyle     = baseStyle.Reverse(true)
+	selectStyle  = baseStyle.Foreground(tcell.ColorBlue).Bold(true)
+	ancestorBar  = baseStyle.Foreground(tcell.ColorYellow)
+	descendedBar = baseStyle.Foreground(tcell.ColorGreen)
+)
+
+// line is a single line of the message list.
+type line struct {
+	text   string
+	style  tcell.Style
+	gutter tcell.Style
+}
+
+// drawText writes text starting at (x, y) without passing maxX. It returns
+// the column after the last rune written.
+func (u *ui) drawText(x, y, maxX int, style tcell.Style, text string) int {
+	for _, r := range text {
+		width := runewidth.RuneWidth(r)
+		if width == 0 {
+			continue
+		}
+		if x+width > maxX {
+			break
+		}
+		u.screen.SetContent(x, y, r, nil, style)
+		x += width
+	}
+	return x
+}
+
+// fill sets every cell in the row from x to maxX to style.
+func (u *ui) fill(x, y, maxX int, style tcell.Style) {
+	for ; x < maxX; x++ {
+		u.screen.SetContent(x, y, ' ', nil, style)
+	}
+}
+
+// wrap breaks text into lines no wider than width, preferring to break
+// between words.
+func wrap(text string, width int) []string {
+	if width < 1 {
+		return nil
+	}
+	var out []string
+	for _, paragraph := range strings.Split(text, "\n") {
+		var (
+			current      strings.Builder
+			currentWidth int
+		)
+		flush := func() {
+			out = append(out, current.String())
+			current.Reset()
+			currentWidth = 0
+		}
+		for i, word := range strings.Split(paragraph, " ") {
+			wordWidth := runewidth.StringWidth(word)
+			if i > 0 {
+				if currentWidth+1+wordWidth <= width {
+					current.WriteByte(' ')
+					currentWidth++
+				} else {
+					flush()
+				}
+			}
+			for _, r := range word {
+				rw := runewidth.RuneWidth(r)
+				if currentWidth+rw > width {
+					flush()
+				}
+				current.WriteRune(r)
+				currentWidth += rw
+			}
+		}
+		flush()
+	}
+	return out
+}
+
+// draw renders the whole interface.
+func (u *ui) draw() {
+	u.screen.Clear()
+	u.screen.HideCursor()
+	width, height := u.screen.Size()
+	listWidth := communityPaneWidth
+	if listWidth > width/3 {
+		listWidth = width / 3
+	}
+	bottom := height - 1
+	if u.composer.active {
+		bottom -= composerLines + 1
+	}
+	if bottom < 1 {
+		return
+	}
+	u.drawCommunities(0, 0, listWidth, bottom)
+	for y := 0; y < bottom; y++ {
+		u.screen.SetContent(listWidth, y, tcell.RuneVLine, nil, dimStyle)
+	}
+	u.drawMessages(listWidth+1, 0, width, bottom)
+	if u.composer.active {
+		u.drawComposer(0, bottom, width, height-1)
+	}
+	u.drawStatus(height-1, width)
+	u.screen.Show()
+}
+
+// drawCommunities renders the community list into the given rectangle.
+func (u *ui) drawCommunities(minX, minY, maxX, maxY int) {
+	headerStyle := dimStyle
+	if u.pane == communityPane {
+		headerStyle = boldStyle
+	}
+	u.drawText(minX+1, minY, maxX, headerStyle, "Communities")
+	subscribed := map[string]bool{}
+	for _, id := range u.Settings().Subscriptions() {
+		subscribed[id] = true
+	}
+	entries := []string{"  All"}
+	selected := 0
+	for i, community := range u.communities() {
+		marker := "  "
+		if subscribed[community.ID().String()] {
+			marker = "* "
+		}
+		entries = append(entries, marker+string(community.Name.Blob))
+		if u.community != nil && community.ID().Equals(u.community.ID()) {
+			selected = i + 1
+		}
+	}
+	for i, entry := range entries {
+		y := minY + 1 + i
+		if y >= maxY {
+			break
+		}
+		style := baseStyle
+		if i == selected {
+			style = boldStyle
+		}
+		if u.pane == communityPane && i == u.communityIndex {
+			style = style.Reverse(true)
+			u.fill(minX, y, maxX, style)
+		}
+		u.drawText(minX, y, maxX, style, entry)
+	}
+}
+
+// messageLines lays out the visible replies. It returns the lines along
+// with the first and last line of the focused reply, which are -1 if no
+// reply is focused.
+func (u *ui) messageLines(width int) (lines []line, focusStart, focusEnd int) {
+	focusStart, focusEnd = -1, -1
+	focusing := u.Focused != nil
+	u.withVisible(func(replies []ds.ReplyData) {
+		for _, reply := range replies {
+			status := u.statusOf(reply)
+			style, gutter := baseStyle, baseStyle
+			switch {
+			case status.Contains(ds.Selected):
+				style, gutter = boldStyle, selectStyle
+				focusStart = len(lines)
+			case status.Contains(ds.Ancestor):
+				gutter = ancestorBar
+			case status.Contains(ds.Descendant):
+				gutter = descendedBar
+			case focusing && status.Contains(ds.None|ds.ConversationRoot):
+				style = dimStyle
+			}
+			author := reply.AuthorName
+			if reply.Signature == ds.SignatureUnverifiable {
+				author = "(unknown author)"
+			}
+			header := fmt.Sprintf("%s  %s", author, reply.CreatedAt.Local().Format("Jan 02 15:04"))
+			if u.community == nil {
+				header += "  #" + reply.CommunityName
+			}
+			if delivery, ok := u.Outbox().Delivery(reply.ID); ok {
+				header += "  (" + delivery.Description() + ")"
+			}
+			lines = append(lines, line{text: header, style: style.Bold(true), gutter: gutter})
+			for _, text := range wrap(reply.Content, width-2) {
+				lines = append(lines, line{text: text, style: style, gutter: gutter})
+			}
+			if status.Contains(ds.Anchor) {
+				hidden := fmt.Sprintf("[%d replies hidden]", u.HiddenTracker.NumDescendants(reply.ID))
+				lines = append(lines, line{text: hidden, style: dimStyle, gutter: gutter})
+			}
+			if status.Contains(ds.Selected) {
+				focusEnd = len(lines) - 1
+			}
+		}
+	})
+	return lines, focusStart, focusEnd
+}
+
+// drawMessages renders the message list into the given rectangle, scrolling
+// to keep the focused message visible.
+func (u *ui) drawMessages(minX, minY, maxX, maxY int) {
+	height := maxY - minY
+	lines, focusStart, focusEnd := u.messageLines(maxX - minX)
+	if len(lines) == 0 {
+		u.drawText(minX+2, minY, maxX, dimStyle, "No messages. Subscribe to communities in sprig or with sprig-cli.")
+		return
+	}
+	if u.follow {
+		u.top = len(lines) - height
+	} else if focusStart >= 0 {
+		if focusStart < u.top {
+			u.top = focusStart
+		} else if focusEnd >= u.top+height {
+			u.top = focusEnd - height + 1
+			if u.top > focusStart {
+				u.top = focusStart
+			}
+		}
+	}
+	if u.top > len(lines)-height {
+		u.top = len(lines) - height
+	}
+	if u.top < 0 {
+		u.top = 0
+	}
+	for i := 0; i < height && u.top+i < len(lines); i++ {
+		l := lines[u.top+i]
+		y := minY + i
+		if l.gutter != baseStyle {
+			u.screen.SetContent(minX, y, '▌', nil, l.gutter)
+		}
+		u.drawText(minX+2, y, maxX, l.style, l.text)
+	}
+}
+
+// drawComposer renders the message being written into the given rectangle
+// and places the cursor.
+func (u *ui) drawComposer(minX, minY, maxX, maxY int) {
+	var header string
+	if to := u.composer.replyingTo; to != nil {
+		header = fmt.Sprintf("Replying to %s: %s", to.AuthorName, strings.ReplaceAll(to.Content, "\n", " "))
+	} else {
+		header = "New conversation in " + string(u.community.Name.Blob)
+	}
+	u.fill(minX, minY, maxX, barStyle)
+	u.drawText(minX+1, minY, maxX, barStyle, header)
+	// lay out the text by character so that the cursor can be placed
+	type cell struct {
+		r    rune
+		x, y int
+	}
+	var (
+		cells            []cell
+		x, y             int
+		cursorX, cursorY int
+		width            = maxX - minX - 2
+	)
+	for i, r := range u.composer.text {
+		if i == u.composer.cursor {
+			cursorX, cursorY = x, y
+		}
+		if r == '\n' {
+			x, y = 0, y+1
+			continue
+		}
+		rw := runewidth.RuneWidth(r)
+		if x+rw > width {
+			x, y = 0, y+1
+		}
+		cells = append(cells, cell{r: r, x: x, y: y})
+		x += rw
+	}
+	if u.composer.cursor >= len(u.composer.text) {
+		cursorX, cursorY = x, y
+	}
+	first := 0
+	if cursorY >= composerLines {
+		first = cursorY - composerLines + 1
+	}
+	for _, c := range cells {
+		if c.y >= first && c.y < first+composerLines {
+			u.screen.SetContent(minX+1+c.x, minY+1+c.y-first, c.r, nil, baseStyle)
+		}
+	}
+	u.screen.ShowCursor(minX+1+cursorX, minY+1+cursorY-first)
+}
+
+// drawStatus renders the status bar on row y.
+func (u *ui) drawStatus(y, width int) {
+	u.fill(0, y, width, barStyle)
+	connected, addresses := 0, u.Settings().Addresses()
+	for _, addr := range addresses {
+		if u.Sprout().State(addr).State == core.Connected {
+			connected++
+		}
+	}
+	text := u.status
+	if text == "" {
+		switch {
+		case u.unlocking:
+			text = "passphrase (enter unlock, esc cancel): " + strings.Repeat("*", len(u.passphrase))
+		case u.composer.active:
+			text = "enter send  alt+enter newline  esc cancel"
+		case u.pane == communityPane:
+			text = "j/k move  enter choose  tab messages  q quit"
+		default:
+			text = "j/k move  enter reply  c new  space filter  d hide  L lock  tab communities  q quit"
+		}
+	}
+	right := fmt.Sprintf(" filter: %s | relays %d/%d ", u.filter, connected, len(addresses))
+	if u.Arbor().Incognito() {
+		right = " incognito |" + right
+	} else if u.Arbor().StoreError() != nil {
+		right = " NOT SAVING |" + right
+	}
+	rightX := width - runewidth.StringWidth(right)
+	u.drawText(1, y, rightX, barStyle, text)
+	u.drawText(rightX, y, width, barStyle, right)
+}
@@ -0,0 +1,76 @@
+// Command sprig-tui is a full-screen terminal client for the Arbor chat
+// system. It shares its settings, keys, and message store with the sprig
+// GUI and offers the same keyboard-driven message browsing, so it can be
+// used on servers and over SSH.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/gdamore/tcell/v2"
+
+	"git.sr.ht/~whereswaldon/sprig/core"
+)
+
+func main() {
+	dataDir, err := os.UserConfigDir()
+	if err == nil {
+		dataDir = filepath.Join(dataDir, "sprig")
+	}
+	var (
+		logPath   string
+		incognito bool
+	)
+	flag.StringVar(&dataDir, "data-dir", dataDir, "application state directory (shared with sprig)")
+	flag.StringVar(&logPath, "log", "", "write diagnostic information to this file")
+	flag.BoolVar(&incognito, "incognito", false, "keep messages in memory only for this session")
+	flag.Parse()
+
+	log.SetOutput(io.Discard)
+	if logPath != "" {
+		logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0660)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "sprig-tui: %v\n", err)
+			os.Exit(1)
+		}
+		defer logFile.Close()
+		log.SetOutput(logFile)
+	}
+
+	var options []core.AppOption
+	if incognito {
+		options = append(options, core.Incognito())
+	}
+	app, err := core.NewApp(dataDir, nil, options...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sprig-tui: %v\n", err)
+		os.Exit(1)
+	}
+	if err := app.Arbor().StoreError(); err != nil {
+		fmt.Fprintf(os.Stderr, "sprig-tui: messages will not be saved: %v\nPress enter to continue or ctrl+c to quit.", err)
+		fmt.Scanln()
+	}
+	defer app.Shutdown()
+	if _, err := app.Settings().Identity(); err != nil {
+		fmt.Fprintf(os.Stderr, "sprig-tui: %v (create one in sprig first)\n", err)
+		os.Exit(1)
+	}
+
+	screen, err := tcell.NewScreen()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sprig-tui: %v\n", err)
+		os.Exit(1)
+	}
+	if err := screen.Init(); err != nil {
+		fmt.Fprintf(os.Stderr, "sprig-tui: %v\n", err)
+		os.Exit(1)
+	}
+	defer screen.Fini()
+
+	newUI(app, screen).Run()
+}
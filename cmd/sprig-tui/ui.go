@@ -0,0 +1,558 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"git.sr.ht/~athorp96/forest-ex/expiration"
+	forest "git.sr.ht/~whereswaldon/forest-go"
+	"git.sr.ht/~whereswaldon/forest-go/fields"
+	"git.sr.ht/~whereswaldon/forest-go/twig"
+	"github.com/gdamore/tcell/v2"
+
+	"git.sr.ht/~whereswaldon/sprig/core"
+	"git.sr.ht/~whereswaldon/sprig/ds"
+)
+
+// filterState controls which messages are shown relative to the focused
+// message. It cycles in the same order as the GUI's filter.
+type filterState uint8
+
+const (
+	filterOff filterState = iota
+	filterConversation
+	filterMessage
+)
+
+func (f filterState) String() string {
+	switch f {
+	case filterConversation:
+		return "conversation"
+	case filterMessage:
+		return "thread"
+	default:
+		return "off"
+	}
+}
+
+// pane identifies the part of the interface receiving key presses.
+type pane uint8
+
+const (
+	messagePane pane = iota
+	communityPane
+)
+
+// historyRequestCount is the number of recent replies loaded at startup.
+const historyRequestCount = 2048
+
+// ui holds the state of the terminal interface. All of its fields are
+// owned by the goroutine executing Run; other goroutines must go through
+// post.
+type ui struct {
+	core.App
+	screen tcell.Screen
+
+	ds.AlphaReplyList
+	ds.FocusTracker
+	ds.HiddenTracker
+	filter filterState
+
+	pane pane
+	// communityIndex is the highlighted entry of the community list. Zero
+	// is "all communities".
+	communityIndex int
+	// community restricts the message list, if set.
+	community *forest.Community
+
+	// top is the first line of the message list on screen. If follow is
+	// set, the list is kept scrolled to the end instead.
+	top    int
+	follow bool
+
+	composer composer
+	status   string
+	quit     bool
+
+	// unlocking is set while the passphrase of the private key is being
+	// entered into passphrase.
+	unlocking  bool
+	passphrase []rune
+}
+
+func newUI(app core.App, screen tcell.Screen) *ui {
+	u := &ui{
+		App:    app,
+		screen: screen,
+		follow: true,
+	}
+	u.unlocking = app.Settings().KeyLocked()
+	u.AlphaReplyList.FilterWith(func(rd ds.ReplyData) bool {
+		if _, ok := rd.Metadata.Values[twig.Key{Name: "invisible", Version: 1}]; ok {
+			return false
+		}
+		if expired, err := expiration.IsExpiredTwig(rd.Metadata); err != nil || expired {
+			return false
+		}
+		return true
+	})
+	app.Arbor().Store().SubscribeToNewMessages(func(node forest.Node) {
+		go func() {
+			if _, ok := node.(*forest.Identity); ok {
+				u.post(func() {
+					u.AlphaReplyList.RecheckAuthor(node.ID(), app.Arbor().Store())
+				})
+				return
+			}
+			var rd ds.ReplyData
+			if !rd.Populate(node, app.Arbor().Store()) {
+				u.post(nil)
+				return
+			}
+			u.post(func() {
+				u.AlphaReplyList.Insert(rd)
+				u.HiddenTracker.Process(node)
+				u.FocusTracker.Invalidate()
+			})
+		}()
+	})
+	app.Sprout().SubscribeToStateChanges(func(core.RelayStatus) {
+		u.post(nil)
+	})
+	app.Outbox().SubscribeToDeliveryChanges(func(core.Delivery) {
+		u.post(nil)
+	})
+	u.loadHistory()
+	return u
+}
+
+// post runs f on the interface goroutine and redraws the screen. A nil f
+// only redraws.
+func (u *ui) post(f func()) {
+	if err := u.screen.PostEvent(tcell.NewEventInterrupt(f)); err != nil {
+		log.Printf("dropped interface update: %v", err)
+	}
+}
+
+// loadHistory populates the message list from the store.
+func (u *ui) loadHistory() {
+	nodes, err := u.Arbor().Store().Recent(fields.NodeTypeReply, historyRequestCount)
+	if err != nil {
+		log.Printf("failed loading history: %v", err)
+	}
+	populated := make([]ds.ReplyData, 0, len(nodes))
+	for _, node := range nodes {
+		var rd ds.ReplyData
+		if rd.Populate(node, u.Arbor().Store()) {
+			populated = append(populated, rd)
+		}
+	}
+	u.AlphaReplyList.Insert(populated...)
+}
+
+// Run processes input until the user quits.
+func (u *ui) Run() {
+	for !u.quit {
+		u.FocusTracker.RefreshNodeStatus(u.Arbor().Store())
+		u.draw()
+		switch event := u.screen.PollEvent().(type) {
+		case nil:
+			return
+		case *tcell.EventResize:
+			u.screen.Sync()
+		case *tcell.EventInterrupt:
+			if f, ok := event.Data().(func()); ok && f != nil {
+				f()
+			}
+		case *tcell.EventKey:
+			u.handleKey(event)
+		}
+	}
+}
+
+// communities returns the known communities in display order.
+func (u *ui) communities() (out []*forest.Community) {
+	u.Arbor().Communities().WithCommunities(func(communities []*forest.Community) {
+		out = append(out, communities...)
+	})
+	return out
+}
+
+// statusOf returns the display status of a reply. It mirrors the GUI's
+// reply list, using the FocusTracker to relate the reply to the focused one.
+func (u *ui) statusOf(reply ds.ReplyData) (status ds.ReplyStatus) {
+	if u.HiddenTracker.IsAnchor(reply.ID) {
+		status |= ds.Anchor
+	}
+	if u.HiddenTracker.IsHidden(reply.ID) {
+		status |= ds.Hidden
+	}
+	if relation := u.FocusTracker.StatusFor(reply); relation != 0 {
+		return status | relation
+	}
+	if u.Focused != nil && reply.Depth == 1 {
+		return status | ds.ConversationRoot
+	}
+	return status | ds.None
+}
+
+// shouldFilter returns whether a reply with the given status is hidden by
+// the current filter.
+func (u *ui) shouldFilter(status ds.ReplyStatus) bool {
+	if status.Contains(ds.Hidden) {
+		return true
+	}
+	switch u.filter {
+	case filterConversation:
+		return status.Contains(ds.None | ds.ConversationRoot)
+	case filterMessage:
+		return status.Contains(ds.Sibling | ds.None | ds.ConversationRoot)
+	default:
+		return false
+	}
+}
+
+// visible reports whether a reply belongs in the message list.
+func (u *ui) visible(reply ds.ReplyData) bool {
+	if u.community != nil && !reply.CommunityID.Equals(u.community.ID()) {
+		return false
+	}
+	return !u.shouldFilter(u.statusOf(reply))
+}
+
+// withVisible invokes f with the replies in the message list.
+func (u *ui) withVisible(f func(replies []ds.ReplyData)) {
+	u.AlphaReplyList.WithReplies(func(all []ds.ReplyData) {
+		replies := make([]ds.ReplyData, 0, len(all))
+		for _, reply := range all {
+			if u.visible(reply) {
+				replies = append(replies, reply)
+			}
+		}
+		f(replies)
+	})
+}
+
+// handleKey dispatches a key press to the composer or the focused pane.
+func (u *ui) handleKey(event *tcell.EventKey) {
+	u.status = ""
+	if u.unlocking {
+		u.handlePassphraseKey(event)
+		return
+	}
+	if u.composer.active {
+		switch u.composer.HandleKey(event) {
+		case composerSubmitted:
+			u.sendReply()
+		case composerCancelled:
+			u.composer.Reset()
+		}
+		return
+	}
+	switch event.Key() {
+	case tcell.KeyCtrlC:
+		u.quit = true
+		return
+	case tcell.KeyTab, tcell.KeyBacktab:
+		if u.pane == messagePane {
+			u.pane = communityPane
+		} else {
+			u.pane = messagePane
+		}
+		return
+	}
+	if event.Key() == tcell.KeyRune && event.Rune() == 'q' {
+		u.quit = true
+		return
+	}
+	if u.pane == communityPane {
+		u.handleCommunityKey(event)
+	} else {
+		u.handleMessageKey(event)
+	}
+}
+
+// handlePassphraseKey processes key presses while the passphrase is being
+// entered. A message waiting in the composer is sent once the key is
+// unlocked.
+func (u *ui) handlePassphraseKey(event *tcell.EventKey) {
+	switch event.Key() {
+	case tcell.KeyCtrlC:
+		u.quit = true
+	case tcell.KeyEscape:
+		u.unlocking = false
+		u.passphrase = u.passphrase[:0]
+		u.status = "Private key is locked; messages cannot be sent"
+	case tcell.KeyEnter:
+		err := u.Settings().UnlockKey(string(u.passphrase))
+		u.passphrase = u.passphrase[:0]
+		if err != nil {
+			u.status = fmt.Sprintf("Failed unlocking: %v", err)
+			return
+		}
+		u.unlocking = false
+		if u.composer.active {
+			u.sendReply()
+		}
+	case tcell.KeyBackspace, tcell.KeyBackspace2:
+		if len(u.passphrase) > 0 {
+			u.passphrase = u.passphrase[:len(u.passphrase)-1]
+		}
+	case tcell.KeyCtrlU:
+		u.passphrase = u.passphrase[:0]
+	case tcell.KeyRune:
+		u.passphrase = append(u.passphrase, event.Rune())
+	}
+}
+
+// handleCommunityKey processes key presses in the community list.
+func (u *ui) handleCommunityKey(event *tcell.EventKey) {
+	communities := u.communities()
+	move := func(by int) {
+		u.communityIndex += by
+		if u.communityIndex < 0 {
+			u.communityIndex = 0
+		} else if u.communityIndex > len(communities) {
+			u.communityIndex = len(communities)
+		}
+	}
+	switch event.Key() {
+	case tcell.KeyUp:
+		move(-1)
+	case tcell.KeyDown:
+		move(1)
+	case tcell.KeyEnter:
+		u.community = nil
+		if u.communityIndex > 0 && u.communityIndex <= len(communities) {
+			u.community = communities[u.communityIndex-1]
+		}
+		u.pane = messagePane
+		u.follow = true
+		if u.Focused != nil && !u.visible(*u.Focused) {
+			u.FocusTracker.SetFocus(nil)
+		}
+	case tcell.KeyRune:
+		switch event.Rune() {
+		case 'k', 'K':
+			move(-1)
+		case 'j', 'J':
+			move(1)
+		}
+	}
+}
+
+// handleMessageKey processes key presses in the message list. The bindings
+// match ReplyListView.Update in the GUI.
+func (u *ui) handleMessageKey(event *tcell.EventKey) {
+	switch event.Key() {
+	case tcell.KeyUp:
+		u.moveFocus(-1)
+	case tcell.KeyDown:
+		u.moveFocus(1)
+	case tcell.KeyHome:
+		u.moveFocusStart()
+	case tcell.KeyEnd:
+		u.moveFocusEnd()
+	case tcell.KeyPgUp:
+		u.moveFocus(-10)
+	case tcell.KeyPgDn:
+		u.moveFocus(10)
+	case tcell.KeyEnter:
+		u.startReply()
+	case tcell.KeyBackspace, tcell.KeyBackspace2:
+		if event.Modifiers()&tcell.ModShift != 0 {
+			u.toggleConversationHidden()
+		} else {
+			u.toggleDescendantsHidden()
+		}
+	case tcell.KeyEscape:
+		u.composer.Reset()
+	case tcell.KeyRune:
+		switch event.Rune() {
+		case 'k', 'K':
+			u.moveFocus(-1)
+		case 'j', 'J':
+			u.moveFocus(1)
+		case 'g':
+			u.moveFocusStart()
+		case 'G':
+			u.moveFocusEnd()
+		case 'c', 'C':
+			u.startConversation()
+		case ' ', 'f', 'F':
+			u.toggleFilter()
+		case 'd':
+			u.toggleDescendantsHidden()
+		case 'D':
+			u.toggleConversationHidden()
+		case 'L':
+			u.Settings().LockKey()
+			u.unlocking = u.Settings().KeyLocked()
+		}
+	}
+}
+
+// moveFocus shifts the focused message by the provided number of visible
+// messages. If nothing is focused, the last message is focused.
+func (u *ui) moveFocus(by int) {
+	u.withVisible(func(replies []ds.ReplyData) {
+		if len(replies) < 1 {
+			return
+		}
+		index := len(replies) - 1
+		if u.Focused != nil {
+			for i := range replies {
+				if replies[i].ID.Equals(u.Focused.ID) {
+					index = i + by
+					break
+				}
+			}
+		}
+		if index < 0 {
+			index = 0
+		} else if index >= len(replies) {
+			index = len(replies) - 1
+		}
+		u.FocusTracker.SetFocus(&replies[index])
+		u.follow = index == len(replies)-1
+	})
+}
+
+// moveFocusStart focuses the first visible message.
+func (u *ui) moveFocusStart() {
+	u.withVisible(func(replies []ds.ReplyData) {
+		if len(replies) > 0 {
+			u.FocusTracker.SetFocus(&replies[0])
+			u.follow = false
+			u.top = 0
+		}
+	})
+}
+
+// moveFocusEnd focuses the last visible message.
+func (u *ui) moveFocusEnd() {
+	u.withVisible(func(replies []ds.ReplyData) {
+		if len(replies) > 0 {
+			u.FocusTracker.SetFocus(&replies[len(replies)-1])
+			u.follow = true
+		}
+	})
+}
+
+// toggleFilter cycles between filter states.
+func (u *ui) toggleFilter() {
+	if u.Focused == nil {
+		u.status = "Select a message to filter by"
+		return
+	}
+	switch u.filter {
+	case filterConversation:
+		u.filter = filterMessage
+	case filterMessage:
+		u.filter = filterOff
+	default:
+		u.filter = filterConversation
+	}
+	u.FocusTracker.Invalidate()
+}
+
+// toggleDescendantsHidden hides the descendants of the focused message (or
+// reveals them).
+func (u *ui) toggleDescendantsHidden() {
+	if u.Focused == nil {
+		return
+	}
+	if err := u.HiddenTracker.ToggleAnchor(u.Focused.ID, u.Arbor().Store()); err != nil {
+		u.status = fmt.Sprintf("Failed hiding replies: %v", err)
+	}
+}
+
+// toggleConversationHidden hides the descendants of the focused message's
+// conversation (or reveals them).
+func (u *ui) toggleConversationHidden() {
+	if u.Focused == nil {
+		return
+	}
+	rootID := u.Focused.ConversationID
+	if rootID.Equals(fields.NullHash()) {
+		// the focused message is the root of a conversation
+		rootID = u.Focused.ID
+	}
+	u.AlphaReplyList.WithReplies(func(replies []ds.ReplyData) {
+		for i := range replies {
+			if replies[i].ID.Equals(rootID) {
+				u.FocusTracker.SetFocus(&replies[i])
+				if err := u.HiddenTracker.ToggleAnchor(rootID, u.Arbor().Store()); err != nil {
+					u.status = fmt.Sprintf("Failed hiding conversation: %v", err)
+				}
+				return
+			}
+		}
+	})
+}
+
+// startReply begins replying to the focused message.
+func (u *ui) startReply() {
+	if u.Focused == nil {
+		u.status = "Select a message to reply to"
+		return
+	}
+	u.composer.StartReply(*u.Focused)
+}
+
+// startConversation begins a new conversation in the selected community.
+func (u *ui) startConversation() {
+	if u.community == nil {
+		u.status = "Choose a community (Tab) to start a conversation in"
+		return
+	}
+	u.composer.StartConversation()
+}
+
+// sendReply posts the composed message as the active identity.
+func (u *ui) sendReply() {
+	if u.Settings().KeyLocked() {
+		// keep the message until the key has been unlocked
+		u.unlocking = true
+		return
+	}
+	defer u.composer.Reset()
+	text := strings.TrimSpace(u.composer.Text())
+	if text == "" {
+		return
+	}
+	builder, err := u.Settings().Builder()
+	if err != nil {
+		u.status = fmt.Sprintf("Failed acquiring node builder: %v", err)
+		return
+	}
+	var parent forest.Node = u.community
+	if u.composer.replyingTo != nil {
+		node, has, err := u.Arbor().Store().Get(u.composer.replyingTo.ID)
+		if err != nil || !has {
+			u.status = fmt.Sprintf("Failed finding parent message %v: %v", u.composer.replyingTo.ID, err)
+			return
+		}
+		parent = node
+	}
+	var replies []*forest.Reply
+	for _, paragraph := range strings.Split(text, "\n\n") {
+		if paragraph = strings.TrimSpace(paragraph); paragraph == "" {
+			continue
+		}
+		reply, err := builder.NewReply(parent, paragraph, []byte{})
+		if err != nil {
+			u.status = fmt.Sprintf("Failed creating reply: %v", err)
+			return
+		}
+		replies = append(replies, reply)
+		parent = reply
+	}
+	u.follow = true
+	go func() {
+		if err := u.Outbox().Post(builder.User, replies...); err != nil {
+			u.post(func() { u.status = fmt.Sprintf("Failed posting: %v", err) })
+		}
+	}()
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"log"
+
 	"gioui.org/layout"
 	"gioui.org/unit"
 	"gioui.org/widget/material"
@@ -13,6 +15,9 @@ import (
 type ConnectFormView struct {
 	manager ViewManager
 	Form    sprigWidget.TextForm
+	// relays found on the local network
+	Discovered     DiscoveredRelayList
+	DiscoveredList layout.List
 
 	core.App
 }
@@ -25,12 +30,18 @@ func NewConnectFormView(app core.App) View {
 	}
 	c.Form.TextField.SingleLine = true
 	c.Form.TextField.Submit = true
+	c.DiscoveredList.Axis = layout.Vertical
 	return c
 }
 
 func (c *ConnectFormView) HandleIntent(intent Intent) {}
 
 func (c *ConnectFormView) BecomeVisible() {
+	go func() {
+		if err := c.Discovery().Browse(); err != nil {
+			log.Printf("failed browsing for local relays: %v", err)
+		}
+	}()
 }
 
 func (c *ConnectFormView) NavItem() *materials.NavItem {
@@ -42,14 +53,22 @@ func (c *ConnectFormView) AppBarData() (bool, string, []materials.AppBarAction,
 }
 
 func (c *ConnectFormView) Update(gtx layout.Context) {
+	if addr, chosen := c.Discovered.Update(gtx, c.Discovery()); chosen {
+		c.connect(addr)
+	}
 	if c.Form.Submitted() {
-		c.Settings().SetAddress(c.Form.TextField.Text())
-		go c.Settings().Persist()
-		c.Sprout().ConnectTo(c.Settings().Address())
-		c.manager.RequestViewSwitch(IdentityFormID)
+		c.connect(c.Form.TextField.Text())
 	}
 }
 
+// connect saves the relay address and connects to it.
+func (c *ConnectFormView) connect(addr string) {
+	c.Settings().AddAddress(addr)
+	go c.Settings().Persist()
+	c.Sprout().ConnectTo(addr)
+	c.manager.RequestViewSwitch(IdentityFormID)
+}
+
 func (c *ConnectFormView) Layout(gtx layout.Context) layout.Dimensions {
 	theme := c.Theme().Current()
 	inset := layout.UniformInset(unit.Dp(8))
@@ -61,7 +80,18 @@ func (c *ConnectFormView) Layout(gtx layout.Context) layout.Dimensions {
 				)
 			}),
 			layout.Rigid(func(gtx C) D {
-				return inset.Layout(gtx, sprigTheme.TextForm(theme, &c.Form, "Connect", "HOST:PORT").Layout)
+				return inset.Layout(gtx, sprigTheme.TextForm(theme, &c.Form, "Connect", "HOST:PORT or URL").Layout)
+			}),
+			layout.Rigid(func(gtx C) D {
+				return inset.Layout(gtx,
+					material.Body1(theme.Theme, "Or choose a relay on your local network:").Layout,
+				)
+			}),
+			layout.Flexed(1, func(gtx C) D {
+				items := c.Discovered.Items(theme.Theme, c.Discovery().Relays(), nil)
+				return c.DiscoveredList.Layout(gtx, len(items), func(gtx C, index int) D {
+					return items[index](gtx)
+				})
 			}),
 		)
 	})
@@ -0,0 +1,590 @@
+package core
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"git.sr.ht/~whereswaldon/forest-go"
+	"git.sr.ht/~whereswaldon/forest-go/fields"
+	"git.sr.ht/~whereswaldon/forest-go/store"
+)
+
+// APIService exposes a JSON-RPC 2.0 interface to the running application on
+// a Unix domain socket so that local bots and scripts can read and post
+// messages. Each request and response is a single line of JSON. Clients must
+// call "auth" with the contents of the token file before any other method.
+// The methods must be safe for concurrent use.
+//
+// The supported methods are:
+//
+//	auth {"token": string}
+//	communities
+//	replies {"community": id, "before": time, "limit": int}
+//	node {"id": id}
+//	post {"parent": id, "content": string}
+//	subscribe
+//	unsubscribe
+//
+// After "subscribe", the server sends a "node" notification with an APINode
+// as its params for every node added to the store.
+type APIService interface {
+	// Start listens on the socket, creating the token file if needed. It
+	// fails if another instance of sprig is listening on the socket.
+	Start() error
+	// Stop closes the socket and disconnects every client.
+	Stop()
+	// Running returns whether the socket is accepting connections.
+	Running() bool
+	// SocketPath returns the location of the Unix domain socket.
+	SocketPath() string
+	// TokenPath returns the location of the file holding the access token.
+	TokenPath() string
+}
+
+// APINode is the JSON representation of a forest node in the API.
+type APINode struct {
+	ID      string    `json:"id"`
+	Type    string    `json:"type"`
+	Created time.Time `json:"created"`
+	Author  string    `json:"author,omitempty"`
+	Parent  string    `json:"parent,omitempty"`
+	Depth   int       `json:"depth"`
+	// Name is set for identities and communities.
+	Name string `json:"name,omitempty"`
+	// The following are set for replies.
+	Community    string `json:"community,omitempty"`
+	Conversation string `json:"conversation,omitempty"`
+	Content      string `json:"content,omitempty"`
+	AuthorName   string `json:"author_name,omitempty"`
+}
+
+// NewAPINode converts a node for use in the API. The author's name is
+// looked up in the store if the node is a reply.
+func NewAPINode(node forest.Node, arbor ArborService) APINode {
+	out := APINode{
+		ID:      node.ID().String(),
+		Created: node.CreatedAt(),
+		Depth:   int(node.TreeDepth()),
+	}
+	if parent := node.ParentID(); parent != nil && !parent.Equals(fields.NullHash()) {
+		out.Parent = parent.String()
+	}
+	switch n := node.(type) {
+	case *forest.Identity:
+		out.Type = "identity"
+		out.Name = string(n.Name.Blob)
+	case *forest.Community:
+		out.Type = "community"
+		out.Name = string(n.Name.Blob)
+		out.Author = n.Author.String()
+	case *forest.Reply:
+		out.Type = "reply"
+		out.Author = n.Author.String()
+		out.Community = n.CommunityID.String()
+		if !n.ConversationID.Equals(fields.NullHash()) {
+			out.Conversation = n.ConversationID.String()
+		}
+		out.Content = string(n.Content.Blob)
+		if author, has, err := arbor.Store().GetIdentity(&n.Author); err == nil && has {
+			out.AuthorName = string(author.(*forest.Identity).Name.Blob)
+		}
+	}
+	return out
+}
+
+// JSON-RPC 2.0 error codes.
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcInternalError  = -32603
+	// rpcUnauthorized is returned for requests sent before "auth".
+	rpcUnauthorized = -32000
+)
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (r *rpcError) Error() string {
+	return r.Message
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  interface{}     `json:"params,omitempty"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+const (
+	// defaultReplyPage is the number of replies returned by "replies" if
+	// no limit is given.
+	defaultReplyPage = 50
+	// maxReplyPage is the largest number of replies "replies" returns.
+	maxReplyPage = 500
+	// maxReplyScan bounds the number of recent replies examined when
+	// paging through a community.
+	maxReplyScan = 1 << 16
+	// apiNotificationQueue is the number of new nodes held for a subscribed
+	// client. Clients that fall further behind are disconnected.
+	apiNotificationQueue = 1024
+)
+
+type apiService struct {
+	ArborService
+	SettingsService
+	OutboxService
+
+	socketPath, tokenPath string
+
+	sync.Mutex
+	listener net.Listener
+	clients  map[*apiClient]struct{}
+}
+
+var _ APIService = &apiService{}
+
+func newAPIService(stateDir string, arbor ArborService, settings SettingsService, outbox OutboxService) APIService {
+	return &apiService{
+		ArborService:    arbor,
+		SettingsService: settings,
+		OutboxService:   outbox,
+		socketPath:      filepath.Join(stateDir, "api.sock"),
+		tokenPath:       filepath.Join(stateDir, "api-token"),
+		clients:         make(map[*apiClient]struct{}),
+	}
+}
+
+func (a *apiService) SocketPath() string {
+	return a.socketPath
+}
+
+func (a *apiService) TokenPath() string {
+	return a.tokenPath
+}
+
+func (a *apiService) Running() bool {
+	a.Lock()
+	defer a.Unlock()
+	return a.listener != nil
+}
+
+// token reads the access token, generating it if it does not exist.
+func (a *apiService) token() (string, error) {
+	data, err := ioutil.ReadFile(a.tokenPath)
+	if err == nil {
+		if token := strings.TrimSpace(string(data)); token != "" {
+			return token, nil
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("failed reading API token: %w", err)
+	}
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed generating API token: %w", err)
+	}
+	token := hex.EncodeToString(buf)
+	if err := ioutil.WriteFile(a.tokenPath, []byte(token+"\n"), 0600); err != nil {
+		return "", fmt.Errorf("failed saving API token: %w", err)
+	}
+	return token, nil
+}
+
+func (a *apiService) Start() error {
+	a.Stop()
+	token, err := a.token()
+	if err != nil {
+		return err
+	}
+	if conn, err := net.DialTimeout("unix", a.socketPath, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("another instance of sprig is serving the API on %s", a.socketPath)
+	}
+	// nothing answers on the socket, so it was left behind by a sprig that
+	// did not exit cleanly
+	if err := os.Remove(a.socketPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed removing stale API socket: %w", err)
+	}
+	listener, err := net.Listen("unix", a.socketPath)
+	if err != nil {
+		return fmt.Errorf("failed listening on %s: %w", a.socketPath, err)
+	}
+	if err := os.Chmod(a.socketPath, 0600); err != nil {
+		log.Printf("failed restricting permissions of API socket: %v", err)
+	}
+	a.Lock()
+	a.listener = listener
+	a.Unlock()
+	log.Printf("serving API on %s", a.socketPath)
+	go a.accept(listener, token)
+	return nil
+}
+
+func (a *apiService) Stop() {
+	a.Lock()
+	defer a.Unlock()
+	if a.listener == nil {
+		return
+	}
+	if err := a.listener.Close(); err != nil {
+		log.Printf("failed closing API socket: %v", err)
+	}
+	a.listener = nil
+	for client := range a.clients {
+		client.conn.Close()
+	}
+}
+
+// accept serves clients until listener is closed.
+func (a *apiService) accept(listener net.Listener, token string) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("failed accepting API connection: %v", err)
+			}
+			return
+		}
+		client := &apiClient{
+			apiService: a,
+			conn:       conn,
+			token:      token,
+			encoder:    json.NewEncoder(conn),
+		}
+		a.Lock()
+		a.clients[client] = struct{}{}
+		a.Unlock()
+		go client.serve()
+	}
+}
+
+// apiClient holds the state of a single API connection.
+type apiClient struct {
+	*apiService
+	conn          net.Conn
+	token         string
+	authenticated bool
+
+	writeLock sync.Mutex
+	encoder   *json.Encoder
+
+	subscribed   bool
+	subscription store.Subscription
+	// notifications holds the new nodes waiting to be sent while
+	// subscribed
+	notifications chan forest.Node
+}
+
+func (c *apiClient) send(response rpcResponse) {
+	if err := c.write(response); err != nil {
+		log.Printf("failed writing API response: %v", err)
+	}
+}
+
+func (c *apiClient) write(response rpcResponse) error {
+	response.JSONRPC = "2.0"
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return c.encoder.Encode(response)
+}
+
+func (c *apiClient) serve() {
+	defer func() {
+		c.unsubscribe()
+		c.conn.Close()
+		c.apiService.Lock()
+		delete(c.apiService.clients, c)
+		c.apiService.Unlock()
+	}()
+	scanner := bufio.NewScanner(c.conn)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(strings.TrimSpace(string(line))) == 0 {
+			continue
+		}
+		var request rpcRequest
+		if err := json.Unmarshal(line, &request); err != nil {
+			c.send(rpcResponse{Error: &rpcError{Code: rpcParseError, Message: err.Error()}})
+			continue
+		}
+		result, err := c.handle(request)
+		if len(request.ID) == 0 {
+			// notifications receive no response
+			continue
+		}
+		response := rpcResponse{ID: request.ID, Result: result}
+		if err != nil {
+			var rpcErr *rpcError
+			if !errors.As(err, &rpcErr) {
+				rpcErr = &rpcError{Code: rpcInternalError, Message: err.Error()}
+			}
+			response.Result = nil
+			response.Error = rpcErr
+		}
+		c.send(response)
+	}
+}
+
+// handle dispatches a request to its method.
+func (c *apiClient) handle(request rpcRequest) (interface{}, error) {
+	if request.JSONRPC != "2.0" || request.Method == "" {
+		return nil, &rpcError{Code: rpcInvalidRequest, Message: "expected a JSON-RPC 2.0 request"}
+	}
+	if request.Method == "auth" {
+		var params struct {
+			Token string `json:"token"`
+		}
+		if err := decodeParams(request.Params, &params); err != nil {
+			return nil, err
+		}
+		if subtle.ConstantTimeCompare([]byte(params.Token), []byte(c.token)) != 1 {
+			return nil, &rpcError{Code: rpcUnauthorized, Message: "invalid token"}
+		}
+		c.authenticated = true
+		return true, nil
+	}
+	if !c.authenticated {
+		return nil, &rpcError{Code: rpcUnauthorized, Message: "call auth first"}
+	}
+	switch request.Method {
+	case "communities":
+		return c.communities()
+	case "replies":
+		var params struct {
+			Community string    `json:"community"`
+			Before    time.Time `json:"before"`
+			Limit     int       `json:"limit"`
+		}
+		if err := decodeParams(request.Params, &params); err != nil {
+			return nil, err
+		}
+		return c.replies(params.Community, params.Before, params.Limit)
+	case "node":
+		var params struct {
+			ID string `json:"id"`
+		}
+		if err := decodeParams(request.Params, &params); err != nil {
+			return nil, err
+		}
+		return c.node(params.ID)
+	case "post":
+		var params struct {
+			Parent  string `json:"parent"`
+			Content string `json:"content"`
+		}
+		if err := decodeParams(request.Params, &params); err != nil {
+			return nil, err
+		}
+		return c.post(params.Parent, params.Content)
+	case "subscribe":
+		c.subscribe()
+		return true, nil
+	case "unsubscribe":
+		c.unsubscribe()
+		return true, nil
+	default:
+		return nil, &rpcError{Code: rpcMethodNotFound, Message: fmt.Sprintf("unknown method %q", request.Method)}
+	}
+}
+
+// decodeParams unmarshals request parameters into out.
+func decodeParams(params json.RawMessage, out interface{}) error {
+	if len(params) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(params, out); err != nil {
+		return &rpcError{Code: rpcInvalidParams, Message: err.Error()}
+	}
+	return nil
+}
+
+// parseID interprets a node ID parameter.
+func parseID(id string) (*fields.QualifiedHash, error) {
+	out := &fields.QualifiedHash{}
+	if err := out.UnmarshalText([]byte(id)); err != nil {
+		return nil, &rpcError{Code: rpcInvalidParams, Message: fmt.Sprintf("invalid node ID %q: %v", id, err)}
+	}
+	return out, nil
+}
+
+func (c *apiClient) communities() ([]APINode, error) {
+	var out []APINode
+	c.ArborService.Communities().WithCommunities(func(communities []*forest.Community) {
+		out = make([]APINode, 0, len(communities))
+		for _, community := range communities {
+			out = append(out, NewAPINode(community, c.ArborService))
+		}
+	})
+	return out, nil
+}
+
+// replies returns up to limit replies in the community created before the
+// given time, newest first. Pass the creation time of the last reply as
+// before to fetch the next page.
+func (c *apiClient) replies(community string, before time.Time, limit int) ([]APINode, error) {
+	communityID, err := parseID(community)
+	if err != nil {
+		return nil, err
+	}
+	if limit < 1 {
+		limit = defaultReplyPage
+	} else if limit > maxReplyPage {
+		limit = maxReplyPage
+	}
+	if before.IsZero() {
+		before = time.Now().Add(time.Hour)
+	}
+	var page []*forest.Reply
+	for quantity := 4 * limit; ; quantity *= 2 {
+		nodes, err := c.ArborService.Store().Recent(fields.NodeTypeReply, quantity)
+		if err != nil && len(nodes) < 1 {
+			return nil, fmt.Errorf("failed listing replies: %w", err)
+		}
+		page = page[:0]
+		for _, node := range nodes {
+			reply, ok := node.(*forest.Reply)
+			if ok && reply.CommunityID.Equals(communityID) && reply.CreatedAt().Before(before) {
+				page = append(page, reply)
+			}
+		}
+		if len(page) >= limit || len(nodes) < quantity || quantity >= maxReplyScan {
+			break
+		}
+	}
+	sort.Slice(page, func(i, j int) bool {
+		return page[i].CreatedAt().After(page[j].CreatedAt())
+	})
+	if len(page) > limit {
+		page = page[:limit]
+	}
+	out := make([]APINode, 0, len(page))
+	for _, reply := range page {
+		out = append(out, NewAPINode(reply, c.ArborService))
+	}
+	return out, nil
+}
+
+func (c *apiClient) node(id string) (*APINode, error) {
+	nodeID, err := parseID(id)
+	if err != nil {
+		return nil, err
+	}
+	node, has, err := c.ArborService.Store().Get(nodeID)
+	if err != nil {
+		return nil, fmt.Errorf("failed looking up %s: %w", id, err)
+	}
+	if !has {
+		return nil, nil
+	}
+	out := NewAPINode(node, c.ArborService)
+	return &out, nil
+}
+
+// post creates a reply to the given community or reply as the active
+// identity and queues it for delivery.
+func (c *apiClient) post(parent, content string) (*APINode, error) {
+	parentID, err := parseID(parent)
+	if err != nil {
+		return nil, err
+	}
+	content = strings.TrimSpace(content)
+	if content == "" {
+		return nil, &rpcError{Code: rpcInvalidParams, Message: "content is empty"}
+	}
+	parentNode, has, err := c.ArborService.Store().Get(parentID)
+	if err != nil {
+		return nil, fmt.Errorf("failed looking up %s: %w", parent, err)
+	} else if !has {
+		return nil, &rpcError{Code: rpcInvalidParams, Message: fmt.Sprintf("unknown parent %s", parent)}
+	}
+	builder, err := c.SettingsService.Builder()
+	if err != nil {
+		return nil, fmt.Errorf("failed acquiring node builder: %w", err)
+	}
+	reply, err := builder.NewReply(parentNode, content, []byte{})
+	if err != nil {
+		return nil, fmt.Errorf("failed creating reply: %w", err)
+	}
+	if err := c.OutboxService.Post(builder.User, reply); err != nil {
+		return nil, err
+	}
+	out := NewAPINode(reply, c.ArborService)
+	return &out, nil
+}
+
+// subscribe streams new nodes to the client.
+func (c *apiClient) subscribe() {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if c.subscribed {
+		return
+	}
+	c.subscribed = true
+	notifications := make(chan forest.Node, apiNotificationQueue)
+	c.notifications = notifications
+	overflowed := false
+	// the handler runs while the store is busy, so it must neither block
+	// nor look anything up
+	c.subscription = c.ArborService.Store().SubscribeToNewMessages(func(node forest.Node) {
+		if overflowed {
+			return
+		}
+		select {
+		case notifications <- node:
+		default:
+			overflowed = true
+			log.Printf("API client fell %d nodes behind, disconnecting", apiNotificationQueue)
+			c.conn.Close()
+		}
+	})
+	go c.notify(notifications)
+}
+
+// notify sends the queued nodes to the client in the order they were
+// stored.
+func (c *apiClient) notify(notifications <-chan forest.Node) {
+	for node := range notifications {
+		if err := c.write(rpcResponse{Method: "node", Params: NewAPINode(node, c.ArborService)}); err != nil {
+			log.Printf("failed writing API notification: %v", err)
+			return
+		}
+	}
+}
+
+func (c *apiClient) unsubscribe() {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if !c.subscribed {
+		return
+	}
+	c.subscribed = false
+	c.ArborService.Store().UnsubscribeToNewMessages(c.subscription)
+	close(c.notifications)
+}
@@ -3,10 +3,13 @@ package core
 import (
 	"fmt"
 	"log"
+	"net"
 	"os"
+	"strconv"
+	"sync"
 
-	gioapp "gioui.org/app"
 	"git.sr.ht/~whereswaldon/forest-go"
+	"git.sr.ht/~whereswaldon/forest-go/fields"
 )
 
 // App bundles core application services into a single convenience type.
@@ -19,10 +22,27 @@ type App interface {
 	Status() StatusService
 	Haptic() HapticService
 	Banner() BannerService
-	Window() *gioapp.Window
+	Trust() TrustService
+	Outbox() OutboxService
+	LocalRelay() LocalRelayService
+	Discovery() DiscoveryService
+	API() APIService
+	Audit() AuditService
+	Search() SearchService
+	// Invalidate requests that the frontend (if any) redraw itself to
+	// reflect changes in application state.
+	Invalidate()
 	Shutdown()
 }
 
+// Frontend is the user interface presenting an App.
+type Frontend interface {
+	// Invalidate requests that the interface be redrawn.
+	Invalidate()
+	// Haptic returns the haptic feedback device of the interface.
+	Haptic() HapticService
+}
+
 // app bundles services together.
 type app struct {
 	NotificationService
@@ -33,21 +53,50 @@ type app struct {
 	StatusService
 	HapticService
 	BannerService
-	window *gioapp.Window
+	TrustService
+	OutboxService
+	LocalRelayService
+	DiscoveryService
+	APIService
+	AuditService
+	SearchService
+	frontend Frontend
+
+	// incognito is set if messages are kept in memory only
+	incognito bool
 }
 
 var _ App = &app{}
 
+// AppOption configures an App constructed by NewApp.
+type AppOption func(*app)
+
+// Incognito starts a session that keeps messages in memory only. Messages
+// already stored are neither shown nor modified.
+func Incognito() AppOption {
+	return func(a *app) {
+		a.incognito = true
+	}
+}
+
 // NewApp constructs an App or fails with an error. This process will fail
 // if any of the application services fail to initialize correctly.
-func NewApp(w *gioapp.Window, stateDir string) (application App, err error) {
+//
+// Headless clients should provide a nil frontend. In that case, desktop
+// notifications, the embedded relay, local relay discovery, the bot API and
+// background store audits are not started automatically, and messages are
+// not indexed for search.
+func NewApp(stateDir string, frontend Frontend, options ...AppOption) (application App, err error) {
 	defer func() {
 		if err != nil {
 			err = fmt.Errorf("failed constructing app: %w", err)
 		}
 	}()
 	a := &app{
-		window: w,
+		frontend: frontend,
+	}
+	for _, option := range options {
+		option(a)
 	}
 
 	// ensure our state directory exists
@@ -62,32 +111,94 @@ func NewApp(w *gioapp.Window, stateDir string) (application App, err error) {
 		return nil, err
 	}
 	a.BannerService = NewBannerService(a)
-	if a.ArborService, err = newArborService(a.SettingsService); err != nil {
+	if a.ArborService, err = newArborService(a.SettingsService, a.BannerService, a.incognito); err != nil {
+		return nil, err
+	}
+	if frontend == nil {
+		a.NotificationService = headlessNotificationService{}
+	} else if a.NotificationService, err = newNotificationService(a.SettingsService, a.ArborService); err != nil {
 		return nil, err
 	}
-	if a.NotificationService, err = newNotificationService(a.SettingsService, a.ArborService); err != nil {
+	if a.TrustService, err = newTrustService(stateDir); err != nil {
 		return nil, err
 	}
-	if a.SproutService, err = newSproutService(a.ArborService, a.BannerService, a.SettingsService); err != nil {
+	if a.SproutService, err = newSproutService(stateDir, a.ArborService, a.BannerService, a.SettingsService, a.TrustService); err != nil {
 		return nil, err
 	}
+	if a.OutboxService, err = newOutboxService(stateDir, a.ArborService, a.SproutService); err != nil {
+		return nil, err
+	}
+	a.LocalRelayService = newLocalRelayService(a.ArborService)
+	a.DiscoveryService = newDiscoveryService()
+	a.APIService = newAPIService(stateDir, a.ArborService, a.SettingsService, a.OutboxService)
+	a.AuditService = newAuditService(stateDir, a.ArborService, a.SproutService, a.BannerService)
+	if frontend == nil {
+		a.SearchService = unavailableSearchService{err: fmt.Errorf("messages are not indexed without a frontend")}
+	} else {
+		a.SearchService = newSearchService(a.SettingsService, a.ArborService, a.BannerService)
+	}
 	if a.ThemeService, err = newThemeService(); err != nil {
 		return nil, err
 	}
 	if a.StatusService, err = newStatusService(); err != nil {
 		return nil, err
 	}
-	a.HapticService = newHapticService(w)
+	if frontend == nil {
+		a.HapticService = headlessHapticService{}
+	} else {
+		a.HapticService = frontend.Haptic()
+	}
 
 	// Connect services together
-	if addr := a.Settings().Address(); addr != "" {
+	for _, addr := range a.Settings().Addresses() {
 		a.Sprout().ConnectTo(addr)
 	}
+	a.LocalRelay().SubscribeToStatusChanges(advertiseLocalRelay(a.Discovery()))
+	if frontend != nil {
+		if err := a.Discovery().Browse(); err != nil {
+			log.Printf("failed browsing for local relays: %v", err)
+		}
+	}
+	if frontend != nil && a.Settings().LocalRelayEnabled() {
+		if err := a.LocalRelay().SetAllowlist(a.Settings().LocalRelayAllowlist()); err != nil {
+			log.Printf("ignoring invalid local relay allowlist: %v", err)
+		}
+		if err := a.LocalRelay().Start(a.Settings().LocalRelayAddress()); err != nil {
+			log.Printf("failed starting local relay: %v", err)
+		}
+	}
+	if frontend != nil && !a.incognito {
+		a.Audit().Schedule()
+	}
+	if frontend != nil && a.Settings().APIEnabled() {
+		if err := a.API().Start(); err != nil {
+			log.Printf("failed starting API: %v", err)
+		}
+	}
 	a.Notifications().Register(a.Arbor().Store())
 	a.Status().Register(a.Arbor().Store())
 
 	a.Arbor().Store().SubscribeToNewMessages(func(n forest.Node) {
-		a.Window().Invalidate()
+		a.Invalidate()
+	})
+	a.Sprout().SubscribeToStateChanges(func(RelayStatus) {
+		a.Invalidate()
+	})
+	a.Outbox().SubscribeToDeliveryChanges(func(Delivery) {
+		a.Invalidate()
+	})
+	a.LocalRelay().SubscribeToStatusChanges(func(LocalRelayStatus) {
+		a.Invalidate()
+	})
+	a.Discovery().SubscribeToDiscoveries(func([]DiscoveredRelay) {
+		a.Invalidate()
+	})
+	a.Audit().SubscribeToProgress(func(AuditReport) {
+		a.Invalidate()
+	})
+	a.Settings().SubscribeToIdentityChanges(func(*fields.QualifiedHash) {
+		go a.Arbor().StartHeartbeat()
+		a.Invalidate()
 	})
 
 	return a, nil
@@ -133,14 +244,97 @@ func (a *app) Banner() BannerService {
 	return a.BannerService
 }
 
+// Trust returns the app's trust service implementation.
+func (a *app) Trust() TrustService {
+	return a.TrustService
+}
+
+// Outbox returns the app's outbox service implementation.
+func (a *app) Outbox() OutboxService {
+	return a.OutboxService
+}
+
+// LocalRelay returns the app's local relay service implementation.
+func (a *app) LocalRelay() LocalRelayService {
+	return a.LocalRelayService
+}
+
+// Discovery returns the app's discovery service implementation.
+func (a *app) Discovery() DiscoveryService {
+	return a.DiscoveryService
+}
+
+// API returns the app's API service implementation.
+func (a *app) API() APIService {
+	return a.APIService
+}
+
+// Audit returns the app's audit service implementation.
+func (a *app) Audit() AuditService {
+	return a.AuditService
+}
+
+// Search returns the app's search service implementation.
+func (a *app) Search() SearchService {
+	return a.SearchService
+}
+
+// advertiseLocalRelay returns a handler that advertises the embedded relay
+// on the local network while it is listening.
+func advertiseLocalRelay(discovery DiscoveryService) func(LocalRelayStatus) {
+	var (
+		lock       sync.Mutex
+		advertised string
+	)
+	return func(status LocalRelayStatus) {
+		lock.Lock()
+		defer lock.Unlock()
+		if !status.Listening {
+			if advertised != "" {
+				advertised = ""
+				go discovery.StopAdvertising()
+			}
+			return
+		}
+		if status.Address == advertised {
+			return
+		}
+		advertised = status.Address
+		_, portString, err := net.SplitHostPort(status.Address)
+		if err != nil {
+			log.Printf("failed advertising local relay: %v", err)
+			return
+		}
+		port, err := strconv.ParseUint(portString, 10, 16)
+		if err != nil {
+			log.Printf("failed advertising local relay: %v", err)
+			return
+		}
+		name, err := os.Hostname()
+		if err != nil {
+			name = "sprig"
+		}
+		go func() {
+			if err := discovery.Advertise(name, uint16(port), false); err != nil {
+				log.Printf("failed advertising local relay: %v", err)
+			}
+		}()
+	}
+}
+
 // Shutdown performs cleanup, and blocks for the duration.
 func (a *app) Shutdown() {
 	log.Printf("cleaning up")
 	defer log.Printf("shutting down")
 	a.Sprout().MarkSelfOffline()
+	a.Discovery().StopAdvertising()
+	a.LocalRelay().Stop()
+	a.API().Stop()
 }
 
-// Window returns the window handle.
-func (a app) Window() *gioapp.Window {
-	return a.window
+// Invalidate requests that the frontend redraw itself.
+func (a *app) Invalidate() {
+	if a.frontend != nil {
+		a.frontend.Invalidate()
+	}
 }
@@ -1,17 +1,17 @@
 package core
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"os"
-	"path/filepath"
+	"sync"
 	"time"
 
 	status "git.sr.ht/~athorp96/forest-ex/active-status"
 	"git.sr.ht/~athorp96/forest-ex/expiration"
 	"git.sr.ht/~whereswaldon/forest-go"
-	"git.sr.ht/~whereswaldon/forest-go/grove"
-	"git.sr.ht/~whereswaldon/forest-go/orchard"
+	"git.sr.ht/~whereswaldon/forest-go/fields"
 	"git.sr.ht/~whereswaldon/forest-go/store"
 	"git.sr.ht/~whereswaldon/sprig/ds"
 )
@@ -20,64 +20,145 @@ import (
 type ArborService interface {
 	Store() store.ExtendedStore
 	Communities() *ds.CommunityList
+	// StartHeartbeat periodically announces that the active identity is
+	// online in every known community, replacing any previous heartbeat.
 	StartHeartbeat()
+	// MigrateStore copies every node in the background into the store
+	// selected by the settings, reporting progress in a banner. The
+	// selected store is used from the next start, and nodes added until
+	// then are copied into it as well. A migration into a store that is no
+	// longer selected is cancelled.
+	MigrateStore()
+	// Incognito reports whether the session was started without a store,
+	// keeping every node in memory only.
+	Incognito() bool
+	// StoreError returns the reason the configured store could not be
+	// opened, in which case nodes are kept in memory until RetryStore
+	// succeeds.
+	StoreError() error
+	// RetryStore tries again to open the configured store after a failure.
+	// Nodes received in the meantime are saved into it.
+	RetryStore() error
+	// SubscribeToRemovedNodes registers a handler that is invoked with the
+	// IDs of the nodes sprig removes from the store, such as expired or
+	// damaged nodes and the replies to them.
+	SubscribeToRemovedNodes(handler func(ids []*fields.QualifiedHash)) RemovalSubscription
+	UnsubscribeFromRemovedNodes(RemovalSubscription)
+	// SubscribeToStoreRecovery registers a handler that is invoked once
+	// RetryStore opens the store, after which nodes are saved.
+	SubscribeToStoreRecovery(handler func()) RecoverySubscription
+	UnsubscribeFromStoreRecovery(RecoverySubscription)
 }
 
+// RemovalSubscription identifies a handler registered to learn of removed
+// nodes.
+type RemovalSubscription int
+
+// RecoverySubscription identifies a handler registered to learn that the
+// store was opened after a failure.
+type RecoverySubscription int
+
 type arborService struct {
 	SettingsService
 	grove store.ExtendedStore
 	cl    *ds.CommunityList
 	done  chan struct{}
+
+	heartbeatLock sync.Mutex
+	stopHeartbeat chan struct{}
+
+	// corrupt holds the IDs of nodes that grove found corrupt and removed
+	corruptLock sync.Mutex
+	corrupt     []string
+
+	banners BannerService
+	// incognito is set if the session deliberately uses a memory store
+	incognito bool
+	// storeLock guards active and storeErr
+	storeLock sync.Mutex
+	// active is the kind of store in use, and empty while nodes are only
+	// held in memory
+	active StoreKind
+	// storeErr explains why the configured store could not be opened
+	storeErr      error
+	migrationLock sync.Mutex
+	// migrating is the kind of store being migrated into, if any
+	migrating     StoreKind
+	stopMigration chan struct{}
+
+	removalLock     sync.Mutex
+	removalHandlers map[RemovalSubscription]func([]*fields.QualifiedHash)
+	nextRemoval     RemovalSubscription
+
+	recoveryLock     sync.Mutex
+	recoveryHandlers map[RecoverySubscription]func()
+	nextRecovery     RecoverySubscription
 }
 
 var _ ArborService = &arborService{}
 
 // newArborService creates a new instance of the Arbor Service using
-// the provided Settings within the app to acquire configuration.
-func newArborService(settings SettingsService) (ArborService, error) {
-	s, err := func() (forest.Store, error) {
-		path := settings.DataPath()
-		if err := os.MkdirAll(path, 0770); err != nil {
-			return nil, fmt.Errorf("preparing data directory for store: %v", err)
-		}
-		if settings.UseOrchardStore() {
-			o, err := orchard.Open(filepath.Join(path, "orchard.db"))
-			if err != nil {
-				return nil, fmt.Errorf("opening Orchard store: %v", err)
-			}
-			return o, nil
-		}
-		g, err := grove.New(path)
-		if err != nil {
-			return nil, fmt.Errorf("opening Grove store: %v", err)
-		}
-		g.SetCorruptNodeHandler(func(id string) {
-			log.Printf("Grove: corrupt node %s", id)
-		})
-		return g, nil
-	}()
-	if err != nil {
-		s = store.NewMemoryStore()
-	}
-	log.Printf("Store: %T\n", s)
+// the provided Settings within the app to acquire configuration. An
+// incognito service keeps nodes in memory without opening the store.
+func newArborService(settings SettingsService, banners BannerService, incognito bool) (ArborService, error) {
 	a := &arborService{
 		SettingsService: settings,
-		grove:           store.NewArchive(s),
+		banners:         banners,
+		incognito:       incognito,
 		done:            make(chan struct{}),
+		removalHandlers: make(map[RemovalSubscription]func([]*fields.QualifiedHash)),
+
+		recoveryHandlers: make(map[RecoverySubscription]func()),
 	}
+	var s forest.Store
+	if incognito {
+		s = store.NewMemoryStore()
+	} else if opened, kind, err := a.openConfiguredStore(); err != nil {
+		log.Printf("Failed opening store, keeping nodes in memory: %v", err)
+		a.storeErr = err
+		s = newFallbackStore()
+	} else {
+		s, a.active = opened, kind
+	}
+	log.Printf("Store: %T\n", s)
+	a.grove = store.NewArchive(s)
 	cl, err := ds.NewCommunityList(a.grove)
 	if err != nil {
 		return nil, err
 	}
 	a.cl = cl
+	if a.active != "" && a.active != storeKindFor(settings.UseOrchardStore()) {
+		// resume an interrupted migration
+		a.MigrateStore()
+	}
 	expiration.ExpiredPurger{
 		Logger:        log.New(log.Writer(), "purge ", log.Flags()),
-		ExtendedStore: a.grove,
+		ExtendedStore: removalReporter{ExtendedStore: a.grove, arbor: a},
 		PurgeInterval: time.Hour,
 	}.Start(a.done)
 	return a, nil
 }
 
+// openConfiguredStore opens the store holding the nodes in the configured
+// data directory.
+func (a *arborService) openConfiguredStore() (forest.Store, StoreKind, error) {
+	path := a.DataPath()
+	if err := os.MkdirAll(path, 0770); err != nil {
+		return nil, "", fmt.Errorf("preparing data directory for store: %v", err)
+	}
+	kind := activeStoreKind(path, a.UseOrchardStore())
+	s, err := openStore(path, kind, func(id string) {
+		log.Printf("Grove: corrupt node %s", id)
+		a.corruptLock.Lock()
+		a.corrupt = append(a.corrupt, id)
+		a.corruptLock.Unlock()
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return s, kind, nil
+}
+
 func (a *arborService) Store() store.ExtendedStore {
 	return a.grove
 }
@@ -86,16 +167,304 @@ func (a *arborService) Communities() *ds.CommunityList {
 	return a.cl
 }
 
+func (a *arborService) Incognito() bool {
+	return a.incognito
+}
+
+func (a *arborService) StoreError() error {
+	a.storeLock.Lock()
+	defer a.storeLock.Unlock()
+	return a.storeErr
+}
+
+func (a *arborService) RetryStore() error {
+	recovered, err := a.reopenStore()
+	if err != nil || !recovered {
+		return err
+	}
+	if a.activeKind() != storeKindFor(a.UseOrchardStore()) {
+		// resume a migration interrupted before the store failed to open
+		a.MigrateStore()
+	}
+	a.recoveryLock.Lock()
+	handlers := make([]func(), 0, len(a.recoveryHandlers))
+	for _, handler := range a.recoveryHandlers {
+		handlers = append(handlers, handler)
+	}
+	a.recoveryLock.Unlock()
+	for _, handler := range handlers {
+		handler()
+	}
+	return nil
+}
+
+// reopenStore opens the configured store in place of the nodes held in
+// memory, reporting whether it did so.
+func (a *arborService) reopenStore() (bool, error) {
+	a.storeLock.Lock()
+	defer a.storeLock.Unlock()
+	if a.storeErr == nil {
+		return false, nil
+	}
+	fallback, ok := a.backend().(*fallbackStore)
+	if !ok {
+		return false, a.storeErr
+	}
+	s, kind, err := a.openConfiguredStore()
+	if err == nil {
+		if err = fallback.replace(s); err != nil {
+			closeStore(s)
+		}
+	}
+	if err != nil {
+		a.storeErr = err
+		return false, err
+	}
+	log.Printf("Store: %T\n", s)
+	a.active, a.storeErr = kind, nil
+	// the community list only learned of the communities received while
+	// nodes were held in memory
+	stored, err := s.Recent(fields.NodeTypeCommunity, 1024)
+	if err != nil {
+		log.Printf("Failed loading stored communities: %v", err)
+	}
+	communities := make([]*forest.Community, 0, len(stored))
+	for _, node := range stored {
+		if community, ok := node.(*forest.Community); ok {
+			communities = append(communities, community)
+		}
+	}
+	a.cl.Insert(communities...)
+	return true, nil
+}
+
+func (a *arborService) SubscribeToRemovedNodes(handler func([]*fields.QualifiedHash)) RemovalSubscription {
+	a.removalLock.Lock()
+	defer a.removalLock.Unlock()
+	a.nextRemoval++
+	a.removalHandlers[a.nextRemoval] = handler
+	return a.nextRemoval
+}
+
+func (a *arborService) UnsubscribeFromRemovedNodes(id RemovalSubscription) {
+	a.removalLock.Lock()
+	defer a.removalLock.Unlock()
+	delete(a.removalHandlers, id)
+}
+
+func (a *arborService) SubscribeToStoreRecovery(handler func()) RecoverySubscription {
+	a.recoveryLock.Lock()
+	defer a.recoveryLock.Unlock()
+	a.nextRecovery++
+	a.recoveryHandlers[a.nextRecovery] = handler
+	return a.nextRecovery
+}
+
+func (a *arborService) UnsubscribeFromStoreRecovery(id RecoverySubscription) {
+	a.recoveryLock.Lock()
+	defer a.recoveryLock.Unlock()
+	delete(a.recoveryHandlers, id)
+}
+
+// reportRemoved notifies subscribers that the nodes were removed.
+func (a *arborService) reportRemoved(ids []*fields.QualifiedHash) {
+	a.removalLock.Lock()
+	handlers := make([]func([]*fields.QualifiedHash), 0, len(a.removalHandlers))
+	for _, handler := range a.removalHandlers {
+		handlers = append(handlers, handler)
+	}
+	a.removalLock.Unlock()
+	for _, handler := range handlers {
+		handler(ids)
+	}
+}
+
+// removeReported removes a node and the replies to it from the store and
+// notifies subscribers.
+func (a *arborService) removeReported(id *fields.QualifiedHash) error {
+	replies, err := a.removeSubtree(id)
+	if err != nil {
+		return err
+	}
+	ids := []*fields.QualifiedHash{id}
+	for _, reply := range replies {
+		ids = append(ids, reply.ID())
+	}
+	a.reportRemoved(ids)
+	return nil
+}
+
+// removalReporter is given to the purger of expired nodes so that the
+// nodes it removes are reported.
+type removalReporter struct {
+	store.ExtendedStore
+	arbor *arborService
+}
+
+func (r removalReporter) RemoveSubtree(id *fields.QualifiedHash) error {
+	return r.arbor.removeReported(id)
+}
+
+// backend returns the store holding the nodes.
+func (a *arborService) backend() forest.Store {
+	archive, ok := a.grove.(*store.Archive)
+	if !ok {
+		return a.grove
+	}
+	return archive.UnderlyingStore()
+}
+
+// activeKind returns the kind of store in use, which is empty while nodes
+// are only held in memory.
+func (a *arborService) activeKind() StoreKind {
+	a.storeLock.Lock()
+	defer a.storeLock.Unlock()
+	return a.active
+}
+
+func (a *arborService) MigrateStore() {
+	a.migrationLock.Lock()
+	defer a.migrationLock.Unlock()
+	to := storeKindFor(a.UseOrchardStore())
+	if to == a.migrating {
+		return
+	}
+	if a.stopMigration != nil {
+		log.Printf("Cancelling migration into the %s store", a.migrating)
+		close(a.stopMigration)
+		a.stopMigration = nil
+		a.migrating = ""
+	}
+	active := a.activeKind()
+	if active == "" {
+		log.Printf("Not migrating nodes held in memory")
+		return
+	}
+	src := a.storedNodes()
+	if to == active {
+		// the active store is still complete, as nodes are only ever
+		// copied out of it
+		record := storeMigration{From: to, To: to, Complete: true}
+		if err := record.save(a.DataPath()); err != nil {
+			log.Printf("Failed recording store selection: %v", err)
+		}
+		return
+	}
+	stop := make(chan struct{})
+	a.migrating = to
+	a.stopMigration = stop
+	go a.migrate(src, to, stop)
+}
+
+// migrate copies the nodes of src into the store of the given kind until
+// stop is closed, then keeps copying new nodes into it.
+func (a *arborService) migrate(src forest.Store, to StoreKind, stop chan struct{}) {
+	log.Printf("Migrating from the %s store into the %s store", storeKindOf(src), to)
+	failed := func(err error) {
+		log.Printf("Failed migrating into the %s store: %v", to, err)
+		a.banners.Add(&ActionBanner{
+			Priority: Error,
+			Text:     fmt.Sprintf("Copying messages into the %s store failed: %v. Sprig will keep using the %s store.", to, err, storeKindOf(src)),
+			Actions:  []BannerAction{{Label: "Dismiss"}},
+		})
+	}
+	dataPath := a.DataPath()
+	dst, err := openStore(dataPath, to, nil)
+	if err != nil {
+		failed(err)
+		return
+	}
+	defer closeStore(dst)
+	// nodes that arrive while the migration runs would otherwise be
+	// missing from the new store once it takes over
+	mirror := a.grove.SubscribeToNewMessages(func(n forest.Node) {
+		if err := dst.Add(n); err != nil {
+			log.Printf("Failed copying node %s into the %s store: %v", n.ID(), to, err)
+		}
+	})
+	defer a.grove.UnsubscribeToNewMessages(mirror)
+	banner := newProgressBanner(a.banners, fmt.Sprintf("Copying messages into the %s store...", to))
+	err = migrateOpenStore(src, dst, dataPath, func(progress StoreMigrationProgress) {
+		banner.Update(describeStoreMigration(progress))
+	}, stop)
+	banner.Cancel()
+	if errors.Is(err, errMigrationCancelled) {
+		return
+	} else if err != nil {
+		failed(err)
+		return
+	}
+	log.Printf("Migrated into the %s store", to)
+	a.banners.Add(&ActionBanner{
+		Priority: Info,
+		Text:     fmt.Sprintf("Every message was copied into the %s store, which will be used when sprig restarts.", to),
+		Actions:  []BannerAction{{Label: "Dismiss"}},
+	})
+	<-stop
+}
+
+// describeStoreMigration summarizes the progress of a migration.
+func describeStoreMigration(progress StoreMigrationProgress) string {
+	if progress.Verifying {
+		return fmt.Sprintf("Verifying messages copied into the %s store...", progress.To)
+	}
+	text := fmt.Sprintf("Copying messages into the %s store: %d of %d", progress.To, progress.Copied, progress.Total)
+	if progress.Skipped > 0 {
+		text += fmt.Sprintf(", %d unreadable", progress.Skipped)
+	}
+	return text
+}
+
+// heartbeatInterval is how often the active identity announces that it is
+// online.
+const heartbeatInterval = time.Minute * 5
+
 func (a *arborService) StartHeartbeat() {
+	a.heartbeatLock.Lock()
+	defer a.heartbeatLock.Unlock()
+	if a.stopHeartbeat != nil {
+		log.Printf("Stopping active-status heartbeat")
+		close(a.stopHeartbeat)
+		a.stopHeartbeat = nil
+	}
+	if a.SettingsService.ActiveArborIdentityID() == nil {
+		return
+	}
+	builder, err := a.SettingsService.Builder()
+	if err != nil {
+		log.Printf("Could not acquire builder: %v", err)
+		return
+	}
+	var communities []*forest.Community
 	a.Communities().WithCommunities(func(c []*forest.Community) {
-		if a.SettingsService.ActiveArborIdentityID() != nil {
-			builder, err := a.SettingsService.Builder()
-			if err == nil {
-				log.Printf("Begining active-status heartbeat")
-				go status.StartActivityHeartBeat(a.Store(), c, builder, time.Minute*5)
-			} else {
-				log.Printf("Could not acquire builder: %v", err)
+		communities = append(communities, c...)
+	})
+	log.Printf("Begining active-status heartbeat")
+	stop := make(chan struct{})
+	a.stopHeartbeat = stop
+	go heartbeat(a.Store(), communities, builder, stop)
+}
+
+// heartbeat emits an active-status node as builder into each community
+// every heartbeatInterval until stop is closed.
+func heartbeat(s store.ExtendedStore, communities []*forest.Community, builder *forest.Builder, stop chan struct{}) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		for _, c := range communities {
+			node, err := status.NewActivityNode(c, builder, status.Active, heartbeatInterval)
+			if err != nil {
+				log.Printf("Error creating active-status node: %v", err)
+				continue
+			}
+			if err := s.Add(node); err != nil {
+				log.Printf("Error adding active status node to store: %v", err)
 			}
 		}
-	})
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
 }
@@ -0,0 +1,845 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"git.sr.ht/~whereswaldon/forest-go"
+	"git.sr.ht/~whereswaldon/forest-go/fields"
+	"git.sr.ht/~whereswaldon/forest-go/grove"
+	"git.sr.ht/~whereswaldon/forest-go/store"
+)
+
+// AuditProblemKind classifies a defect found in a stored node.
+type AuditProblemKind int
+
+const (
+	// AuditUnreadable indicates that the node's data could not be decoded.
+	AuditUnreadable AuditProblemKind = iota
+	// AuditHashMismatch indicates that the node's content does not hash to
+	// the ID it is stored under.
+	AuditHashMismatch
+	// AuditMalformed indicates that the node violates the structural rules
+	// of its node type.
+	AuditMalformed
+	// AuditBadSignature indicates that the node's signature does not match
+	// its author.
+	AuditBadSignature
+	// AuditMissingParent indicates that the node's parent is not stored.
+	AuditMissingParent
+	// AuditMissingCommunity indicates that the community a reply belongs to
+	// is not stored.
+	AuditMissingCommunity
+	// AuditMissingAuthor indicates that the identity that authored the node
+	// is not stored.
+	AuditMissingAuthor
+)
+
+func (k AuditProblemKind) String() string {
+	switch k {
+	case AuditUnreadable:
+		return "unreadable"
+	case AuditHashMismatch:
+		return "hash mismatch"
+	case AuditMalformed:
+		return "malformed"
+	case AuditBadSignature:
+		return "bad signature"
+	case AuditMissingParent:
+		return "missing parent"
+	case AuditMissingCommunity:
+		return "missing community"
+	case AuditMissingAuthor:
+		return "missing author"
+	default:
+		return "unknown"
+	}
+}
+
+// Missing reports whether the problem is a reference to a node that is not
+// stored, rather than a defect in the node itself.
+func (k AuditProblemKind) Missing() bool {
+	return k == AuditMissingParent || k == AuditMissingCommunity || k == AuditMissingAuthor
+}
+
+// AuditProblem describes a defect found in a stored node.
+type AuditProblem struct {
+	// ID is the ID the node is stored under.
+	ID   *fields.QualifiedHash
+	Kind AuditProblemKind
+	// Detail explains the problem.
+	Detail string
+	// Missing is the ID of the absent node for problems whose Kind is
+	// Missing.
+	Missing *fields.QualifiedHash
+	// Resolution describes the action taken on the node, and is empty until
+	// one succeeds.
+	Resolution string
+}
+
+// AuditReport summarizes the progress and findings of a store audit.
+type AuditReport struct {
+	Running bool
+	// Checked is the number of nodes examined so far out of Total.
+	Checked, Total    int
+	Started, Finished time.Time
+	Problems          []AuditProblem
+	// Err is set if the store could not be read in full.
+	Err error
+}
+
+// AuditSubscription identifies a handler registered to receive audit
+// progress.
+type AuditSubscription int
+
+// AuditService checks the integrity of every node in the store and repairs
+// the defects it finds.
+type AuditService interface {
+	// Start begins auditing the store in the background. It does nothing
+	// if an audit is already running.
+	Start()
+	// Schedule audits the store in the background once a day, and sooner
+	// when reading the store reveals corrupt nodes.
+	Schedule()
+	// Report returns the state of the current or most recent audit.
+	Report() AuditReport
+	// Quarantine moves the node into the quarantine directory, removing it
+	// and any replies to it from the store.
+	Quarantine(id *fields.QualifiedHash) error
+	// Delete removes the node and any replies to it from the store.
+	Delete(id *fields.QualifiedHash) error
+	// Refetch requests a problem's node from the connected relays. Missing
+	// nodes are fetched and stored. Defective nodes are replaced if a
+	// relay supplies a valid copy.
+	Refetch(id *fields.QualifiedHash) error
+	// QuarantineDir returns the directory holding quarantined nodes.
+	QuarantineDir() string
+	// SubscribeToProgress registers a handler that will be invoked with the
+	// report whenever an audit makes progress or a problem is resolved.
+	SubscribeToProgress(handler func(AuditReport)) AuditSubscription
+	UnsubscribeFromProgress(AuditSubscription)
+}
+
+// auditProgressInterval limits how often progress is reported during an
+// audit.
+const auditProgressInterval = time.Second / 4
+
+// refetchTimeout bounds how long Refetch waits on each relay.
+const refetchTimeout = time.Second * 10
+
+const (
+	// auditInterval is how often the store is audited in the background.
+	auditInterval = 24 * time.Hour
+	// auditStartDelay postpones the first background audit so that it
+	// does not slow down startup.
+	auditStartDelay = time.Minute
+	// auditPollInterval is how often the background audit checks whether
+	// an audit is due.
+	auditPollInterval = 5 * time.Minute
+)
+
+// auditRecord describes the most recent complete audit, so that background
+// audits are not repeated each time sprig starts.
+type auditRecord struct {
+	Finished time.Time
+	Problems int
+}
+
+type auditService struct {
+	ArborService
+	SproutService
+	BannerService
+	stateDir string
+
+	sync.Mutex
+	report      AuditReport
+	handlers    map[AuditSubscription]func(AuditReport)
+	nextHandler AuditSubscription
+	// last is the most recent complete audit
+	last auditRecord
+}
+
+var _ AuditService = &auditService{}
+
+func newAuditService(stateDir string, arbor ArborService, sprout SproutService, banner BannerService) AuditService {
+	a := &auditService{
+		ArborService:  arbor,
+		SproutService: sprout,
+		BannerService: banner,
+		stateDir:      stateDir,
+		handlers:      make(map[AuditSubscription]func(AuditReport)),
+	}
+	data, err := ioutil.ReadFile(a.recordPath())
+	if err == nil {
+		err = json.Unmarshal(data, &a.last)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("ignoring record of the last store audit: %v", err)
+	}
+	return a
+}
+
+// recordPath returns the file describing the most recent complete audit.
+func (a *auditService) recordPath() string {
+	return filepath.Join(a.stateDir, "audit.json")
+}
+
+func (a *auditService) QuarantineDir() string {
+	return filepath.Join(a.stateDir, "quarantine")
+}
+
+func (a *auditService) Report() AuditReport {
+	a.Lock()
+	defer a.Unlock()
+	return a.snapshot()
+}
+
+// snapshot copies the report so that it can be read without the lock. The
+// caller must hold the lock.
+func (a *auditService) snapshot() AuditReport {
+	report := a.report
+	report.Problems = append([]AuditProblem(nil), a.report.Problems...)
+	return report
+}
+
+func (a *auditService) SubscribeToProgress(handler func(AuditReport)) AuditSubscription {
+	a.Lock()
+	defer a.Unlock()
+	a.nextHandler++
+	a.handlers[a.nextHandler] = handler
+	return a.nextHandler
+}
+
+func (a *auditService) UnsubscribeFromProgress(id AuditSubscription) {
+	a.Lock()
+	defer a.Unlock()
+	delete(a.handlers, id)
+}
+
+// update applies modify with the lock held and notifies subscribers of the
+// resulting report.
+func (a *auditService) update(modify func()) {
+	a.Lock()
+	modify()
+	report := a.snapshot()
+	handlers := make([]func(AuditReport), 0, len(a.handlers))
+	for _, handler := range a.handlers {
+		handlers = append(handlers, handler)
+	}
+	a.Unlock()
+	for _, handler := range handlers {
+		handler(report)
+	}
+}
+
+func (a *auditService) Start() {
+	a.start(false)
+}
+
+// start begins an audit unless one is running. Background audits only
+// announce their findings if they differ from those of the last audit.
+func (a *auditService) start(background bool) {
+	a.Lock()
+	if a.report.Running {
+		a.Unlock()
+		return
+	}
+	a.report = AuditReport{Running: true, Started: time.Now()}
+	a.Unlock()
+	go a.run(background)
+}
+
+func (a *auditService) Schedule() {
+	go func() {
+		time.Sleep(auditStartDelay)
+		reported := 0
+		for {
+			reported = a.startIfDue(reported)
+			time.Sleep(auditPollInterval)
+		}
+	}()
+}
+
+// startIfDue begins a background audit if none completed recently or if
+// more corrupt nodes than the given number have been reported by the
+// store. It returns the number of corrupt nodes reported.
+func (a *auditService) startIfDue(reported int) int {
+	walker, ok := a.ArborService.(storeWalker)
+	if !ok || a.Incognito() || a.StoreError() != nil {
+		// nodes held in memory are not worth auditing
+		return reported
+	}
+	corrupt := len(walker.corruptNodes())
+	a.Lock()
+	due := time.Since(a.last.Finished) > auditInterval
+	a.Unlock()
+	if due || corrupt > reported {
+		a.start(true)
+	}
+	return corrupt
+}
+
+// run audits every stored node, reporting progress in a banner.
+func (a *auditService) run(background bool) {
+	banner := newProgressBanner(a.BannerService, "Auditing stored messages...")
+	defer banner.Cancel()
+
+	walker, ok := a.ArborService.(storeWalker)
+	if !ok {
+		a.update(func() {
+			a.report.Running = false
+			a.report.Finished = time.Now()
+			a.report.Err = fmt.Errorf("the store cannot be audited")
+		})
+		return
+	}
+	var discarded []AuditProblem
+	for _, name := range walker.corruptNodes() {
+		id := &fields.QualifiedHash{}
+		if id.UnmarshalText([]byte(name)) != nil {
+			continue
+		}
+		discarded = append(discarded, AuditProblem{
+			ID:         id,
+			Kind:       AuditUnreadable,
+			Detail:     "truncated data found while reading the store",
+			Resolution: "discarded by the store",
+		})
+	}
+	a.update(func() { a.report.Problems = discarded })
+	lastProgress := time.Now()
+	err := walker.walkStore(func(total int) {
+		a.update(func() { a.report.Total = total })
+	}, func(stored storedNode) {
+		problems := a.check(stored)
+		progress := time.Since(lastProgress) > auditProgressInterval
+		if len(problems) == 0 && !progress {
+			a.Lock()
+			a.report.Checked++
+			a.Unlock()
+			return
+		}
+		lastProgress = time.Now()
+		a.update(func() {
+			a.report.Checked++
+			a.report.Problems = append(a.report.Problems, problems...)
+		})
+		report := a.Report()
+		banner.Update(fmt.Sprintf("Auditing stored messages: %d of %d checked, %d problems", report.Checked, report.Total, len(report.Problems)))
+	})
+	a.update(func() {
+		a.report.Running = false
+		a.report.Finished = time.Now()
+		a.report.Err = err
+	})
+	report := a.Report()
+	log.Printf("store audit checked %d nodes and found %d problems", report.Checked, len(report.Problems))
+	if err != nil {
+		log.Printf("store audit incomplete: %v", err)
+	}
+	a.Lock()
+	previous := a.last
+	if err == nil {
+		a.last = auditRecord{Finished: report.Finished, Problems: len(report.Problems)}
+		if data, err := json.MarshalIndent(a.last, "", "  "); err != nil {
+			log.Printf("couldn't marshal store audit record as json: %v", err)
+		} else if err := ioutil.WriteFile(a.recordPath(), data, 0660); err != nil {
+			log.Printf("couldn't save store audit record: %v", err)
+		}
+	}
+	a.Unlock()
+	if len(report.Problems) == 0 && err == nil {
+		return
+	}
+	if background && err == nil && len(report.Problems) == previous.Problems {
+		// the user has already been told about these problems
+		return
+	}
+	text := fmt.Sprintf("The store audit found %d problems. Review them under Settings > Store audit.", len(report.Problems))
+	if err != nil {
+		text = fmt.Sprintf("The store audit could not read every message: %v", err)
+	}
+	a.BannerService.Add(&ActionBanner{
+		Priority: Warn,
+		Text:     text,
+		Actions:  []BannerAction{{Label: "Dismiss"}},
+	})
+}
+
+// check returns the problems with a stored node.
+func (a *auditService) check(stored storedNode) []AuditProblem {
+	problem := func(kind AuditProblemKind, detail string) []AuditProblem {
+		return []AuditProblem{{ID: stored.ID, Kind: kind, Detail: detail}}
+	}
+	if stored.Err != nil {
+		return problem(AuditUnreadable, stored.Err.Error())
+	}
+	node := stored.Node
+	if !node.ID().Equals(stored.ID) {
+		return problem(AuditHashMismatch, "content hashes to "+node.ID().String())
+	}
+	if err := node.ValidateInternal(); err != nil {
+		return problem(AuditMalformed, err.Error())
+	}
+	var problems []AuditProblem
+	missing := func(kind AuditProblemKind, id *fields.QualifiedHash) bool {
+		if _, has, err := a.Store().Get(id); err == nil && has {
+			return false
+		}
+		problems = append(problems, AuditProblem{
+			ID:      stored.ID,
+			Kind:    kind,
+			Detail:  id.String() + " is not stored",
+			Missing: id,
+		})
+		return true
+	}
+	var author *forest.Identity
+	switch n := node.(type) {
+	case *forest.Identity:
+		author = n
+	case *forest.Community:
+		if !missing(AuditMissingAuthor, &n.Author) {
+			author, _ = a.identity(&n.Author)
+		}
+	case *forest.Reply:
+		if !missing(AuditMissingAuthor, &n.Author) {
+			author, _ = a.identity(&n.Author)
+		}
+		missing(AuditMissingCommunity, &n.CommunityID)
+		if !n.Parent.Equals(&n.CommunityID) {
+			missing(AuditMissingParent, &n.Parent)
+		}
+	}
+	if author != nil {
+		if validator, ok := node.(forest.SignatureValidator); ok {
+			if valid, err := forest.ValidateSignature(validator, author); err != nil || !valid {
+				detail := "signature does not match " + author.ID().String()
+				if err != nil {
+					detail = err.Error()
+				}
+				problems = append(problems, AuditProblem{ID: stored.ID, Kind: AuditBadSignature, Detail: detail})
+			}
+		}
+	}
+	return problems
+}
+
+// identity looks up a stored identity.
+func (a *auditService) identity(id *fields.QualifiedHash) (*forest.Identity, error) {
+	node, has, err := a.Store().GetIdentity(id)
+	if err != nil {
+		return nil, err
+	} else if !has {
+		return nil, fmt.Errorf("identity %s is not stored", id)
+	}
+	identity, ok := node.(*forest.Identity)
+	if !ok {
+		return nil, fmt.Errorf("node %s is not an identity", id)
+	}
+	return identity, nil
+}
+
+// problem returns an unresolved problem recorded for the node, preferring
+// defects in the node itself over missing references.
+func (a *auditService) problem(id *fields.QualifiedHash) (AuditProblem, error) {
+	a.Lock()
+	defer a.Unlock()
+	var found *AuditProblem
+	for i := range a.report.Problems {
+		problem := &a.report.Problems[i]
+		if !problem.ID.Equals(id) || problem.Resolution != "" {
+			continue
+		}
+		if found == nil || (found.Kind.Missing() && !problem.Kind.Missing()) {
+			found = problem
+		}
+	}
+	if found == nil {
+		return AuditProblem{}, fmt.Errorf("no unresolved problem recorded for %s", id)
+	}
+	return *found, nil
+}
+
+// resolve records the action taken on every problem with the node.
+func (a *auditService) resolve(id *fields.QualifiedHash, resolution string) {
+	a.update(func() {
+		for i := range a.report.Problems {
+			if a.report.Problems[i].ID.Equals(id) {
+				a.report.Problems[i].Resolution = resolution
+			}
+		}
+	})
+}
+
+// remove deletes a problem node from the store.
+func (a *auditService) remove(problem AuditProblem) error {
+	walker, ok := a.ArborService.(storeWalker)
+	if !ok {
+		return fmt.Errorf("the store cannot be repaired")
+	}
+	// nodes that could not be decoded were never cached, so their data can
+	// be removed without disturbing replies to them
+	direct := problem.Kind == AuditUnreadable || problem.Kind == AuditHashMismatch
+	return walker.removeStored(problem.ID, direct)
+}
+
+// replace stores a fetched copy of a problem node in place of the stored
+// one, keeping the replies to it.
+func (a *auditService) replace(problem AuditProblem, node forest.Node) error {
+	walker, ok := a.ArborService.(storeWalker)
+	if !ok {
+		return fmt.Errorf("the store cannot be repaired")
+	}
+	if problem.Kind != AuditUnreadable && problem.Kind != AuditHashMismatch {
+		return walker.replaceStored(node)
+	}
+	if err := walker.removeStored(problem.ID, true); err != nil {
+		return err
+	}
+	if err := a.Store().Add(node); err != nil {
+		return fmt.Errorf("failed storing fetched node: %w", err)
+	}
+	return nil
+}
+
+func (a *auditService) Quarantine(id *fields.QualifiedHash) error {
+	problem, err := a.problem(id)
+	if err != nil {
+		return err
+	}
+	walker, ok := a.ArborService.(storeWalker)
+	if !ok {
+		return fmt.Errorf("the store cannot be repaired")
+	}
+	data, err := walker.readStored(id)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(a.QuarantineDir(), 0770); err != nil {
+		return fmt.Errorf("failed creating quarantine directory: %w", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(a.QuarantineDir(), id.String()), data, 0660); err != nil {
+		return fmt.Errorf("failed quarantining node: %w", err)
+	}
+	if err := a.remove(problem); err != nil {
+		return err
+	}
+	a.resolve(id, "quarantined")
+	return nil
+}
+
+func (a *auditService) Delete(id *fields.QualifiedHash) error {
+	problem, err := a.problem(id)
+	if err != nil {
+		return err
+	}
+	if err := a.remove(problem); err != nil {
+		return err
+	}
+	a.resolve(id, "deleted")
+	return nil
+}
+
+func (a *auditService) Refetch(id *fields.QualifiedHash) error {
+	problem, err := a.problem(id)
+	if err != nil {
+		return err
+	}
+	if !problem.Kind.Missing() {
+		node, err := a.fetch(id)
+		if err != nil {
+			return err
+		}
+		if err := a.replace(problem, node); err != nil {
+			return err
+		}
+		a.resolve(id, "fetched again")
+		return nil
+	}
+	var missing []*fields.QualifiedHash
+	a.Lock()
+	for _, p := range a.report.Problems {
+		if p.ID.Equals(id) && p.Kind.Missing() && p.Resolution == "" {
+			missing = append(missing, p.Missing)
+		}
+	}
+	a.Unlock()
+	for _, target := range missing {
+		node, err := a.fetch(target)
+		if err != nil {
+			return err
+		}
+		if err := a.Store().Add(node); err != nil {
+			return fmt.Errorf("failed storing fetched node: %w", err)
+		}
+		a.update(func() {
+			for i := range a.report.Problems {
+				if p := &a.report.Problems[i]; p.Missing != nil && p.Missing.Equals(target) {
+					p.Resolution = "fetched missing node"
+				}
+			}
+		})
+	}
+	return nil
+}
+
+// fetch queries the connected relays for a node and returns the first
+// valid copy.
+func (a *auditService) fetch(id *fields.QualifiedHash) (forest.Node, error) {
+	var errs []error
+	for _, addr := range a.Connections() {
+		worker := a.WorkerFor(addr)
+		if worker == nil {
+			continue
+		}
+		response, err := worker.SendQuery([]*fields.QualifiedHash{id}, time.After(refetchTimeout))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", addr, err))
+			continue
+		}
+		for _, node := range response.Nodes {
+			if !node.ID().Equals(id) {
+				continue
+			}
+			if err := a.validateFetched(node); err != nil {
+				errs = append(errs, fmt.Errorf("%s sent an invalid copy: %w", addr, err))
+				continue
+			}
+			return node, nil
+		}
+		errs = append(errs, fmt.Errorf("%s does not have it", addr))
+	}
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("no relays are connected")
+	}
+	return nil, fmt.Errorf("could not fetch %s: %v", id, errs)
+}
+
+// validateFetched checks a node received from a relay before it replaces a
+// stored one.
+func (a *auditService) validateFetched(node forest.Node) error {
+	if err := node.ValidateInternal(); err != nil {
+		return err
+	}
+	author, ok := node.(*forest.Identity)
+	if !ok {
+		var err error
+		if author, err = a.identity(node.AuthorID()); err != nil {
+			return err
+		}
+	}
+	validator, ok := node.(forest.SignatureValidator)
+	if !ok {
+		return fmt.Errorf("node %s cannot be verified", node.ID())
+	}
+	if valid, err := forest.ValidateSignature(validator, author); err != nil {
+		return err
+	} else if !valid {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
+// storedNode is a node read directly from the backing store.
+type storedNode struct {
+	// ID is the ID the node is stored under.
+	ID *fields.QualifiedHash
+	// Node is nil if the data could not be decoded, in which case Err
+	// explains why.
+	Node forest.Node
+	Err  error
+}
+
+// storeWalker provides the raw store access needed by audits.
+type storeWalker interface {
+	// walkStore invokes begin with the number of stored nodes, then visit
+	// with each of them.
+	walkStore(begin func(total int), visit func(storedNode)) error
+	// readStored returns the stored data of a node.
+	readStored(id *fields.QualifiedHash) ([]byte, error)
+	// removeStored deletes a node. If direct is set, only the node's data
+	// is removed, otherwise the node and its descendants are removed
+	// through the store.
+	removeStored(id *fields.QualifiedHash, direct bool) error
+	// replaceStored stores node in place of the stored node with the same
+	// ID without removing the replies to it.
+	replaceStored(node forest.Node) error
+	// corruptNodes returns the IDs of nodes that the store found corrupt
+	// and discarded on its own.
+	corruptNodes() []string
+}
+
+var _ storeWalker = &arborService{}
+
+// groveDir returns the directory of the grove backing the store, if there
+// is one.
+func (a *arborService) groveDir() (string, bool) {
+	if _, ok := a.storedNodes().(*grove.Grove); !ok {
+		return "", false
+	}
+	return a.DataPath(), true
+}
+
+// storedNodes returns the store holding the nodes, looking through the
+// fallback used when the configured store could not be opened.
+func (a *arborService) storedNodes() forest.Store {
+	s := a.backend()
+	if fallback, ok := s.(*fallbackStore); ok {
+		return fallback.Current()
+	}
+	return s
+}
+
+func (a *arborService) corruptNodes() []string {
+	a.corruptLock.Lock()
+	defer a.corruptLock.Unlock()
+	return append([]string(nil), a.corrupt...)
+}
+
+func (a *arborService) walkStore(begin func(total int), visit func(storedNode)) error {
+	return walkNodes(a.storedNodes(), a.DataPath(), begin, visit)
+}
+
+// walkNodes visits every node in s, whose data is in dir if it is a grove.
+func walkNodes(s forest.Store, dir string, begin func(total int), visit func(storedNode)) error {
+	if _, ok := s.(*grove.Grove); ok {
+		return walkGrove(dir, begin, visit)
+	}
+	copiable, ok := s.(forest.Copiable)
+	if !ok {
+		return fmt.Errorf("store %T cannot be listed", s)
+	}
+	copied := store.NewMemoryStore()
+	err := copiable.CopyInto(copied)
+	begin(len(copied.Items))
+	for _, node := range copied.Items {
+		visit(storedNode{ID: node.ID(), Node: node})
+	}
+	if err != nil {
+		return fmt.Errorf("failed reading every node: %w", err)
+	}
+	return nil
+}
+
+// walkGrove visits the node files in dir. Reading the files directly
+// rather than through the grove exposes data that no longer matches its
+// file name.
+func walkGrove(dir string, begin func(total int), visit func(storedNode)) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed listing stored nodes: %w", err)
+	}
+	var ids []*fields.QualifiedHash
+	for _, entry := range entries {
+		id := &fields.QualifiedHash{}
+		if entry.IsDir() || id.UnmarshalText([]byte(entry.Name())) != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	begin(len(ids))
+	for _, id := range ids {
+		stored := storedNode{ID: id}
+		data, err := ioutil.ReadFile(filepath.Join(dir, id.String()))
+		if err == nil {
+			stored.Node, err = forest.UnmarshalBinaryNode(data)
+		}
+		stored.Err = err
+		visit(stored)
+	}
+	return nil
+}
+
+func (a *arborService) readStored(id *fields.QualifiedHash) ([]byte, error) {
+	if dir, ok := a.groveDir(); ok {
+		data, err := ioutil.ReadFile(filepath.Join(dir, id.String()))
+		if err != nil {
+			return nil, fmt.Errorf("failed reading node %s: %w", id, err)
+		}
+		return data, nil
+	}
+	node, has, err := a.grove.Get(id)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading node %s: %w", id, err)
+	} else if !has {
+		return nil, fmt.Errorf("node %s is not stored", id)
+	}
+	return node.MarshalBinary()
+}
+
+func (a *arborService) removeStored(id *fields.QualifiedHash, direct bool) error {
+	if dir, ok := a.groveDir(); ok && direct {
+		if err := os.Remove(filepath.Join(dir, id.String())); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed removing node %s: %w", id, err)
+		}
+		a.reportRemoved([]*fields.QualifiedHash{id})
+		return nil
+	}
+	return a.removeReported(id)
+}
+
+// removeSubtree removes a node and its replies from the store, returning
+// the replies parents first.
+func (a *arborService) removeSubtree(id *fields.QualifiedHash) ([]forest.Node, error) {
+	ids, err := a.grove.DescendantsOf(id)
+	if err != nil {
+		return nil, fmt.Errorf("failed listing replies to %s: %w", id, err)
+	}
+	replies := make([]forest.Node, 0, len(ids))
+	for _, id := range ids {
+		reply, has, err := a.grove.Get(id)
+		if err != nil {
+			return nil, fmt.Errorf("failed reading reply %s: %w", id, err)
+		} else if has {
+			replies = append(replies, reply)
+		}
+	}
+	sort.SliceStable(replies, func(i, j int) bool {
+		return replies[i].TreeDepth() < replies[j].TreeDepth()
+	})
+	// Orchard deadlocks removing a node that has replies, so the deepest
+	// replies are removed first
+	for i := len(replies) - 1; i >= 0; i-- {
+		if err := a.grove.RemoveSubtree(replies[i].ID()); err != nil {
+			return nil, fmt.Errorf("failed removing reply %s: %w", replies[i].ID(), err)
+		}
+	}
+	if err := a.grove.RemoveSubtree(id); err != nil {
+		return nil, fmt.Errorf("failed removing node %s: %w", id, err)
+	}
+	return replies, nil
+}
+
+func (a *arborService) replaceStored(node forest.Node) error {
+	// the stores can only remove a node together with its replies, so the
+	// replies are stored again afterwards
+	replies, err := a.removeSubtree(node.ID())
+	if err != nil {
+		return err
+	}
+	if err := a.grove.Add(node); err != nil {
+		return fmt.Errorf("failed storing fetched node: %w", err)
+	}
+	// the replies are not new, so they are stored without notifying
+	// subscribers
+	s := a.storedNodes()
+	var failed error
+	for _, reply := range replies {
+		if err := s.Add(reply); err != nil {
+			log.Printf("Failed restoring reply %s: %v", reply.ID(), err)
+			if failed == nil {
+				failed = fmt.Errorf("failed restoring reply %s: %w", reply.ID(), err)
+			}
+		}
+	}
+	return failed
+}
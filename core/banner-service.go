@@ -1,6 +1,9 @@
 package core
 
-import "sort"
+import (
+	"sort"
+	"sync"
+)
 
 // Banner is a type that provides details for a persistent on-screen
 // notification banner
@@ -21,33 +24,31 @@ type BannerService interface {
 
 type bannerService struct {
 	App
-	newBanners chan Banner
-	banners    []Banner
+	sync.Mutex
+	banners []Banner
 }
 
 var _ BannerService = &bannerService{}
 
 func NewBannerService(app App) BannerService {
 	return &bannerService{
-		newBanners: make(chan Banner, 1),
-		App:        app,
+		App: app,
 	}
 }
 
 func (b *bannerService) Add(banner Banner) {
-	b.newBanners <- banner
-	b.App.Window().Invalidate()
+	b.Lock()
+	b.banners = append(b.banners, banner)
+	sort.SliceStable(b.banners, func(i, j int) bool {
+		return b.banners[i].BannerPriority() > b.banners[j].BannerPriority()
+	})
+	b.Unlock()
+	b.App.Invalidate()
 }
 
 func (b *bannerService) Top() Banner {
-	select {
-	case banner := <-b.newBanners:
-		b.banners = append(b.banners, banner)
-		sort.Slice(b.banners, func(i, j int) bool {
-			return b.banners[i].BannerPriority() > b.banners[j].BannerPriority()
-		})
-	default:
-	}
+	b.Lock()
+	defer b.Unlock()
 	if len(b.banners) < 1 {
 		return nil
 	}
@@ -90,3 +91,63 @@ func (l *LoadingBanner) Cancel() {
 func (l *LoadingBanner) IsCancelled() bool {
 	return l.cancelled
 }
+
+// progressBanner displays the progress of a long-running task in a
+// LoadingBanner. The banner is replaced rather than edited on each update
+// because the frontend reads it concurrently.
+type progressBanner struct {
+	BannerService
+	current *LoadingBanner
+}
+
+// newProgressBanner displays text in a new loading banner.
+func newProgressBanner(banners BannerService, text string) *progressBanner {
+	p := &progressBanner{BannerService: banners}
+	p.Update(text)
+	return p
+}
+
+// Update replaces the displayed text.
+func (p *progressBanner) Update(text string) {
+	next := &LoadingBanner{Priority: Info, Text: text}
+	p.BannerService.Add(next)
+	if p.current != nil {
+		p.current.Cancel()
+	}
+	p.current = next
+}
+
+// Cancel removes the banner.
+func (p *progressBanner) Cancel() {
+	p.current.Cancel()
+}
+
+// BannerAction is a button displayed on an ActionBanner.
+type BannerAction struct {
+	Label string
+	// Do is invoked when the action is chosen. The banner is cancelled
+	// afterward.
+	Do func()
+}
+
+// ActionBanner requests a banner displaying the provided text along with
+// a button for each action. It will not disappear until cancelled or until
+// the user chooses one of the actions.
+type ActionBanner struct {
+	Priority
+	Text      string
+	Actions   []BannerAction
+	cancelled bool
+}
+
+func (a *ActionBanner) BannerPriority() Priority {
+	return a.Priority
+}
+
+func (a *ActionBanner) Cancel() {
+	a.cancelled = true
+}
+
+func (a *ActionBanner) IsCancelled() bool {
+	return a.cancelled
+}
@@ -0,0 +1,366 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"git.sr.ht/~whereswaldon/forest-go"
+	"git.sr.ht/~whereswaldon/forest-go/fields"
+	"git.sr.ht/~whereswaldon/forest-go/store"
+)
+
+// bundleMagic begins every bundle file.
+var bundleMagic = []byte("ARBORBDL")
+
+// bundleVersion is the version of the bundle layout written by WriteBundle.
+const bundleVersion = 1
+
+// maxBundleNodeSize bounds the size of a single node in a bundle, so that
+// a damaged length cannot exhaust memory.
+const maxBundleNodeSize = 1 << 24
+
+// BundleExtension is the conventional file name extension of bundles.
+const BundleExtension = ".arbor-bundle"
+
+// BundleSelection chooses the nodes written to a bundle.
+type BundleSelection struct {
+	// Roots are identities, communities, or replies. Communities and
+	// replies are bundled with every reply beneath them.
+	Roots []*fields.QualifiedHash
+	// Since and Until bound the creation time of the replies beneath the
+	// roots, and are ignored if zero.
+	Since, Until time.Time
+}
+
+// WriteBundle writes the selected nodes to w in forest's binary encoding,
+// returning the number of nodes written. The ancestors and authors of
+// every node are included, so that the bundle can be validated and stored
+// by a client that has none of its nodes. Nodes are ordered so that each
+// follows those it refers to.
+func WriteBundle(s store.ExtendedStore, selection BundleSelection, w io.Writer) (int, error) {
+	nodes := make(map[string]forest.Node)
+	var include func(id *fields.QualifiedHash) error
+	include = func(id *fields.QualifiedHash) error {
+		if id.Equals(fields.NullHash()) || nodes[id.String()] != nil {
+			return nil
+		}
+		node, has, err := s.Get(id)
+		if err != nil {
+			return fmt.Errorf("failed loading %s: %w", id, err)
+		} else if !has {
+			return fmt.Errorf("%s is not stored", id)
+		}
+		nodes[id.String()] = node
+		if err := include(node.ParentID()); err != nil {
+			return err
+		}
+		return include(node.AuthorID())
+	}
+	inRange := func(node forest.Node) bool {
+		created := node.CreatedAt()
+		return (selection.Since.IsZero() || !created.Before(selection.Since)) &&
+			(selection.Until.IsZero() || !created.After(selection.Until))
+	}
+	for _, root := range selection.Roots {
+		if err := include(root); err != nil {
+			return 0, err
+		}
+		if _, ok := nodes[root.String()].(*forest.Identity); ok {
+			continue
+		}
+		descendants, err := s.DescendantsOf(root)
+		if err != nil {
+			return 0, fmt.Errorf("failed listing replies beneath %s: %w", root, err)
+		}
+		for _, id := range descendants {
+			node, has, err := s.Get(id)
+			if err != nil {
+				return 0, fmt.Errorf("failed loading %s: %w", id, err)
+			} else if !has || !inRange(node) {
+				continue
+			}
+			if err := include(id); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	ordered := make([]forest.Node, 0, len(nodes))
+	for _, node := range nodes {
+		ordered = append(ordered, node)
+	}
+	sortBundleNodes(ordered)
+	out := bufio.NewWriter(w)
+	var header [2]byte
+	binary.BigEndian.PutUint16(header[:], bundleVersion)
+	if _, err := out.Write(append(append([]byte{}, bundleMagic...), header[:]...)); err != nil {
+		return 0, fmt.Errorf("failed writing bundle: %w", err)
+	}
+	for _, node := range ordered {
+		data, err := node.MarshalBinary()
+		if err != nil {
+			return 0, fmt.Errorf("failed encoding %s: %w", node.ID(), err)
+		}
+		var length [4]byte
+		binary.BigEndian.PutUint32(length[:], uint32(len(data)))
+		if _, err := out.Write(length[:]); err != nil {
+			return 0, fmt.Errorf("failed writing bundle: %w", err)
+		}
+		if _, err := out.Write(data); err != nil {
+			return 0, fmt.Errorf("failed writing bundle: %w", err)
+		}
+	}
+	if err := out.Flush(); err != nil {
+		return 0, fmt.Errorf("failed writing bundle: %w", err)
+	}
+	return len(ordered), nil
+}
+
+// WriteBundleFile writes the selected nodes to a bundle at path, returning
+// the number of nodes written. The file is replaced only once the bundle
+// is complete.
+func WriteBundleFile(s store.ExtendedStore, selection BundleSelection, path string) (int, error) {
+	out, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return 0, fmt.Errorf("failed creating bundle: %w", err)
+	}
+	defer os.Remove(out.Name())
+	count, err := WriteBundle(s, selection, out)
+	if err != nil {
+		out.Close()
+		return 0, err
+	}
+	if err := out.Close(); err != nil {
+		return 0, fmt.Errorf("failed writing bundle: %w", err)
+	}
+	if err := os.Rename(out.Name(), path); err != nil {
+		return 0, fmt.Errorf("failed writing bundle: %w", err)
+	}
+	return count, nil
+}
+
+// sortBundleNodes orders identities before communities before replies,
+// and replies by depth, so that every node follows the nodes it refers to.
+func sortBundleNodes(nodes []forest.Node) {
+	rank := func(node forest.Node) int {
+		switch node.(type) {
+		case *forest.Identity:
+			return 0
+		case *forest.Community:
+			return 1
+		default:
+			return 2
+		}
+	}
+	sort.SliceStable(nodes, func(i, j int) bool {
+		if ri, rj := rank(nodes[i]), rank(nodes[j]); ri != rj {
+			return ri < rj
+		}
+		if di, dj := nodes[i].TreeDepth(), nodes[j].TreeDepth(); di != dj {
+			return di < dj
+		}
+		return nodes[i].CreatedAt().Before(nodes[j].CreatedAt())
+	})
+}
+
+// BundleRejection explains why a node in a bundle was not stored.
+type BundleRejection struct {
+	// ID is nil if the node could not be decoded.
+	ID *fields.QualifiedHash
+	// Index is the position of the node within the bundle.
+	Index  int
+	Reason string
+}
+
+// BundleReport describes the outcome of importing a bundle.
+type BundleReport struct {
+	// Accepted holds the IDs of the nodes that were validated and stored.
+	Accepted []*fields.QualifiedHash
+	// Duplicate holds the IDs of the nodes that were already stored.
+	Duplicate []*fields.QualifiedHash
+	Rejected  []BundleRejection
+}
+
+// String summarizes the report.
+func (r BundleReport) String() string {
+	return fmt.Sprintf("%d accepted, %d already stored, %d rejected", len(r.Accepted), len(r.Duplicate), len(r.Rejected))
+}
+
+// ImportBundle reads a bundle written by WriteBundle and stores each of its
+// nodes whose signature is valid and whose parent, author, and community
+// are either stored already or accepted from the bundle. Nodes that fail
+// validation are reported rather than causing the import to fail. An error
+// is returned if the bundle is damaged, in which case the nodes preceding
+// the damage are still imported and reported.
+func ImportBundle(s store.ExtendedStore, r io.Reader) (BundleReport, error) {
+	var report BundleReport
+	in := bufio.NewReader(r)
+	header := make([]byte, len(bundleMagic)+2)
+	if _, err := io.ReadFull(in, header); err != nil {
+		return report, fmt.Errorf("failed reading bundle: %w", err)
+	}
+	if !bytes.Equal(header[:len(bundleMagic)], bundleMagic) {
+		return report, fmt.Errorf("not a bundle")
+	}
+	if version := binary.BigEndian.Uint16(header[len(bundleMagic):]); version != bundleVersion {
+		return report, fmt.Errorf("unsupported bundle version %d", version)
+	}
+
+	type bundled struct {
+		index int
+		node  forest.Node
+	}
+	var nodes []bundled
+	var readErr error
+	for index := 0; ; index++ {
+		var length [4]byte
+		if _, err := io.ReadFull(in, length[:]); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			readErr = fmt.Errorf("failed reading bundle: %w", err)
+			break
+		}
+		size := binary.BigEndian.Uint32(length[:])
+		if size > maxBundleNodeSize {
+			readErr = fmt.Errorf("failed reading bundle: node %d claims to be %d bytes", index, size)
+			break
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(in, data); err != nil {
+			readErr = fmt.Errorf("failed reading bundle: %w", err)
+			break
+		}
+		node, err := forest.UnmarshalBinaryNode(data)
+		if err != nil {
+			report.Rejected = append(report.Rejected, BundleRejection{Index: index, Reason: err.Error()})
+			continue
+		}
+		nodes = append(nodes, bundled{index: index, node: node})
+	}
+
+	// bundles written by other tools may not order nodes after those they
+	// refer to
+	ordered := make([]forest.Node, len(nodes))
+	indices := make(map[forest.Node]int, len(nodes))
+	for i, b := range nodes {
+		ordered[i] = b.node
+		indices[b.node] = b.index
+	}
+	sortBundleNodes(ordered)
+	for _, node := range ordered {
+		if _, has, err := s.Get(node.ID()); err == nil && has {
+			report.Duplicate = append(report.Duplicate, node.ID())
+			continue
+		}
+		if err := validateBundled(s, node); err != nil {
+			report.Rejected = append(report.Rejected, BundleRejection{
+				ID:     node.ID(),
+				Index:  indices[node],
+				Reason: err.Error(),
+			})
+			continue
+		}
+		if err := s.Add(node); err != nil {
+			report.Rejected = append(report.Rejected, BundleRejection{
+				ID:     node.ID(),
+				Index:  indices[node],
+				Reason: fmt.Sprintf("failed storing: %v", err),
+			})
+			continue
+		}
+		report.Accepted = append(report.Accepted, node.ID())
+	}
+	sort.Slice(report.Rejected, func(i, j int) bool {
+		return report.Rejected[i].Index < report.Rejected[j].Index
+	})
+	return report, readErr
+}
+
+// ImportBundleFile imports the bundle at path.
+func ImportBundleFile(s store.ExtendedStore, path string) (BundleReport, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return BundleReport{}, fmt.Errorf("failed opening bundle: %w", err)
+	}
+	defer f.Close()
+	return ImportBundle(s, f)
+}
+
+// validateBundled checks a node from a bundle against the nodes in s,
+// which must hold everything it refers to.
+func validateBundled(s store.ExtendedStore, node forest.Node) error {
+	if err := node.ValidateInternal(); err != nil {
+		return fmt.Errorf("malformed: %w", err)
+	}
+	if err := node.ValidateReferences(s); err != nil {
+		return fmt.Errorf("missing reference: %w", err)
+	}
+	if reply, ok := node.(*forest.Reply); ok {
+		if err := validateParentChain(s, reply); err != nil {
+			return err
+		}
+	}
+	author, ok := node.(*forest.Identity)
+	if !ok {
+		stored, has, err := s.GetIdentity(node.AuthorID())
+		if err != nil {
+			return fmt.Errorf("failed loading author %s: %w", node.AuthorID(), err)
+		} else if !has {
+			return fmt.Errorf("author %s is not stored", node.AuthorID())
+		}
+		author = stored.(*forest.Identity)
+	}
+	validator, ok := node.(forest.SignatureValidator)
+	if !ok {
+		return fmt.Errorf("cannot be verified")
+	}
+	if valid, err := forest.ValidateSignature(validator, author); err != nil {
+		return fmt.Errorf("invalid signature: %w", err)
+	} else if !valid {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
+// validateParentChain checks that a reply agrees with its parent about
+// the community, conversation, and depth that it belongs to.
+func validateParentChain(s store.ExtendedStore, reply *forest.Reply) error {
+	parent, has, err := s.Get(&reply.Parent)
+	if err != nil {
+		return fmt.Errorf("failed loading parent %s: %w", &reply.Parent, err)
+	} else if !has {
+		return fmt.Errorf("parent %s is not stored", &reply.Parent)
+	}
+	switch parent := parent.(type) {
+	case *forest.Community:
+		if !parent.ID().Equals(&reply.CommunityID) {
+			return fmt.Errorf("parent community %s differs from community %s", parent.ID(), &reply.CommunityID)
+		}
+	case *forest.Reply:
+		if !parent.CommunityID.Equals(&reply.CommunityID) {
+			return fmt.Errorf("parent is in community %s rather than %s", &parent.CommunityID, &reply.CommunityID)
+		}
+		conversation := &parent.ConversationID
+		if parent.Depth == 1 {
+			conversation = parent.ID()
+		}
+		if !conversation.Equals(&reply.ConversationID) {
+			return fmt.Errorf("parent is in conversation %s rather than %s", conversation, &reply.ConversationID)
+		}
+	default:
+		return fmt.Errorf("parent %s is neither a community nor a reply", &reply.Parent)
+	}
+	if reply.Depth != parent.TreeDepth()+1 {
+		return fmt.Errorf("depth %d does not follow parent depth %d", reply.Depth, parent.TreeDepth())
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package core
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// DefaultCaptureSize is the number of messages retained by a protocol
+// capture.
+const DefaultCaptureSize = 1000
+
+// CapturedMessage is a single sprout protocol message exchanged with a relay.
+type CapturedMessage struct {
+	// Seq orders messages across all relays. It is unique within a
+	// capture.
+	Seq      uint64
+	At       time.Time
+	Relay    string
+	Outbound bool
+	Verb     string
+	// Header is the first line of the message.
+	Header string
+	// Payload holds the lines following the header, such as the nodes in
+	// an announce or response.
+	Payload []string
+}
+
+// Direction describes whether the message was sent or received.
+func (c CapturedMessage) Direction() string {
+	if c.Outbound {
+		return ">>"
+	}
+	return "<<"
+}
+
+// ProtocolCapture records sprout protocol messages into a bounded ring
+// buffer while enabled. It is safe for concurrent use.
+type ProtocolCapture struct {
+	sync.Mutex
+	enabled  bool
+	messages []CapturedMessage
+	// next is the index in messages that will be overwritten next once the
+	// buffer is full.
+	next    int
+	nextSeq uint64
+	size    int
+}
+
+// NewProtocolCapture creates a disabled capture retaining up to size
+// messages.
+func NewProtocolCapture(size int) *ProtocolCapture {
+	return &ProtocolCapture{size: size}
+}
+
+// Enabled returns whether messages are being recorded.
+func (p *ProtocolCapture) Enabled() bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.enabled
+}
+
+// SetEnabled starts or stops recording messages. Previously captured
+// messages are retained.
+func (p *ProtocolCapture) SetEnabled(enabled bool) {
+	p.Lock()
+	defer p.Unlock()
+	p.enabled = enabled
+}
+
+// Record adds msg to the capture if it is enabled, evicting the oldest
+// message if the capture is full.
+func (p *ProtocolCapture) Record(msg CapturedMessage) {
+	p.Lock()
+	defer p.Unlock()
+	if !p.enabled || p.size < 1 {
+		return
+	}
+	msg.Seq = p.nextSeq
+	p.nextSeq++
+	if len(p.messages) < p.size {
+		p.messages = append(p.messages, msg)
+		return
+	}
+	p.messages[p.next] = msg
+	p.next = (p.next + 1) % p.size
+}
+
+// Messages returns the captured messages, oldest first.
+func (p *ProtocolCapture) Messages() []CapturedMessage {
+	p.Lock()
+	defer p.Unlock()
+	out := make([]CapturedMessage, 0, len(p.messages))
+	out = append(out, p.messages[p.next:]...)
+	out = append(out, p.messages[:p.next]...)
+	return out
+}
+
+// Clear discards all captured messages.
+func (p *ProtocolCapture) Clear() {
+	p.Lock()
+	defer p.Unlock()
+	p.messages = nil
+	p.next = 0
+}
+
+// WriteCapture writes messages to w in a human-readable text format, one
+// header line per message followed by its indented payload.
+func WriteCapture(w io.Writer, messages []CapturedMessage) error {
+	out := bufio.NewWriter(w)
+	for _, msg := range messages {
+		if _, err := fmt.Fprintf(out, "%s %s %s %s\n", msg.At.Format(time.RFC3339Nano), msg.Relay, msg.Direction(), msg.Header); err != nil {
+			return err
+		}
+		for _, line := range msg.Payload {
+			if _, err := fmt.Fprintf(out, "\t%s\n", line); err != nil {
+				return err
+			}
+		}
+	}
+	return out.Flush()
+}
@@ -0,0 +1,437 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// RelayServiceType is the DNS-SD service type advertised by arbor
+	// relays.
+	RelayServiceType = "_arbor-relay._tcp.local."
+	// discoveryTTL is the time to live of advertised records, in seconds.
+	discoveryTTL = 120
+	// discoveryExpiry is how long a relay remains listed after it was
+	// last seen.
+	discoveryExpiry = 2 * discoveryTTL * time.Second
+)
+
+// mdnsAddr is the IPv4 multicast DNS group.
+var mdnsAddr = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// DiscoveredRelay is a relay found on the local network.
+type DiscoveredRelay struct {
+	// Name is the human-readable instance name of the relay.
+	Name string
+	// Host and Port locate the relay.
+	Host string
+	Port uint16
+	// TLS is whether the relay expects TLS connections.
+	TLS      bool
+	LastSeen time.Time
+}
+
+// Address returns the relay address to connect to the relay with.
+func (d DiscoveredRelay) Address() string {
+	hostPort := net.JoinHostPort(d.Host, fmt.Sprintf("%d", d.Port))
+	if d.TLS {
+		return hostPort
+	}
+	return "tcp://" + hostPort
+}
+
+// DiscoverySubscription identifies a handler registered to receive changes
+// to the discovered relays.
+type DiscoverySubscription int
+
+// DiscoveryService finds relays on the local network using multicast DNS
+// service discovery, and advertises the embedded relay so that other
+// instances can find it. The methods must be safe for concurrent use.
+type DiscoveryService interface {
+	// Browse asks relays on the local network to announce themselves.
+	// Responses are collected in the background.
+	Browse() error
+	// Relays returns the relays discovered recently, sorted by name.
+	Relays() []DiscoveredRelay
+	// Advertise announces a relay named name listening on port of this
+	// host, replacing any previous advertisement.
+	Advertise(name string, port uint16, useTLS bool) error
+	// StopAdvertising withdraws any advertisement.
+	StopAdvertising()
+	// SubscribeToDiscoveries registers a handler that will be invoked
+	// every time the list of discovered relays changes. The handler must
+	// not block.
+	SubscribeToDiscoveries(handler func([]DiscoveredRelay)) DiscoverySubscription
+	UnsubscribeFromDiscoveries(DiscoverySubscription)
+}
+
+// advertisement describes the relay announced by this host.
+type advertisement struct {
+	instance string
+	host     string
+	port     uint16
+	tls      bool
+}
+
+type discoveryService struct {
+	sync.Mutex
+	conn        *net.UDPConn
+	relays      map[string]DiscoveredRelay
+	advertised  *advertisement
+	handlers    map[DiscoverySubscription]func([]DiscoveredRelay)
+	nextHandler DiscoverySubscription
+}
+
+var _ DiscoveryService = &discoveryService{}
+
+func newDiscoveryService() DiscoveryService {
+	return &discoveryService{
+		relays:   make(map[string]DiscoveredRelay),
+		handlers: make(map[DiscoverySubscription]func([]DiscoveredRelay)),
+	}
+}
+
+// listen joins the multicast DNS group if it has not been joined already.
+func (d *discoveryService) listen() (*net.UDPConn, error) {
+	d.Lock()
+	defer d.Unlock()
+	if d.conn != nil {
+		return d.conn, nil
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed joining multicast DNS group: %w", err)
+	}
+	d.conn = conn
+	go d.read(conn)
+	return conn, nil
+}
+
+func (d *discoveryService) Browse() error {
+	conn, err := d.listen()
+	if err != nil {
+		return err
+	}
+	service := dnsmessage.MustNewName(RelayServiceType)
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{})
+	if err := builder.StartQuestions(); err != nil {
+		return err
+	}
+	if err := builder.Question(dnsmessage.Question{
+		Name:  service,
+		Type:  dnsmessage.TypePTR,
+		Class: dnsmessage.ClassINET,
+	}); err != nil {
+		return err
+	}
+	query, err := builder.Finish()
+	if err != nil {
+		return fmt.Errorf("failed building discovery query: %w", err)
+	}
+	if _, err := conn.WriteToUDP(query, mdnsAddr); err != nil {
+		return fmt.Errorf("failed sending discovery query: %w", err)
+	}
+	return nil
+}
+
+func (d *discoveryService) Relays() []DiscoveredRelay {
+	d.Lock()
+	defer d.Unlock()
+	return d.list()
+}
+
+// list returns the unexpired relays. It must be called with the lock held.
+func (d *discoveryService) list() []DiscoveredRelay {
+	out := make([]DiscoveredRelay, 0, len(d.relays))
+	for instance, relay := range d.relays {
+		if time.Since(relay.LastSeen) > discoveryExpiry {
+			delete(d.relays, instance)
+			continue
+		}
+		out = append(out, relay)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+func (d *discoveryService) Advertise(name string, port uint16, useTLS bool) error {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("failed determining hostname: %w", err)
+	}
+	// dots would split the names into extra labels
+	name = strings.ReplaceAll(name, ".", "-")
+	hostname = strings.ReplaceAll(strings.SplitN(hostname, ".", 2)[0], " ", "-")
+	ad := &advertisement{
+		instance: name + "." + RelayServiceType,
+		host:     hostname + ".local.",
+		port:     port,
+		tls:      useTLS,
+	}
+	conn, err := d.listen()
+	if err != nil {
+		return err
+	}
+	d.Lock()
+	d.advertised = ad
+	d.Unlock()
+	return d.announce(conn, ad, discoveryTTL)
+}
+
+func (d *discoveryService) StopAdvertising() {
+	d.Lock()
+	ad, conn := d.advertised, d.conn
+	d.advertised = nil
+	d.Unlock()
+	if ad == nil || conn == nil {
+		return
+	}
+	// a zero TTL tells listeners that the relay is going away
+	if err := d.announce(conn, ad, 0); err != nil {
+		log.Printf("failed withdrawing relay advertisement: %v", err)
+	}
+}
+
+func (d *discoveryService) SubscribeToDiscoveries(handler func([]DiscoveredRelay)) DiscoverySubscription {
+	d.Lock()
+	defer d.Unlock()
+	d.nextHandler++
+	d.handlers[d.nextHandler] = handler
+	return d.nextHandler
+}
+
+func (d *discoveryService) UnsubscribeFromDiscoveries(id DiscoverySubscription) {
+	d.Lock()
+	defer d.Unlock()
+	delete(d.handlers, id)
+}
+
+// announce multicasts the records describing ad.
+func (d *discoveryService) announce(conn *net.UDPConn, ad *advertisement, ttl uint32) error {
+	response, err := buildAdvertisement(ad, ttl)
+	if err != nil {
+		return fmt.Errorf("failed building relay advertisement: %w", err)
+	}
+	if _, err := conn.WriteToUDP(response, mdnsAddr); err != nil {
+		return fmt.Errorf("failed sending relay advertisement: %w", err)
+	}
+	return nil
+}
+
+// buildAdvertisement constructs a multicast DNS response describing ad.
+func buildAdvertisement(ad *advertisement, ttl uint32) ([]byte, error) {
+	service, err := dnsmessage.NewName(RelayServiceType)
+	if err != nil {
+		return nil, err
+	}
+	instance, err := dnsmessage.NewName(ad.instance)
+	if err != nil {
+		return nil, err
+	}
+	host, err := dnsmessage.NewName(ad.host)
+	if err != nil {
+		return nil, err
+	}
+	header := func(name dnsmessage.Name, rtype dnsmessage.Type) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{Name: name, Type: rtype, Class: dnsmessage.ClassINET, TTL: ttl}
+	}
+	txt := "tls=0"
+	if ad.tls {
+		txt = "tls=1"
+	}
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{Response: true, Authoritative: true})
+	builder.EnableCompression()
+	if err := builder.StartAnswers(); err != nil {
+		return nil, err
+	}
+	if err := builder.PTRResource(header(service, dnsmessage.TypePTR), dnsmessage.PTRResource{PTR: instance}); err != nil {
+		return nil, err
+	}
+	if err := builder.StartAdditionals(); err != nil {
+		return nil, err
+	}
+	if err := builder.SRVResource(header(instance, dnsmessage.TypeSRV), dnsmessage.SRVResource{Target: host, Port: ad.port}); err != nil {
+		return nil, err
+	}
+	if err := builder.TXTResource(header(instance, dnsmessage.TypeTXT), dnsmessage.TXTResource{TXT: []string{txt}}); err != nil {
+		return nil, err
+	}
+	for _, ip := range localIPv4Addresses() {
+		var a dnsmessage.AResource
+		copy(a.A[:], ip)
+		if err := builder.AResource(header(host, dnsmessage.TypeA), a); err != nil {
+			return nil, err
+		}
+	}
+	return builder.Finish()
+}
+
+// localIPv4Addresses returns the non-loopback IPv4 addresses of this host.
+func localIPv4Addresses() []net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.Printf("failed listing interface addresses: %v", err)
+		return nil
+	}
+	var out []net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() {
+			continue
+		}
+		if ip4 := ipNet.IP.To4(); ip4 != nil {
+			out = append(out, ip4)
+		}
+	}
+	return out
+}
+
+// read processes multicast DNS messages until conn is closed.
+func (d *discoveryService) read(conn *net.UDPConn) {
+	buf := make([]byte, 9000)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("failed reading multicast DNS: %v", err)
+			}
+			return
+		}
+		if err := d.handle(conn, buf[:n]); err != nil {
+			log.Printf("ignoring multicast DNS message: %v", err)
+		}
+	}
+}
+
+// handle answers queries for the advertised relay and records relays
+// described in responses.
+func (d *discoveryService) handle(conn *net.UDPConn, msg []byte) error {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(msg)
+	if err != nil {
+		return err
+	}
+	if !header.Response {
+		questions, err := parser.AllQuestions()
+		if err != nil {
+			return err
+		}
+		d.Lock()
+		ad := d.advertised
+		d.Unlock()
+		if ad == nil {
+			return nil
+		}
+		for _, q := range questions {
+			if q.Type == dnsmessage.TypePTR && strings.EqualFold(q.Name.String(), RelayServiceType) {
+				return d.announce(conn, ad, discoveryTTL)
+			}
+		}
+		return nil
+	}
+	var records []dnsmessage.Resource
+	for _, section := range []func() ([]dnsmessage.Resource, error){
+		parser.AllAnswers, parser.AllAuthorities, parser.AllAdditionals,
+	} {
+		resources, err := section()
+		if err != nil {
+			return err
+		}
+		records = append(records, resources...)
+	}
+	d.record(records)
+	return nil
+}
+
+// record updates the discovered relays from the records of a response.
+func (d *discoveryService) record(records []dnsmessage.Resource) {
+	var (
+		// instances maps the lowercase instance name to the name as
+		// advertised
+		instances = map[string]string{}
+		ttls      = map[string]uint32{}
+		srvs      = map[string]*dnsmessage.SRVResource{}
+		useTLS    = map[string]bool{}
+		hosts     = map[string]string{}
+	)
+	for _, r := range records {
+		name := strings.ToLower(r.Header.Name.String())
+		switch body := r.Body.(type) {
+		case *dnsmessage.PTRResource:
+			if name == RelayServiceType {
+				advertised := body.PTR.String()
+				suffix := len(advertised) - len("."+RelayServiceType)
+				if suffix < 0 || !strings.EqualFold(advertised[suffix:], "."+RelayServiceType) {
+					// not an instance of the service, so it has no name
+					continue
+				}
+				instance := strings.ToLower(advertised)
+				instances[instance] = advertised
+				ttls[instance] = r.Header.TTL
+			}
+		case *dnsmessage.SRVResource:
+			srvs[name] = body
+		case *dnsmessage.TXTResource:
+			for _, entry := range body.TXT {
+				if entry == "tls=1" {
+					useTLS[name] = true
+				}
+			}
+		case *dnsmessage.AResource:
+			if _, ok := hosts[name]; !ok {
+				hosts[name] = net.IP(body.A[:]).String()
+			}
+		}
+	}
+	if len(instances) < 1 {
+		return
+	}
+	d.Lock()
+	for instance, advertised := range instances {
+		if d.advertised != nil && instance == strings.ToLower(d.advertised.instance) {
+			// multicast messages are looped back, so we hear our own
+			// advertisement
+			continue
+		}
+		if ttls[instance] == 0 {
+			delete(d.relays, instance)
+			continue
+		}
+		srv, ok := srvs[instance]
+		if !ok {
+			continue
+		}
+		target := strings.ToLower(srv.Target.String())
+		host, ok := hosts[target]
+		if !ok {
+			host = strings.TrimSuffix(target, ".")
+		}
+		d.relays[instance] = DiscoveredRelay{
+			Name:     advertised[:len(advertised)-len("."+RelayServiceType)],
+			Host:     host,
+			Port:     srv.Port,
+			TLS:      useTLS[instance],
+			LastSeen: time.Now(),
+		}
+	}
+	relays := d.list()
+	handlers := make([]func([]DiscoveredRelay), 0, len(d.handlers))
+	for _, handler := range d.handlers {
+		handlers = append(handlers, handler)
+	}
+	d.Unlock()
+	for _, handler := range handlers {
+		handler(relays)
+	}
+}
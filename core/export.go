@@ -0,0 +1,410 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"git.sr.ht/~whereswaldon/forest-go"
+	"git.sr.ht/~whereswaldon/forest-go/fields"
+	"git.sr.ht/~whereswaldon/forest-go/store"
+	"git.sr.ht/~whereswaldon/sprig/ds"
+)
+
+// ExportFormat names a file format for exported messages.
+type ExportFormat string
+
+const (
+	// MarkdownExport writes threads as nested Markdown lists.
+	MarkdownExport ExportFormat = "markdown"
+	// HTMLExport writes a self-contained HTML page.
+	HTMLExport ExportFormat = "html"
+	// JSONExport writes the threads as structured JSON.
+	JSONExport ExportFormat = "json"
+)
+
+// ExportFormats lists every supported format.
+var ExportFormats = []ExportFormat{MarkdownExport, HTMLExport, JSONExport}
+
+// String returns a human-readable name for the format.
+func (f ExportFormat) String() string {
+	switch f {
+	case MarkdownExport:
+		return "Markdown"
+	case HTMLExport:
+		return "HTML"
+	case JSONExport:
+		return "JSON"
+	default:
+		return string(f)
+	}
+}
+
+// Extension returns the conventional file name extension of the format.
+func (f ExportFormat) Extension() string {
+	switch f {
+	case MarkdownExport:
+		return ".md"
+	case HTMLExport:
+		return ".html"
+	default:
+		return "." + string(f)
+	}
+}
+
+// ExportScope selects the messages to export.
+type ExportScope struct {
+	// Root is a community, whose conversations are exported, or a reply,
+	// which is exported along with every reply beneath it. If Root is nil,
+	// every stored community is exported.
+	Root *fields.QualifiedHash
+	// Since and Until bound the creation time of exported replies, and
+	// are ignored if zero.
+	Since, Until time.Time
+}
+
+// Export holds threads of replies ready to be written in any format.
+type Export struct {
+	Generated   time.Time          `json:"generated"`
+	Since       *time.Time         `json:"since,omitempty"`
+	Until       *time.Time         `json:"until,omitempty"`
+	Communities []*ExportCommunity `json:"communities"`
+}
+
+// ExportCommunity holds the exported threads within a community.
+type ExportCommunity struct {
+	ID      string         `json:"id"`
+	Name    string         `json:"name"`
+	Threads []*ExportReply `json:"threads"`
+}
+
+// ExportReply is an exported reply and the exported replies to it.
+type ExportReply struct {
+	ID string `json:"id"`
+	// Parent is the ID of the node that the reply answers, which may not
+	// have been exported.
+	Parent string `json:"parent"`
+	// Author is empty if the author's identity is not stored.
+	Author   string    `json:"author"`
+	AuthorID string    `json:"author_id"`
+	Created  time.Time `json:"created"`
+	Content  string    `json:"content"`
+	// Signature is "verified", or "unverifiable" if the author is unknown.
+	Signature string         `json:"signature"`
+	Replies   []*ExportReply `json:"replies,omitempty"`
+}
+
+// exportCommunityLimit bounds the number of communities exported when no
+// root is given.
+const exportCommunityLimit = 4096
+
+// NewExport gathers the replies selected by scope from s. Replies are
+// omitted under the same rules that hide them in the message list, and
+// the replies beneath an omitted reply are attached to its closest exported
+// ancestor.
+func NewExport(s store.ExtendedStore, scope ExportScope) (*Export, error) {
+	export := &Export{Generated: time.Now().UTC()}
+	if !scope.Since.IsZero() {
+		since := scope.Since.UTC()
+		export.Since = &since
+	}
+	if !scope.Until.IsZero() {
+		until := scope.Until.UTC()
+		export.Until = &until
+	}
+	var communities []*forest.Community
+	var root *forest.Reply
+	if scope.Root == nil {
+		nodes, err := s.Recent(fields.NodeTypeCommunity, exportCommunityLimit)
+		if err != nil && len(nodes) < 1 {
+			return nil, fmt.Errorf("failed listing communities: %w", err)
+		}
+		for _, node := range nodes {
+			if community, ok := node.(*forest.Community); ok {
+				communities = append(communities, community)
+			}
+		}
+		sort.Slice(communities, func(i, j int) bool {
+			return string(communities[i].Name.Blob) < string(communities[j].Name.Blob)
+		})
+	} else {
+		node, has, err := s.Get(scope.Root)
+		if err != nil {
+			return nil, fmt.Errorf("failed loading %s: %w", scope.Root, err)
+		} else if !has {
+			return nil, fmt.Errorf("%s is not stored", scope.Root)
+		}
+		switch node := node.(type) {
+		case *forest.Community:
+			communities = append(communities, node)
+		case *forest.Reply:
+			root = node
+			community, has, err := s.GetCommunity(&node.CommunityID)
+			if err != nil || !has {
+				return nil, fmt.Errorf("failed loading community of %s: %v", scope.Root, err)
+			}
+			communities = append(communities, community.(*forest.Community))
+		default:
+			return nil, fmt.Errorf("%s is neither a community nor a reply", scope.Root)
+		}
+	}
+	for _, community := range communities {
+		top := community.ID()
+		if root != nil {
+			top = root.ID()
+		}
+		ids, err := s.DescendantsOf(top)
+		if err != nil {
+			return nil, fmt.Errorf("failed listing replies in %s: %w", string(community.Name.Blob), err)
+		}
+		if root != nil {
+			ids = append(ids, root.ID())
+		}
+		threads, err := exportThreads(s, ids, scope)
+		if err != nil {
+			return nil, err
+		}
+		export.Communities = append(export.Communities, &ExportCommunity{
+			ID:      community.ID().String(),
+			Name:    string(community.Name.Blob),
+			Threads: threads,
+		})
+	}
+	return export, nil
+}
+
+// exportThreads loads the replies with the given IDs and arranges those
+// within the scope into threads.
+func exportThreads(s store.ExtendedStore, ids []*fields.QualifiedHash, scope ExportScope) ([]*ExportReply, error) {
+	// parents maps every listed reply to its parent, including those that
+	// are omitted, so that threads can be joined across them
+	parents := make(map[string]string, len(ids))
+	exported := make(map[string]*ExportReply, len(ids))
+	for _, id := range ids {
+		node, has, err := s.Get(id)
+		if err != nil {
+			return nil, fmt.Errorf("failed loading %s: %w", id, err)
+		} else if !has {
+			continue
+		}
+		parents[id.String()] = node.ParentID().String()
+		var rd ds.ReplyData
+		if !rd.Populate(node, s) {
+			continue
+		}
+		if !scope.Since.IsZero() && rd.CreatedAt.Before(scope.Since) {
+			continue
+		}
+		if !scope.Until.IsZero() && rd.CreatedAt.After(scope.Until) {
+			continue
+		}
+		exported[id.String()] = &ExportReply{
+			ID:        rd.ID.String(),
+			Parent:    rd.ParentID.String(),
+			Author:    rd.AuthorName,
+			AuthorID:  rd.AuthorID.String(),
+			Created:   rd.CreatedAt.UTC(),
+			Content:   rd.Content,
+			Signature: rd.Signature.String(),
+		}
+	}
+	var threads []*ExportReply
+	for id, reply := range exported {
+		parent, ok := parents[id]
+		for ok && exported[parent] == nil {
+			parent, ok = parents[parent]
+		}
+		if ok {
+			exported[parent].Replies = append(exported[parent].Replies, reply)
+		} else {
+			threads = append(threads, reply)
+		}
+	}
+	sortExportReplies(threads)
+	return threads, nil
+}
+
+// sortExportReplies orders replies and their descendants by creation time.
+func sortExportReplies(replies []*ExportReply) {
+	sort.Slice(replies, func(i, j int) bool {
+		if !replies[i].Created.Equal(replies[j].Created) {
+			return replies[i].Created.Before(replies[j].Created)
+		}
+		return replies[i].ID < replies[j].ID
+	})
+	for _, reply := range replies {
+		sortExportReplies(reply.Replies)
+	}
+}
+
+// Count returns the number of exported replies.
+func (e *Export) Count() int {
+	var count func([]*ExportReply) int
+	count = func(replies []*ExportReply) int {
+		n := len(replies)
+		for _, reply := range replies {
+			n += count(reply.Replies)
+		}
+		return n
+	}
+	total := 0
+	for _, community := range e.Communities {
+		total += count(community.Threads)
+	}
+	return total
+}
+
+// Write encodes the export to w in the given format.
+func (e *Export) Write(w io.Writer, format ExportFormat) error {
+	switch format {
+	case MarkdownExport:
+		return e.writeMarkdown(w)
+	case HTMLExport:
+		return exportTemplate.Execute(w, e)
+	case JSONExport:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(e)
+	default:
+		return fmt.Errorf("unknown export format %q", string(format))
+	}
+}
+
+// ExportToFile writes the replies selected by scope from s to the file at
+// path, returning the number of replies written. The file is replaced only
+// once the export is complete.
+func ExportToFile(s store.ExtendedStore, scope ExportScope, format ExportFormat, path string) (int, error) {
+	export, err := NewExport(s, scope)
+	if err != nil {
+		return 0, err
+	}
+	out, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return 0, fmt.Errorf("failed creating export: %w", err)
+	}
+	defer os.Remove(out.Name())
+	if err := export.Write(out, format); err != nil {
+		out.Close()
+		return 0, fmt.Errorf("failed writing export: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return 0, fmt.Errorf("failed writing export: %w", err)
+	}
+	if err := os.Rename(out.Name(), path); err != nil {
+		return 0, fmt.Errorf("failed writing export: %w", err)
+	}
+	return export.Count(), nil
+}
+
+// exportTimeLayout formats timestamps in Markdown and HTML exports.
+const exportTimeLayout = "2006-01-02 15:04 UTC"
+
+// exportAuthor returns the name of a reply's author for display.
+func exportAuthor(reply *ExportReply) string {
+	if reply.Author == "" {
+		return "unknown author"
+	}
+	return reply.Author
+}
+
+// exportRange describes the time range of an export, if it has one.
+func (e *Export) exportRange() string {
+	switch {
+	case e.Since != nil && e.Until != nil:
+		return fmt.Sprintf("Messages from %s until %s.", e.Since.Format(exportTimeLayout), e.Until.Format(exportTimeLayout))
+	case e.Since != nil:
+		return fmt.Sprintf("Messages since %s.", e.Since.Format(exportTimeLayout))
+	case e.Until != nil:
+		return fmt.Sprintf("Messages until %s.", e.Until.Format(exportTimeLayout))
+	default:
+		return ""
+	}
+}
+
+func (e *Export) writeMarkdown(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Arbor messages\n\nExported %s.", e.Generated.Format(exportTimeLayout))
+	if r := e.exportRange(); r != "" {
+		b.WriteString(" " + r)
+	}
+	b.WriteString("\n")
+	var writeReply func(reply *ExportReply, depth int)
+	writeReply = func(reply *ExportReply, depth int) {
+		indent := strings.Repeat("  ", depth)
+		fmt.Fprintf(&b, "\n%s- **%s** · %s · `%s`\n", indent, exportAuthor(reply), reply.Created.Format(exportTimeLayout), reply.ID)
+		if reply.Signature != ds.SignatureVerified.String() {
+			fmt.Fprintf(&b, "%s  _signature %s_\n", indent, reply.Signature)
+		}
+		b.WriteString("\n")
+		for _, line := range strings.Split(strings.TrimRight(reply.Content, "\n"), "\n") {
+			if strings.TrimSpace(line) == "" {
+				b.WriteString("\n")
+				continue
+			}
+			fmt.Fprintf(&b, "%s  %s\n", indent, line)
+		}
+		for _, child := range reply.Replies {
+			writeReply(child, depth+1)
+		}
+	}
+	for _, community := range e.Communities {
+		fmt.Fprintf(&b, "\n## %s\n\nCommunity `%s`\n", community.Name, community.ID)
+		for _, thread := range community.Threads {
+			writeReply(thread, 0)
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// exportTemplate renders an export as a standalone HTML page.
+var exportTemplate = template.Must(template.New("export").Funcs(template.FuncMap{
+	"author": exportAuthor,
+	"period": (*Export).exportRange,
+	"time": func(t time.Time) string {
+		return t.Format(exportTimeLayout)
+	},
+	"iso": func(t time.Time) string {
+		return t.Format(time.RFC3339)
+	},
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Arbor messages</title>
+<style>
+body { font-family: sans-serif; max-width: 50em; margin: auto; padding: 1em; color: #222; }
+ul { list-style: none; padding-left: 1.5em; border-left: 1px solid #ccc; }
+body > section > ul { padding-left: 0; border-left: none; }
+li { margin: 0.75em 0; }
+.meta { font-size: 0.85em; color: #666; }
+.meta code { font-size: 0.9em; }
+.content { white-space: pre-wrap; margin: 0.25em 0; }
+.unverified { color: #a00; }
+</style>
+</head>
+<body>
+<h1>Arbor messages</h1>
+<p>Exported {{time .Generated}}. {{period .}}</p>
+{{range .Communities}}<section>
+<h2>{{.Name}}</h2>
+<p class="meta">Community <code>{{.ID}}</code></p>
+<ul>
+{{range .Threads}}{{template "reply" .}}{{end}}</ul>
+</section>
+{{end}}</body>
+</html>
+{{define "reply"}}<li id="{{.ID}}">
+<div class="meta"><strong>{{author .}}</strong> · <time datetime="{{iso .Created}}">{{time .Created}}</time> · <code>{{.ID}}</code>{{if ne .Signature "verified"}} · <span class="unverified">signature {{.Signature}}</span>{{end}}</div>
+<div class="content">{{.Content}}</div>
+{{if .Replies}}<ul>
+{{range .Replies}}{{template "reply" .}}{{end}}</ul>
+{{end}}</li>
+{{end}}`))
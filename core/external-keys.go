@@ -0,0 +1,161 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+
+	"git.sr.ht/~whereswaldon/forest-go"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// ErrExternalKey is returned when an operation needs the private key of an
+// identity that signs through gpg, which never shares its keys with sprig.
+var ErrExternalKey = errors.New("private key is held by gpg")
+
+// gpgKeyPrefix begins the key file of an identity that signs through gpg.
+// It is followed by the fingerprint of the gpg key.
+const gpgKeyPrefix = "sprig-gpg-key "
+
+// readGPGKeyReference returns the fingerprint of the gpg key recorded in
+// key file contents, and whether the contents are such a reference.
+func readGPGKeyReference(data []byte) (string, bool) {
+	if !bytes.HasPrefix(data, []byte(gpgKeyPrefix)) {
+		return "", false
+	}
+	return strings.TrimSpace(string(data[len(gpgKeyPrefix):])), true
+}
+
+// gpgSigner returns a signer that signs with the gpg key identified by
+// keyID. Passphrases are requested by the gpg agent, so gpg is kept from
+// prompting on sprig's terminal.
+func gpgSigner(keyID string) (*forest.GPGSigner, error) {
+	signer, err := forest.NewGPGSigner(keyID)
+	if err != nil {
+		return nil, err
+	}
+	signer.Rewriter = func(cmd *exec.Cmd) error {
+		cmd.Args = append([]string{cmd.Args[0], "--no-tty"}, cmd.Args[1:]...)
+		return nil
+	}
+	return signer, nil
+}
+
+func (s *settingsService) UsesExternalKey() bool {
+	s.identityLock.Lock()
+	defer s.identityLock.Unlock()
+	if s.ActiveIdentity == nil {
+		return false
+	}
+	if s.activeKeyExternal == nil {
+		_, err := readPrivateKey(s.activeKeyPath())
+		external := errors.Is(err, ErrExternalKey)
+		s.activeKeyExternal = &external
+	}
+	return *s.activeKeyExternal
+}
+
+// externalSigner returns a signer for the gpg key referenced by the active
+// identity's key file. The caller must hold identityLock.
+func (s *settingsService) externalSigner() (forest.Signer, error) {
+	data, err := ioutil.ReadFile(s.activeKeyPath())
+	if err != nil {
+		return nil, fmt.Errorf("unable to read key file: %w", err)
+	}
+	fingerprint, ok := readGPGKeyReference(data)
+	if !ok {
+		return nil, fmt.Errorf("key file does not refer to a gpg key")
+	}
+	return gpgSigner(fingerprint)
+}
+
+// validateIdentitySigner checks that the identity node is well-formed and
+// self-signed, and that signer produces signatures that verify against it.
+func validateIdentitySigner(identity *forest.Identity, signer forest.Signer) error {
+	if err := identity.ValidateInternal(); err != nil {
+		return fmt.Errorf("invalid identity: %w", err)
+	}
+	if _, err := forest.ValidateSignature(identity, identity); err != nil {
+		return fmt.Errorf("identity signature is invalid: %w", err)
+	}
+	// sign a throwaway node to prove that the private key matches the
+	// public key embedded in the identity
+	probe, err := forest.As(identity, signer).NewCommunity("key check", []byte{})
+	if err != nil {
+		return fmt.Errorf("failed signing with private key: %w", err)
+	}
+	if _, err := forest.ValidateSignature(probe, identity); err != nil {
+		return fmt.Errorf("private key does not belong to identity %s", identity.ID())
+	}
+	return nil
+}
+
+// CreateGPGIdentity creates an identity that signs with the gpg key
+// identified by keyID and makes it active. Only the key's fingerprint is
+// stored by sprig.
+func (s *settingsService) CreateGPGIdentity(name, keyID string) error {
+	signer, err := gpgSigner(keyID)
+	if err != nil {
+		return err
+	}
+	pubkey, err := signer.PublicKey()
+	if err != nil {
+		return fmt.Errorf("failed exporting public key from gpg: %w", err)
+	}
+	if len(pubkey) == 0 {
+		return fmt.Errorf("gpg has no key matching %q", keyID)
+	}
+	entity, err := openpgp.ReadEntity(packet.NewReader(bytes.NewReader(pubkey)))
+	if err != nil {
+		return fmt.Errorf("failed decoding public key from gpg: %w", err)
+	}
+	// pin the exact key so that later changes to the gpg keyring cannot
+	// swap it out
+	fingerprint := fmt.Sprintf("%X", entity.PrimaryKey.Fingerprint[:])
+	signer.GPGUserName = fingerprint
+	identity, err := forest.NewIdentity(signer, name, []byte{})
+	if err != nil {
+		return fmt.Errorf("failed generating arbor identity with gpg: %w", err)
+	}
+	if err := validateIdentitySigner(identity, signer); err != nil {
+		return err
+	}
+	if err := s.writeNewIdentity(identity, func(w io.Writer) error {
+		_, err := io.WriteString(w, gpgKeyPrefix+fingerprint+"\n")
+		return err
+	}); err != nil {
+		return err
+	}
+	s.setActiveIdentity(identity.ID(), identity, nil)
+	return s.Persist()
+}
+
+// ImportSecretKey creates an identity that signs with an existing
+// ASCII-armored OpenPGP secret key and makes it active. The passphrase
+// decrypts the key if it is protected, and the key is stored encrypted with
+// it unless it is empty.
+func (s *settingsService) ImportSecretKey(name string, armored []byte, passphrase string) error {
+	entities, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(armored))
+	if err != nil {
+		return fmt.Errorf("failed reading secret key: %w", err)
+	}
+	var keypair *openpgp.Entity
+	for _, entity := range entities {
+		if entity.PrivateKey != nil {
+			keypair = entity
+			break
+		}
+	}
+	if keypair == nil {
+		return fmt.Errorf("no secret key found; export it with gpg --export-secret-keys --armor")
+	}
+	if err := decryptPrivateKey(keypair, passphrase); err != nil {
+		return err
+	}
+	return s.createNativeIdentity(name, keypair, passphrase)
+}
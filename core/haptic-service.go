@@ -1,37 +1,17 @@
 package core
 
-import (
-	"log"
-
-	gioapp "gioui.org/app"
-	"gioui.org/x/haptic"
-)
-
 // HapticService provides access to haptic feedback devices features.
 type HapticService interface {
 	UpdateAndroidViewRef(uintptr)
 	Buzz()
 }
 
-type hapticService struct {
-	*haptic.Buzzer
-}
+// headlessHapticService is used when there is no frontend to provide
+// haptic feedback.
+type headlessHapticService struct{}
 
-func newHapticService(w *gioapp.Window) HapticService {
-	return &hapticService{
-		Buzzer: haptic.NewBuzzer(w),
-	}
-}
+var _ HapticService = headlessHapticService{}
 
-func (h *hapticService) UpdateAndroidViewRef(view uintptr) {
-	h.Buzzer.SetView(view)
-}
+func (headlessHapticService) UpdateAndroidViewRef(uintptr) {}
 
-func (h *hapticService) Buzz() {
-	defer func() {
-		if err := recover(); err != nil {
-			log.Printf("Recovered from buzz panic: %v", err)
-		}
-	}()
-	h.Buzzer.Buzz()
-}
+func (headlessHapticService) Buzz() {}
@@ -0,0 +1,232 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"git.sr.ht/~whereswaldon/forest-go"
+	"git.sr.ht/~whereswaldon/forest-go/fields"
+	"golang.org/x/crypto/openpgp"
+)
+
+// IdentityInfo describes an identity stored locally.
+type IdentityInfo struct {
+	ID   *fields.QualifiedHash
+	Name string
+	// Fingerprint is the fingerprint of the identity's OpenPGP key,
+	// formatted for display.
+	Fingerprint string
+	// Algorithm names the algorithm of the identity's OpenPGP key.
+	Algorithm string
+	// Active is whether this identity is used to author messages.
+	Active bool
+	// Archived is whether the identity has been set aside. Archived
+	// identities cannot be activated until they are restored.
+	Archived bool
+}
+
+// IdentitySubscription identifies a handler registered to receive changes to
+// the active identity.
+type IdentitySubscription int
+
+// ArchiveDir returns the directory holding archived identities and keys.
+func (s *settingsService) ArchiveDir() string {
+	return filepath.Join(s.dataDir, "archive")
+}
+
+// identityPaths returns the locations of the identity and key files of the
+// given identity, either in the usable set or in the archive.
+func (s *settingsService) identityPaths(id *fields.QualifiedHash, archived bool) (identity, key string) {
+	idsDir, keysDir := s.IdentitiesDir(), s.KeysDir()
+	if archived {
+		idsDir = filepath.Join(s.ArchiveDir(), "identities")
+		keysDir = filepath.Join(s.ArchiveDir(), "keys")
+	}
+	return filepath.Join(idsDir, id.String()), filepath.Join(keysDir, id.String())
+}
+
+// formatKeyFingerprint formats an OpenPGP fingerprint as groups of four
+// hexadecimal digits.
+func formatKeyFingerprint(fingerprint []byte) string {
+	hex := fmt.Sprintf("%X", fingerprint)
+	var groups []string
+	for len(hex) > 4 {
+		groups = append(groups, hex[:4])
+		hex = hex[4:]
+	}
+	return strings.Join(append(groups, hex), " ")
+}
+
+// readIdentities lists the identities in dir.
+func readIdentities(dir string) ([]IdentityInfo, error) {
+	names, err := ioutil.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed listing identities in %s: %w", dir, err)
+	}
+	var out []IdentityInfo
+	for _, file := range names {
+		id := &fields.QualifiedHash{}
+		if err := id.UnmarshalText([]byte(file.Name())); err != nil {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			log.Printf("failed reading identity %s: %v", id, err)
+			continue
+		}
+		identity, err := forest.UnmarshalIdentity(data)
+		if err != nil {
+			log.Printf("failed decoding identity %s: %v", id, err)
+			continue
+		}
+		info := IdentityInfo{
+			ID:   id,
+			Name: string(identity.Name.Blob),
+		}
+		if entity, err := identity.PublicKey.AsEntity(); err == nil {
+			info.Fingerprint = formatKeyFingerprint(entity.PrimaryKey.Fingerprint[:])
+			info.Algorithm = describeKeyAlgorithm(entity.PrimaryKey)
+		}
+		out = append(out, info)
+	}
+	return out, nil
+}
+
+func (s *settingsService) Identities() ([]IdentityInfo, error) {
+	usable, err := readIdentities(s.IdentitiesDir())
+	if err != nil {
+		return nil, err
+	}
+	archived, err := readIdentities(filepath.Join(s.ArchiveDir(), "identities"))
+	if err != nil {
+		return nil, err
+	}
+	active := s.ActiveArborIdentityID()
+	for i := range usable {
+		usable[i].Active = usable[i].ID.Equals(active)
+	}
+	for i := range archived {
+		archived[i].Archived = true
+	}
+	out := append(usable, archived...)
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].Archived != out[j].Archived {
+			return !out[i].Archived
+		}
+		return out[i].Name < out[j].Name
+	})
+	return out, nil
+}
+
+func (s *settingsService) SwitchIdentity(id *fields.QualifiedHash) error {
+	idPath, _ := s.identityPaths(id, false)
+	data, err := ioutil.ReadFile(idPath)
+	if err != nil {
+		return fmt.Errorf("failed reading identity %s: %w", id, err)
+	}
+	identity, err := forest.UnmarshalIdentity(data)
+	if err != nil {
+		return fmt.Errorf("failed decoding identity %s: %w", id, err)
+	}
+	s.setActiveIdentity(id, identity, nil)
+	return s.Persist()
+}
+
+// setActiveIdentity replaces the active identity, discarding cached state
+// for the previous one, and notifies subscribers. The private key is loaded
+// on demand if it is nil.
+func (s *settingsService) setActiveIdentity(id *fields.QualifiedHash, identity *forest.Identity, privKey *openpgp.Entity) {
+	s.identityLock.Lock()
+	s.ActiveIdentity = id
+	s.activeIdCache = identity
+	s.activePrivKey = privKey
+	s.activeKeyEncrypted = nil
+	s.activeKeyExternal = nil
+	s.stopAutoLock()
+	if privKey != nil {
+		s.resetAutoLock()
+	}
+	s.identityLock.Unlock()
+	s.notifyIdentityHandlers()
+}
+
+// notifyIdentityHandlers informs subscribers that the active identity or
+// the availability of its private key changed.
+func (s *settingsService) notifyIdentityHandlers() {
+	s.identityLock.Lock()
+	id := s.ActiveIdentity
+	handlers := make([]func(*fields.QualifiedHash), 0, len(s.identityHandlers))
+	for _, handler := range s.identityHandlers {
+		handlers = append(handlers, handler)
+	}
+	s.identityLock.Unlock()
+	for _, handler := range handlers {
+		handler(id)
+	}
+}
+
+// moveIdentity moves the identity and key files of an inactive identity
+// into or out of the archive.
+func (s *settingsService) moveIdentity(id *fields.QualifiedHash, toArchive bool) error {
+	if id.Equals(s.ActiveArborIdentityID()) {
+		return fmt.Errorf("cannot archive the active identity; switch to another one first")
+	}
+	fromID, fromKey := s.identityPaths(id, !toArchive)
+	toID, toKey := s.identityPaths(id, toArchive)
+	for _, dir := range []string{filepath.Dir(toID), filepath.Dir(toKey)} {
+		if err := os.MkdirAll(dir, 0770); err != nil {
+			return fmt.Errorf("failed creating identity directory: %w", err)
+		}
+	}
+	if err := os.Rename(fromID, toID); err != nil {
+		return fmt.Errorf("failed moving identity %s: %w", id, err)
+	}
+	if err := os.Rename(fromKey, toKey); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed moving key of identity %s: %w", id, err)
+	}
+	return nil
+}
+
+func (s *settingsService) ArchiveIdentity(id *fields.QualifiedHash) error {
+	return s.moveIdentity(id, true)
+}
+
+func (s *settingsService) RestoreIdentity(id *fields.QualifiedHash) error {
+	return s.moveIdentity(id, false)
+}
+
+func (s *settingsService) DeleteIdentity(id *fields.QualifiedHash) error {
+	idPath, keyPath := s.identityPaths(id, true)
+	if _, err := os.Stat(idPath); err != nil {
+		return fmt.Errorf("only archived identities can be deleted: %w", err)
+	}
+	if err := os.Remove(keyPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed deleting key of identity %s: %w", id, err)
+	}
+	if err := os.Remove(idPath); err != nil {
+		return fmt.Errorf("failed deleting identity %s: %w", id, err)
+	}
+	return nil
+}
+
+func (s *settingsService) SubscribeToIdentityChanges(handler func(*fields.QualifiedHash)) IdentitySubscription {
+	s.identityLock.Lock()
+	defer s.identityLock.Unlock()
+	s.nextIdentityHandler++
+	s.identityHandlers[s.nextIdentityHandler] = handler
+	return s.nextIdentityHandler
+}
+
+func (s *settingsService) UnsubscribeFromIdentityChanges(id IdentitySubscription) {
+	s.identityLock.Lock()
+	defer s.identityLock.Unlock()
+	delete(s.identityHandlers, id)
+}
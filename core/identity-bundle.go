@@ -0,0 +1,182 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"git.sr.ht/~whereswaldon/forest-go"
+	"git.sr.ht/~whereswaldon/forest-go/fields"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// IdentityBundleType is the armor block type of exported identities.
+const IdentityBundleType = "SPRIG IDENTITY"
+
+// identityBundleVersion is the version of the bundle layout written by
+// ExportIdentity.
+const identityBundleVersion = "1"
+
+// maxIdentityNodeSize bounds the length of the identity node read from a
+// backup, which is not trusted until it has been decoded.
+const maxIdentityNodeSize = 1 << 20
+
+// ExportIdentity returns a backup of the active identity that can be
+// restored with ImportIdentity. The backup is an armored text block
+// holding the identity node and its private key. If passphrase is not
+// empty, the private key in the backup is encrypted with it.
+func (s *settingsService) ExportIdentity(passphrase string) ([]byte, error) {
+	identity, err := s.Identity()
+	if err != nil {
+		return nil, err
+	}
+	s.identityLock.Lock()
+	privkey, err := s.privateKey()
+	s.identityLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	stored, err := storablePrivateKey(privkey, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	node, err := identity.MarshalBinary()
+	if err != nil {
+		return nil, fmt.Errorf("failed serializing identity: %w", err)
+	}
+
+	var out bytes.Buffer
+	armored, err := armor.Encode(&out, IdentityBundleType, map[string]string{
+		"Version": identityBundleVersion,
+		"Name":    string(identity.Name.Blob),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed armoring identity: %w", err)
+	}
+	compressed, err := flate.NewWriter(armored, flate.BestCompression)
+	if err != nil {
+		return nil, fmt.Errorf("failed compressing identity: %w", err)
+	}
+	var length [binary.MaxVarintLen64]byte
+	if _, err := compressed.Write(length[:binary.PutUvarint(length[:], uint64(len(node)))]); err != nil {
+		return nil, fmt.Errorf("failed writing identity: %w", err)
+	}
+	if _, err := compressed.Write(node); err != nil {
+		return nil, fmt.Errorf("failed writing identity: %w", err)
+	}
+	if err := stored.SerializePrivateWithoutSigning(compressed, nil); err != nil {
+		return nil, fmt.Errorf("failed writing private key: %w", err)
+	}
+	if err := compressed.Close(); err != nil {
+		return nil, fmt.Errorf("failed compressing identity: %w", err)
+	}
+	if err := armored.Close(); err != nil {
+		return nil, fmt.Errorf("failed armoring identity: %w", err)
+	}
+	out.WriteByte('\n')
+	return out.Bytes(), nil
+}
+
+// decodeIdentityBundle extracts the identity and private key from a backup
+// written by ExportIdentity. The private key is decrypted with passphrase
+// if it is encrypted.
+func decodeIdentityBundle(bundle []byte, passphrase string) (*forest.Identity, *openpgp.Entity, error) {
+	block, err := armor.Decode(bytes.NewReader(bytes.TrimSpace(bundle)))
+	if err != nil {
+		return nil, nil, fmt.Errorf("not an identity backup: %w", err)
+	}
+	if block.Type != IdentityBundleType {
+		return nil, nil, fmt.Errorf("not an identity backup: found %q", block.Type)
+	}
+	if version := block.Header["Version"]; version != identityBundleVersion {
+		return nil, nil, fmt.Errorf("unsupported identity backup version %q", version)
+	}
+	payload := bufio.NewReader(flate.NewReader(block.Body))
+	length, err := binary.ReadUvarint(payload)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed reading identity backup: %w", err)
+	} else if length > maxIdentityNodeSize {
+		return nil, nil, fmt.Errorf("failed reading identity backup: identity of %d bytes is too large", length)
+	}
+	node := make([]byte, length)
+	if _, err := io.ReadFull(payload, node); err != nil {
+		return nil, nil, fmt.Errorf("failed reading identity backup: %w", err)
+	}
+	identity, err := forest.UnmarshalIdentity(node)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed decoding identity: %w", err)
+	}
+	privkey, err := openpgp.ReadEntity(packet.NewReader(payload))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed decoding private key: %w", err)
+	}
+	if err := decryptPrivateKey(privkey, passphrase); err != nil {
+		return nil, nil, err
+	}
+	return identity, privkey, nil
+}
+
+// validateIdentityKey checks that the identity node is well-formed and
+// self-signed, and that privkey is the key that signed it.
+func validateIdentityKey(identity *forest.Identity, privkey *openpgp.Entity) error {
+	signer, err := forest.NewNativeSigner(privkey)
+	if err != nil {
+		return fmt.Errorf("failed wrapping private key: %w", err)
+	}
+	return validateIdentitySigner(identity, signer)
+}
+
+// ImportIdentity restores an identity from a backup created by
+// ExportIdentity and makes it active. The passphrase decrypts the private
+// key if the backup is encrypted, and the key is stored encrypted with it
+// unless it is empty.
+func (s *settingsService) ImportIdentity(bundle []byte, passphrase string) (*fields.QualifiedHash, error) {
+	identity, privkey, err := decodeIdentityBundle(bundle, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateIdentityKey(identity, privkey); err != nil {
+		return nil, err
+	}
+	id := identity.ID()
+	for _, archived := range []bool{false, true} {
+		idPath, _ := s.identityPaths(id, archived)
+		if _, err := os.Stat(idPath); err == nil {
+			return nil, fmt.Errorf("identity %s is already stored on this device", id)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("failed checking for identity %s: %w", id, err)
+		}
+	}
+	stored, err := storablePrivateKey(privkey, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	idPath, keyPath := s.identityPaths(id, false)
+	for _, dir := range []string{filepath.Dir(idPath), filepath.Dir(keyPath)} {
+		if err := os.MkdirAll(dir, 0770); err != nil {
+			return nil, fmt.Errorf("failed creating identity directory: %w", err)
+		}
+	}
+	if err := replacePrivateKey(keyPath, stored); err != nil {
+		return nil, err
+	}
+	node, err := identity.MarshalBinary()
+	if err != nil {
+		return nil, fmt.Errorf("failed serializing identity: %w", err)
+	}
+	if err := ioutil.WriteFile(idPath, node, 0660); err != nil {
+		os.Remove(keyPath)
+		return nil, fmt.Errorf("failed writing identity: %w", err)
+	}
+	s.setActiveIdentity(id, identity, privkey)
+	return id, s.Persist()
+}
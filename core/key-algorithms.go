@@ -0,0 +1,77 @@
+package core
+
+import (
+	"fmt"
+
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// KeyAlgorithm selects the kind of OpenPGP key generated for a new
+// identity. The Arbor protocol only defines RSA identity keys, so although
+// the OpenPGP library can generate Ed25519 keys, forest rejects identities
+// made with them.
+type KeyAlgorithm string
+
+const (
+	KeyAlgorithmRSA2048 KeyAlgorithm = "rsa2048"
+	KeyAlgorithmRSA3072 KeyAlgorithm = "rsa3072"
+	KeyAlgorithmRSA4096 KeyAlgorithm = "rsa4096"
+)
+
+// DefaultKeyAlgorithm is used for new identities unless another algorithm
+// is chosen. It matches the keys generated by earlier versions of sprig,
+// which every Arbor client can verify.
+const DefaultKeyAlgorithm = KeyAlgorithmRSA2048
+
+// KeyAlgorithms lists the algorithms that can be chosen for new
+// identities, in the order they should be offered.
+var KeyAlgorithms = []KeyAlgorithm{
+	KeyAlgorithmRSA2048,
+	KeyAlgorithmRSA3072,
+	KeyAlgorithmRSA4096,
+}
+
+// String returns a human-readable name for the algorithm.
+func (a KeyAlgorithm) String() string {
+	switch a {
+	case KeyAlgorithmRSA2048:
+		return "RSA 2048"
+	case KeyAlgorithmRSA3072:
+		return "RSA 3072"
+	case KeyAlgorithmRSA4096:
+		return "RSA 4096"
+	default:
+		return string(a)
+	}
+}
+
+// config returns the key generation settings for the algorithm. An empty
+// algorithm selects DefaultKeyAlgorithm.
+func (a KeyAlgorithm) config() (*packet.Config, error) {
+	switch a {
+	case "":
+		return DefaultKeyAlgorithm.config()
+	case KeyAlgorithmRSA2048:
+		return &packet.Config{Algorithm: packet.PubKeyAlgoRSA, RSABits: 2048}, nil
+	case KeyAlgorithmRSA3072:
+		return &packet.Config{Algorithm: packet.PubKeyAlgoRSA, RSABits: 3072}, nil
+	case KeyAlgorithmRSA4096:
+		return &packet.Config{Algorithm: packet.PubKeyAlgoRSA, RSABits: 4096}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key algorithm %q", string(a))
+	}
+}
+
+// describeKeyAlgorithm names the algorithm of an existing public key for
+// display.
+func describeKeyAlgorithm(key *packet.PublicKey) string {
+	bits, err := key.BitLength()
+	switch {
+	case key.PubKeyAlgo != packet.PubKeyAlgoRSA && key.PubKeyAlgo != packet.PubKeyAlgoRSASignOnly:
+		return fmt.Sprintf("algorithm %d", key.PubKeyAlgo)
+	case err != nil:
+		return "RSA"
+	default:
+		return fmt.Sprintf("RSA %d", bits)
+	}
+}
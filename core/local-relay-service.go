@@ -0,0 +1,277 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"git.sr.ht/~whereswaldon/sprout-go"
+)
+
+// LocalRelayStatus describes the state of the embedded relay.
+type LocalRelayStatus struct {
+	// Listening is whether incoming connections are being accepted.
+	Listening bool
+	// Address is the address being listened on.
+	Address string
+	// Peers lists the remote addresses of the connected peers.
+	Peers []string
+	// Rejected counts connections refused because the peer was not in the
+	// allowlist.
+	Rejected int
+	// LastError is the most recent error encountered, if any.
+	LastError error
+}
+
+// LocalRelaySubscription identifies a handler registered to receive local
+// relay status changes.
+type LocalRelaySubscription int
+
+// LocalRelayService accepts incoming sprout connections so that peers on the
+// local network can exchange nodes with sprig directly. Peers are served from
+// the local store. The methods must be safe for concurrent use.
+type LocalRelayService interface {
+	// Start listens for sprout connections on address (HOST:PORT),
+	// replacing any existing listener.
+	Start(address string) error
+	// Stop closes the listener and disconnects every peer.
+	Stop()
+	// SetAllowlist restricts which peers may connect. Each entry is an IP
+	// address or a CIDR range. Connections from loopback addresses are
+	// always accepted.
+	SetAllowlist(entries []string) error
+	Status() LocalRelayStatus
+	// SubscribeToStatusChanges registers a handler that will be invoked
+	// every time the status of the embedded relay changes. The handler
+	// must not block.
+	SubscribeToStatusChanges(handler func(LocalRelayStatus)) LocalRelaySubscription
+	UnsubscribeFromStatusChanges(LocalRelaySubscription)
+}
+
+// ParseAllowlist validates allowlist entries, returning the network matched
+// by each.
+func ParseAllowlist(entries []string) ([]*net.IPNet, error) {
+	out := make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if strings.Contains(entry, "/") {
+			_, network, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid allowlist entry %q: %w", entry, err)
+			}
+			out = append(out, network)
+			continue
+		}
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid allowlist entry %q: not an IP address or CIDR range", entry)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		out = append(out, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return out, nil
+}
+
+type localRelayService struct {
+	ArborService
+
+	sync.Mutex
+	listener  net.Listener
+	done      chan struct{}
+	allowlist []*net.IPNet
+	peers     map[string]net.Conn
+	rejected  int
+	lastError error
+
+	handlers    map[LocalRelaySubscription]func(LocalRelayStatus)
+	nextHandler LocalRelaySubscription
+}
+
+var _ LocalRelayService = &localRelayService{}
+
+func newLocalRelayService(arbor ArborService) LocalRelayService {
+	return &localRelayService{
+		ArborService: arbor,
+		peers:        make(map[string]net.Conn),
+		handlers:     make(map[LocalRelaySubscription]func(LocalRelayStatus)),
+	}
+}
+
+func (l *localRelayService) Start(address string) error {
+	l.Stop()
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		err = fmt.Errorf("failed listening on %s: %w", address, err)
+		l.update(func() { l.lastError = err })
+		return err
+	}
+	done := make(chan struct{})
+	l.update(func() {
+		l.listener = listener
+		l.done = done
+		l.lastError = nil
+		l.rejected = 0
+	})
+	log.Printf("serving sprout peers on %s", listener.Addr())
+	go l.accept(listener, done)
+	return nil
+}
+
+func (l *localRelayService) Stop() {
+	l.update(func() {
+		if l.listener == nil {
+			return
+		}
+		close(l.done)
+		if err := l.listener.Close(); err != nil {
+			log.Printf("failed closing local relay listener: %v", err)
+		}
+		for _, conn := range l.peers {
+			conn.Close()
+		}
+		l.listener = nil
+		l.done = nil
+	})
+}
+
+func (l *localRelayService) SetAllowlist(entries []string) error {
+	allowlist, err := ParseAllowlist(entries)
+	if err != nil {
+		return err
+	}
+	l.update(func() { l.allowlist = allowlist })
+	return nil
+}
+
+func (l *localRelayService) Status() LocalRelayStatus {
+	l.Lock()
+	defer l.Unlock()
+	return l.status()
+}
+
+// status builds the current status. It must be called with the lock held.
+func (l *localRelayService) status() LocalRelayStatus {
+	status := LocalRelayStatus{
+		Listening: l.listener != nil,
+		Rejected:  l.rejected,
+		LastError: l.lastError,
+	}
+	if l.listener != nil {
+		status.Address = l.listener.Addr().String()
+	}
+	for peer := range l.peers {
+		status.Peers = append(status.Peers, peer)
+	}
+	sort.Strings(status.Peers)
+	return status
+}
+
+func (l *localRelayService) SubscribeToStatusChanges(handler func(LocalRelayStatus)) LocalRelaySubscription {
+	l.Lock()
+	defer l.Unlock()
+	l.nextHandler++
+	l.handlers[l.nextHandler] = handler
+	return l.nextHandler
+}
+
+func (l *localRelayService) UnsubscribeFromStatusChanges(id LocalRelaySubscription) {
+	l.Lock()
+	defer l.Unlock()
+	delete(l.handlers, id)
+}
+
+// update applies modify with the lock held and notifies subscribers of the
+// resulting status.
+func (l *localRelayService) update(modify func()) {
+	l.Lock()
+	modify()
+	status := l.status()
+	handlers := make([]func(LocalRelayStatus), 0, len(l.handlers))
+	for _, handler := range l.handlers {
+		handlers = append(handlers, handler)
+	}
+	l.Unlock()
+	for _, handler := range handlers {
+		handler(status)
+	}
+}
+
+// allowed reports whether the peer at addr may connect.
+func (l *localRelayService) allowed(addr net.Addr) bool {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() {
+		return true
+	}
+	l.Lock()
+	defer l.Unlock()
+	for _, network := range l.allowlist {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// accept serves connections from listener until done is closed.
+func (l *localRelayService) accept(listener net.Listener, done chan struct{}) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("failed accepting local relay connection: %v", err)
+			l.update(func() { l.lastError = err })
+			continue
+		}
+		if !l.allowed(conn.RemoteAddr()) {
+			log.Printf("refusing connection from %s: not in allowlist", conn.RemoteAddr())
+			conn.Close()
+			l.update(func() { l.rejected++ })
+			continue
+		}
+		go l.serve(conn, done)
+	}
+}
+
+// serve answers sprout requests from a single peer using the local store.
+func (l *localRelayService) serve(conn net.Conn, done chan struct{}) {
+	peer := conn.RemoteAddr().String()
+	worker, err := sprout.NewWorker(done, conn, l.ArborService.Store())
+	if err != nil {
+		log.Printf("failed serving local peer %s: %v", peer, err)
+		conn.Close()
+		return
+	}
+	worker.Logger = log.New(log.Writer(), fmt.Sprintf("local-peer-%v ", peer), log.Flags())
+	l.update(func() {
+		select {
+		case <-done:
+			// the relay was stopped while the connection was starting
+			conn.Close()
+		default:
+			l.peers[peer] = conn
+		}
+	})
+	defer l.update(func() { delete(l.peers, peer) })
+	worker.Run()
+}
@@ -0,0 +1,334 @@
+package core
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.sr.ht/~whereswaldon/forest-go"
+	"git.sr.ht/~whereswaldon/forest-go/store"
+)
+
+// maxRecentErrors is the number of errors retained for each relay.
+const maxRecentErrors = 10
+
+// TimestampedError is an error along with when it occurred.
+type TimestampedError struct {
+	At  time.Time
+	Err error
+}
+
+// LatencyStats summarizes the round-trip times of requests sent to a relay.
+type LatencyStats struct {
+	Samples int
+	Last    time.Duration
+	Max     time.Duration
+	total   time.Duration
+}
+
+// Average returns the mean round-trip time.
+func (l LatencyStats) Average() time.Duration {
+	if l.Samples < 1 {
+		return 0
+	}
+	return l.total / time.Duration(l.Samples)
+}
+
+func (l *LatencyStats) add(sample time.Duration) {
+	l.Samples++
+	l.Last = sample
+	l.total += sample
+	if sample > l.Max {
+		l.Max = sample
+	}
+}
+
+// RelayMetrics is a snapshot of the traffic statistics for a single relay.
+// Counters accumulate across reconnections.
+type RelayMetrics struct {
+	Address string
+	// ConnectedAt is when the current (or most recent) connection was
+	// established.
+	ConnectedAt time.Time
+	// Connections is the number of connections established.
+	Connections   int
+	BytesSent     int64
+	BytesReceived int64
+	// Sent and Received count protocol messages by verb.
+	Sent     map[string]int
+	Received map[string]int
+	// NodesIngested counts nodes from the relay that were added to the
+	// local store.
+	NodesIngested int
+	Latency       LatencyStats
+	// RecentErrors holds the most recent errors, oldest first.
+	RecentErrors []TimestampedError
+}
+
+// Meter collects traffic statistics for a single relay. It is safe for
+// concurrent use.
+type Meter struct {
+	sync.Mutex
+	metrics RelayMetrics
+	// pending maps the IDs of requests awaiting a reply to when they were
+	// sent.
+	pending map[int]time.Time
+	// capture receives every message if not nil.
+	capture *ProtocolCapture
+}
+
+// NewMeter creates a meter for the relay at the given address. If capture is
+// not nil, messages are recorded into it while it is enabled.
+func NewMeter(address string, capture *ProtocolCapture) *Meter {
+	return &Meter{
+		capture: capture,
+		metrics: RelayMetrics{
+			Address:  address,
+			Sent:     make(map[string]int),
+			Received: make(map[string]int),
+		},
+		pending: make(map[int]time.Time),
+	}
+}
+
+// Snapshot returns a copy of the current statistics.
+func (m *Meter) Snapshot() RelayMetrics {
+	m.Lock()
+	defer m.Unlock()
+	out := m.metrics
+	out.Sent = make(map[string]int, len(m.metrics.Sent))
+	for verb, count := range m.metrics.Sent {
+		out.Sent[verb] = count
+	}
+	out.Received = make(map[string]int, len(m.metrics.Received))
+	for verb, count := range m.metrics.Received {
+		out.Received[verb] = count
+	}
+	out.RecentErrors = append([]TimestampedError(nil), m.metrics.RecentErrors...)
+	return out
+}
+
+// RecordError adds err to the relay's recent errors.
+func (m *Meter) RecordError(err error) {
+	m.Lock()
+	defer m.Unlock()
+	m.metrics.RecentErrors = append(m.metrics.RecentErrors, TimestampedError{At: time.Now(), Err: err})
+	if extra := len(m.metrics.RecentErrors) - maxRecentErrors; extra > 0 {
+		m.metrics.RecentErrors = m.metrics.RecentErrors[extra:]
+	}
+}
+
+// WrapConn returns a connection that records the traffic passing through
+// conn.
+func (m *Meter) WrapConn(conn net.Conn) net.Conn {
+	m.Lock()
+	m.metrics.ConnectedAt = time.Now()
+	m.metrics.Connections++
+	m.pending = make(map[int]time.Time)
+	m.Unlock()
+	return &meteredConn{
+		Conn:  conn,
+		meter: m,
+		read: lineTap{
+			keepPayload: m.capturing,
+			onMessage: func(header string, payload []string) {
+				m.observe(header, payload, false)
+			},
+		},
+		write: lineTap{
+			keepPayload: m.capturing,
+			onMessage: func(header string, payload []string) {
+				m.observe(header, payload, true)
+			},
+		},
+	}
+}
+
+// capturing reports whether messages are being captured for inspection.
+func (m *Meter) capturing() bool {
+	return m.capture != nil && m.capture.Enabled()
+}
+
+// WrapStore returns a store that counts the nodes added to s.
+func (m *Meter) WrapStore(s store.ExtendedStore) store.ExtendedStore {
+	return &meteredStore{ExtendedStore: s, meter: m}
+}
+
+// parseHeader interprets the first line of a sprout protocol message,
+// returning its verb, message ID, and the number of payload lines that
+// follow it.
+func parseHeader(line string) (verb string, id int, payloadLines int, ok bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return "", 0, 0, false
+	}
+	verb = fields[0]
+	id, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return "", 0, 0, false
+	}
+	switch verb {
+	case "query", "announce", "response":
+		if len(fields) > 2 {
+			if count, err := strconv.Atoi(fields[2]); err == nil && count > 0 {
+				payloadLines = count
+			}
+		}
+	}
+	return verb, id, payloadLines, true
+}
+
+// observe records a complete protocol message.
+func (m *Meter) observe(header string, payload []string, outbound bool) {
+	verb, id, _, ok := parseHeader(header)
+	if !ok {
+		return
+	}
+	m.Lock()
+	if outbound {
+		m.metrics.Sent[verb]++
+	} else {
+		m.metrics.Received[verb]++
+	}
+	switch verb {
+	case "response", "status":
+		if !outbound {
+			if sentAt, ok := m.pending[id]; ok {
+				m.metrics.Latency.add(time.Since(sentAt))
+				delete(m.pending, id)
+			}
+		}
+	default:
+		if outbound {
+			m.pending[id] = time.Now()
+		}
+	}
+	address := m.metrics.Address
+	m.Unlock()
+	if m.capture != nil {
+		m.capture.Record(CapturedMessage{
+			At:       time.Now(),
+			Relay:    address,
+			Outbound: outbound,
+			Verb:     verb,
+			Header:   header,
+			Payload:  payload,
+		})
+	}
+}
+
+// lineTap reassembles protocol messages (a header line followed by any
+// payload lines) from a byte stream and passes each complete message to
+// onMessage.
+type lineTap struct {
+	sync.Mutex
+	partial []byte
+	header  string
+	payload []string
+	// remaining is the number of payload lines still expected for the
+	// message being assembled.
+	remaining int
+	// keepPayload reports whether payload lines should be retained.
+	// Payloads are discarded when it returns false.
+	keepPayload func() bool
+	onMessage   func(header string, payload []string)
+}
+
+func (l *lineTap) Write(data []byte) {
+	l.Lock()
+	defer l.Unlock()
+	for len(data) > 0 {
+		newline := bytes.IndexByte(data, '\n')
+		if newline < 0 {
+			l.partial = append(l.partial, data...)
+			return
+		}
+		line := string(append(l.partial, data[:newline]...))
+		l.partial = l.partial[:0]
+		data = data[newline+1:]
+		if l.remaining > 0 {
+			if l.keepPayload() {
+				l.payload = append(l.payload, line)
+			}
+			l.remaining--
+			if l.remaining == 0 {
+				l.onMessage(l.header, l.payload)
+			}
+			continue
+		}
+		_, _, payloadLines, _ := parseHeader(line)
+		l.header = line
+		l.payload = nil
+		l.remaining = payloadLines
+		if l.remaining == 0 {
+			l.onMessage(l.header, nil)
+		}
+	}
+}
+
+// meteredConn counts the bytes and protocol messages passing through a
+// connection.
+type meteredConn struct {
+	net.Conn
+	meter       *Meter
+	read, write lineTap
+}
+
+func (c *meteredConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.meter.Lock()
+		c.meter.metrics.BytesReceived += int64(n)
+		c.meter.Unlock()
+		c.read.Write(b[:n])
+	}
+	return n, err
+}
+
+func (c *meteredConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.meter.Lock()
+		c.meter.metrics.BytesSent += int64(n)
+		c.meter.Unlock()
+		c.write.Write(b[:n])
+	}
+	return n, err
+}
+
+// meteredStore counts the nodes added to a store.
+type meteredStore struct {
+	store.ExtendedStore
+	meter *Meter
+}
+
+var _ store.ExtendedStore = &meteredStore{}
+
+func (s *meteredStore) Add(node forest.Node) error {
+	return s.count(node, func() error {
+		return s.ExtendedStore.Add(node)
+	})
+}
+
+func (s *meteredStore) AddAs(node forest.Node, addedByID store.Subscription) error {
+	return s.count(node, func() error {
+		return s.ExtendedStore.AddAs(node, addedByID)
+	})
+}
+
+// count invokes add and counts node as ingested if it is new to the store.
+func (s *meteredStore) count(node forest.Node, add func() error) error {
+	_, alreadyPresent, _ := s.ExtendedStore.Get(node.ID())
+	if err := add(); err != nil {
+		return err
+	}
+	if !alreadyPresent {
+		s.meter.Lock()
+		s.meter.metrics.NodesIngested++
+		s.meter.Unlock()
+	}
+	return nil
+}
@@ -154,3 +154,15 @@ func (n *notificationManager) handleNode(node forest.Node) {
 		}(asReply)
 	}
 }
+
+// headlessNotificationService is used when there is no frontend to display
+// notifications.
+type headlessNotificationService struct{}
+
+var _ NotificationService = headlessNotificationService{}
+
+func (headlessNotificationService) Register(store.ExtendedStore) {}
+
+func (headlessNotificationService) Notify(title, content string) error {
+	return fmt.Errorf("notifications are unavailable without a frontend")
+}
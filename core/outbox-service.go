@@ -0,0 +1,439 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"git.sr.ht/~whereswaldon/forest-go"
+	"git.sr.ht/~whereswaldon/forest-go/fields"
+	"git.sr.ht/~whereswaldon/sprout-go"
+)
+
+// DeliveryState describes how far a locally authored node has progressed
+// toward reaching the network.
+type DeliveryState uint8
+
+const (
+	// Queued indicates that the node is waiting for a relay connection, or
+	// that some connected relay has yet to be offered it.
+	Queued DeliveryState = iota
+	// Sent indicates that at least one relay acknowledged the node. It is
+	// still offered to the other relays as they connect.
+	Sent
+	// Failed indicates that no relay acknowledged the node and every
+	// connected relay refused it or failed to respond. Relays that failed
+	// to respond are offered the node again when they reconnect, while
+	// those that refused it are only offered it again on request.
+	Failed
+)
+
+func (d DeliveryState) String() string {
+	switch d {
+	case Queued:
+		return "queued"
+	case Sent:
+		return "sent"
+	case Failed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+// Delivery records the delivery status of a single locally authored node.
+type Delivery struct {
+	ID       *fields.QualifiedHash
+	State    DeliveryState
+	QueuedAt time.Time
+	// Relays lists the addresses of the relays that acknowledged the node.
+	Relays    []string `json:",omitempty"`
+	SentAt    time.Time
+	LastError string `json:",omitempty"`
+
+	// FailedRelays lists the addresses of the relays that failed to
+	// respond when last offered the node.
+	FailedRelays []string `json:",omitempty"`
+	// RefusedBy lists the addresses of the relays that rejected the node.
+	RefusedBy []string `json:",omitempty"`
+}
+
+// Description summarizes the delivery for display.
+func (d Delivery) Description() string {
+	switch d.State {
+	case Sent:
+		return "sent to " + strings.Join(d.Relays, ", ")
+	case Failed:
+		if d.LastError != "" {
+			return "failed: " + d.LastError
+		}
+	}
+	return d.State.String()
+}
+
+// DeliverySubscription identifies a handler registered to receive delivery
+// changes.
+type DeliverySubscription int
+
+// OutboxService sends locally authored replies to relays and keeps track of
+// whether they arrived. Replies that cannot be sent because no relay is
+// connected are queued and sent automatically once a relay connects. The
+// methods must be safe for concurrent use.
+type OutboxService interface {
+	// Post adds the replies (and their author) to the local store and
+	// queues the replies for delivery.
+	Post(author *forest.Identity, replies ...*forest.Reply) error
+	// Delivery returns the delivery status of the node with the given ID,
+	// if it was posted through the outbox.
+	Delivery(id *fields.QualifiedHash) (Delivery, bool)
+	// Retry queues a failed node for delivery again and attempts to send
+	// it immediately.
+	Retry(id *fields.QualifiedHash)
+	// SubscribeToDeliveryChanges registers a handler that will be invoked
+	// every time the delivery status of a node changes. The handler must
+	// not block.
+	SubscribeToDeliveryChanges(handler func(Delivery)) DeliverySubscription
+	UnsubscribeFromDeliveryChanges(DeliverySubscription)
+}
+
+// outboxRetention is how long delivered nodes are remembered so that their
+// status can be displayed.
+const outboxRetention = 7 * 24 * time.Hour
+
+type outboxService struct {
+	ArborService
+	SproutService
+
+	path string
+
+	sync.Mutex
+	deliveries  map[string]Delivery
+	handlers    map[DeliverySubscription]func(Delivery)
+	nextHandler DeliverySubscription
+
+	// flushLock serializes flushes so that a node is never offered to the
+	// same relay twice concurrently.
+	flushLock sync.Mutex
+}
+
+var _ OutboxService = &outboxService{}
+
+func newOutboxService(stateDir string, arbor ArborService, sprout SproutService) (OutboxService, error) {
+	o := &outboxService{
+		ArborService:  arbor,
+		SproutService: sprout,
+		path:          filepath.Join(stateDir, "outbox.json"),
+		deliveries:    make(map[string]Delivery),
+		handlers:      make(map[DeliverySubscription]func(Delivery)),
+	}
+	if err := o.load(); err != nil {
+		return nil, err
+	}
+	arbor.SubscribeToStoreRecovery(func() {
+		// the queued replies were saved along with the other nodes held
+		// in memory
+		o.Lock()
+		o.persist()
+		o.Unlock()
+	})
+	sprout.SubscribeToStateChanges(func(status RelayStatus) {
+		if status.State == Connected {
+			go func() {
+				o.reconnected(status.Address)
+				o.flush(status.Address)
+			}()
+		}
+	})
+	return o, nil
+}
+
+// load reads the outbox from disk, discarding deliveries that completed
+// long ago.
+func (o *outboxService) load() error {
+	if o.ArborService.Incognito() {
+		return nil
+	}
+	data, err := ioutil.ReadFile(o.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed reading outbox: %w", err)
+	}
+	var deliveries []Delivery
+	if err := json.Unmarshal(data, &deliveries); err != nil {
+		return fmt.Errorf("failed parsing outbox: %w", err)
+	}
+	for _, d := range deliveries {
+		if d.ID == nil || (d.State == Sent && time.Since(d.SentAt) > outboxRetention) {
+			continue
+		}
+		o.deliveries[d.ID.String()] = d
+	}
+	return nil
+}
+
+// persist writes the outbox to disk. It must be called with the lock held.
+func (o *outboxService) persist() {
+	if o.ArborService.Incognito() || o.ArborService.StoreError() != nil {
+		// the replies are only held in memory, so they must not be
+		// remembered once sprig exits
+		return
+	}
+	deliveries := make([]Delivery, 0, len(o.deliveries))
+	for _, d := range o.deliveries {
+		deliveries = append(deliveries, d)
+	}
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].QueuedAt.Before(deliveries[j].QueuedAt)
+	})
+	data, err := json.MarshalIndent(deliveries, "", "  ")
+	if err != nil {
+		log.Printf("couldn't marshal outbox as json: %v", err)
+		return
+	}
+	if err := ioutil.WriteFile(o.path, data, 0660); err != nil {
+		log.Printf("couldn't save outbox: %v", err)
+	}
+}
+
+func (o *outboxService) Post(author *forest.Identity, replies ...*forest.Reply) error {
+	if err := o.ArborService.Store().Add(author); err != nil {
+		return fmt.Errorf("failed adding replying identity to store: %w", err)
+	}
+	for _, reply := range replies {
+		if err := o.ArborService.Store().Add(reply); err != nil {
+			return fmt.Errorf("failed adding reply to store: %w", err)
+		}
+		o.update(reply.ID(), func(d *Delivery) {
+			d.State = Queued
+			d.QueuedAt = time.Now()
+		})
+	}
+	go o.flushAll()
+	return nil
+}
+
+func (o *outboxService) Delivery(id *fields.QualifiedHash) (Delivery, bool) {
+	o.Lock()
+	defer o.Unlock()
+	d, ok := o.deliveries[id.String()]
+	return d, ok
+}
+
+func (o *outboxService) Retry(id *fields.QualifiedHash) {
+	if _, ok := o.Delivery(id); !ok {
+		return
+	}
+	o.update(id, func(d *Delivery) {
+		d.FailedRelays = nil
+		d.RefusedBy = nil
+		if d.State == Failed {
+			d.State = Queued
+		}
+	})
+	go o.flushAll()
+}
+
+func (o *outboxService) SubscribeToDeliveryChanges(handler func(Delivery)) DeliverySubscription {
+	o.Lock()
+	defer o.Unlock()
+	o.nextHandler++
+	o.handlers[o.nextHandler] = handler
+	return o.nextHandler
+}
+
+func (o *outboxService) UnsubscribeFromDeliveryChanges(id DeliverySubscription) {
+	o.Lock()
+	defer o.Unlock()
+	delete(o.handlers, id)
+}
+
+// update applies the modification to the delivery of the given node, saves
+// the outbox, and notifies subscribers of the result.
+func (o *outboxService) update(id *fields.QualifiedHash, modify func(*Delivery)) {
+	o.Lock()
+	d, ok := o.deliveries[id.String()]
+	if !ok {
+		d = Delivery{ID: id}
+	}
+	modify(&d)
+	o.deliveries[id.String()] = d
+	o.persist()
+	handlers := make([]func(Delivery), 0, len(o.handlers))
+	for _, handler := range o.handlers {
+		handlers = append(handlers, handler)
+	}
+	o.Unlock()
+	for _, handler := range handlers {
+		handler(d)
+	}
+}
+
+// pending returns the IDs of the nodes that the relay at addr has neither
+// acknowledged nor refused.
+func (o *outboxService) pending(addr string) []*fields.QualifiedHash {
+	o.Lock()
+	defer o.Unlock()
+	var out []*fields.QualifiedHash
+	for _, d := range o.deliveries {
+		if !containsRelay(d.Relays, addr) && !containsRelay(d.RefusedBy, addr) {
+			out = append(out, d.ID)
+		}
+	}
+	return out
+}
+
+// reconnected forgets that the relay at addr failed to respond, so that
+// the nodes are queued for it again.
+func (o *outboxService) reconnected(addr string) {
+	o.Lock()
+	var unanswered []*fields.QualifiedHash
+	for _, d := range o.deliveries {
+		if containsRelay(d.FailedRelays, addr) {
+			unanswered = append(unanswered, d.ID)
+		}
+	}
+	o.Unlock()
+	for _, id := range unanswered {
+		o.update(id, func(d *Delivery) {
+			d.FailedRelays = removeRelay(d.FailedRelays, addr)
+			if d.State == Failed {
+				d.State = Queued
+			}
+		})
+	}
+}
+
+// flushAll offers queued nodes to every connected relay.
+func (o *outboxService) flushAll() {
+	for _, addr := range o.SproutService.Connections() {
+		o.flush(addr)
+	}
+}
+
+// flush offers the relay at the given address the nodes it has not
+// acknowledged.
+func (o *outboxService) flush(addr string) {
+	o.flushLock.Lock()
+	defer o.flushLock.Unlock()
+	worker := o.SproutService.WorkerFor(addr)
+	if worker == nil {
+		return
+	}
+	s := o.ArborService.Store()
+	for _, id := range o.pending(addr) {
+		node, has, err := s.Get(id)
+		if err != nil || !has {
+			log.Printf("outbox entry %s is missing from the local store (err: %v)", id, err)
+			continue
+		}
+		reply, ok := node.(*forest.Reply)
+		if !ok {
+			continue
+		}
+		author, has, err := s.GetIdentity(&reply.Author)
+		if err != nil || !has {
+			log.Printf("author of outbox entry %s is missing from the local store (err: %v)", id, err)
+			continue
+		}
+		// nodes stored while the relay was connected were already
+		// forwarded to it by its worker
+		if missing := unknownTo(worker, author, reply); len(missing) > 0 {
+			err = worker.SendAnnounce(missing, makeTicker(worker.DefaultTimeout))
+		}
+		connected := o.SproutService.Connections()
+		o.update(id, func(d *Delivery) {
+			if err != nil {
+				d.LastError = err.Error()
+				recordFailure(d, addr, err, connected)
+				return
+			}
+			d.State = Sent
+			d.SentAt = time.Now()
+			d.LastError = ""
+			d.FailedRelays = removeRelay(d.FailedRelays, addr)
+			if !containsRelay(d.Relays, addr) {
+				d.Relays = append(d.Relays, addr)
+			}
+		})
+		if err != nil {
+			log.Printf("failed sending %s to %s: %v", id, addr, err)
+		}
+	}
+}
+
+// recordFailure notes that the relay at addr did not accept the node. A
+// delivery that no relay acknowledged fails once every connected relay has
+// failed to accept it.
+func recordFailure(d *Delivery, addr string, err error, connected []string) {
+	var status sprout.Status
+	if errors.As(err, &status) {
+		d.FailedRelays = removeRelay(d.FailedRelays, addr)
+		if !containsRelay(d.RefusedBy, addr) {
+			d.RefusedBy = append(d.RefusedBy, addr)
+		}
+	} else if !containsRelay(d.FailedRelays, addr) {
+		d.FailedRelays = append(d.FailedRelays, addr)
+	}
+	if len(d.Relays) > 0 {
+		return
+	}
+	for _, relay := range connected {
+		if !containsRelay(d.FailedRelays, relay) && !containsRelay(d.RefusedBy, relay) {
+			return
+		}
+	}
+	d.State = Failed
+}
+
+// containsRelay reports whether the relay is in the list.
+func containsRelay(relays []string, addr string) bool {
+	for _, relay := range relays {
+		if relay == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// removeRelay returns the list with the relay removed.
+func removeRelay(relays []string, addr string) []string {
+	var out []string
+	for _, relay := range relays {
+		if relay != addr {
+			out = append(out, relay)
+		}
+	}
+	return out
+}
+
+// unknownTo returns the nodes that the relay does not have.
+func unknownTo(worker *sprout.Worker, nodes ...forest.Node) []forest.Node {
+	ids := make([]*fields.QualifiedHash, len(nodes))
+	for i, node := range nodes {
+		ids[i] = node.ID()
+	}
+	response, err := worker.SendQuery(ids, makeTicker(worker.DefaultTimeout))
+	if err != nil {
+		return nodes
+	}
+	known := make(map[string]bool, len(response.Nodes))
+	for _, node := range response.Nodes {
+		known[node.ID().String()] = true
+	}
+	var missing []forest.Node
+	for _, node := range nodes {
+		if !known[node.ID().String()] {
+			missing = append(missing, node)
+		}
+	}
+	return missing
+}
@@ -0,0 +1,268 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+var (
+	// ErrKeyLocked is returned when the private key of the active identity
+	// is needed but has not been unlocked with its passphrase.
+	ErrKeyLocked = errors.New("private key is locked")
+	// ErrIncorrectPassphrase is returned when a passphrase does not
+	// decrypt the private key of the active identity.
+	ErrIncorrectPassphrase = errors.New("incorrect passphrase")
+)
+
+// readPrivateKey reads the private key stored at path without decrypting it.
+// It returns ErrExternalKey if the key file refers to a key held by gpg.
+func readPrivateKey(path string) (*openpgp.Entity, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read key file: %w", err)
+	}
+	if _, ok := readGPGKeyReference(data); ok {
+		return nil, ErrExternalKey
+	}
+	privkey, err := openpgp.ReadEntity(packet.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode key data: %w", err)
+	}
+	return privkey, nil
+}
+
+// decryptPrivateKey decrypts the primary key and subkeys of entity in place.
+// Keys that are not encrypted are left unchanged.
+func decryptPrivateKey(entity *openpgp.Entity, passphrase string) error {
+	if err := entity.PrivateKey.Decrypt([]byte(passphrase)); err != nil {
+		return ErrIncorrectPassphrase
+	}
+	for _, subkey := range entity.Subkeys {
+		if subkey.PrivateKey == nil {
+			continue
+		}
+		if err := subkey.PrivateKey.Decrypt([]byte(passphrase)); err != nil {
+			return ErrIncorrectPassphrase
+		}
+	}
+	return nil
+}
+
+// encryptPrivateKey returns a copy of the decrypted entity with its primary
+// key and subkeys encrypted by passphrase. Encryption discards the key
+// material of the encrypted packets, so the original entity remains usable
+// for signing.
+func encryptPrivateKey(entity *openpgp.Entity, passphrase string) (*openpgp.Entity, error) {
+	var buf bytes.Buffer
+	if err := entity.SerializePrivateWithoutSigning(&buf, nil); err != nil {
+		return nil, fmt.Errorf("failed serializing private key: %w", err)
+	}
+	encrypted, err := openpgp.ReadEntity(packet.NewReader(&buf))
+	if err != nil {
+		return nil, fmt.Errorf("failed copying private key: %w", err)
+	}
+	if err := encrypted.PrivateKey.Encrypt([]byte(passphrase)); err != nil {
+		return nil, fmt.Errorf("failed encrypting private key: %w", err)
+	}
+	for _, subkey := range encrypted.Subkeys {
+		if subkey.PrivateKey == nil {
+			continue
+		}
+		if err := subkey.PrivateKey.Encrypt([]byte(passphrase)); err != nil {
+			return nil, fmt.Errorf("failed encrypting private subkey: %w", err)
+		}
+	}
+	return encrypted, nil
+}
+
+// storablePrivateKey returns the form of the decrypted entity that should
+// be written to disk. An empty passphrase leaves the key unencrypted.
+func storablePrivateKey(entity *openpgp.Entity, passphrase string) (*openpgp.Entity, error) {
+	if passphrase == "" {
+		return entity, nil
+	}
+	return encryptPrivateKey(entity, passphrase)
+}
+
+// replacePrivateKey atomically overwrites the key file at path with entity.
+func replacePrivateKey(path string, entity *openpgp.Entity) (err error) {
+	tmpPath := path + ".tmp"
+	keyFile, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed creating key file: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			keyFile.Close()
+			os.Remove(tmpPath)
+		}
+	}()
+	if err := entity.SerializePrivateWithoutSigning(keyFile, nil); err != nil {
+		return fmt.Errorf("failed saving private key: %w", err)
+	}
+	if err := keyFile.Sync(); err != nil {
+		return fmt.Errorf("failed flushing key file: %w", err)
+	}
+	if err := keyFile.Close(); err != nil {
+		return fmt.Errorf("failed closing key file: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed replacing key file: %w", err)
+	}
+	return nil
+}
+
+// activeKeyPath returns the location of the active identity's private key.
+// The caller must hold identityLock.
+func (s *settingsService) activeKeyPath() string {
+	return filepath.Join(s.KeysDir(), s.ActiveIdentity.String())
+}
+
+func (s *settingsService) KeyEncrypted() bool {
+	s.identityLock.Lock()
+	defer s.identityLock.Unlock()
+	return s.keyEncrypted()
+}
+
+// keyEncrypted reports whether the active identity's private key is stored
+// encrypted. The caller must hold identityLock.
+func (s *settingsService) keyEncrypted() bool {
+	if s.ActiveIdentity == nil {
+		return false
+	}
+	if s.activeKeyEncrypted == nil {
+		privkey, err := readPrivateKey(s.activeKeyPath())
+		if errors.Is(err, ErrExternalKey) {
+			return false
+		} else if err != nil {
+			log.Printf("failed checking private key encryption: %v", err)
+			return false
+		}
+		encrypted := privkey.PrivateKey.Encrypted
+		s.activeKeyEncrypted = &encrypted
+	}
+	return *s.activeKeyEncrypted
+}
+
+func (s *settingsService) KeyLocked() bool {
+	s.identityLock.Lock()
+	defer s.identityLock.Unlock()
+	return s.activePrivKey == nil && s.keyEncrypted()
+}
+
+func (s *settingsService) UnlockKey(passphrase string) error {
+	s.identityLock.Lock()
+	if s.ActiveIdentity == nil {
+		s.identityLock.Unlock()
+		return fmt.Errorf("no identity configured, therefore no private key")
+	}
+	privkey, err := readPrivateKey(s.activeKeyPath())
+	if err != nil {
+		s.identityLock.Unlock()
+		return err
+	}
+	if err := decryptPrivateKey(privkey, passphrase); err != nil {
+		s.identityLock.Unlock()
+		return err
+	}
+	encrypted := true
+	s.activeKeyEncrypted = &encrypted
+	s.activePrivKey = privkey
+	s.resetAutoLock()
+	s.identityLock.Unlock()
+	s.notifyIdentityHandlers()
+	return nil
+}
+
+func (s *settingsService) LockKey() {
+	s.identityLock.Lock()
+	if s.activePrivKey == nil || !s.keyEncrypted() {
+		s.identityLock.Unlock()
+		return
+	}
+	s.activePrivKey = nil
+	s.stopAutoLock()
+	s.identityLock.Unlock()
+	s.notifyIdentityHandlers()
+}
+
+func (s *settingsService) ChangePassphrase(oldPassphrase, newPassphrase string) error {
+	s.identityLock.Lock()
+	if s.ActiveIdentity == nil {
+		s.identityLock.Unlock()
+		return fmt.Errorf("no identity configured, therefore no private key")
+	}
+	privkey, err := readPrivateKey(s.activeKeyPath())
+	if err != nil {
+		s.identityLock.Unlock()
+		return err
+	}
+	if err := decryptPrivateKey(privkey, oldPassphrase); err != nil {
+		s.identityLock.Unlock()
+		return err
+	}
+	stored, err := storablePrivateKey(privkey, newPassphrase)
+	if err != nil {
+		s.identityLock.Unlock()
+		return err
+	}
+	if err := replacePrivateKey(s.activeKeyPath(), stored); err != nil {
+		s.identityLock.Unlock()
+		return err
+	}
+	encrypted := newPassphrase != ""
+	s.activeKeyEncrypted = &encrypted
+	s.activePrivKey = privkey
+	s.resetAutoLock()
+	s.identityLock.Unlock()
+	s.notifyIdentityHandlers()
+	return nil
+}
+
+func (s *settingsService) AutoLockTimeout() time.Duration {
+	s.identityLock.Lock()
+	defer s.identityLock.Unlock()
+	return time.Duration(s.Settings.AutoLockMinutes) * time.Minute
+}
+
+func (s *settingsService) SetAutoLockTimeout(timeout time.Duration) {
+	s.identityLock.Lock()
+	defer s.identityLock.Unlock()
+	s.Settings.AutoLockMinutes = int(timeout / time.Minute)
+	s.stopAutoLock()
+	if s.activePrivKey != nil {
+		s.resetAutoLock()
+	}
+}
+
+// resetAutoLock restarts the countdown to locking an encrypted private key
+// after it was used. The caller must hold identityLock.
+func (s *settingsService) resetAutoLock() {
+	timeout := time.Duration(s.Settings.AutoLockMinutes) * time.Minute
+	if timeout <= 0 || !s.keyEncrypted() {
+		return
+	}
+	if s.autoLockTimer == nil {
+		s.autoLockTimer = time.AfterFunc(timeout, s.LockKey)
+		return
+	}
+	s.autoLockTimer.Reset(timeout)
+}
+
+// stopAutoLock cancels any pending automatic lock. The caller must hold
+// identityLock.
+func (s *settingsService) stopAutoLock() {
+	if s.autoLockTimer != nil {
+		s.autoLockTimer.Stop()
+		s.autoLockTimer = nil
+	}
+}
@@ -0,0 +1,105 @@
+package core
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ConnectionState describes the lifecycle phase of the connection to a
+// single relay.
+type ConnectionState uint8
+
+const (
+	// Disconnected indicates that no connection is desired or running.
+	Disconnected ConnectionState = iota
+	// Connecting indicates that a connection attempt is in progress.
+	Connecting
+	// Syncing indicates that the connection is established and subscribed
+	// communities are being synchronized.
+	Syncing
+	// Connected indicates that the connection is established and idle.
+	Connected
+	// BackingOff indicates that the last connection attempt failed and that
+	// sprig is waiting before trying again.
+	BackingOff
+)
+
+func (c ConnectionState) String() string {
+	switch c {
+	case Disconnected:
+		return "disconnected"
+	case Connecting:
+		return "connecting"
+	case Syncing:
+		return "syncing"
+	case Connected:
+		return "connected"
+	case BackingOff:
+		return "backing off"
+	default:
+		return "unknown"
+	}
+}
+
+// RelayStatus is a snapshot of the state of the connection to a single relay.
+type RelayStatus struct {
+	Address string
+	State   ConnectionState
+	// Since is when the connection entered its current State.
+	Since time.Time
+	// Attempts is the number of consecutive failed connection attempts.
+	Attempts int
+	// RetryAt is when the next connection attempt will be made. It is only
+	// meaningful in the BackingOff state.
+	RetryAt time.Time
+	// LastError is the most recent error encountered by the connection, if
+	// any. It persists across state changes until a newer error replaces it.
+	LastError   error
+	LastErrorAt time.Time
+}
+
+// StateSubscription identifies a handler registered to receive relay state
+// changes.
+type StateSubscription int
+
+// Backoff computes exponentially increasing retry delays with jitter.
+type Backoff struct {
+	// Base is the maximum delay before the first retry.
+	Base time.Duration
+	// Max caps the delay between retries.
+	Max time.Duration
+}
+
+// jitter is the random source for backoff delays. It is seeded independently
+// so that clients started at the same moment do not retry in lockstep.
+var jitter = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// DefaultBackoff is the retry policy used for relay connections.
+var DefaultBackoff = Backoff{
+	Base: time.Second,
+	Max:  5 * time.Minute,
+}
+
+// Delay returns how long to wait before the given (1-indexed) retry attempt.
+// The result is chosen uniformly between half of the exponential delay and
+// the full exponential delay so that many clients reconnecting to the same
+// relay spread out their attempts.
+func (b Backoff) Delay(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	ceiling := b.Max
+	if shift := attempt - 1; shift < 32 {
+		if exp := b.Base << uint(shift); exp > 0 && exp < b.Max {
+			ceiling = exp
+		}
+	}
+	half := ceiling / 2
+	jitter.Lock()
+	defer jitter.Unlock()
+	return half + time.Duration(jitter.Int63n(int64(ceiling-half)+1))
+}
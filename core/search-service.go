@@ -0,0 +1,829 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"git.sr.ht/~whereswaldon/forest-go"
+	"git.sr.ht/~whereswaldon/forest-go/fields"
+	"git.sr.ht/~whereswaldon/forest-go/store"
+	bolt "go.etcd.io/bbolt"
+)
+
+// SearchQuery selects replies from the search index. Empty fields do not
+// restrict the results.
+type SearchQuery struct {
+	// Text holds the words that must all appear in a reply. Each word also
+	// matches longer words that begin with it, so partial words can be
+	// searched for. Single characters are not indexed, so text without
+	// longer words matches nothing.
+	Text string
+	// Author and Community match case-insensitively against any part of the
+	// name of a reply's author and community, or against their full IDs.
+	Author, Community string
+	// Since and Until bound the creation time of replies.
+	Since, Until time.Time
+	// Limit is the maximum number of results, or zero for
+	// DefaultSearchLimit.
+	Limit int
+}
+
+// DefaultSearchLimit is the number of results returned by queries without
+// a Limit.
+const DefaultSearchLimit = 100
+
+// SearchResult describes a reply matching a query.
+type SearchResult struct {
+	ID, CommunityID, AuthorID *fields.QualifiedHash
+	// Author and Community are names, and Author is empty if the author's
+	// identity is not stored.
+	Author, Community string
+	Created           time.Time
+	// Snippet is an excerpt of the reply's content around the first match.
+	Snippet string
+}
+
+// SearchService finds stored replies by their content. The index is kept
+// in the data directory and updated as nodes are stored.
+type SearchService interface {
+	// Search returns the replies matching the query, newest first.
+	Search(query SearchQuery) ([]SearchResult, error)
+	// Indexing reports whether replies stored before the index was created
+	// are still being added to it, in which case results may be missing.
+	Indexing() bool
+}
+
+// searchIndexFile is the name of the index within the data directory.
+const searchIndexFile = "search.db"
+
+// searchIndexVersion changes whenever the layout or the tokenizer of the
+// index changes, requiring it to be rebuilt.
+const searchIndexVersion = "2"
+
+// searchBatchSize bounds the number of replies indexed in each transaction.
+const searchBatchSize = 256
+
+// searchProgressInterval limits how often backfill progress is reported.
+const searchProgressInterval = time.Second / 4
+
+// searchSnippetLength is the approximate number of characters in the
+// snippet of each result.
+const searchSnippetLength = 160
+
+// searchEntry describes an indexed reply.
+type searchEntry struct {
+	ID        string `json:"-"`
+	Community string
+	Author    string
+	// Created is in milliseconds since the epoch, like forest timestamps.
+	Created int64
+	// Terms are stored so that they can be removed along with the reply.
+	Terms []string
+}
+
+// searchIndex stores the terms contained in each reply.
+type searchIndex interface {
+	// add indexes the entries, ignoring any already present.
+	add(entries ...searchEntry) error
+	// remove drops the replies with the given IDs from the index.
+	remove(ids ...string) error
+	// lookup returns the IDs of replies containing a term beginning with
+	// prefix.
+	lookup(prefix string) (map[string]bool, error)
+	// entry returns the indexed reply with the given ID.
+	entry(id string) (searchEntry, bool, error)
+	// each visits every indexed reply.
+	each(visit func(searchEntry)) error
+	// backfilled reports whether every reply stored before the index was
+	// created has been added to it.
+	backfilled() bool
+	markBackfilled() error
+}
+
+type searchService struct {
+	ArborService
+	BannerService
+	// indexLock is held for writing while the index is replaced
+	indexLock sync.RWMutex
+	index     searchIndex
+
+	// pending holds the replies stored since they were last indexed, and
+	// wake signals that it is not empty
+	pendingLock sync.Mutex
+	pending     []searchEntry
+	wake        chan struct{}
+
+	sync.Mutex
+	// backfills counts the indexes being filled with stored replies
+	backfills int
+}
+
+var _ SearchService = &searchService{}
+
+// newSearchService opens the index in the data directory, or keeps it in
+// memory while nodes are not being saved, and keeps it up to date with the
+// store. Search is unavailable if the index is in use by another instance
+// of sprig.
+func newSearchService(settings SettingsService, arbor ArborService, banners BannerService) SearchService {
+	s := &searchService{
+		ArborService:  arbor,
+		BannerService: banners,
+		wake:          make(chan struct{}, 1),
+	}
+	if arbor.Incognito() || arbor.StoreError() != nil {
+		s.index = newMemorySearchIndex()
+	} else if index, err := openBoltSearchIndex(filepath.Join(settings.DataPath(), searchIndexFile)); err != nil {
+		log.Printf("search is unavailable: %v", err)
+		return unavailableSearchService{err: err}
+	} else {
+		s.index = index
+	}
+	arbor.Store().SubscribeToNewMessages(func(node forest.Node) {
+		// this runs on the store's goroutine, so it must never wait for
+		// the index
+		if reply, ok := node.(*forest.Reply); ok {
+			s.pendingLock.Lock()
+			s.pending = append(s.pending, newSearchEntry(reply))
+			s.pendingLock.Unlock()
+			select {
+			case s.wake <- struct{}{}:
+			default:
+			}
+		}
+	})
+	arbor.SubscribeToRemovedNodes(func(ids []*fields.QualifiedHash) {
+		removed := make([]string, len(ids))
+		for i, id := range ids {
+			removed[i] = id.String()
+		}
+		s.indexLock.RLock()
+		defer s.indexLock.RUnlock()
+		if err := s.index.remove(removed...); err != nil {
+			log.Printf("failed removing %d replies from the search index: %v", len(removed), err)
+		}
+	})
+	arbor.SubscribeToStoreRecovery(func() {
+		go s.openIndex(filepath.Join(settings.DataPath(), searchIndexFile))
+	})
+	go s.indexPending()
+	if !s.index.backfilled() {
+		s.startBackfill(s.index)
+	}
+	return s
+}
+
+// openIndex replaces the index held in memory with the one at path once
+// the store is saving nodes, moving the replies indexed so far into it.
+func (s *searchService) openIndex(path string) {
+	index, err := openBoltSearchIndex(path)
+	if err != nil {
+		log.Printf("keeping search index in memory: %v", err)
+		return
+	}
+	s.Lock()
+	s.backfills++
+	s.Unlock()
+	s.indexLock.Lock()
+	session := s.index
+	s.index = index
+	s.indexLock.Unlock()
+	// nothing is added to the previous index once it is replaced, so its
+	// replies can be moved without holding the lock
+	var entries []searchEntry
+	err = session.each(func(entry searchEntry) {
+		entries = append(entries, entry)
+	})
+	for start := 0; err == nil && start < len(entries); start += searchBatchSize {
+		end := start + searchBatchSize
+		if end > len(entries) {
+			end = len(entries)
+		}
+		err = index.add(entries[start:end]...)
+	}
+	if err != nil {
+		log.Printf("failed moving %d replies into the search index: %v", len(entries), err)
+	}
+	s.Lock()
+	s.backfills--
+	s.Unlock()
+	if !index.backfilled() {
+		s.startBackfill(index)
+	}
+}
+
+func (s *searchService) Indexing() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.backfills > 0
+}
+
+// startBackfill fills the index with the stored replies in the background.
+func (s *searchService) startBackfill(index searchIndex) {
+	s.Lock()
+	s.backfills++
+	s.Unlock()
+	go s.backfill(index)
+}
+
+// indexPending indexes replies as they are stored, gathering those that
+// arrive together into batches.
+func (s *searchService) indexPending() {
+	for range s.wake {
+		for {
+			s.pendingLock.Lock()
+			entries := s.pending
+			if len(entries) > searchBatchSize {
+				entries = entries[:searchBatchSize:searchBatchSize]
+				s.pending = s.pending[searchBatchSize:]
+			} else {
+				s.pending = nil
+			}
+			s.pendingLock.Unlock()
+			if len(entries) == 0 {
+				break
+			}
+			s.indexLock.RLock()
+			if err := s.index.add(entries...); err != nil {
+				log.Printf("failed indexing %d replies for search: %v", len(entries), err)
+			}
+			s.indexLock.RUnlock()
+		}
+	}
+}
+
+// backfill adds the replies stored before the index was created to it.
+func (s *searchService) backfill(index searchIndex) {
+	defer func() {
+		s.Lock()
+		s.backfills--
+		s.Unlock()
+	}()
+	walker, ok := s.ArborService.(storeWalker)
+	if !ok {
+		log.Printf("cannot index stored replies for search: store cannot be listed")
+		return
+	}
+	banner := newProgressBanner(s.BannerService, "Indexing messages for search...")
+	defer banner.Cancel()
+	var (
+		batch        []searchEntry
+		failure      error
+		checked      int
+		total        int
+		lastProgress time.Time
+	)
+	flush := func() {
+		if failure == nil && len(batch) > 0 {
+			failure = index.add(batch...)
+		}
+		batch = batch[:0]
+	}
+	err := walker.walkStore(func(n int) {
+		total = n
+	}, func(stored storedNode) {
+		checked++
+		if time.Since(lastProgress) > searchProgressInterval {
+			lastProgress = time.Now()
+			banner.Update(fmt.Sprintf("Indexing messages for search (%d of %d)...", checked, total))
+		}
+		reply, ok := stored.Node.(*forest.Reply)
+		if stored.Err != nil || !ok || !reply.ID().Equals(stored.ID) {
+			return
+		}
+		batch = append(batch, newSearchEntry(reply))
+		if len(batch) >= searchBatchSize {
+			flush()
+		}
+	})
+	flush()
+	if err == nil {
+		err = failure
+	}
+	if err != nil {
+		log.Printf("failed indexing stored replies for search: %v", err)
+		return
+	}
+	if err := index.markBackfilled(); err != nil {
+		log.Printf("failed recording search index completion: %v", err)
+	}
+}
+
+// unavailableSearchService is used when replies cannot be indexed.
+type unavailableSearchService struct {
+	err error
+}
+
+var _ SearchService = unavailableSearchService{}
+
+func (u unavailableSearchService) Search(SearchQuery) ([]SearchResult, error) {
+	return nil, fmt.Errorf("search is unavailable: %w", u.err)
+}
+
+func (unavailableSearchService) Indexing() bool {
+	return false
+}
+
+// newSearchEntry describes a reply for the index.
+func newSearchEntry(reply *forest.Reply) searchEntry {
+	return searchEntry{
+		ID:        reply.ID().String(),
+		Community: reply.CommunityID.String(),
+		Author:    reply.Author.String(),
+		Created:   int64(reply.Created),
+		Terms:     searchTerms(string(reply.Content.Blob)),
+	}
+}
+
+// searchTermLength bounds the length in bytes of indexed terms.
+const searchTermLength = 64
+
+// searchTerms splits text into the distinct lowercase words it contains,
+// ignoring single characters.
+func searchTerms(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	seen := make(map[string]bool, len(words))
+	terms := words[:0]
+	for _, word := range words {
+		if utf8.RuneCountInString(word) < 2 {
+			continue
+		}
+		if len(word) > searchTermLength {
+			word = truncateUTF8(word, searchTermLength)
+		}
+		if !seen[word] {
+			seen[word] = true
+			terms = append(terms, word)
+		}
+	}
+	return terms
+}
+
+// truncateUTF8 shortens s to at most n bytes without splitting a rune.
+func truncateUTF8(s string, n int) string {
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+func (s *searchService) Search(query SearchQuery) ([]SearchResult, error) {
+	limit := query.Limit
+	if limit <= 0 {
+		limit = DefaultSearchLimit
+	}
+	terms := searchTerms(query.Text)
+	if len(terms) == 0 && strings.TrimSpace(query.Text) != "" {
+		// nothing in the text could match an indexed word
+		return nil, nil
+	}
+	s.indexLock.RLock()
+	candidates, err := s.candidates(terms)
+	s.indexLock.RUnlock()
+	if err != nil {
+		return nil, fmt.Errorf("failed searching: %w", err)
+	}
+	names := newSearchNames(s.Store())
+	author := strings.ToLower(query.Author)
+	community := strings.ToLower(query.Community)
+	filtered := candidates[:0]
+	for _, entry := range candidates {
+		created := time.Unix(0, entry.Created*int64(time.Millisecond))
+		if !query.Since.IsZero() && created.Before(query.Since) {
+			continue
+		}
+		if !query.Until.IsZero() && created.After(query.Until) {
+			continue
+		}
+		if author != "" && !names.matches(entry.Author, author) {
+			continue
+		}
+		if community != "" && !names.matches(entry.Community, community) {
+			continue
+		}
+		filtered = append(filtered, entry)
+	}
+	sort.Slice(filtered, func(i, j int) bool {
+		return filtered[i].Created > filtered[j].Created
+	})
+
+	results := make([]SearchResult, 0, limit)
+	for _, entry := range filtered {
+		if len(results) >= limit {
+			break
+		}
+		result, ok := s.result(entry, terms, names)
+		if ok {
+			results = append(results, result)
+		}
+	}
+	return results, nil
+}
+
+// candidates returns the indexed replies containing every term, or every
+// indexed reply if there are no terms. It must be called with indexLock
+// held.
+func (s *searchService) candidates(terms []string) ([]searchEntry, error) {
+	var candidates []searchEntry
+	if len(terms) == 0 {
+		err := s.index.each(func(entry searchEntry) {
+			candidates = append(candidates, entry)
+		})
+		return candidates, err
+	}
+	var matches map[string]bool
+	for _, term := range terms {
+		ids, err := s.index.lookup(term)
+		if err != nil {
+			return nil, err
+		}
+		if matches == nil {
+			matches = ids
+			continue
+		}
+		for id := range matches {
+			if !ids[id] {
+				delete(matches, id)
+			}
+		}
+	}
+	for id := range matches {
+		entry, ok, err := s.index.entry(id)
+		if err != nil {
+			return nil, err
+		} else if ok {
+			candidates = append(candidates, entry)
+		}
+	}
+	return candidates, nil
+}
+
+// result loads the reply described by entry, returning false if it is no
+// longer stored.
+func (s *searchService) result(entry searchEntry, terms []string, names *searchNames) (SearchResult, bool) {
+	id := &fields.QualifiedHash{}
+	if err := id.UnmarshalText([]byte(entry.ID)); err != nil {
+		return SearchResult{}, false
+	}
+	node, has, err := s.Store().Get(id)
+	if err != nil || !has {
+		return SearchResult{}, false
+	}
+	reply, ok := node.(*forest.Reply)
+	if !ok {
+		return SearchResult{}, false
+	}
+	return SearchResult{
+		ID:          id,
+		CommunityID: &reply.CommunityID,
+		AuthorID:    &reply.Author,
+		Author:      names.name(entry.Author),
+		Community:   names.name(entry.Community),
+		Created:     reply.CreatedAt(),
+		Snippet:     searchSnippet(string(reply.Content.Blob), terms),
+	}, true
+}
+
+// searchSnippet returns the part of content surrounding the first word that
+// begins with one of the terms.
+func searchSnippet(content string, terms []string) string {
+	content = strings.Join(strings.Fields(content), " ")
+	lower := strings.ToLower(content)
+	start := -1
+	for _, term := range terms {
+		if i := strings.Index(lower, term); i >= 0 && (start < 0 || i < start) {
+			start = i
+		}
+	}
+	// ToLower can change the length of some runes, in which case the
+	// position of the match is only approximate
+	if start < 0 || len(lower) != len(content) {
+		start = 0
+	}
+	prefix := ""
+	if start > searchSnippetLength/4 {
+		start -= searchSnippetLength / 4
+		for start < len(content) && !utf8.RuneStart(content[start]) {
+			start++
+		}
+		prefix = "…"
+	} else {
+		start = 0
+	}
+	snippet := content[start:]
+	if len(snippet) > searchSnippetLength {
+		return prefix + truncateUTF8(snippet, searchSnippetLength) + "…"
+	}
+	return prefix + snippet
+}
+
+// searchNames resolves the names of identities and communities during a
+// query, looking each up in the store once.
+type searchNames struct {
+	store store.ExtendedStore
+	names map[string]string
+}
+
+func newSearchNames(s store.ExtendedStore) *searchNames {
+	return &searchNames{store: s, names: make(map[string]string)}
+}
+
+// name returns the name of the identity or community with the given ID, or
+// an empty string if it is not stored.
+func (n *searchNames) name(id string) string {
+	if name, ok := n.names[id]; ok {
+		return name
+	}
+	name := ""
+	hash := &fields.QualifiedHash{}
+	if hash.UnmarshalText([]byte(id)) == nil {
+		if node, has, err := n.store.Get(hash); err == nil && has {
+			switch node := node.(type) {
+			case *forest.Identity:
+				name = string(node.Name.Blob)
+			case *forest.Community:
+				name = string(node.Name.Blob)
+			}
+		}
+	}
+	n.names[id] = name
+	return name
+}
+
+// matches reports whether filter, which must be lowercase, is part of the
+// name of the node with the given ID or is the full ID.
+func (n *searchNames) matches(id, filter string) bool {
+	return strings.ToLower(id) == filter || strings.Contains(strings.ToLower(n.name(id)), filter)
+}
+
+// memorySearchIndex keeps the index for sessions that do not save nodes.
+type memorySearchIndex struct {
+	sync.RWMutex
+	terms   map[string]map[string]bool
+	entries map[string]searchEntry
+	done    bool
+}
+
+func newMemorySearchIndex() *memorySearchIndex {
+	return &memorySearchIndex{
+		terms:   make(map[string]map[string]bool),
+		entries: make(map[string]searchEntry),
+	}
+}
+
+func (m *memorySearchIndex) add(entries ...searchEntry) error {
+	m.Lock()
+	defer m.Unlock()
+	for _, entry := range entries {
+		if _, ok := m.entries[entry.ID]; ok {
+			continue
+		}
+		m.entries[entry.ID] = entry
+		for _, term := range entry.Terms {
+			if m.terms[term] == nil {
+				m.terms[term] = make(map[string]bool)
+			}
+			m.terms[term][entry.ID] = true
+		}
+	}
+	return nil
+}
+
+func (m *memorySearchIndex) remove(ids ...string) error {
+	m.Lock()
+	defer m.Unlock()
+	for _, id := range ids {
+		entry, ok := m.entries[id]
+		if !ok {
+			continue
+		}
+		delete(m.entries, id)
+		for _, term := range entry.Terms {
+			delete(m.terms[term], id)
+			if len(m.terms[term]) == 0 {
+				delete(m.terms, term)
+			}
+		}
+	}
+	return nil
+}
+
+func (m *memorySearchIndex) lookup(prefix string) (map[string]bool, error) {
+	m.RLock()
+	defer m.RUnlock()
+	ids := make(map[string]bool)
+	for term, matches := range m.terms {
+		if strings.HasPrefix(term, prefix) {
+			for id := range matches {
+				ids[id] = true
+			}
+		}
+	}
+	return ids, nil
+}
+
+func (m *memorySearchIndex) entry(id string) (searchEntry, bool, error) {
+	m.RLock()
+	defer m.RUnlock()
+	entry, ok := m.entries[id]
+	return entry, ok, nil
+}
+
+func (m *memorySearchIndex) each(visit func(searchEntry)) error {
+	m.RLock()
+	defer m.RUnlock()
+	for _, entry := range m.entries {
+		visit(entry)
+	}
+	return nil
+}
+
+func (m *memorySearchIndex) backfilled() bool {
+	m.RLock()
+	defer m.RUnlock()
+	return m.done
+}
+
+func (m *memorySearchIndex) markBackfilled() error {
+	m.Lock()
+	defer m.Unlock()
+	m.done = true
+	return nil
+}
+
+var (
+	// searchTermsBucket holds a key for each term in each reply, made of
+	// the term and the reply's ID separated by a zero byte, so that the
+	// replies containing terms with a given prefix are adjacent.
+	searchTermsBucket = []byte("terms")
+	// searchEntriesBucket maps reply IDs to their encoded searchEntry.
+	searchEntriesBucket = []byte("replies")
+	// searchMetaBucket holds the version of the index and whether it has
+	// been backfilled.
+	searchMetaBucket = []byte("meta")
+
+	searchVersionKey    = []byte("version")
+	searchBackfilledKey = []byte("backfilled")
+)
+
+// boltSearchIndex keeps the index in a database file.
+type boltSearchIndex struct {
+	*bolt.DB
+}
+
+// openBoltSearchIndex opens the index at path, creating it or rebuilding it
+// if it was made by another version of sprig.
+func openBoltSearchIndex(path string) (*boltSearchIndex, error) {
+	db, err := bolt.Open(path, 0660, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed opening search index: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(searchMetaBucket)
+		if err != nil {
+			return err
+		}
+		if string(meta.Get(searchVersionKey)) != searchIndexVersion {
+			for _, name := range [][]byte{searchTermsBucket, searchEntriesBucket} {
+				if err := tx.DeleteBucket(name); err != nil && err != bolt.ErrBucketNotFound {
+					return err
+				}
+			}
+			if err := meta.Delete(searchBackfilledKey); err != nil {
+				return err
+			}
+			if err := meta.Put(searchVersionKey, []byte(searchIndexVersion)); err != nil {
+				return err
+			}
+		}
+		for _, name := range [][]byte{searchTermsBucket, searchEntriesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed preparing search index: %w", err)
+	}
+	return &boltSearchIndex{DB: db}, nil
+}
+
+func (b *boltSearchIndex) add(entries ...searchEntry) error {
+	return b.Update(func(tx *bolt.Tx) error {
+		terms := tx.Bucket(searchTermsBucket)
+		stored := tx.Bucket(searchEntriesBucket)
+		for _, entry := range entries {
+			if stored.Get([]byte(entry.ID)) != nil {
+				continue
+			}
+			data, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			if err := stored.Put([]byte(entry.ID), data); err != nil {
+				return err
+			}
+			for _, term := range entry.Terms {
+				if err := terms.Put([]byte(term+"\x00"+entry.ID), nil); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (b *boltSearchIndex) remove(ids ...string) error {
+	return b.Update(func(tx *bolt.Tx) error {
+		terms := tx.Bucket(searchTermsBucket)
+		stored := tx.Bucket(searchEntriesBucket)
+		for _, id := range ids {
+			data := stored.Get([]byte(id))
+			if data == nil {
+				continue
+			}
+			var entry searchEntry
+			if err := json.Unmarshal(data, &entry); err != nil {
+				return err
+			}
+			for _, term := range entry.Terms {
+				if err := terms.Delete([]byte(term + "\x00" + id)); err != nil {
+					return err
+				}
+			}
+			if err := stored.Delete([]byte(id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *boltSearchIndex) lookup(prefix string) (map[string]bool, error) {
+	ids := make(map[string]bool)
+	err := b.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(searchTermsBucket).Cursor()
+		p := []byte(prefix)
+		for k, _ := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, _ = c.Next() {
+			if i := bytes.IndexByte(k, 0); i >= 0 {
+				ids[string(k[i+1:])] = true
+			}
+		}
+		return nil
+	})
+	return ids, err
+}
+
+func (b *boltSearchIndex) entry(id string) (entry searchEntry, ok bool, err error) {
+	err = b.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(searchEntriesBucket).Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		ok = true
+		entry.ID = id
+		return json.Unmarshal(data, &entry)
+	})
+	return entry, ok, err
+}
+
+func (b *boltSearchIndex) each(visit func(searchEntry)) error {
+	return b.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(searchEntriesBucket).ForEach(func(k, v []byte) error {
+			entry := searchEntry{ID: string(k)}
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			visit(entry)
+			return nil
+		})
+	})
+}
+
+func (b *boltSearchIndex) backfilled() (done bool) {
+	if err := b.View(func(tx *bolt.Tx) error {
+		done = tx.Bucket(searchMetaBucket).Get(searchBackfilledKey) != nil
+		return nil
+	}); err != nil {
+		log.Printf("failed reading search index state: %v", err)
+	}
+	return done
+}
+
+func (b *boltSearchIndex) markBackfilled() error {
+	return b.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(searchMetaBucket).Put(searchBackfilledKey, []byte{1})
+	})
+}
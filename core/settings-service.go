@@ -2,17 +2,20 @@ package core
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
+	"time"
 
 	"git.sr.ht/~whereswaldon/forest-go"
 	"git.sr.ht/~whereswaldon/forest-go/fields"
 	"golang.org/x/crypto/openpgp"
-	"golang.org/x/crypto/openpgp/packet"
 )
 
 // SettingsService allows querying, updating, and saving settings.
@@ -24,8 +27,9 @@ type SettingsService interface {
 	AddSubscription(id string)
 	RemoveSubscription(id string)
 	Subscriptions() []string
-	Address() string
-	SetAddress(string)
+	Addresses() []string
+	AddAddress(string)
+	RemoveAddress(string)
 	BottomAppBar() bool
 	SetBottomAppBar(bool)
 	DockNavDrawer() bool
@@ -34,17 +38,93 @@ type SettingsService interface {
 	SetDarkMode(bool)
 	ActiveArborIdentityID() *fields.QualifiedHash
 	Identity() (*forest.Identity, error)
+	// DataPath is the directory holding the message store.
 	DataPath() string
+	// SetDataPath moves the message store to the given directory. An
+	// empty path restores the default within the state directory.
+	SetDataPath(string)
 	Persist() error
-	CreateIdentity(name string) error
+	// CreateIdentity generates a new identity with a key of the given
+	// algorithm and makes it active. Its private key is encrypted with
+	// passphrase unless passphrase is empty.
+	CreateIdentity(name, passphrase string, algorithm KeyAlgorithm) error
+	// ImportSecretKey creates an identity from an existing armored
+	// OpenPGP secret key and makes it active. The passphrase decrypts the
+	// key if needed and protects the stored copy unless it is empty.
+	ImportSecretKey(name string, armored []byte, passphrase string) error
+	// CreateGPGIdentity creates an identity that signs through the local
+	// gpg binary and agent with the key identified by keyID, and makes it
+	// active.
+	CreateGPGIdentity(name, keyID string) error
+	// UsesExternalKey reports whether the active identity signs through
+	// gpg rather than with a key stored by sprig.
+	UsesExternalKey() bool
 	Builder() (*forest.Builder, error)
+	// Identities lists every identity stored locally, including archived
+	// ones.
+	Identities() ([]IdentityInfo, error)
+	// SwitchIdentity makes the given identity the one used to author
+	// messages and persists the choice.
+	SwitchIdentity(id *fields.QualifiedHash) error
+	// ArchiveIdentity moves an inactive identity and its key out of the
+	// set of usable identities without deleting them.
+	ArchiveIdentity(id *fields.QualifiedHash) error
+	// RestoreIdentity returns an archived identity to the usable set.
+	RestoreIdentity(id *fields.QualifiedHash) error
+	// DeleteIdentity permanently removes an archived identity and its
+	// private key.
+	DeleteIdentity(id *fields.QualifiedHash) error
+	// ExportIdentity returns an armored backup of the active identity and
+	// its private key, which is encrypted with passphrase unless it is
+	// empty.
+	ExportIdentity(passphrase string) ([]byte, error)
+	// ImportIdentity validates and stores an identity backup created by
+	// ExportIdentity, then makes it the active identity.
+	ImportIdentity(bundle []byte, passphrase string) (*fields.QualifiedHash, error)
+	// SubscribeToIdentityChanges registers a handler that will be invoked
+	// with the active identity every time it changes or its private key is
+	// locked or unlocked.
+	SubscribeToIdentityChanges(handler func(*fields.QualifiedHash)) IdentitySubscription
+	UnsubscribeFromIdentityChanges(IdentitySubscription)
+	// KeyEncrypted reports whether the active identity's private key is
+	// stored encrypted with a passphrase.
+	KeyEncrypted() bool
+	// KeyLocked reports whether the active identity's private key must be
+	// unlocked before messages can be signed.
+	KeyLocked() bool
+	// UnlockKey decrypts the active identity's private key for signing.
+	UnlockKey(passphrase string) error
+	// LockKey forgets the decrypted private key of the active identity if it
+	// is stored encrypted.
+	LockKey()
+	// ChangePassphrase re-encrypts the active identity's private key with
+	// a new passphrase. The old passphrase is ignored for keys that are not
+	// yet encrypted, and an empty new passphrase stores the key without
+	// encryption.
+	ChangePassphrase(oldPassphrase, newPassphrase string) error
+	// AutoLockTimeout is how long an unlocked private key may go unused
+	// before it is locked again. Zero disables locking automatically.
+	AutoLockTimeout() time.Duration
+	SetAutoLockTimeout(time.Duration)
 	UseOrchardStore() bool
 	SetUseOrchardStore(bool)
+	LocalRelayEnabled() bool
+	SetLocalRelayEnabled(bool)
+	LocalRelayAddress() string
+	SetLocalRelayAddress(string)
+	LocalRelayAllowlist() []string
+	SetLocalRelayAllowlist([]string)
+	APIEnabled() bool
+	SetAPIEnabled(bool)
 }
 
 type Settings struct {
-	// relay address to connect to
-	Address string
+	// relay addresses to connect to
+	Addresses []string
+
+	// single relay address used by older versions of sprig. It is migrated
+	// into Addresses when settings are loaded.
+	Address string `json:",omitempty"`
 
 	// user's local identity ID
 	ActiveIdentity *fields.QualifiedHash
@@ -71,23 +151,54 @@ type Settings struct {
 	// Will become default in future release.
 	OrchardStore bool
 
+	// whether sprig accepts sprout connections from peers on the local
+	// network, the address to listen on, and the IP addresses or CIDR
+	// ranges of the peers allowed to connect
+	LocalRelayEnabled   bool
+	LocalRelayAddress   string   `json:",omitempty"`
+	LocalRelayAllowlist []string `json:",omitempty"`
+
+	// whether sprig serves the local bot API on a Unix domain socket
+	APIEnabled bool
+
+	// minutes an unlocked private key may go unused before it is locked
+	// again, or zero to keep it unlocked until sprig exits
+	AutoLockMinutes int `json:",omitempty"`
+
 	Subscriptions []string
+
+	// directory holding the message store, if not the default
+	DataDir string `json:",omitempty"`
 }
 
 type settingsService struct {
 	subscriptionLock sync.Mutex
+	addressLock      sync.Mutex
 	Settings
 	dataDir string
-	// state used for authoring messages
+	// identityLock guards the active identity and the state used for
+	// authoring messages
+	identityLock  sync.Mutex
 	activePrivKey *openpgp.Entity
 	activeIdCache *forest.Identity
+	// activeKeyEncrypted caches whether the private key is stored
+	// encrypted, and is nil until the key file has been checked
+	activeKeyEncrypted *bool
+	// activeKeyExternal caches whether the private key is held by gpg,
+	// and is nil until the key file has been checked
+	activeKeyExternal *bool
+	autoLockTimer     *time.Timer
+
+	identityHandlers    map[IdentitySubscription]func(*fields.QualifiedHash)
+	nextIdentityHandler IdentitySubscription
 }
 
 var _ SettingsService = &settingsService{}
 
 func newSettingsService(stateDir string) (SettingsService, error) {
 	s := &settingsService{
-		dataDir: stateDir,
+		dataDir:          stateDir,
+		identityHandlers: make(map[IdentitySubscription]func(*fields.QualifiedHash)),
 	}
 	if err := s.Load(); err != nil {
 		log.Printf("no loadable settings file found; defaults will be used: %v", err)
@@ -104,6 +215,10 @@ func (s *settingsService) Load() error {
 	if err = json.Unmarshal(jsonSettings, &s.Settings); err != nil {
 		return fmt.Errorf("couldn't parse json settings: %w", err)
 	}
+	if s.Settings.Address != "" {
+		s.AddAddress(s.Settings.Address)
+		s.Settings.Address = ""
+	}
 	return nil
 }
 
@@ -167,21 +282,52 @@ func (s *settingsService) SetNotificationsGloballyAllowed(allowed bool) {
 }
 
 func (s *settingsService) ActiveArborIdentityID() *fields.QualifiedHash {
+	s.identityLock.Lock()
+	defer s.identityLock.Unlock()
 	return s.Settings.ActiveIdentity
 }
 
-func (s *settingsService) Address() string {
-	return s.Settings.Address
+func (s *settingsService) AddAddress(addr string) {
+	s.addressLock.Lock()
+	defer s.addressLock.Unlock()
+	for _, existing := range s.Settings.Addresses {
+		if existing == addr {
+			return
+		}
+	}
+	s.Settings.Addresses = append(s.Settings.Addresses, addr)
+}
+
+func (s *settingsService) RemoveAddress(addr string) {
+	s.addressLock.Lock()
+	defer s.addressLock.Unlock()
+	for i, existing := range s.Settings.Addresses {
+		if existing == addr {
+			s.Settings.Addresses = append(s.Settings.Addresses[:i], s.Settings.Addresses[i+1:]...)
+			return
+		}
+	}
 }
 
-func (s *settingsService) SetAddress(addr string) {
-	s.Settings.Address = addr
+func (s *settingsService) Addresses() []string {
+	s.addressLock.Lock()
+	defer s.addressLock.Unlock()
+	var out []string
+	out = append(out, s.Settings.Addresses...)
+	return out
 }
 
 func (s *settingsService) DataPath() string {
+	if s.Settings.DataDir != "" {
+		return s.Settings.DataDir
+	}
 	return filepath.Join(s.dataDir, "data")
 }
 
+func (s *settingsService) SetDataPath(path string) {
+	s.Settings.DataDir = path
+}
+
 func (s *settingsService) BottomAppBar() bool {
 	return s.Settings.BottomAppBar
 }
@@ -206,6 +352,51 @@ func (s *settingsService) SetUseOrchardStore(enabled bool) {
 	s.Settings.OrchardStore = enabled
 }
 
+func (s *settingsService) APIEnabled() bool {
+	return s.Settings.APIEnabled
+}
+
+func (s *settingsService) SetAPIEnabled(enabled bool) {
+	s.Settings.APIEnabled = enabled
+}
+
+// DefaultLocalRelayAddress is the address the embedded relay listens on if
+// none is configured.
+const DefaultLocalRelayAddress = ":7117"
+
+func (s *settingsService) LocalRelayEnabled() bool {
+	return s.Settings.LocalRelayEnabled
+}
+
+func (s *settingsService) SetLocalRelayEnabled(enabled bool) {
+	s.Settings.LocalRelayEnabled = enabled
+}
+
+func (s *settingsService) LocalRelayAddress() string {
+	if s.Settings.LocalRelayAddress == "" {
+		return DefaultLocalRelayAddress
+	}
+	return s.Settings.LocalRelayAddress
+}
+
+func (s *settingsService) SetLocalRelayAddress(addr string) {
+	s.Settings.LocalRelayAddress = addr
+}
+
+func (s *settingsService) LocalRelayAllowlist() []string {
+	s.addressLock.Lock()
+	defer s.addressLock.Unlock()
+	var out []string
+	out = append(out, s.Settings.LocalRelayAllowlist...)
+	return out
+}
+
+func (s *settingsService) SetLocalRelayAllowlist(entries []string) {
+	s.addressLock.Lock()
+	defer s.addressLock.Unlock()
+	s.Settings.LocalRelayAllowlist = append([]string(nil), entries...)
+}
+
 func (s *settingsService) SettingsFile() string {
 	return filepath.Join(s.dataDir, "settings.json")
 }
@@ -218,26 +409,44 @@ func (s *settingsService) IdentitiesDir() string {
 	return filepath.Join(s.dataDir, "identities")
 }
 
+// DiscoverIdentities ensures that the active identity is one stored in the
+// identities directory, choosing the first one if the configured identity
+// is missing.
 func (s *settingsService) DiscoverIdentities() error {
 	idsDir, err := os.Open(s.IdentitiesDir())
 	if err != nil {
 		return fmt.Errorf("failed opening identities directory: %w", err)
 	}
+	defer idsDir.Close()
 	names, err := idsDir.Readdirnames(0)
 	if err != nil {
 		return fmt.Errorf("failed listing identities directory: %w", err)
 	}
-	name := names[0]
-	id := &fields.QualifiedHash{}
-	err = id.UnmarshalText([]byte(name))
-	if err != nil {
-		return fmt.Errorf("failed unmarshalling name of first identity %s: %w", name, err)
+	sort.Strings(names)
+	s.identityLock.Lock()
+	defer s.identityLock.Unlock()
+	if s.ActiveIdentity != nil {
+		for _, name := range names {
+			if name == s.ActiveIdentity.String() {
+				return nil
+			}
+		}
 	}
-	s.ActiveIdentity = id
-	return nil
+	for _, name := range names {
+		id := &fields.QualifiedHash{}
+		if err := id.UnmarshalText([]byte(name)); err != nil {
+			log.Printf("ignoring unrecognized file in identities directory %s: %v", name, err)
+			continue
+		}
+		s.ActiveIdentity = id
+		return nil
+	}
+	return fmt.Errorf("no identities found in %s", s.IdentitiesDir())
 }
 
 func (s *settingsService) Identity() (*forest.Identity, error) {
+	s.identityLock.Lock()
+	defer s.identityLock.Unlock()
 	if s.ActiveIdentity == nil {
 		return nil, fmt.Errorf("no identity configured")
 	}
@@ -257,30 +466,43 @@ func (s *settingsService) Identity() (*forest.Identity, error) {
 }
 
 func (s *settingsService) Signer() (forest.Signer, error) {
+	s.identityLock.Lock()
+	defer s.identityLock.Unlock()
+	privkey, err := s.privateKey()
+	if errors.Is(err, ErrExternalKey) {
+		return s.externalSigner()
+	} else if err != nil {
+		return nil, err
+	}
+	s.resetAutoLock()
+	signer, err := forest.NewNativeSigner(privkey)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't wrap privkey in forest signer: %w", err)
+	}
+	return signer, nil
+}
+
+// privateKey returns the decrypted private key of the active identity,
+// loading it if it is stored unencrypted. The caller must hold
+// identityLock.
+func (s *settingsService) privateKey() (*openpgp.Entity, error) {
 	if s.ActiveIdentity == nil {
 		return nil, fmt.Errorf("no identity configured, therefore no private key")
 	}
-	var privkey *openpgp.Entity
 	if s.activePrivKey != nil {
-		privkey = s.activePrivKey
-	} else {
-		keyfilePath := filepath.Join(s.KeysDir(), s.ActiveIdentity.String())
-		keyfile, err := os.Open(keyfilePath)
-		if err != nil {
-			return nil, fmt.Errorf("unable to read key file: %w", err)
-		}
-		defer keyfile.Close()
-		privkey, err = openpgp.ReadEntity(packet.NewReader(keyfile))
-		if err != nil {
-			return nil, fmt.Errorf("unable to decode key data: %w", err)
-		}
-		s.activePrivKey = privkey
+		return s.activePrivKey, nil
 	}
-	signer, err := forest.NewNativeSigner(privkey)
+	privkey, err := readPrivateKey(s.activeKeyPath())
 	if err != nil {
-		return nil, fmt.Errorf("couldn't wrap privkey in forest signer: %w", err)
+		return nil, err
 	}
-	return signer, nil
+	encrypted := privkey.PrivateKey.Encrypted
+	s.activeKeyEncrypted = &encrypted
+	if encrypted {
+		return nil, ErrKeyLocked
+	}
+	s.activePrivKey = privkey
+	return privkey, nil
 }
 
 func (s *settingsService) Builder() (*forest.Builder, error) {
@@ -296,15 +518,22 @@ func (s *settingsService) Builder() (*forest.Builder, error) {
 	return builder, nil
 }
 
-func (s *settingsService) CreateIdentity(name string) (err error) {
-	keysDir := s.KeysDir()
-	if err := os.MkdirAll(keysDir, 0770); err != nil {
-		return fmt.Errorf("failed creating key storage directory: %w", err)
+func (s *settingsService) CreateIdentity(name, passphrase string, algorithm KeyAlgorithm) error {
+	config, err := algorithm.config()
+	if err != nil {
+		return err
 	}
-	keypair, err := openpgp.NewEntity(name, "sprig-generated arbor identity", "", &packet.Config{})
+	keypair, err := openpgp.NewEntity(name, "sprig-generated arbor identity", "", config)
 	if err != nil {
 		return fmt.Errorf("failed generating new keypair: %w", err)
 	}
+	return s.createNativeIdentity(name, keypair, passphrase)
+}
+
+// createNativeIdentity creates an identity signed by the decrypted keypair,
+// stores the keypair encrypted with passphrase unless it is empty, and makes
+// the identity active.
+func (s *settingsService) createNativeIdentity(name string, keypair *openpgp.Entity, passphrase string) error {
 	signer, err := forest.NewNativeSigner(keypair)
 	if err != nil {
 		return fmt.Errorf("failed wrapping keypair into Signer: %w", err)
@@ -313,21 +542,42 @@ func (s *settingsService) CreateIdentity(name string) (err error) {
 	if err != nil {
 		return fmt.Errorf("failed generating arbor identity from signer: %w", err)
 	}
-	id := identity.ID()
+	if err := validateIdentitySigner(identity, signer); err != nil {
+		return err
+	}
+	stored, err := storablePrivateKey(keypair, passphrase)
+	if err != nil {
+		return err
+	}
+	if err := s.writeNewIdentity(identity, func(w io.Writer) error {
+		return stored.SerializePrivateWithoutSigning(w, nil)
+	}); err != nil {
+		return err
+	}
+	s.setActiveIdentity(identity.ID(), identity, keypair)
+	return s.Persist()
+}
 
+// writeNewIdentity saves a newly created identity along with its key file,
+// whose contents are produced by writeKey. It fails if the identity already
+// exists.
+func (s *settingsService) writeNewIdentity(identity *forest.Identity, writeKey func(io.Writer) error) (err error) {
+	id := identity.ID()
+	keysDir := s.KeysDir()
+	if err := os.MkdirAll(keysDir, 0770); err != nil {
+		return fmt.Errorf("failed creating key storage directory: %w", err)
+	}
 	keyFilePath := filepath.Join(keysDir, id.String())
-	keyFile, err := os.OpenFile(keyFilePath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0660)
+	keyFile, err := os.OpenFile(keyFilePath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
 	if err != nil {
 		return fmt.Errorf("failed creating key file: %w", err)
 	}
 	defer func() {
-		if err != nil {
-			if err = keyFile.Close(); err != nil {
-				err = fmt.Errorf("failed closing key file: %w", err)
-			}
+		if closeErr := keyFile.Close(); err == nil && closeErr != nil {
+			err = fmt.Errorf("failed closing key file: %w", closeErr)
 		}
 	}()
-	if err := keypair.SerializePrivateWithoutSigning(keyFile, nil); err != nil {
+	if err := writeKey(keyFile); err != nil {
 		return fmt.Errorf("failed saving private key: %w", err)
 	}
 
@@ -342,10 +592,8 @@ func (s *settingsService) CreateIdentity(name string) (err error) {
 		return fmt.Errorf("failed creating identity file: %w", err)
 	}
 	defer func() {
-		if err != nil {
-			if err = idFile.Close(); err != nil {
-				err = fmt.Errorf("failed closing identity file: %w", err)
-			}
+		if closeErr := idFile.Close(); err == nil && closeErr != nil {
+			err = fmt.Errorf("failed closing identity file: %w", closeErr)
 		}
 	}()
 	binIdent, err := identity.MarshalBinary()
@@ -355,10 +603,7 @@ func (s *settingsService) CreateIdentity(name string) (err error) {
 	if _, err := idFile.Write(binIdent); err != nil {
 		return fmt.Errorf("failed writing identity: %w", err)
 	}
-
-	s.ActiveIdentity = id
-	s.activePrivKey = keypair
-	return s.Persist()
+	return nil
 }
 
 func (s *settingsService) Persist() error {
@@ -2,6 +2,7 @@ package core
 
 import (
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
 	"sync"
@@ -14,32 +15,101 @@ import (
 	"git.sr.ht/~whereswaldon/sprout-go"
 )
 
+// SproutService manages the connections to arbor relays. Each relay address
+// is serviced by an independent worker with its own lifecycle.
 type SproutService interface {
+	// ConnectTo (re)connects to the specified address without affecting
+	// connections to any other address.
 	ConnectTo(address string) error
+	// Disconnect terminates the connection to the specified address (if any).
+	Disconnect(address string)
+	// RetryNow skips any remaining backoff delay for the specified address
+	// and attempts to connect immediately.
+	RetryNow(address string)
+	// State returns the current status of the connection to the specified
+	// address.
+	State(address string) RelayStatus
+	// SubscribeToStateChanges registers a handler that will be invoked
+	// with the new status of a relay every time that it changes. The
+	// handler must not block.
+	SubscribeToStateChanges(handler func(RelayStatus)) StateSubscription
+	UnsubscribeFromStateChanges(StateSubscription)
+	// Synchronize subscribes to the given communities on the relay at
+	// address and fetches the history added since they were last
+	// synchronized.
+	Synchronize(address string, communities []string) error
+	// Resync fetches the full history of every subscribed community from
+	// the relay at address. It blocks until finished.
+	Resync(address string) error
+	// Metrics returns the traffic statistics for the relay at address.
+	Metrics(address string) RelayMetrics
+	// Capture returns the recorder of raw protocol messages exchanged with
+	// every relay. It is disabled until explicitly enabled.
+	Capture() *ProtocolCapture
 	Connections() []string
 	WorkerFor(address string) *sprout.Worker
 	MarkSelfOffline()
 }
 
+// relayHandle holds the channels used to control the goroutine servicing
+// a single relay address.
+type relayHandle struct {
+	// done is closed to shut the relay goroutine down.
+	done chan struct{}
+	// retry interrupts any backoff delay in progress.
+	retry chan struct{}
+}
+
 type sproutService struct {
 	ArborService
 	BannerService
 	SettingsService
+	TrustService
 	workerLock sync.Mutex
-	workerDone chan struct{}
+	relays     map[string]*relayHandle
 	workers    map[string]*sprout.Worker
+
+	stateLock   sync.Mutex
+	states      map[string]RelayStatus
+	handlers    map[StateSubscription]func(RelayStatus)
+	nextHandler StateSubscription
+	backoff     Backoff
+	meters      map[string]*Meter
+	capture     *ProtocolCapture
+
+	watermarks *syncWatermarks
+	// sessionMarks replaces watermarks while nodes are only held in memory,
+	// so that the saved watermarks never claim history that will be lost
+	sessionMarks *syncWatermarks
 }
 
 var _ SproutService = &sproutService{}
 
-func newSproutService(arbor ArborService, banner BannerService, settings SettingsService) (SproutService, error) {
+func newSproutService(stateDir string, arbor ArborService, banner BannerService, settings SettingsService, trust TrustService) (SproutService, error) {
+	watermarks, err := newSyncWatermarks(stateDir)
+	if err != nil {
+		return nil, err
+	}
 	s := &sproutService{
+		watermarks:      watermarks,
+		sessionMarks:    newSessionWatermarks(),
 		ArborService:    arbor,
 		BannerService:   banner,
 		SettingsService: settings,
+		TrustService:    trust,
 		workers:         make(map[string]*sprout.Worker),
-		workerDone:      make(chan struct{}),
+		relays:          make(map[string]*relayHandle),
+		states:          make(map[string]RelayStatus),
+		handlers:        make(map[StateSubscription]func(RelayStatus)),
+		meters:          make(map[string]*Meter),
+		capture:         NewProtocolCapture(DefaultCaptureSize),
+		backoff:         DefaultBackoff,
 	}
+	arbor.SubscribeToStoreRecovery(func() {
+		// the saved watermarks are used from now on, and predate the
+		// nodes synchronized while the store was unavailable
+		s.sessionMarks.clear()
+	})
 	return s, nil
 }
 
@@ -47,14 +117,54 @@ func newSproutService(arbor ArborService, banner BannerService, settings Setting
 func (s *sproutService) ConnectTo(address string) error {
 	s.workerLock.Lock()
 	defer s.workerLock.Unlock()
-	if s.workerDone != nil {
-		close(s.workerDone)
+	s.stopWorker(address)
+	handle := &relayHandle{
+		done:  make(chan struct{}),
+		retry: make(chan struct{}, 1),
 	}
-	s.workerDone = make(chan struct{})
-	go s.launchWorker(address)
+	s.relays[address] = handle
+	go s.launchWorker(address, handle)
 	return nil
 }
 
+// Disconnect shuts down the worker for the specified address.
+func (s *sproutService) Disconnect(address string) {
+	s.workerLock.Lock()
+	s.stopWorker(address)
+	s.workerLock.Unlock()
+	s.setState(address, Disconnected)
+}
+
+// RetryNow interrupts the backoff delay for the specified address.
+func (s *sproutService) RetryNow(address string) {
+	s.workerLock.Lock()
+	defer s.workerLock.Unlock()
+	handle, ok := s.relays[address]
+	if !ok {
+		return
+	}
+	select {
+	case handle.retry <- struct{}{}:
+	default:
+	}
+}
+
+// stopWorker signals the worker for the given address to shut down and
+// closes its network connection so that it notices promptly. It must be
+// called with the workerLock held.
+func (s *sproutService) stopWorker(address string) {
+	if handle, ok := s.relays[address]; ok {
+		close(handle.done)
+		delete(s.relays, address)
+	}
+	if worker, ok := s.workers[address]; ok {
+		if err := worker.Conn.Conn.Close(); err != nil {
+			log.Printf("closing connection to %s: %v", address, err)
+		}
+		delete(s.workers, address)
+	}
+}
+
 func (s *sproutService) Connections() []string {
 	s.workerLock.Lock()
 	defer s.workerLock.Unlock()
@@ -75,42 +185,184 @@ func (s *sproutService) WorkerFor(address string) *sprout.Worker {
 	return out
 }
 
-func (s *sproutService) launchWorker(addr string) {
-	firstAttempt := true
+// State returns the status of the connection to the given address.
+func (s *sproutService) State(address string) RelayStatus {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+	status, ok := s.states[address]
+	if !ok {
+		return RelayStatus{Address: address, State: Disconnected}
+	}
+	return status
+}
+
+func (s *sproutService) SubscribeToStateChanges(handler func(RelayStatus)) StateSubscription {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+	s.nextHandler++
+	s.handlers[s.nextHandler] = handler
+	return s.nextHandler
+}
+
+func (s *sproutService) UnsubscribeFromStateChanges(id StateSubscription) {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+	delete(s.handlers, id)
+}
+
+// updateState applies the provided modification to the status of the given
+// address and notifies subscribers of the result.
+func (s *sproutService) updateState(address string, modify func(*RelayStatus)) {
+	s.stateLock.Lock()
+	status, ok := s.states[address]
+	if !ok {
+		status = RelayStatus{Address: address}
+	}
+	previous := status.State
+	modify(&status)
+	if status.State != previous || status.Since.IsZero() {
+		status.Since = time.Now()
+	}
+	s.states[address] = status
+	handlers := make([]func(RelayStatus), 0, len(s.handlers))
+	for _, handler := range s.handlers {
+		handlers = append(handlers, handler)
+	}
+	s.stateLock.Unlock()
+	for _, handler := range handlers {
+		handler(status)
+	}
+}
+
+// setState moves the given address into the provided state.
+func (s *sproutService) setState(address string, state ConnectionState) {
+	s.updateState(address, func(status *RelayStatus) {
+		status.State = state
+	})
+}
+
+// meterFor returns the meter collecting statistics for the given address.
+func (s *sproutService) meterFor(address string) *Meter {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+	meter, ok := s.meters[address]
+	if !ok {
+		meter = NewMeter(address, s.capture)
+		s.meters[address] = meter
+	}
+	return meter
+}
+
+// Metrics returns the traffic statistics for the given address.
+func (s *sproutService) Metrics(address string) RelayMetrics {
+	return s.meterFor(address).Snapshot()
+}
+
+func (s *sproutService) Capture() *ProtocolCapture {
+	return s.capture
+}
+
+// recordError stores err as the most recent error for the given address.
+func (s *sproutService) recordError(address string, err error) {
+	s.meterFor(address).RecordError(err)
+	s.updateState(address, func(status *RelayStatus) {
+		status.LastError = err
+		status.LastErrorAt = time.Now()
+	})
+}
+
+// isDone returns whether the provided done channel has been closed.
+func isDone(done chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+// waitToRetry waits for the backoff delay appropriate to the given attempt
+// number. It returns false if the relay was shut down while waiting.
+func (s *sproutService) waitToRetry(addr string, handle *relayHandle, attempt int) bool {
+	delay := s.backoff.Delay(attempt)
+	s.updateState(addr, func(status *RelayStatus) {
+		status.State = BackingOff
+		status.Attempts = attempt
+		status.RetryAt = time.Now().Add(delay)
+	})
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-handle.done:
+		return false
+	case <-handle.retry:
+	case <-timer.C:
+	}
+	return true
+}
+
+func (s *sproutService) launchWorker(addr string, handle *relayHandle) {
+	done := handle.done
+	attempt := 0
 	logger := log.New(log.Writer(), "worker "+addr, log.LstdFlags|log.Lshortfile)
 	for {
-		worker, done := func() (*sprout.Worker, chan struct{}) {
+		if attempt > 0 {
+			logger.Printf("Restarting worker for address %s (attempt %d)", addr, attempt)
+			if !s.waitToRetry(addr, handle, attempt) {
+				return
+			}
+		}
+		s.setState(addr, Connecting)
+		worker, err := func() (*sprout.Worker, error) {
 			connectionBanner := &LoadingBanner{
 				Priority: Info,
 				Text:     "Connecting to " + addr + "...",
 			}
 			defer connectionBanner.Cancel()
 			s.BannerService.Add(connectionBanner)
-			if !firstAttempt {
-				logger.Printf("Restarting worker for address %s", addr)
-				time.Sleep(time.Second)
-			}
-			firstAttempt = false
 
-			s.workerLock.Lock()
-			done := s.workerDone
-			s.workerLock.Unlock()
-
-			worker, err := NewWorker(addr, done, s.ArborService.Store())
+			worker, err := NewWorker(addr, s.TrustService.TLSConfig(addr), s.meterFor(addr), done, s.ArborService.Store())
 			if err != nil {
-				log.Printf("Failed starting worker: %v", err)
-				return nil, nil
+				return nil, err
 			}
 			worker.Logger = log.New(logger.Writer(), fmt.Sprintf("worker-%v ", addr), log.Flags())
 
 			s.workerLock.Lock()
+			defer s.workerLock.Unlock()
+			if isDone(done) {
+				// we were disconnected while dialing
+				worker.Conn.Conn.Close()
+				return nil, nil
+			}
 			s.workers[addr] = worker
-			s.workerLock.Unlock()
-			return worker, done
+			return worker, nil
 		}()
-		if worker == nil {
+		if isDone(done) {
+			return
+		}
+		if err != nil {
+			log.Printf("Failed starting worker: %v", err)
+			s.recordError(addr, err)
+			var mismatch *CertificateMismatchError
+			if errors.As(err, &mismatch) {
+				// Retrying cannot help, and the relay may be an impostor.
+				s.blockCertificate(addr, handle, mismatch.Actual, fmt.Sprintf(
+					"The certificate for %s has changed and the connection was blocked. "+
+						"This can happen if the relay renewed its certificate, but it can also mean that someone "+
+						"is impersonating the relay. Accept the new certificate only if its fingerprint matches the "+
+						"one the relay's operator gave you, or verify the relay with a CA bundle in the settings."+
+						"\nPinned: %s\nPresented: %s",
+					addr, FormatFingerprint(mismatch.Expected), FormatFingerprint(mismatch.Actual)))
+				return
+			}
+			attempt++
 			continue
 		}
+		attempt = 0
+		s.updateState(addr, func(status *RelayStatus) {
+			status.State = Syncing
+			status.Attempts = 0
+		})
 
 		go func() {
 			synchronizingBanner := &LoadingBanner{
@@ -119,16 +371,59 @@ func (s *sproutService) launchWorker(addr string) {
 			}
 			s.BannerService.Add(synchronizingBanner)
 			defer synchronizingBanner.Cancel()
-			BootstrapSubscribed(worker, s.SettingsService.Subscriptions())
+			if err := s.bootstrapSubscribed(addr, worker, s.SettingsService.Subscriptions(), false); err != nil {
+				s.recordError(addr, err)
+			}
+			if s.WorkerFor(addr) == worker {
+				s.setState(addr, Connected)
+			}
 		}()
 
 		worker.Run()
-		select {
-		case <-done:
+		s.workerLock.Lock()
+		if s.workers[addr] == worker {
+			delete(s.workers, addr)
+		}
+		s.workerLock.Unlock()
+		if isDone(done) {
 			return
-		default:
 		}
+		s.recordError(addr, fmt.Errorf("connection to %s lost", addr))
+		attempt++
+	}
+}
+
+// blockCertificate stops connecting to a relay whose certificate changed
+// and asks the user whether to pin the certificate with the given
+// fingerprint instead.
+func (s *sproutService) blockCertificate(addr string, handle *relayHandle, fingerprint, text string) {
+	s.workerLock.Lock()
+	if s.relays[addr] == handle {
+		close(handle.done)
+		delete(s.relays, addr)
 	}
+	s.workerLock.Unlock()
+	s.setState(addr, Disconnected)
+	s.BannerService.Add(&ActionBanner{
+		Priority: Error,
+		Text:     text,
+		Actions: []BannerAction{
+			{
+				Label: "Accept new certificate",
+				Do: func() {
+					if err := s.TrustService.AcceptCertificate(addr, fingerprint); err != nil {
+						log.Printf("failed trusting certificate for %s: %v", addr, err)
+						s.recordError(addr, err)
+						return
+					}
+					s.ConnectTo(addr)
+				},
+			},
+			{
+				Label: "Keep blocked",
+			},
+		},
+	})
 }
 
 // MarkSelfOffline announces that the local user is offline in all known
@@ -169,9 +464,11 @@ func makeTicker(duration time.Duration) <-chan time.Time {
 	return time.NewTicker(duration).C
 }
 
-func BootstrapSubscribed(worker *sprout.Worker, subscribed []string) error {
-	leaves := 1024
-	communities, err := worker.SendList(fields.NodeTypeCommunity, leaves, makeTicker(worker.DefaultTimeout))
+// bootstrapSubscribed subscribes to the given communities on the relay and
+// synchronizes their history. Unless full is set, only history newer than
+// the stored watermark for each community is fetched.
+func (s *sproutService) bootstrapSubscribed(addr string, worker *sprout.Worker, subscribed []string, full bool) error {
+	communities, err := worker.SendList(fields.NodeTypeCommunity, fullSyncLeaves, makeTicker(worker.DefaultTimeout))
 	if err != nil {
 		worker.Printf("Failed listing peer communities: %v", err)
 		return err
@@ -186,33 +483,90 @@ func BootstrapSubscribed(worker *sprout.Worker, subscribed []string) error {
 			worker.Printf("Got response in community list that isn't a community: %s", node.ID().String())
 			continue
 		}
-		if !subbed[community.ID().String()] {
+		id := community.ID().String()
+		if !subbed[id] {
 			continue
 		}
 		if err := worker.IngestNode(community); err != nil {
-			worker.Printf("Couldn't ingest community %s: %v", community.ID().String(), err)
+			worker.Printf("Couldn't ingest community %s: %v", id, err)
 			continue
 		}
 		if err := worker.SendSubscribe(community, makeTicker(worker.DefaultTimeout)); err != nil {
-			worker.Printf("Couldn't subscribe to community %s", community.ID().String())
+			worker.Printf("Couldn't subscribe to community %s", id)
 			continue
 		}
 		worker.Subscribe(community.ID())
-		worker.Printf("Subscribed to %s", community.ID().String())
-		if err := worker.SynchronizeFullTree(community, leaves, worker.DefaultTimeout); err != nil {
-			worker.Printf("Couldn't fetch message tree rooted at community %s: %v", community.ID().String(), err)
+		worker.Printf("Subscribed to %s", id)
+		marks := s.syncMarks()
+		var mark Watermark
+		if !full {
+			mark, _ = marks.Get(addr, id)
+		}
+		mark, err := SynchronizeSince(worker, community, mark)
+		if err != nil {
+			worker.Printf("Couldn't fetch message tree rooted at community %s: %v", id, err)
 			continue
 		}
+		marks.Set(addr, id, mark)
 	}
 	return nil
 }
 
+// syncMarks returns the watermarks describing the nodes in the store.
+func (s *sproutService) syncMarks() *syncWatermarks {
+	if s.ArborService.Incognito() || s.ArborService.StoreError() != nil {
+		return s.sessionMarks
+	}
+	return s.watermarks
+}
+
+// Synchronize subscribes to the given communities on the relay at address
+// and fetches their history since the last synchronization.
+func (s *sproutService) Synchronize(address string, communities []string) error {
+	worker := s.WorkerFor(address)
+	if worker == nil {
+		return fmt.Errorf("not connected to %s", address)
+	}
+	return s.bootstrapSubscribed(address, worker, communities, false)
+}
+
+// Resync fetches the full history of every subscribed community from the
+// relay at address, ignoring stored watermarks.
+func (s *sproutService) Resync(address string) error {
+	worker := s.WorkerFor(address)
+	if worker == nil {
+		return fmt.Errorf("not connected to %s", address)
+	}
+	s.setState(address, Syncing)
+	synchronizingBanner := &LoadingBanner{
+		Priority: Info,
+		Text:     "Resyncing with " + address + "...",
+	}
+	s.BannerService.Add(synchronizingBanner)
+	defer synchronizingBanner.Cancel()
+	err := s.bootstrapSubscribed(address, worker, s.SettingsService.Subscriptions(), true)
+	if err != nil {
+		s.recordError(address, err)
+	}
+	if s.WorkerFor(address) == worker {
+		s.setState(address, Connected)
+	}
+	return err
+}
+
 // NewWorker creates a sprout worker connected to the provided address using
-// TLS over TCP as a transport.
-func NewWorker(addr string, done <-chan struct{}, s store.ExtendedStore) (*sprout.Worker, error) {
-	conn, err := tls.Dial("tcp", addr, nil)
+// the transport selected by the address's URL scheme. Bare HOST:PORT
+// addresses use TLS over TCP. The config is used by transports that employ
+// TLS, and may be nil to verify certificates against the system roots. If
+// meter is not nil, it records the worker's traffic and ingested nodes.
+func NewWorker(addr string, config *tls.Config, meter *Meter, done <-chan struct{}, s store.ExtendedStore) (*sprout.Worker, error) {
+	conn, err := DialRelay(addr, config)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to %s: %v", addr, err)
+		return nil, fmt.Errorf("failed to connect to %s: %w", addr, err)
+	}
+	if meter != nil {
+		conn = meter.WrapConn(conn)
+		s = meter.WrapStore(s)
 	}
 
 	worker, err := sprout.NewWorker(done, conn, s)
@@ -0,0 +1,98 @@
+package core
+
+import (
+	"fmt"
+	"sync"
+
+	"git.sr.ht/~whereswaldon/forest-go"
+	"git.sr.ht/~whereswaldon/forest-go/fields"
+	"git.sr.ht/~whereswaldon/forest-go/store"
+)
+
+// fallbackStore keeps nodes in memory while the configured store cannot be
+// opened. Once the configured store opens, the nodes received in the
+// meantime are copied into it and all further use is forwarded to it.
+type fallbackStore struct {
+	sync.RWMutex
+	current forest.Store
+}
+
+var _ forest.Store = &fallbackStore{}
+var _ forest.Copiable = &fallbackStore{}
+
+func newFallbackStore() *fallbackStore {
+	return &fallbackStore{current: store.NewMemoryStore()}
+}
+
+// Current returns the store that nodes are forwarded to.
+func (f *fallbackStore) Current() forest.Store {
+	f.RLock()
+	defer f.RUnlock()
+	return f.current
+}
+
+// replace copies the nodes held so far into s and forwards to it from then
+// on.
+func (f *fallbackStore) replace(s forest.Store) error {
+	f.Lock()
+	defer f.Unlock()
+	copiable, ok := f.current.(forest.Copiable)
+	if !ok {
+		return fmt.Errorf("store %T cannot be copied", f.current)
+	}
+	if err := copiable.CopyInto(s); err != nil {
+		return fmt.Errorf("failed copying received nodes: %w", err)
+	}
+	f.current = s
+	return nil
+}
+
+func (f *fallbackStore) Get(id *fields.QualifiedHash) (forest.Node, bool, error) {
+	return f.Current().Get(id)
+}
+
+func (f *fallbackStore) GetIdentity(id *fields.QualifiedHash) (forest.Node, bool, error) {
+	return f.Current().GetIdentity(id)
+}
+
+func (f *fallbackStore) GetCommunity(id *fields.QualifiedHash) (forest.Node, bool, error) {
+	return f.Current().GetCommunity(id)
+}
+
+func (f *fallbackStore) GetConversation(communityID, conversationID *fields.QualifiedHash) (forest.Node, bool, error) {
+	return f.Current().GetConversation(communityID, conversationID)
+}
+
+func (f *fallbackStore) GetReply(communityID, conversationID, replyID *fields.QualifiedHash) (forest.Node, bool, error) {
+	return f.Current().GetReply(communityID, conversationID, replyID)
+}
+
+func (f *fallbackStore) Children(id *fields.QualifiedHash) ([]*fields.QualifiedHash, error) {
+	return f.Current().Children(id)
+}
+
+func (f *fallbackStore) Recent(nodeType fields.NodeType, quantity int) ([]forest.Node, error) {
+	return f.Current().Recent(nodeType, quantity)
+}
+
+func (f *fallbackStore) Add(node forest.Node) error {
+	// hold the read lock so that nodes cannot be added to the memory store
+	// while it is being replaced
+	f.RLock()
+	defer f.RUnlock()
+	return f.current.Add(node)
+}
+
+func (f *fallbackStore) RemoveSubtree(id *fields.QualifiedHash) error {
+	f.RLock()
+	defer f.RUnlock()
+	return f.current.RemoveSubtree(id)
+}
+
+func (f *fallbackStore) CopyInto(other forest.Store) error {
+	copiable, ok := f.Current().(forest.Copiable)
+	if !ok {
+		return fmt.Errorf("store %T cannot be copied", f.Current())
+	}
+	return copiable.CopyInto(other)
+}
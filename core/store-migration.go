@@ -0,0 +1,302 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"git.sr.ht/~whereswaldon/forest-go"
+	"git.sr.ht/~whereswaldon/forest-go/grove"
+	"git.sr.ht/~whereswaldon/forest-go/orchard"
+)
+
+// StoreKind names an implementation of the node store.
+type StoreKind string
+
+const (
+	// GroveStore keeps each node in its own file.
+	GroveStore StoreKind = "grove"
+	// OrchardStore keeps every node in a single database file.
+	OrchardStore StoreKind = "orchard"
+)
+
+// storeKindFor returns the kind of store selected by the Orchard setting.
+func storeKindFor(useOrchard bool) StoreKind {
+	if useOrchard {
+		return OrchardStore
+	}
+	return GroveStore
+}
+
+// String returns a human-readable name for the store.
+func (k StoreKind) String() string {
+	switch k {
+	case GroveStore:
+		return "Grove"
+	case OrchardStore:
+		return "Orchard"
+	default:
+		return string(k)
+	}
+}
+
+// openStore opens the store of the given kind within the data directory.
+// Grove calls onCorrupt with the ID of each corrupt node it discards.
+func openStore(dataPath string, kind StoreKind, onCorrupt func(id string)) (forest.Store, error) {
+	switch kind {
+	case OrchardStore:
+		o, err := orchard.Open(filepath.Join(dataPath, "orchard.db"))
+		if err != nil {
+			return nil, fmt.Errorf("opening Orchard store: %v", err)
+		}
+		return o, nil
+	case GroveStore:
+		g, err := grove.New(dataPath)
+		if err != nil {
+			return nil, fmt.Errorf("opening Grove store: %v", err)
+		}
+		if onCorrupt != nil {
+			g.SetCorruptNodeHandler(onCorrupt)
+		}
+		return g, nil
+	default:
+		return nil, fmt.Errorf("unknown store %q", string(kind))
+	}
+}
+
+// closeStore releases the resources held by a store opened with openStore.
+func closeStore(s forest.Store) {
+	if closer, ok := s.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Printf("failed closing %T: %v", s, err)
+		}
+	}
+}
+
+// storeMigrationFile records the progress of the latest migration between
+// stores within the data directory.
+const storeMigrationFile = "store-migration.json"
+
+// storeMigration is the record of a migration between stores.
+type storeMigration struct {
+	From, To StoreKind
+	// Complete is set once every node in From has been verified in To.
+	Complete bool
+}
+
+// location returns the store holding the complete set of nodes.
+func (m storeMigration) location() StoreKind {
+	if m.Complete {
+		return m.To
+	}
+	return m.From
+}
+
+// loadStoreMigration reads the migration record in dataPath. It returns
+// nil if no migration has been started.
+func loadStoreMigration(dataPath string) (*storeMigration, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dataPath, storeMigrationFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed reading store migration record: %w", err)
+	}
+	var m storeMigration
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed parsing store migration record: %w", err)
+	}
+	return &m, nil
+}
+
+// save records the migration in dataPath.
+func (m storeMigration) save(dataPath string) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("failed encoding store migration record: %w", err)
+	}
+	path := filepath.Join(dataPath, storeMigrationFile)
+	if err := ioutil.WriteFile(path+".tmp", data, 0660); err != nil {
+		return fmt.Errorf("failed writing store migration record: %w", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("failed writing store migration record: %w", err)
+	}
+	return nil
+}
+
+// activeStoreKind returns the kind of store that holds the nodes in
+// dataPath. This is the kind selected by the settings unless a migration
+// into it is unfinished, in which case the store being migrated from is
+// still used.
+func activeStoreKind(dataPath string, useOrchard bool) StoreKind {
+	m, err := loadStoreMigration(dataPath)
+	if err != nil {
+		log.Printf("assuming the selected store holds every node: %v", err)
+	}
+	if m == nil {
+		return storeKindFor(useOrchard)
+	}
+	return m.location()
+}
+
+// StoreMigrationProgress describes how far a migration between stores
+// has advanced.
+type StoreMigrationProgress struct {
+	From, To StoreKind
+	// Copied is the number of nodes examined so far out of Total. Nodes
+	// already present in the destination are counted without being
+	// copied again, which lets an interrupted migration resume cheaply.
+	Copied, Total int
+	// Skipped counts nodes that could not be read from the source.
+	Skipped int
+	// Verifying is set once copying is done and the destination is being
+	// checked.
+	Verifying bool
+}
+
+// storeMigrationProgressInterval limits how often progress is reported.
+const storeMigrationProgressInterval = time.Second / 4
+
+// errMigrationCancelled is returned when a migration is stopped before it
+// finishes.
+var errMigrationCancelled = errors.New("store migration cancelled")
+
+// migrateNodes copies every node from src into dst and verifies that each
+// of them can be read back from dst with content matching its ID. The
+// directories hold the data of whichever stores are groves. The migration
+// stops early if stop is closed.
+func migrateNodes(src forest.Store, srcDir string, dst forest.Store, dstDir string, progress func(StoreMigrationProgress), stop <-chan struct{}) error {
+	state := StoreMigrationProgress{From: storeKindOf(src), To: storeKindOf(dst)}
+	lastProgress := time.Time{}
+	report := func(force bool) {
+		if force || time.Since(lastProgress) > storeMigrationProgressInterval {
+			lastProgress = time.Now()
+			progress(state)
+		}
+	}
+	copied := make(map[string]bool)
+	var failure error
+	err := walkNodes(src, srcDir, func(total int) {
+		state.Total = total
+		report(true)
+	}, func(stored storedNode) {
+		if failure != nil {
+			return
+		}
+		select {
+		case <-stop:
+			failure = errMigrationCancelled
+			return
+		default:
+		}
+		state.Copied++
+		defer report(false)
+		if stored.Err != nil || !stored.Node.ID().Equals(stored.ID) {
+			log.Printf("store migration skipping unreadable node %s: %v", stored.ID, stored.Err)
+			state.Skipped++
+			return
+		}
+		if _, present, err := dst.Get(stored.ID); err != nil || !present {
+			if err := dst.Add(stored.Node); err != nil {
+				failure = fmt.Errorf("failed copying node %s: %w", stored.ID, err)
+				return
+			}
+		}
+		copied[stored.ID.String()] = true
+	})
+	if failure != nil {
+		return failure
+	} else if err != nil {
+		return err
+	}
+
+	state.Verifying = true
+	report(true)
+	found := 0
+	if err := walkNodes(dst, dstDir, func(int) {}, func(stored storedNode) {
+		// nodes are listed under the ID their content hashes to, except in
+		// groves where a mismatch reveals damage to the copy
+		if stored.Err == nil && stored.Node.ID().Equals(stored.ID) && copied[stored.ID.String()] {
+			found++
+		}
+	}); err != nil {
+		return fmt.Errorf("failed verifying copied nodes: %w", err)
+	}
+	if found != len(copied) {
+		return fmt.Errorf("verification found %d of %d copied nodes intact", found, len(copied))
+	}
+	report(true)
+	return nil
+}
+
+// storeKindOf returns the kind of an open store.
+func storeKindOf(s forest.Store) StoreKind {
+	switch s.(type) {
+	case *grove.Grove:
+		return GroveStore
+	case *orchard.Orchard:
+		return OrchardStore
+	default:
+		return StoreKind(fmt.Sprintf("%T", s))
+	}
+}
+
+// MigrateStore copies every node in the data directory of the sprig state
+// in stateDir into the store of the given kind, then selects that store in
+// the settings. Interrupted migrations resume where they stopped. It must
+// not be used while the state is open in an App.
+func MigrateStore(stateDir string, to StoreKind, progress func(StoreMigrationProgress)) error {
+	settings, err := newSettingsService(stateDir)
+	if err != nil {
+		return err
+	}
+	dataPath := settings.DataPath()
+	if err := os.MkdirAll(dataPath, 0770); err != nil {
+		return fmt.Errorf("preparing data directory for store: %v", err)
+	}
+	from := activeStoreKind(dataPath, settings.UseOrchardStore())
+	if from != to {
+		if err := migrateStoreAt(dataPath, from, to, progress, nil); err != nil {
+			return err
+		}
+	}
+	settings.SetUseOrchardStore(to == OrchardStore)
+	return settings.Persist()
+}
+
+// migrateStoreAt opens the stores of both kinds within dataPath and
+// migrates the nodes between them, recording progress so that the
+// migration can resume if it is interrupted.
+func migrateStoreAt(dataPath string, from, to StoreKind, progress func(StoreMigrationProgress), stop <-chan struct{}) error {
+	src, err := openStore(dataPath, from, nil)
+	if err != nil {
+		return err
+	}
+	defer closeStore(src)
+	dst, err := openStore(dataPath, to, nil)
+	if err != nil {
+		return err
+	}
+	defer closeStore(dst)
+	return migrateOpenStore(src, dst, dataPath, progress, stop)
+}
+
+// migrateOpenStore migrates the nodes from src into dst, both within
+// dataPath, recording the progress of the migration.
+func migrateOpenStore(src, dst forest.Store, dataPath string, progress func(StoreMigrationProgress), stop <-chan struct{}) error {
+	record := storeMigration{From: storeKindOf(src), To: storeKindOf(dst)}
+	if err := record.save(dataPath); err != nil {
+		return err
+	}
+	if err := migrateNodes(src, dataPath, dst, dataPath, progress, stop); err != nil {
+		return err
+	}
+	record.Complete = true
+	return record.save(dataPath)
+}
@@ -0,0 +1,207 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"git.sr.ht/~whereswaldon/forest-go"
+	"git.sr.ht/~whereswaldon/forest-go/store"
+	"git.sr.ht/~whereswaldon/sprout-go"
+)
+
+// Watermark records how far the history of a community has been
+// synchronized with a particular relay.
+type Watermark struct {
+	// NewestLeaf is the creation time of the newest leaf node the relay
+	// reported for the community.
+	NewestLeaf time.Time
+	// LastSync is when synchronization last completed.
+	LastSync time.Time
+}
+
+// syncWatermarks persists a Watermark for each (relay, community) pair. It is
+// safe for concurrent use.
+type syncWatermarks struct {
+	sync.Mutex
+	// path is the file the watermarks are saved in, and empty if they are
+	// only held in memory
+	path string
+	// marks maps relay address to community ID to watermark
+	marks map[string]map[string]Watermark
+}
+
+func newSyncWatermarks(stateDir string) (*syncWatermarks, error) {
+	w := &syncWatermarks{
+		path:  filepath.Join(stateDir, "sync-watermarks.json"),
+		marks: make(map[string]map[string]Watermark),
+	}
+	data, err := ioutil.ReadFile(w.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return w, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed reading sync watermarks: %w", err)
+	}
+	if err := json.Unmarshal(data, &w.marks); err != nil {
+		return nil, fmt.Errorf("failed parsing sync watermarks: %w", err)
+	}
+	return w, nil
+}
+
+// newSessionWatermarks creates watermarks that are only held in memory, for
+// stores that are discarded when sprig exits.
+func newSessionWatermarks() *syncWatermarks {
+	return &syncWatermarks{
+		marks: make(map[string]map[string]Watermark),
+	}
+}
+
+// clear forgets every watermark.
+func (w *syncWatermarks) clear() {
+	w.Lock()
+	defer w.Unlock()
+	w.marks = make(map[string]map[string]Watermark)
+	w.persist()
+}
+
+// Get returns the watermark for the given relay and community, if any.
+func (w *syncWatermarks) Get(relay, community string) (Watermark, bool) {
+	w.Lock()
+	defer w.Unlock()
+	mark, ok := w.marks[relay][community]
+	return mark, ok
+}
+
+// Set records the watermark for the given relay and community and saves
+// the result.
+func (w *syncWatermarks) Set(relay, community string, mark Watermark) {
+	w.Lock()
+	defer w.Unlock()
+	if w.marks[relay] == nil {
+		w.marks[relay] = make(map[string]Watermark)
+	}
+	w.marks[relay][community] = mark
+	w.persist()
+}
+
+// persist writes the watermarks to disk. It must be called with the lock
+// held.
+func (w *syncWatermarks) persist() {
+	if w.path == "" {
+		return
+	}
+	data, err := json.MarshalIndent(w.marks, "", "  ")
+	if err != nil {
+		log.Printf("couldn't marshal sync watermarks as json: %v", err)
+		return
+	}
+	if err := ioutil.WriteFile(w.path, data, 0660); err != nil {
+		log.Printf("couldn't save sync watermarks: %v", err)
+	}
+}
+
+const (
+	// fullSyncLeaves is the number of leaves requested when synchronizing
+	// a community without a watermark.
+	fullSyncLeaves = 1024
+	// incrementalSyncLeaves is the number of leaves initially requested
+	// when synchronizing a community with a watermark. The request grows
+	// until it reaches leaves that were already known.
+	incrementalSyncLeaves = 32
+)
+
+// SynchronizeSince fetches the leaves of the community that are newer than
+// the watermark (along with their ancestry) and announces local leaves
+// created since the last synchronization. A zero watermark synchronizes the
+// full tree. It returns the watermark to use for the next synchronization.
+func SynchronizeSince(worker *sprout.Worker, community *forest.Community, mark Watermark) (Watermark, error) {
+	full := mark.NewestLeaf.IsZero()
+	quantity := incrementalSyncLeaves
+	if full {
+		quantity = fullSyncLeaves
+	}
+	var leaves []forest.Node
+	for {
+		response, err := worker.SendLeavesOf(community.ID(), quantity, makeTicker(worker.DefaultTimeout))
+		if err != nil {
+			return mark, fmt.Errorf("couldn't fetch leaves of node %s: %w", community.ID(), err)
+		}
+		leaves = response.Nodes
+		if full || len(leaves) < quantity || quantity >= fullSyncLeaves {
+			break
+		}
+		reachedWatermark := false
+		for _, leaf := range leaves {
+			if !leaf.CreatedAt().After(mark.NewestLeaf) {
+				reachedWatermark = true
+				break
+			}
+		}
+		if reachedWatermark {
+			break
+		}
+		// every leaf was new, so there may be more that we missed
+		quantity *= 2
+	}
+
+	next := Watermark{NewestLeaf: mark.NewestLeaf}
+	sort.Slice(leaves, func(i, j int) bool {
+		return leaves[i].TreeDepth() < leaves[j].TreeDepth()
+	})
+	for _, leaf := range leaves {
+		if leaf.CreatedAt().After(next.NewestLeaf) {
+			next.NewestLeaf = leaf.CreatedAt()
+		}
+		if !full && !leaf.CreatedAt().After(mark.NewestLeaf) {
+			continue
+		}
+		if _, alreadyInStore, err := worker.SubscribableStore.Get(leaf.ID()); err != nil {
+			return mark, fmt.Errorf("failed checking if we already have leaf node %s: %w", leaf.ID(), err)
+		} else if alreadyInStore {
+			continue
+		}
+		if err := worker.IngestNode(leaf); err != nil {
+			return mark, fmt.Errorf("failed ingesting leaf node %s: %w", leaf.ID(), err)
+		}
+	}
+
+	if err := announceLocalLeaves(worker, community, mark.LastSync); err != nil {
+		return mark, err
+	}
+	next.LastSync = time.Now()
+	worker.Printf("Synchronized %s since %v (%d leaves)", community.ID(), mark.NewestLeaf, len(leaves))
+	return next, nil
+}
+
+// announceLocalLeaves tells the relay about local leaves of the community
+// created after the given time.
+func announceLocalLeaves(worker *sprout.Worker, community *forest.Community, since time.Time) error {
+	archive := store.NewArchive(worker.SubscribableStore)
+	localLeaves, err := archive.LeavesOf(community.ID())
+	if err != nil {
+		return fmt.Errorf("couldn't list local leaves of node %s: %w", community.ID(), err)
+	}
+	nodes := make([]forest.Node, 0, len(localLeaves))
+	for _, id := range localLeaves {
+		node, inStore, err := archive.Get(id)
+		if err != nil {
+			return fmt.Errorf("couldn't get local node %s: %w", id, err)
+		} else if inStore && node.CreatedAt().After(since) {
+			nodes = append(nodes, node)
+		}
+	}
+	if len(nodes) < 1 {
+		return nil
+	}
+	if err := worker.SendAnnounce(nodes, makeTicker(worker.DefaultTimeout)); err != nil {
+		return fmt.Errorf("failed announcing available local nodes: %w", err)
+	}
+	return nil
+}
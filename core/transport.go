@@ -0,0 +1,265 @@
+package core
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/proxy"
+	"golang.org/x/net/websocket"
+)
+
+// Transport establishes connections to relays for a particular URL scheme.
+type Transport interface {
+	// Dial connects to the relay described by u. Transports that use TLS
+	// should use the provided config (which may be nil to request the
+	// default configuration).
+	Dial(u *url.URL, config *tls.Config) (net.Conn, error)
+}
+
+// TransportFunc adapts an ordinary function to the Transport interface.
+type TransportFunc func(u *url.URL, config *tls.Config) (net.Conn, error)
+
+// Dial invokes the function.
+func (t TransportFunc) Dial(u *url.URL, config *tls.Config) (net.Conn, error) {
+	return t(u, config)
+}
+
+// DefaultScheme is the transport used for relay addresses that do not
+// specify one.
+const DefaultScheme = "tls"
+
+var (
+	transportLock sync.RWMutex
+	transports    = map[string]Transport{
+		"tls":    TransportFunc(dialTLS),
+		"tcp":    TransportFunc(dialTCP),
+		"unix":   TransportFunc(dialUnix),
+		"ws":     TransportFunc(dialWebsocket),
+		"wss":    TransportFunc(dialWebsocket),
+		"socks5": TransportFunc(dialSOCKS5),
+	}
+)
+
+// RegisterTransport makes a transport available for relay addresses with
+// the given URL scheme, replacing any existing transport for that scheme.
+func RegisterTransport(scheme string, t Transport) {
+	transportLock.Lock()
+	defer transportLock.Unlock()
+	transports[strings.ToLower(scheme)] = t
+}
+
+// ParseRelayAddress interprets a relay address. Addresses may either be
+// URLs like "tcp://localhost:7117" or bare "HOST:PORT" pairs, which use
+// the DefaultScheme.
+func ParseRelayAddress(addr string) (*url.URL, error) {
+	addr = strings.TrimSpace(addr)
+	if !strings.Contains(addr, "://") && !strings.HasPrefix(addr, "unix:") {
+		addr = DefaultScheme + "://" + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid relay address %q: %w", addr, err)
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	return u, nil
+}
+
+// DialRelay connects to the relay at the given address using the transport
+// registered for the address's scheme.
+func DialRelay(addr string, config *tls.Config) (net.Conn, error) {
+	u, err := ParseRelayAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+	transportLock.RLock()
+	t, ok := transports[u.Scheme]
+	transportLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no transport for relay address scheme %q", u.Scheme)
+	}
+	return t.Dial(u, config)
+}
+
+// UsesTLS reports whether connections to the given relay address are
+// protected by TLS.
+func UsesTLS(addr string) bool {
+	u, err := ParseRelayAddress(addr)
+	if err != nil {
+		return false
+	}
+	switch u.Scheme {
+	case "tls", "wss":
+		return true
+	case "socks5":
+		return socksUsesTLS(u)
+	default:
+		return false
+	}
+}
+
+// tlsConfigFor returns a copy of config suitable for connecting to the
+// given host.
+func tlsConfigFor(config *tls.Config, hostport string) *tls.Config {
+	if config == nil {
+		config = &tls.Config{}
+	} else {
+		config = config.Clone()
+	}
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(hostport)
+		if err != nil {
+			host = hostport
+		}
+		config.ServerName = host
+	}
+	return config
+}
+
+// relayHostname returns the name of the host that TLS connections to the
+// given relay address are made to.
+func relayHostname(addr string) string {
+	u, err := ParseRelayAddress(addr)
+	if err != nil {
+		return ""
+	}
+	hostport := u.Host
+	if u.Scheme == "socks5" {
+		// the relay follows the proxy
+		hostport = strings.TrimPrefix(u.Path, "/")
+	}
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return hostport
+	}
+	return host
+}
+
+// requireHost ensures that a URL names a host and port to connect to.
+func requireHost(u *url.URL) error {
+	if u.Host == "" {
+		return fmt.Errorf("relay address %q does not include a host", u.String())
+	}
+	if u.Port() == "" {
+		return fmt.Errorf("relay address %q does not include a port", u.String())
+	}
+	return nil
+}
+
+// dialTLS connects using TLS over TCP.
+func dialTLS(u *url.URL, config *tls.Config) (net.Conn, error) {
+	if err := requireHost(u); err != nil {
+		return nil, err
+	}
+	return tls.Dial("tcp", u.Host, tlsConfigFor(config, u.Host))
+}
+
+// dialTCP connects using unencrypted TCP. This is intended for relays
+// running on the local machine or network.
+func dialTCP(u *url.URL, _ *tls.Config) (net.Conn, error) {
+	if err := requireHost(u); err != nil {
+		return nil, err
+	}
+	return net.Dial("tcp", u.Host)
+}
+
+// dialUnix connects to a unix domain socket. Both "unix:///abs/path" and
+// "unix:relative/path" forms are accepted.
+func dialUnix(u *url.URL, _ *tls.Config) (net.Conn, error) {
+	path := u.Path
+	if u.Opaque != "" {
+		path = u.Opaque
+	} else if u.Host != "" {
+		path = u.Host + u.Path
+	}
+	if path == "" {
+		return nil, fmt.Errorf("relay address %q does not include a socket path", u.String())
+	}
+	return net.Dial("unix", path)
+}
+
+// dialWebsocket tunnels the sprout connection through a WebSocket. This
+// allows reaching relays from networks that only permit HTTP(S) traffic.
+func dialWebsocket(u *url.URL, config *tls.Config) (net.Conn, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("relay address %q does not include a host", u.String())
+	}
+	origin := &url.URL{Scheme: "http", Host: u.Host}
+	if u.Scheme == "wss" {
+		origin.Scheme = "https"
+	}
+	wsConfig, err := websocket.NewConfig(u.String(), origin.String())
+	if err != nil {
+		return nil, fmt.Errorf("configuring websocket for %s: %w", u, err)
+	}
+	if u.Scheme == "wss" {
+		wsConfig.TlsConfig = tlsConfigFor(config, u.Host)
+	}
+	conn, err := websocket.DialConfig(wsConfig)
+	if err != nil {
+		var dialErr *websocket.DialError
+		if errors.As(err, &dialErr) {
+			// expose the underlying error (e.g. a TLS verification
+			// failure) to callers
+			return nil, fmt.Errorf("websocket dial %s: %w", u, dialErr.Err)
+		}
+		return nil, err
+	}
+	conn.PayloadType = websocket.BinaryFrame
+	return conn, nil
+}
+
+// socksUsesTLS reports whether a socks5 relay URL requests TLS to the relay
+// on the far side of the proxy. TLS is used unless the "tls" query parameter
+// is set to a false value.
+func socksUsesTLS(u *url.URL) bool {
+	value := u.Query().Get("tls")
+	if value == "" {
+		return true
+	}
+	useTLS, err := strconv.ParseBool(value)
+	return err != nil || useTLS
+}
+
+// dialSOCKS5 connects through a SOCKS5 proxy. The URL has the form
+// "socks5://[user:password@]proxyhost:port/relayhost:port". The connection
+// to the relay uses TLS unless "?tls=false" is appended.
+func dialSOCKS5(u *url.URL, config *tls.Config) (net.Conn, error) {
+	if err := requireHost(u); err != nil {
+		return nil, err
+	}
+	target := strings.TrimPrefix(u.Path, "/")
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		return nil, fmt.Errorf("relay address %q must name the relay as /HOST:PORT after the proxy: %w", u.String(), err)
+	}
+	var auth *proxy.Auth
+	if u.User != nil {
+		password, _ := u.User.Password()
+		auth = &proxy.Auth{
+			User:     u.User.Username(),
+			Password: password,
+		}
+	}
+	dialer, err := proxy.SOCKS5("tcp", u.Host, auth, proxy.Direct)
+	if err != nil {
+		return nil, fmt.Errorf("configuring socks5 proxy %s: %w", u.Host, err)
+	}
+	conn, err := dialer.Dial("tcp", target)
+	if err != nil {
+		return nil, err
+	}
+	if !socksUsesTLS(u) {
+		return conn, nil
+	}
+	tlsConn := tls.Client(conn, tlsConfigFor(config, target))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
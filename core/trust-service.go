@@ -0,0 +1,252 @@
+package core
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TrustService decides which TLS certificates are acceptable for each relay.
+// The first certificate presented by a relay is pinned, and later
+// connections are refused if the relay presents a different one until the
+// user accepts it. Relays can instead be configured with a custom CA bundle,
+// in which case any certificate issued by that CA is accepted. The methods
+// must be safe for concurrent use.
+type TrustService interface {
+	// TLSConfig returns the TLS configuration to use when connecting to
+	// the given relay address.
+	TLSConfig(address string) *tls.Config
+	// Fingerprint returns the fingerprint of the certificate pinned for
+	// the given address, if any.
+	Fingerprint(address string) (fingerprint string, pinned bool)
+	// AcceptCertificate pins the certificate with the given fingerprint
+	// for the given address, replacing any existing pin.
+	AcceptCertificate(address, fingerprint string) error
+	// Forget removes any pinned certificate for the given address.
+	Forget(address string) error
+	// SetCABundle reads a PEM-encoded CA bundle from the provided path and
+	// uses it to verify the given relay instead of a pinned certificate.
+	SetCABundle(address, path string) error
+	// ClearCABundle removes any custom CA bundle for the given relay.
+	ClearCABundle(address string) error
+	// HasCABundle returns whether the given relay is verified using a
+	// custom CA bundle.
+	HasCABundle(address string) bool
+}
+
+// CertificateMismatchError is returned when a relay presents a certificate
+// that differs from the one pinned for it.
+type CertificateMismatchError struct {
+	Address  string
+	Expected string
+	Actual   string
+}
+
+func (c *CertificateMismatchError) Error() string {
+	return fmt.Sprintf("certificate for %s changed: expected fingerprint %s, got %s", c.Address, c.Expected, c.Actual)
+}
+
+// RelayTrust records the trust decisions made for a single relay.
+type RelayTrust struct {
+	// hex-encoded SHA-256 fingerprint of the relay's pinned certificate
+	Fingerprint string    `json:",omitempty"`
+	PinnedAt    time.Time `json:",omitempty"`
+	// PEM-encoded CA certificates used to verify the relay instead of the
+	// pinned certificate
+	CABundle string `json:",omitempty"`
+}
+
+type trustService struct {
+	sync.Mutex
+	path   string
+	relays map[string]RelayTrust
+}
+
+var _ TrustService = &trustService{}
+
+func newTrustService(stateDir string) (TrustService, error) {
+	t := &trustService{
+		path:   filepath.Join(stateDir, "trusted-relays.json"),
+		relays: make(map[string]RelayTrust),
+	}
+	data, err := ioutil.ReadFile(t.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return t, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed reading trusted relays: %w", err)
+	}
+	if err := json.Unmarshal(data, &t.relays); err != nil {
+		return nil, fmt.Errorf("failed parsing trusted relays: %w", err)
+	}
+	return t, nil
+}
+
+// CertificateFingerprint returns the fingerprint used to pin a certificate.
+func CertificateFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// FormatFingerprint makes a fingerprint easier to compare by eye.
+func FormatFingerprint(fingerprint string) string {
+	var parts []string
+	for len(fingerprint) > 2 {
+		parts = append(parts, fingerprint[:2])
+		fingerprint = fingerprint[2:]
+	}
+	parts = append(parts, fingerprint)
+	return strings.ToUpper(strings.Join(parts, ":"))
+}
+
+func (t *trustService) TLSConfig(address string) *tls.Config {
+	host := relayHostname(address)
+	return &tls.Config{
+		ServerName: host,
+		// Verification is performed by VerifyConnection so that
+		// self-signed certificates can be pinned.
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			return t.verify(address, host, state)
+		},
+	}
+}
+
+// verify checks the certificates presented by a relay for the given host.
+// Relays with a CA bundle must present a certificate issued by it. Others
+// must present the certificate pinned for them, which is the first one
+// they presented.
+func (t *trustService) verify(address, host string, state tls.ConnectionState) error {
+	if len(state.PeerCertificates) < 1 {
+		return fmt.Errorf("relay %s presented no certificates", address)
+	}
+	leaf := state.PeerCertificates[0]
+	t.Lock()
+	trust := t.relays[address]
+	t.Unlock()
+	if trust.CABundle != "" {
+		options := x509.VerifyOptions{
+			DNSName:       host,
+			Roots:         x509.NewCertPool(),
+			Intermediates: x509.NewCertPool(),
+		}
+		for _, cert := range state.PeerCertificates[1:] {
+			options.Intermediates.AddCert(cert)
+		}
+		if !options.Roots.AppendCertsFromPEM([]byte(trust.CABundle)) {
+			return fmt.Errorf("CA bundle for %s contains no certificates", address)
+		}
+		if _, err := leaf.Verify(options); err != nil {
+			return fmt.Errorf("verifying %s with custom CA bundle: %w", address, err)
+		}
+		return nil
+	}
+	fingerprint := CertificateFingerprint(leaf)
+	if trust.Fingerprint == "" {
+		err := t.update(address, func(trust *RelayTrust) {
+			// another connection may have pinned a certificate meanwhile
+			if trust.Fingerprint == "" {
+				trust.Fingerprint = fingerprint
+				trust.PinnedAt = time.Now()
+			}
+		})
+		if err != nil {
+			log.Printf("failed saving certificate pinned for %s: %v", address, err)
+		}
+		t.Lock()
+		trust = t.relays[address]
+		t.Unlock()
+	}
+	if trust.Fingerprint != fingerprint {
+		return &CertificateMismatchError{
+			Address:  address,
+			Expected: trust.Fingerprint,
+			Actual:   fingerprint,
+		}
+	}
+	return nil
+}
+
+func (t *trustService) Fingerprint(address string) (string, bool) {
+	t.Lock()
+	defer t.Unlock()
+	trust, ok := t.relays[address]
+	return trust.Fingerprint, ok && trust.Fingerprint != ""
+}
+
+func (t *trustService) AcceptCertificate(address, fingerprint string) error {
+	return t.update(address, func(trust *RelayTrust) {
+		trust.Fingerprint = fingerprint
+		trust.PinnedAt = time.Now()
+	})
+}
+
+func (t *trustService) Forget(address string) error {
+	return t.update(address, func(trust *RelayTrust) {
+		trust.Fingerprint = ""
+		trust.PinnedAt = time.Time{}
+	})
+}
+
+func (t *trustService) SetCABundle(address, path string) error {
+	bundle, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed reading CA bundle: %w", err)
+	}
+	if !x509.NewCertPool().AppendCertsFromPEM(bundle) {
+		return fmt.Errorf("%s contains no PEM-encoded certificates", path)
+	}
+	return t.update(address, func(trust *RelayTrust) {
+		trust.CABundle = string(bundle)
+	})
+}
+
+func (t *trustService) ClearCABundle(address string) error {
+	return t.update(address, func(trust *RelayTrust) {
+		trust.CABundle = ""
+	})
+}
+
+func (t *trustService) HasCABundle(address string) bool {
+	t.Lock()
+	defer t.Unlock()
+	return t.relays[address].CABundle != ""
+}
+
+// update applies the modification to the trust for address and saves the
+// result.
+func (t *trustService) update(address string, modify func(*RelayTrust)) error {
+	t.Lock()
+	defer t.Unlock()
+	trust := t.relays[address]
+	modify(&trust)
+	if trust == (RelayTrust{}) {
+		delete(t.relays, address)
+	} else {
+		t.relays[address] = trust
+	}
+	return t.persist()
+}
+
+// persist writes the trust store to disk. It must be called with the lock
+// held.
+func (t *trustService) persist() error {
+	data, err := json.MarshalIndent(t.relays, "", "  ")
+	if err != nil {
+		return fmt.Errorf("couldn't marshal trusted relays as json: %w", err)
+	}
+	if err := ioutil.WriteFile(t.path, data, 0660); err != nil {
+		return fmt.Errorf("couldn't save trusted relays: %w", err)
+	}
+	return nil
+}
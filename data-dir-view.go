@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"gioui.org/layout"
+	"gioui.org/unit"
+	"gioui.org/widget"
+	"gioui.org/widget/material"
+	materials "gioui.org/x/component"
+	"git.sr.ht/~whereswaldon/sprig/core"
+)
+
+// DataDirView chooses the directory holding the message store after the
+// configured one could not be opened.
+type DataDirView struct {
+	manager ViewManager
+
+	Path                     materials.TextField
+	UseButton, DefaultButton widget.Clickable
+	Status                   string
+
+	core.App
+}
+
+var _ View = &DataDirView{}
+
+func NewDataDirView(app core.App) View {
+	c := &DataDirView{
+		App: app,
+	}
+	c.Path.SingleLine = true
+	c.Path.Submit = true
+	return c
+}
+
+func (c *DataDirView) HandleIntent(intent Intent) {}
+
+func (c *DataDirView) BecomeVisible() {
+	c.Path.SetText(c.Settings().DataPath())
+	c.Status = ""
+}
+
+func (c *DataDirView) NavItem() *materials.NavItem {
+	return nil
+}
+
+func (c *DataDirView) AppBarData() (bool, string, []materials.AppBarAction, []materials.OverflowAction) {
+	return true, "Message Storage", nil, nil
+}
+
+func (c *DataDirView) SetManager(mgr ViewManager) {
+	c.manager = mgr
+}
+
+// use stores messages in path, which restores the default directory if it
+// is empty.
+func (c *DataDirView) use(path string) {
+	if path != "" {
+		if err := os.MkdirAll(path, 0770); err != nil {
+			c.Status = "Failed: " + err.Error()
+			return
+		}
+	}
+	c.Settings().SetDataPath(path)
+	if err := c.Arbor().RetryStore(); err != nil {
+		c.Status = "Failed: " + err.Error()
+		return
+	}
+	if err := c.Settings().Persist(); err != nil {
+		c.Status = "Messages are saved, but the directory could not be remembered: " + err.Error()
+		return
+	}
+	c.manager.HandleBackNavigation()
+}
+
+func (c *DataDirView) Update(gtx layout.Context) {
+	for _, e := range c.Path.Events() {
+		if _, ok := e.(widget.SubmitEvent); ok {
+			c.use(c.Path.Text())
+		}
+	}
+	if c.UseButton.Clicked(gtx) {
+		c.use(c.Path.Text())
+	}
+	if c.DefaultButton.Clicked(gtx) {
+		c.use("")
+	}
+}
+
+func (c *DataDirView) Layout(gtx layout.Context) layout.Dimensions {
+	theme := c.Theme().Current().Theme
+	inset := layout.UniformInset(unit.Dp(4))
+	explanation := "Messages are being saved."
+	if err := c.Arbor().StoreError(); err != nil {
+		explanation = fmt.Sprintf("Messages cannot be saved: %v. Choose a directory to store them in. Messages received so far will be saved there.", err)
+	}
+	return layout.UniformInset(unit.Dp(8)).Layout(gtx, func(gtx C) D {
+		return layout.Flex{Axis: layout.Vertical}.Layout(gtx,
+			layout.Rigid(func(gtx C) D {
+				return inset.Layout(gtx, material.Body1(theme, explanation).Layout)
+			}),
+			layout.Rigid(func(gtx C) D {
+				return inset.Layout(gtx, func(gtx C) D {
+					return c.Path.Layout(gtx, theme, "Directory")
+				})
+			}),
+			layout.Rigid(func(gtx C) D {
+				return layout.Flex{Alignment: layout.Middle}.Layout(gtx,
+					layout.Rigid(func(gtx C) D {
+						return inset.Layout(gtx, material.Button(theme, &c.UseButton, "Use this directory").Layout)
+					}),
+					layout.Rigid(func(gtx C) D {
+						return inset.Layout(gtx, material.Button(theme, &c.DefaultButton, "Use default directory").Layout)
+					}),
+				)
+			}),
+			layout.Rigid(func(gtx C) D {
+				if c.Status == "" {
+					return D{}
+				}
+				return inset.Layout(gtx, material.Body2(theme, c.Status).Layout)
+			}),
+		)
+	})
+}
+
+// reportStoreError displays a banner explaining that messages cannot be
+// saved, offering to retry, to choose another directory, or to carry on
+// with messages held in memory.
+func reportStoreError(app core.App, vm ViewManager) {
+	err := app.Arbor().StoreError()
+	if err == nil {
+		return
+	}
+	app.Banner().Add(&core.ActionBanner{
+		Priority: core.Error,
+		Text:     fmt.Sprintf("Messages cannot be saved and will be lost when sprig exits: %v", err),
+		Actions: []core.BannerAction{
+			{
+				Label: "Retry",
+				Do: func() {
+					if err := app.Arbor().RetryStore(); err != nil {
+						reportStoreError(app, vm)
+					}
+				},
+			},
+			{
+				Label: "Choose directory",
+				Do: func() {
+					vm.RequestViewSwitch(DataDirViewID)
+				},
+			},
+			{
+				Label: "Continue without saving",
+			},
+		},
+	})
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"gioui.org/layout"
+	"gioui.org/op"
+	"gioui.org/unit"
+	"gioui.org/widget"
+	"gioui.org/widget/material"
+	materials "gioui.org/x/component"
+	"git.sr.ht/~whereswaldon/sprig/core"
+	"git.sr.ht/~whereswaldon/sprig/icons"
+)
+
+// DiagnosticsView displays live traffic statistics for each relay
+// connection.
+type DiagnosticsView struct {
+	manager ViewManager
+
+	core.App
+
+	widget.List
+}
+
+var _ View = &DiagnosticsView{}
+
+// diagnosticsRefreshInterval is how often the statistics are redrawn while
+// the view is visible.
+const diagnosticsRefreshInterval = time.Second
+
+func NewDiagnosticsView(app core.App) View {
+	c := &DiagnosticsView{
+		App: app,
+	}
+	c.List.Axis = layout.Vertical
+	return c
+}
+
+func (c *DiagnosticsView) HandleIntent(intent Intent) {}
+
+func (c *DiagnosticsView) AppBarData() (bool, string, []materials.AppBarAction, []materials.OverflowAction) {
+	return true, "Diagnostics", []materials.AppBarAction{}, []materials.OverflowAction{}
+}
+
+func (c *DiagnosticsView) NavItem() *materials.NavItem {
+	return &materials.NavItem{
+		Name: "Diagnostics",
+		Icon: icons.DiagnosticsIcon,
+	}
+}
+
+func (c *DiagnosticsView) Update(gtx layout.Context) {}
+
+func (c *DiagnosticsView) BecomeVisible() {}
+
+func (c *DiagnosticsView) SetManager(mgr ViewManager) {
+	c.manager = mgr
+}
+
+// relays returns the addresses of all configured or connected relays.
+func (c *DiagnosticsView) relays() []string {
+	seen := map[string]bool{}
+	var out []string
+	for _, addr := range append(c.Settings().Addresses(), c.Sprout().Connections()...) {
+		if !seen[addr] {
+			seen[addr] = true
+			out = append(out, addr)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+func (c *DiagnosticsView) Layout(gtx layout.Context) layout.Dimensions {
+	op.InvalidateOp{At: gtx.Now.Add(diagnosticsRefreshInterval)}.Add(gtx.Ops)
+	theme := c.Theme().Current().Theme
+	relays := c.relays()
+	if len(relays) < 1 {
+		return layout.UniformInset(unit.Dp(8)).Layout(gtx, material.Body1(theme, "No relays configured.").Layout)
+	}
+	sections := make([]Section, 0, len(relays))
+	for _, addr := range relays {
+		sections = append(sections, Section{
+			Theme:   theme,
+			Heading: addr,
+			Items:   diagnosticsItems(theme, gtx.Now, c.Sprout().State(addr), c.Sprout().Metrics(addr)),
+		})
+	}
+	return material.List(theme, &c.List).Layout(gtx, len(sections), func(gtx C, index int) D {
+		return layout.UniformInset(unit.Dp(8)).Layout(gtx, sections[index].Layout)
+	})
+}
+
+// diagnosticsItems presents the statistics for a single relay.
+func diagnosticsItems(theme *material.Theme, now time.Time, status core.RelayStatus, metrics core.RelayMetrics) []layout.Widget {
+	connected := "never"
+	if !metrics.ConnectedAt.IsZero() {
+		connected = fmt.Sprintf("%s (%v ago, %d connections)",
+			metrics.ConnectedAt.Local().Format("2006/01/02 15:04:05"),
+			now.Sub(metrics.ConnectedAt).Round(time.Second),
+			metrics.Connections)
+	}
+	latency := "no samples"
+	if metrics.Latency.Samples > 0 {
+		latency = fmt.Sprintf("last %v, average %v, max %v over %d requests",
+			metrics.Latency.Last.Round(time.Millisecond),
+			metrics.Latency.Average().Round(time.Millisecond),
+			metrics.Latency.Max.Round(time.Millisecond),
+			metrics.Latency.Samples)
+	}
+	lines := [][2]string{
+		{"State", status.State.String()},
+		{"Connected", connected},
+		{"Messages sent", formatVerbCounts(metrics.Sent)},
+		{"Messages received", formatVerbCounts(metrics.Received)},
+		{"Nodes ingested", fmt.Sprintf("%d", metrics.NodesIngested)},
+		{"Bytes transferred", fmt.Sprintf("%s sent, %s received", formatBytes(metrics.BytesSent), formatBytes(metrics.BytesReceived))},
+		{"Round-trip latency", latency},
+	}
+	items := make([]layout.Widget, 0, len(lines)+len(metrics.RecentErrors)+1)
+	for _, line := range lines {
+		label, value := line[0], line[1]
+		items = append(items, func(gtx C) D {
+			return itemInset.Layout(gtx, func(gtx C) D {
+				return layout.Flex{}.Layout(gtx,
+					layout.Flexed(.35, material.Body2(theme, label).Layout),
+					layout.Flexed(.65, material.Body2(theme, value).Layout),
+				)
+			})
+		})
+	}
+	if len(metrics.RecentErrors) > 0 {
+		items = append(items, func(gtx C) D {
+			return itemInset.Layout(gtx, material.Body2(theme, "Recent errors").Layout)
+		})
+	}
+	for i := len(metrics.RecentErrors) - 1; i >= 0; i-- {
+		e := metrics.RecentErrors[i]
+		text := fmt.Sprintf("%s %v", e.At.Local().Format("15:04:05"), e.Err)
+		items = append(items, func(gtx C) D {
+			return itemInset.Layout(gtx, material.Caption(theme, text).Layout)
+		})
+	}
+	return items
+}
+
+// formatVerbCounts summarizes protocol message counts by verb.
+func formatVerbCounts(counts map[string]int) string {
+	if len(counts) < 1 {
+		return "none"
+	}
+	verbs := make([]string, 0, len(counts))
+	for verb := range counts {
+		verbs = append(verbs, verb)
+	}
+	sort.Strings(verbs)
+	parts := make([]string, 0, len(verbs))
+	for _, verb := range verbs {
+		parts = append(parts, fmt.Sprintf("%s: %d", verb, counts[verb]))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// formatBytes renders a byte count with a binary unit suffix.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"log"
+
+	"gioui.org/layout"
+	"gioui.org/widget"
+	"gioui.org/widget/material"
+	"git.sr.ht/~whereswaldon/sprig/core"
+)
+
+// DiscoveredRelayList holds the UI state for choosing among the relays
+// discovered on the local network.
+type DiscoveredRelayList struct {
+	Search widget.Clickable
+	// choices maps relay addresses to their buttons.
+	choices map[string]*widget.Clickable
+}
+
+// Update handles clicks on the list. It returns the address of the relay
+// that was chosen, if any.
+func (d *DiscoveredRelayList) Update(gtx C, discovery core.DiscoveryService) (address string, chosen bool) {
+	if d.Search.Clicked(gtx) {
+		go func() {
+			if err := discovery.Browse(); err != nil {
+				log.Printf("failed browsing for local relays: %v", err)
+			}
+		}()
+	}
+	for addr, choice := range d.choices {
+		if choice.Clicked(gtx) {
+			address, chosen = addr, true
+		}
+	}
+	return address, chosen
+}
+
+// Items returns a widget for each discovered relay whose address is not
+// in exclude, followed by a button to search again.
+func (d *DiscoveredRelayList) Items(theme *material.Theme, relays []core.DiscoveredRelay, exclude []string) []layout.Widget {
+	if d.choices == nil {
+		d.choices = make(map[string]*widget.Clickable)
+	}
+	skip := make(map[string]bool, len(exclude))
+	for _, addr := range exclude {
+		skip[addr] = true
+	}
+	var items []layout.Widget
+	for _, relay := range relays {
+		relay := relay
+		addr := relay.Address()
+		if skip[addr] {
+			continue
+		}
+		choice, ok := d.choices[addr]
+		if !ok {
+			choice = new(widget.Clickable)
+			d.choices[addr] = choice
+		}
+		security := "no TLS"
+		if relay.TLS {
+			security = "TLS"
+		}
+		items = append(items, func(gtx C) D {
+			return material.Clickable(gtx, choice, func(gtx C) D {
+				return itemInset.Layout(gtx, func(gtx C) D {
+					return layout.Flex{Alignment: layout.Middle}.Layout(gtx,
+						layout.Flexed(1, func(gtx C) D {
+							return layout.Flex{Axis: layout.Vertical}.Layout(gtx,
+								layout.Rigid(material.Body1(theme, relay.Name).Layout),
+								layout.Rigid(material.Caption(theme, addr).Layout),
+							)
+						}),
+						layout.Rigid(material.Body2(theme, security).Layout),
+					)
+				})
+			})
+		})
+	}
+	label := "Search local network"
+	if len(items) > 0 {
+		label = "Search again"
+	}
+	items = append(items, func(gtx C) D {
+		return itemInset.Layout(gtx, material.Button(theme, &d.Search, label).Layout)
+	})
+	return items
+}
@@ -9,7 +9,6 @@ import (
 	"sync"
 	"time"
 
-	"git.sr.ht/~gioverse/chat/list"
 	forest "git.sr.ht/~whereswaldon/forest-go"
 	"git.sr.ht/~whereswaldon/forest-go/fields"
 	"git.sr.ht/~whereswaldon/forest-go/store"
@@ -53,6 +52,16 @@ func (c *CommunityList) IndexForID(id *fields.QualifiedHash) int {
 	return c.nodelist.IndexForID(id)
 }
 
+// Insert adds communities to the list that were not announced by the store,
+// ignoring any already present.
+func (c *CommunityList) Insert(communities ...*forest.Community) {
+	nodes := make([]forest.Node, len(communities))
+	for i, community := range communities {
+		nodes[i] = community
+	}
+	c.nodelist.Insert(nodes...)
+}
+
 // WithCommunities executes an arbitrary closure with access to the communities stored
 // inside of the CommunitList. The closure must not modify the slice that it is
 // given.
@@ -80,11 +89,15 @@ type ReplyData struct {
 	CreatedAt      time.Time
 	Content        string
 	Metadata       *twig.Data
+	// Signature records whether the reply's signature was verified against
+	// its author when it was populated.
+	Signature SignatureStatus
 }
 
 // populate populates the the fields of a ReplyData object from a given node and a store.
 // It can be used on an unfilled ReplyData instance in place of a constructor. It returns
-// false if the node cannot be processed into ReplyData
+// false if the node cannot be processed into ReplyData or its signature is invalid, in
+// which case the node should not be displayed.
 func (r *ReplyData) Populate(reply forest.Node, store store.ExtendedStore) bool {
 	asReply, ok := reply.(*forest.Reply)
 	if !ok {
@@ -118,25 +131,20 @@ func (r *ReplyData) Populate(reply forest.Node, store store.ExtendedStore) bool
 	r.CommunityName = string(asCommunity.Name.Blob)
 
 	author, has, err := store.GetIdentity(&asReply.Author)
-	if err != nil || !has {
+	if err != nil {
 		return false
+	} else if !has {
+		// the author may arrive later, so show the reply without vouching
+		// for it
+		r.AuthorName = ""
+		r.Signature = SignatureUnverifiable
+		return true
 	}
 	asAuthor := author.(*forest.Identity)
 	r.AuthorName = string(asAuthor.Name.Blob)
+	r.Signature = verifySignature(asReply, asAuthor)
 
-	return true
-}
-
-// ensure ReplyData satisfies list.Element.
-var _ list.Element = ReplyData{}
-
-// Serial returns a unique identifier for this ReplyData which can be used for
-// dynamic list state management.
-func (r ReplyData) Serial() list.Serial {
-	if r.ID != nil {
-		return list.Serial(r.ID.String())
-	}
-	return list.NoSerial
+	return r.Signature != SignatureInvalid
 }
 
 // NodeList implements a generic data structure for storing ordered lists of forest nodes.
@@ -0,0 +1,88 @@
+package ds
+
+import (
+	"git.sr.ht/~whereswaldon/forest-go/fields"
+	"git.sr.ht/~whereswaldon/forest-go/store"
+)
+
+// FocusTracker keeps track of which message (if any) is focused and the status
+// of ancestor/descendant messages relative to that message.
+type FocusTracker struct {
+	Pending     *ReplyData
+	Focused     *ReplyData
+	Ancestry    []*fields.QualifiedHash
+	Descendants []*fields.QualifiedHash
+	// Whether the Ancestry and Descendants need to be regenerated because the
+	// contents of the replylist changed
+	stateRefreshNeeded bool
+}
+
+// SetFocus requests that the provided ReplyData become the focused message.
+func (f *FocusTracker) SetFocus(focused *ReplyData) {
+	f.stateRefreshNeeded = true
+	f.Focused = focused
+}
+
+// SetFocusDeferred requests that the provided ReplyData become the focused message
+// at the next state refresh.
+func (f *FocusTracker) SetFocusDeferred(focused *ReplyData) {
+	f.stateRefreshNeeded = true
+	f.Pending = focused
+}
+
+// Invalidate notifies the FocusTracker that its Ancestry and Descendants lists
+// are possibly incorrect as a result of a state change elsewhere.
+func (f *FocusTracker) Invalidate() {
+	f.stateRefreshNeeded = true
+}
+
+// RefreshNodeStatus updates the Ancestry and Descendants of the FocusTracker
+// using the provided store to look them up. If the FocusTracker has not been
+// invalidated since this method was last invoked, this method will return
+// false and do nothing.
+func (f *FocusTracker) RefreshNodeStatus(s store.ExtendedStore) bool {
+	if f.stateRefreshNeeded {
+		f.stateRefreshNeeded = false
+		if f.Pending != nil {
+			f.Focused, f.Pending = f.Pending, nil
+		}
+		if f.Focused == nil {
+			f.Ancestry = nil
+			f.Descendants = nil
+			return true
+		}
+		f.Ancestry, _ = s.AncestryOf(f.Focused.ID)
+		f.Descendants, _ = s.DescendantsOf(f.Focused.ID)
+		return true
+	}
+	return false
+}
+
+// StatusFor returns one of these statuses for a ReplyData, depending on
+// what is currently focused:
+// - Selected
+// - Ancestor
+// - Descendant
+func (f *FocusTracker) StatusFor(rd ReplyData) (status ReplyStatus) {
+	if f.Focused == nil || f.Focused.ID == nil {
+		return
+	}
+	if rd.ID.Equals(f.Focused.ID) {
+		return Selected
+	}
+	for _, id := range f.Ancestry {
+		if id.Equals(rd.ID) {
+			return Ancestor
+		}
+	}
+	for _, id := range f.Descendants {
+		if id.Equals(rd.ID) {
+			return Descendant
+		}
+	}
+	if f.Focused.ConversationID != nil &&
+		f.Focused.ConversationID.Equals(rd.ConversationID) {
+		return Sibling
+	}
+	return
+}
@@ -5,6 +5,7 @@ import (
 	"sync"
 
 	"git.sr.ht/~whereswaldon/forest-go/fields"
+	"git.sr.ht/~whereswaldon/forest-go/store"
 )
 
 // sortable is a slice of reply data that conforms to the sort.Interface
@@ -86,6 +87,22 @@ func (s *sortable) Insert(nodes ...ReplyData) {
 	s.Sort()
 }
 
+// remove deletes the replies for which discard returns true.
+func (s *sortable) remove(discard func(ReplyData) bool) {
+	s.initialize()
+	kept := s.data[:0]
+	for _, rd := range s.data {
+		if !discard(rd) {
+			kept = append(kept, rd)
+		}
+	}
+	s.data = kept
+	s.indexForID = make(map[string]int, len(kept))
+	for i := range s.data {
+		s.ensureIndexed(i)
+	}
+}
+
 // AlphaReplyList creates a thread-safe list of ReplyData that maintains its
 // internal sort order and supports looking up the index of specific nodes.
 // It enforces uniqueness on the nodes it contains
@@ -119,6 +136,37 @@ func (r *AlphaReplyList) Insert(nodes ...ReplyData) {
 	})
 }
 
+// RecheckAuthor populates the replies by author again if their signatures
+// could not be checked, for use once the author's identity is stored.
+// Replies whose signatures turn out to be invalid are removed.
+func (r *AlphaReplyList) RecheckAuthor(author *fields.QualifiedHash, s store.ExtendedStore) {
+	r.asWritable(func() {
+		invalid := false
+		for i := range r.data {
+			rd := &r.data[i]
+			if rd.Signature != SignatureUnverifiable || !rd.AuthorID.Equals(author) {
+				continue
+			}
+			node, has, err := s.Get(rd.ID)
+			if err != nil || !has {
+				continue
+			}
+			var updated ReplyData
+			if updated.Populate(node, s) {
+				*rd = updated
+			} else if updated.Signature == SignatureInvalid {
+				rd.Signature = SignatureInvalid
+				invalid = true
+			}
+		}
+		if invalid {
+			r.sortable.remove(func(rd ReplyData) bool {
+				return rd.Signature == SignatureInvalid
+			})
+		}
+	})
+}
+
 // IndexForID returns the index at which the given ID's data is stored.
 // It is safe (and recommended) to call this function from within the function
 // passed to WithReplies(), as otherwise the node may by moved by another
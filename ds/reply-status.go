@@ -0,0 +1,54 @@
+package ds
+
+import "strings"
+
+// ReplyStatus describes how a reply relates to the focused reply and
+// whether it is hidden.
+type ReplyStatus int
+
+const (
+	None ReplyStatus = 1 << iota
+	Sibling
+	Selected
+	Ancestor
+	Descendant
+	ConversationRoot
+	// Anchor indicates that this node is visible, but its descendants have been
+	// hidden.
+	Anchor
+	// Hidden indicates that this node is not currently visible.
+	Hidden
+)
+
+func (r ReplyStatus) Contains(other ReplyStatus) bool {
+	return r&other > 0
+}
+
+func (r ReplyStatus) String() string {
+	var out []string
+	if r.Contains(None) {
+		out = append(out, "None")
+	}
+	if r.Contains(Sibling) {
+		out = append(out, "Sibling")
+	}
+	if r.Contains(Selected) {
+		out = append(out, "Selected")
+	}
+	if r.Contains(Ancestor) {
+		out = append(out, "Ancestor")
+	}
+	if r.Contains(Descendant) {
+		out = append(out, "Descendant")
+	}
+	if r.Contains(ConversationRoot) {
+		out = append(out, "ConversationRoot")
+	}
+	if r.Contains(Anchor) {
+		out = append(out, "Anchor")
+	}
+	if r.Contains(Hidden) {
+		out = append(out, "Hidden")
+	}
+	return strings.Join(out, "|")
+}
@@ -0,0 +1,80 @@
+package ds
+
+import (
+	"log"
+	"sync"
+
+	"git.sr.ht/~whereswaldon/forest-go"
+)
+
+// SignatureStatus describes whether the signature on a node was checked
+// against the identity of its author.
+type SignatureStatus int
+
+const (
+	// SignatureUnchecked indicates that the signature has not been
+	// checked, as in a ReplyData that was never populated.
+	SignatureUnchecked SignatureStatus = iota
+	// SignatureVerified indicates that the node was signed by its author.
+	SignatureVerified
+	// SignatureUnverifiable indicates that the author's identity is not in
+	// the store, so the signature could not be checked.
+	SignatureUnverifiable
+	// SignatureInvalid indicates that the signature does not match the
+	// author's identity. Such nodes may have been forged or corrupted.
+	SignatureInvalid
+)
+
+func (s SignatureStatus) String() string {
+	switch s {
+	case SignatureUnchecked:
+		return "unchecked"
+	case SignatureVerified:
+		return "verified"
+	case SignatureUnverifiable:
+		return "unverifiable"
+	case SignatureInvalid:
+		return "invalid"
+	default:
+		return "unknown"
+	}
+}
+
+// maxCachedSignatures bounds the number of signature checks remembered.
+const maxCachedSignatures = 1 << 14
+
+// signatureCache remembers the outcome of signature checks. A node's ID
+// covers its signature, so the outcome for an ID never changes once the
+// author is known.
+var signatureCache = struct {
+	sync.RWMutex
+	results map[string]SignatureStatus
+}{results: make(map[string]SignatureStatus)}
+
+// verifySignature checks the signature of reply against its author,
+// consulting and filling the cache.
+func verifySignature(reply *forest.Reply, author *forest.Identity) SignatureStatus {
+	id := reply.ID().String()
+	signatureCache.RLock()
+	status, cached := signatureCache.results[id]
+	signatureCache.RUnlock()
+	if cached {
+		return status
+	}
+	status = SignatureVerified
+	if valid, err := forest.ValidateSignature(reply, author); err != nil || !valid {
+		log.Printf("rejecting node %s with invalid signature: %v", id, err)
+		status = SignatureInvalid
+	}
+	signatureCache.Lock()
+	if len(signatureCache.results) >= maxCachedSignatures {
+		// forget an arbitrary result to make room
+		for cached := range signatureCache.results {
+			delete(signatureCache.results, cached)
+			break
+		}
+	}
+	signatureCache.results[id] = status
+	signatureCache.Unlock()
+	return status
+}
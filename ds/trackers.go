@@ -123,7 +123,7 @@ func (h *HiddenTracker) process(node forest.Node) {
 func (h *HiddenTracker) Reveal(id *fields.QualifiedHash) {
 	h.Lock()
 	defer h.Unlock()
-	h.Reveal(id)
+	h.reveal(id)
 }
 
 func (h *HiddenTracker) reveal(id *fields.QualifiedHash) {
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"image"
 	"log"
 	"runtime"
@@ -55,7 +56,7 @@ type DynamicChatView struct {
 	// FocusAnimation is the shared animation state for all messages.
 	FocusAnimation anim.Normal
 
-	FocusTracker
+	ds.FocusTracker
 
 	BackgroundClick gesture.Click
 
@@ -87,8 +88,8 @@ func NewDynamicChatView(app core.App) View {
 			return &sprigwidget.Reply{}
 		},
 		Comparator: func(a, b list.Element) bool {
-			aRD := a.(ds.ReplyData)
-			bRD := b.(ds.ReplyData)
+			aRD := a.(chatElement)
+			bRD := b.(chatElement)
 			return aRD.CreatedAt.Before(bRD.CreatedAt)
 		},
 		Synthesizer: func(prev, current, next list.Element) []list.Element {
@@ -118,7 +119,7 @@ func (c *DynamicChatView) handleNewNode(node forest.Node) {
 			if !rd.Populate(node, c.Arbor().Store()) {
 				return
 			}
-			c.chatManager.Modify([]list.Element{rd}, nil, nil)
+			c.chatManager.Modify([]list.Element{chatElement{rd}}, nil, nil)
 			c.FocusTracker.Invalidate()
 			c.manager.RequestInvalidate()
 		default:
@@ -162,8 +163,12 @@ func (c *DynamicChatView) sendMessage() {
 	replyText = strings.TrimSpace(replyText)
 
 	nodeBuilder, err := c.Settings().Builder()
-	if err != nil {
+	if errors.Is(err, core.ErrKeyLocked) {
+		c.manager.RequestViewSwitch(UnlockViewID)
+		return
+	} else if err != nil {
 		log.Printf("failed acquiring node builder: %v", err)
+		return
 	}
 	author = nodeBuilder.User
 	if c.ReplyingTo == nil {
@@ -206,20 +211,12 @@ func (c *DynamicChatView) sendMessage() {
 	c.postReplies(author, newReplies)
 }
 
-// postReplies actually adds the replies to the store of history (and
-// causes them to be sent because the sprout working is watching the
-// store for updates).
+// postReplies hands the replies to the outbox, which adds them to the
+// store of history and tracks their delivery to relays.
 func (c *DynamicChatView) postReplies(author *forest.Identity, replies []*forest.Reply) {
 	go func() {
-		for _, reply := range replies {
-			if err := c.Arbor().Store().Add(author); err != nil {
-				log.Printf("failed adding replying identity to store: %v", err)
-				return
-			}
-			if err := c.Arbor().Store().Add(reply); err != nil {
-				log.Printf("failed adding reply to store: %v", err)
-				return
-			}
+		if err := c.Outbox().Post(author, replies...); err != nil {
+			log.Printf("failed posting replies: %v", err)
 		}
 	}()
 }
@@ -285,7 +282,7 @@ func (c *DynamicChatView) Update(gtx layout.Context) {
 	c.Hint = ""
 
 	for _, e := range elements {
-		element, ok := e.(ds.ReplyData)
+		element, ok := e.(chatElement)
 		if !ok {
 			continue
 		}
@@ -295,7 +292,7 @@ func (c *DynamicChatView) Update(gtx layout.Context) {
 		}
 		switch state := state.(type) {
 		case *sprigwidget.Reply:
-			c.processReplyStateUpdates(gtx, element, state)
+			c.processReplyStateUpdates(gtx, element.ReplyData, state)
 		}
 	}
 
@@ -332,11 +329,11 @@ func (c *DynamicChatView) moveFocusUp(gtx layout.Context) {
 searchLoop:
 	for _, e := range elements {
 		switch e := e.(type) {
-		case ds.ReplyData:
+		case chatElement:
 			if c.Focused.ID.Equals(e.ID) {
 				break searchLoop
 			} else {
-				lastElement = &e
+				lastElement = &e.ReplyData
 			}
 		}
 	}
@@ -359,11 +356,11 @@ func (c *DynamicChatView) moveFocusDown(gtx layout.Context) {
 	var foundFocused bool
 	for _, e := range elements {
 		switch e := e.(type) {
-		case ds.ReplyData:
+		case chatElement:
 			if c.Focused.ID.Equals(e.ID) {
 				foundFocused = true
 			} else if foundFocused {
-				c.SetFocus(&e)
+				c.SetFocus(&e.ReplyData)
 				return
 			}
 		}
@@ -376,8 +373,8 @@ func (c *DynamicChatView) moveFocusStart(gtx layout.Context) {
 	elements := c.chatManager.ManagedElements(gtx)
 	for _, e := range elements {
 		switch e := e.(type) {
-		case ds.ReplyData:
-			c.SetFocus(&e)
+		case chatElement:
+			c.SetFocus(&e.ReplyData)
 			return
 		}
 	}
@@ -390,8 +387,8 @@ func (c *DynamicChatView) moveFocusEnd(gtx layout.Context) {
 	for i := len(elements) - 1; i >= 0; i-- {
 		e := elements[i]
 		switch e := e.(type) {
-		case ds.ReplyData:
-			c.SetFocus(&e)
+		case chatElement:
+			c.SetFocus(&e.ReplyData)
 			return
 		}
 	}
@@ -408,7 +405,7 @@ func (c *DynamicChatView) makeFocusedVisible(gtx layout.Context) {
 searchLoop:
 	for i, e := range elements {
 		switch e := e.(type) {
-		case ds.ReplyData:
+		case chatElement:
 			if e.ID.Equals(c.Focused.ID) {
 				index = i
 				break searchLoop
@@ -673,13 +670,30 @@ func replyIsVisible(reply *forest.Reply) bool {
 	return true
 }
 
+// chatElement adapts ReplyData for display in a chat list.
+type chatElement struct {
+	ds.ReplyData
+}
+
+// ensure chatElement satisfies list.Element.
+var _ list.Element = chatElement{}
+
+// Serial returns a unique identifier for the reply which can be used for
+// dynamic list state management.
+func (c chatElement) Serial() list.Serial {
+	if c.ID != nil {
+		return list.Serial(c.ID.String())
+	}
+	return list.NoSerial
+}
+
 func replyToElement(store store.ExtendedStore, reply *forest.Reply) list.Element {
 	if !replyIsVisible(reply) {
 		return nil
 	}
 	var rd ds.ReplyData
 	rd.Populate(reply, store)
-	return rd
+	return chatElement{rd}
 }
 
 func replyNodesToElements(store store.ExtendedStore, replies ...forest.Node) []list.Element {
@@ -792,7 +806,7 @@ func (c *DynamicChatView) loadMessages(dir list.Direction, relativeTo list.Seria
 		}
 		var rd ds.ReplyData
 		rd.Populate(reply, c.Arbor().Store())
-		elements = append(elements, rd)
+		elements = append(elements, chatElement{rd})
 	}
 	return elements, len(elements) > 0
 }
@@ -815,7 +829,7 @@ func (c *DynamicChatView) layoutReply(replyData list.Element, state interface{})
 	return func(gtx C) D {
 		// Expose the concrete types of the parameters.
 		state := state.(*sprigwidget.Reply)
-		rd := replyData.(ds.ReplyData)
+		rd := replyData.(chatElement).ReplyData
 		// Render the markdown content of the reply.
 		content, _ := markdown.NewRenderer().Render([]byte(rd.Content))
 		richContent := richtext.Text(&state.InteractiveText, theme.Shaper, content...)
@@ -841,7 +855,13 @@ func (c *DynamicChatView) layoutReply(replyData list.Element, state interface{})
 				c.Editing = true
 			}
 		}
+		if state.Retry.Clicked(gtx) {
+			c.Outbox().Retry(rd.ID)
+		}
+		description, retryable := deliveryOf(c.Outbox(), rd)
 		// Layout the reply.
-		return sprigtheme.ReplyRow(sTheme, state, animState, rd, richContent).Layout(gtx)
+		return sprigtheme.ReplyRow(sTheme, state, animState, rd, richContent).
+			Delivering(sTheme, description, retryable).
+			Layout(gtx)
 	}
 }
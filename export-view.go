@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"gioui.org/layout"
+	"gioui.org/unit"
+	"gioui.org/widget"
+	"gioui.org/widget/material"
+	materials "gioui.org/x/component"
+	"git.sr.ht/~whereswaldon/forest-go"
+	"git.sr.ht/~whereswaldon/forest-go/fields"
+	"git.sr.ht/~whereswaldon/sprig/core"
+)
+
+// Values of ExportView.Scope other than community IDs.
+const (
+	exportScopeRoot = "root"
+	exportScopeAll  = "all"
+)
+
+// ExportView writes a conversation, a community, or every community to a
+// Markdown, HTML, or JSON file.
+type ExportView struct {
+	manager ViewManager
+
+	core.App
+
+	widget.List
+	// Root is the conversation chosen when the view was opened, if any
+	Root *fields.QualifiedHash
+	// Scope is exportScopeRoot, exportScopeAll, or the ID of a community
+	Scope        widget.Enum
+	Format       widget.Enum
+	Since, Until materials.TextField
+	Path         materials.TextField
+	ExportButton widget.Clickable
+
+	// statusLock guards Status and exporting, which are set when an export
+	// finishes
+	statusLock sync.Mutex
+	Status     string
+	exporting  bool
+}
+
+var _ View = &ExportView{}
+
+func NewExportView(app core.App) View {
+	c := &ExportView{
+		App: app,
+	}
+	c.List.Axis = layout.Vertical
+	for _, field := range []*materials.TextField{&c.Since, &c.Until, &c.Path} {
+		field.SingleLine = true
+	}
+	c.Format.Value = string(core.MarkdownExport)
+	return c
+}
+
+// HandleIntent chooses the conversation to export.
+func (c *ExportView) HandleIntent(intent Intent) {
+	if intent.ID != ExportReplies {
+		return
+	}
+	details, ok := intent.Details.(ExportRepliesDetails)
+	if !ok {
+		return
+	}
+	c.Root = nil
+	c.Scope.Value = exportScopeAll
+	if details.RootID == "" {
+		return
+	}
+	id := &fields.QualifiedHash{}
+	if err := id.UnmarshalText([]byte(details.RootID)); err != nil {
+		return
+	}
+	c.Root = id
+	c.Scope.Value = exportScopeRoot
+}
+
+func (c *ExportView) BecomeVisible() {
+	c.setStatus("")
+	if c.Scope.Value == "" {
+		c.Scope.Value = exportScopeAll
+	}
+	dir, err := os.UserHomeDir()
+	if err != nil {
+		dir = ""
+	}
+	c.Path.SetText(filepath.Join(dir, "arbor-messages"+core.ExportFormat(c.Format.Value).Extension()))
+}
+
+func (c *ExportView) NavItem() *materials.NavItem {
+	return nil
+}
+
+func (c *ExportView) AppBarData() (bool, string, []materials.AppBarAction, []materials.OverflowAction) {
+	return true, "Export Messages", nil, nil
+}
+
+func (c *ExportView) SetManager(mgr ViewManager) {
+	c.manager = mgr
+}
+
+func (c *ExportView) setStatus(status string) {
+	c.statusLock.Lock()
+	defer c.statusLock.Unlock()
+	c.Status = status
+}
+
+func (c *ExportView) status() (string, bool) {
+	c.statusLock.Lock()
+	defer c.statusLock.Unlock()
+	return c.Status, c.exporting
+}
+
+// scope returns the messages chosen for export.
+func (c *ExportView) scope() (core.ExportScope, error) {
+	var scope core.ExportScope
+	switch c.Scope.Value {
+	case exportScopeAll:
+	case exportScopeRoot:
+		scope.Root = c.Root
+	default:
+		scope.Root = &fields.QualifiedHash{}
+		if err := scope.Root.UnmarshalText([]byte(c.Scope.Value)); err != nil {
+			return scope, fmt.Errorf("invalid community: %w", err)
+		}
+	}
+	var err error
+	if scope.Since, err = parseSearchDate(c.Since.Text(), false); err != nil {
+		return scope, err
+	}
+	if scope.Until, err = parseSearchDate(c.Until.Text(), true); err != nil {
+		return scope, err
+	}
+	return scope, nil
+}
+
+// export writes the chosen messages to the file in the background.
+func (c *ExportView) export() {
+	scope, err := c.scope()
+	if err != nil {
+		c.setStatus("Failed: " + err.Error())
+		return
+	}
+	format := core.ExportFormat(c.Format.Value)
+	path := c.Path.Text()
+	c.statusLock.Lock()
+	if c.exporting {
+		c.statusLock.Unlock()
+		return
+	}
+	c.exporting = true
+	c.Status = "Exporting..."
+	c.statusLock.Unlock()
+	go func() {
+		status := ""
+		if count, err := core.ExportToFile(c.Arbor().Store(), scope, format, path); err != nil {
+			status = "Failed: " + err.Error()
+		} else {
+			status = fmt.Sprintf("Exported %d messages to %s", count, path)
+		}
+		c.statusLock.Lock()
+		c.exporting = false
+		c.Status = status
+		c.statusLock.Unlock()
+		c.Invalidate()
+	}()
+}
+
+func (c *ExportView) Update(gtx layout.Context) {
+	if c.Format.Update(gtx) {
+		// keep the file name in step with the format
+		path := c.Path.Text()
+		for _, format := range core.ExportFormats {
+			if strings.HasSuffix(path, format.Extension()) {
+				path = strings.TrimSuffix(path, format.Extension()) + core.ExportFormat(c.Format.Value).Extension()
+				c.Path.SetText(path)
+				break
+			}
+		}
+	}
+	if c.ExportButton.Clicked(gtx) {
+		c.export()
+	}
+}
+
+func (c *ExportView) Layout(gtx layout.Context) layout.Dimensions {
+	theme := c.Theme().Current().Theme
+	radio := func(enum *widget.Enum, key, label string) layout.Widget {
+		return func(gtx C) D {
+			return itemInset.Layout(gtx, material.RadioButton(theme, enum, key, label).Layout)
+		}
+	}
+	field := func(f *materials.TextField, hint string) layout.Widget {
+		return func(gtx C) D {
+			return itemInset.Layout(gtx, func(gtx C) D {
+				return f.Layout(gtx, theme, hint)
+			})
+		}
+	}
+	heading := func(text string) layout.Widget {
+		return func(gtx C) D {
+			return itemInset.Layout(gtx, material.Body1(theme, text).Layout)
+		}
+	}
+	items := []layout.Widget{heading("Messages")}
+	if c.Root != nil {
+		items = append(items, radio(&c.Scope, exportScopeRoot, "Selected conversation"))
+	}
+	c.Arbor().Communities().WithCommunities(func(communities []*forest.Community) {
+		for _, community := range communities {
+			items = append(items, radio(&c.Scope, community.ID().String(), "Community "+string(community.Name.Blob)))
+		}
+	})
+	items = append(items,
+		radio(&c.Scope, exportScopeAll, "All communities"),
+		func(gtx C) D {
+			return layout.Flex{}.Layout(gtx,
+				layout.Flexed(1, field(&c.Since, "From ("+searchDateLayout+")")),
+				layout.Flexed(1, field(&c.Until, "Until ("+searchDateLayout+")")),
+			)
+		},
+		heading("Format"),
+	)
+	for _, format := range core.ExportFormats {
+		items = append(items, radio(&c.Format, string(format), format.String()))
+	}
+	status, exporting := c.status()
+	items = append(items,
+		field(&c.Path, "File"),
+		func(gtx C) D {
+			if exporting {
+				return D{}
+			}
+			return itemInset.Layout(gtx, material.Button(theme, &c.ExportButton, "Export").Layout)
+		},
+		func(gtx C) D {
+			if status == "" {
+				return D{}
+			}
+			return itemInset.Layout(gtx, material.Body2(theme, status).Layout)
+		},
+	)
+	return material.List(theme, &c.List).Layout(gtx, len(items), func(gtx C, index int) D {
+		return layout.UniformInset(unit.Dp(4)).Layout(gtx, items[index])
+	})
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"log"
+
+	"gioui.org/app"
+	"gioui.org/x/haptic"
+	"git.sr.ht/~whereswaldon/sprig/core"
+)
+
+// windowFrontend presents the core application services in a Gio window.
+type windowFrontend struct {
+	*app.Window
+	haptic core.HapticService
+}
+
+var _ core.Frontend = &windowFrontend{}
+
+func newWindowFrontend(w *app.Window) *windowFrontend {
+	return &windowFrontend{
+		Window: w,
+		haptic: &hapticService{
+			Buzzer: haptic.NewBuzzer(w),
+		},
+	}
+}
+
+func (w *windowFrontend) Haptic() core.HapticService {
+	return w.haptic
+}
+
+type hapticService struct {
+	*haptic.Buzzer
+}
+
+func (h *hapticService) UpdateAndroidViewRef(view uintptr) {
+	h.Buzzer.SetView(view)
+}
+
+func (h *hapticService) Buzz() {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("Recovered from buzz panic: %v", err)
+		}
+	}()
+	h.Buzzer.Buzz()
+}
@@ -11,11 +11,17 @@ require (
 	git.sr.ht/~whereswaldon/forest-go v0.0.0-20230530191337-133031baad4c
 	git.sr.ht/~whereswaldon/latest v0.0.0-20210304001450-aafd2a13a1bb
 	git.sr.ht/~whereswaldon/sprout-go v0.0.0-20220128205300-c2f66369262c
+	github.com/gdamore/tcell/v2 v2.6.0
 	github.com/inkeliz/giohyperlink v0.0.0-20210728190223-81136d95d4bb
 	github.com/magefile/mage v1.10.0
+	github.com/mattn/go-runewidth v0.0.14
 	github.com/pkg/profile v1.6.0
-	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519
+	go.etcd.io/bbolt v1.3.6
+	golang.org/x/crypto v0.18.0
 	golang.org/x/exp/shiny v0.0.0-20220827204233-334a2380cb91
+	golang.org/x/net v0.20.0
+	golang.org/x/term v0.16.0
+	rsc.io/qr v0.2.0
 )
 
 require (
@@ -25,12 +31,14 @@ require (
 	git.wow.st/gmp/jni v0.0.0-20210610011705-34026c7e22d0 // indirect
 	github.com/akavel/rsrc v0.10.1 // indirect
 	github.com/esiqveland/notify v0.11.0 // indirect
+	github.com/gdamore/encoding v1.0.0 // indirect
 	github.com/go-ole/go-ole v1.2.6 // indirect
 	github.com/go-text/typesetting v0.0.0-20230803102845-24e03d8b5372 // indirect
 	github.com/godbus/dbus/v5 v5.0.6 // indirect
+	github.com/lucasb-eyer/go-colorful v1.2.0 // indirect
+	github.com/rivo/uniseg v0.4.3 // indirect
 	github.com/shamaton/msgpack v1.2.1 // indirect
 	github.com/yuin/goldmark v1.4.13 // indirect
-	go.etcd.io/bbolt v1.3.6 // indirect
 	golang.org/x/exp v0.0.0-20230905200255-921286631fa9 // indirect
 	golang.org/x/image v0.15.0 // indirect
 	golang.org/x/mod v0.14.0 // indirect
@@ -99,3 +99,23 @@ var ExpandIcon *widget.Icon = func() *widget.Icon {
     icon, _ := widget.NewIcon(icons.NavigationUnfoldMore)
     return icon
 }()
+
+var SyncIcon *widget.Icon = func() *widget.Icon {
+	icon, _ := widget.NewIcon(icons.NotificationSync)
+	return icon
+}()
+
+var DiagnosticsIcon *widget.Icon = func() *widget.Icon {
+	icon, _ := widget.NewIcon(icons.ActionAssessment)
+	return icon
+}()
+
+var ProtocolIcon *widget.Icon = func() *widget.Icon {
+	icon, _ := widget.NewIcon(icons.ActionCode)
+	return icon
+}()
+
+var SearchIcon *widget.Icon = func() *widget.Icon {
+	icon, _ := widget.NewIcon(icons.ActionSearch)
+	return icon
+}()
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"gioui.org/io/clipboard"
+	"gioui.org/layout"
+	"gioui.org/op/paint"
+	"gioui.org/unit"
+	"gioui.org/widget"
+	"gioui.org/widget/material"
+	materials "gioui.org/x/component"
+	"git.sr.ht/~whereswaldon/sprig/core"
+	"rsc.io/qr"
+)
+
+// qrChunkSize is the number of characters of an identity backup encoded in
+// each QR code. Backups are too large for a single code, so they are split
+// into a sequence that is scanned in order.
+const qrChunkSize = 1024
+
+// IdentityExportView writes a backup of the active identity to a file or
+// displays it as QR codes.
+type IdentityExportView struct {
+	manager ViewManager
+
+	// Passphrase and Confirm optionally protect the private key in the
+	// backup
+	Passphrase, Confirm materials.TextField
+	Path                materials.TextField
+
+	SaveButton, CopyButton, QRButton widget.Clickable
+	PrevCode, NextCode               widget.Clickable
+
+	// codes holds the QR codes of the backup being displayed and page is
+	// the index of the visible one
+	codes  []paint.ImageOp
+	page   int
+	Status string
+
+	core.App
+}
+
+var _ View = &IdentityExportView{}
+
+func NewIdentityExportView(app core.App) View {
+	c := &IdentityExportView{
+		App: app,
+	}
+	for _, field := range []*materials.TextField{&c.Passphrase, &c.Confirm} {
+		field.SingleLine = true
+		field.Mask = '•'
+	}
+	c.Path.SingleLine = true
+	return c
+}
+
+func (c *IdentityExportView) HandleIntent(intent Intent) {}
+
+func (c *IdentityExportView) BecomeVisible() {
+	c.Passphrase.Clear()
+	c.Confirm.Clear()
+	c.codes = nil
+	c.Status = ""
+	name := "identity"
+	if identity, err := c.Settings().Identity(); err == nil {
+		name = string(identity.Name.Blob)
+	}
+	dir, err := os.UserHomeDir()
+	if err != nil {
+		dir = ""
+	}
+	c.Path.SetText(filepath.Join(dir, name+".sprig-identity"))
+}
+
+func (c *IdentityExportView) NavItem() *materials.NavItem {
+	return nil
+}
+
+func (c *IdentityExportView) AppBarData() (bool, string, []materials.AppBarAction, []materials.OverflowAction) {
+	return true, "Back up Identity", nil, nil
+}
+
+// export returns the backup of the active identity protected by the
+// chosen passphrase.
+func (c *IdentityExportView) export() ([]byte, error) {
+	if c.Passphrase.Text() != c.Confirm.Text() {
+		return nil, fmt.Errorf("the passphrases do not match")
+	}
+	return c.Settings().ExportIdentity(c.Passphrase.Text())
+}
+
+func (c *IdentityExportView) Update(gtx layout.Context) {
+	if c.SaveButton.Clicked(gtx) {
+		c.codes = nil
+		if bundle, err := c.export(); err != nil {
+			c.Status = "Failed: " + err.Error()
+		} else if err := ioutil.WriteFile(c.Path.Text(), bundle, 0600); err != nil {
+			c.Status = "Failed: " + err.Error()
+		} else {
+			c.Status = "Saved to " + c.Path.Text()
+		}
+	}
+	if c.CopyButton.Clicked(gtx) {
+		c.codes = nil
+		if bundle, err := c.export(); err != nil {
+			c.Status = "Failed: " + err.Error()
+		} else {
+			clipboard.WriteOp{Text: string(bundle)}.Add(gtx.Ops)
+			c.Status = "Copied to the clipboard"
+		}
+	}
+	if c.QRButton.Clicked(gtx) {
+		c.codes = nil
+		if bundle, err := c.export(); err != nil {
+			c.Status = "Failed: " + err.Error()
+		} else if codes, err := qrCodes(string(bundle)); err != nil {
+			c.Status = "Failed: " + err.Error()
+		} else {
+			c.codes, c.page = codes, 0
+			c.Status = ""
+		}
+	}
+	if c.PrevCode.Clicked(gtx) && c.page > 0 {
+		c.page--
+	}
+	if c.NextCode.Clicked(gtx) && c.page < len(c.codes)-1 {
+		c.page++
+	}
+}
+
+// qrCodes encodes text as a sequence of QR codes. Joining the text of the
+// codes in order reproduces the original.
+func qrCodes(text string) ([]paint.ImageOp, error) {
+	var codes []paint.ImageOp
+	for len(text) > 0 {
+		chunk := text
+		if len(chunk) > qrChunkSize {
+			chunk = chunk[:qrChunkSize]
+		}
+		text = text[len(chunk):]
+		code, err := qr.Encode(chunk, qr.M)
+		if err != nil {
+			return nil, fmt.Errorf("failed encoding QR code: %w", err)
+		}
+		code.Scale = 1
+		op := paint.NewImageOp(code.Image())
+		op.Filter = paint.FilterNearest
+		codes = append(codes, op)
+	}
+	return codes, nil
+}
+
+func (c *IdentityExportView) Layout(gtx layout.Context) layout.Dimensions {
+	theme := c.Theme().Current().Theme
+	inset := layout.UniformInset(unit.Dp(4))
+	field := func(f *materials.TextField, hint string) layout.FlexChild {
+		return layout.Rigid(func(gtx C) D {
+			return inset.Layout(gtx, func(gtx C) D {
+				return f.Layout(gtx, theme, hint)
+			})
+		})
+	}
+	button := func(b *widget.Clickable, label string) layout.FlexChild {
+		return layout.Rigid(func(gtx C) D {
+			return inset.Layout(gtx, material.Button(theme, b, label).Layout)
+		})
+	}
+	return layout.UniformInset(unit.Dp(8)).Layout(gtx, func(gtx C) D {
+		return layout.Flex{Axis: layout.Vertical}.Layout(gtx,
+			layout.Rigid(func(gtx C) D {
+				return inset.Layout(gtx, material.Body1(theme, "A backup contains your identity and its private key. Anyone holding an unencrypted backup can post as you, so choose a passphrase unless you will import it right away.").Layout)
+			}),
+			field(&c.Passphrase, "Backup passphrase (optional)"),
+			field(&c.Confirm, "Confirm backup passphrase"),
+			field(&c.Path, "File"),
+			layout.Rigid(func(gtx C) D {
+				return layout.Flex{Alignment: layout.Middle}.Layout(gtx,
+					button(&c.SaveButton, "Save"),
+					button(&c.CopyButton, "Copy"),
+					button(&c.QRButton, "Show QR codes"),
+				)
+			}),
+			layout.Rigid(func(gtx C) D {
+				if c.Status == "" {
+					return D{}
+				}
+				return inset.Layout(gtx, material.Body2(theme, c.Status).Layout)
+			}),
+			layout.Flexed(1, func(gtx C) D {
+				if len(c.codes) == 0 {
+					return D{}
+				}
+				return c.layoutCodes(gtx, theme)
+			}),
+		)
+	})
+}
+
+// layoutCodes displays the current QR code along with controls to page
+// through the sequence.
+func (c *IdentityExportView) layoutCodes(gtx C, theme *material.Theme) D {
+	inset := layout.UniformInset(unit.Dp(4))
+	return layout.Flex{Axis: layout.Vertical, Alignment: layout.Middle}.Layout(gtx,
+		layout.Rigid(func(gtx C) D {
+			return layout.Flex{Alignment: layout.Middle}.Layout(gtx,
+				layout.Rigid(func(gtx C) D {
+					return inset.Layout(gtx, material.Button(theme, &c.PrevCode, "Previous").Layout)
+				}),
+				layout.Rigid(func(gtx C) D {
+					label := fmt.Sprintf("Code %d of %d", c.page+1, len(c.codes))
+					return inset.Layout(gtx, material.Body1(theme, label).Layout)
+				}),
+				layout.Rigid(func(gtx C) D {
+					return inset.Layout(gtx, material.Button(theme, &c.NextCode, "Next").Layout)
+				}),
+			)
+		}),
+		layout.Rigid(func(gtx C) D {
+			return inset.Layout(gtx, material.Caption(theme, "Scan the codes in order and join their text to restore the backup.").Layout)
+		}),
+		layout.Flexed(1, func(gtx C) D {
+			return widget.Image{
+				Src: c.codes[c.page],
+				Fit: widget.Contain,
+			}.Layout(gtx)
+		}),
+	)
+}
+
+func (c *IdentityExportView) SetManager(mgr ViewManager) {
+	c.manager = mgr
+}
@@ -1,6 +1,10 @@
 package main
 
 import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
 	"gioui.org/layout"
 	"gioui.org/unit"
 	"gioui.org/widget"
@@ -10,11 +14,35 @@ import (
 	sprigWidget "git.sr.ht/~whereswaldon/sprig/widget"
 )
 
+// Values of IdentityFormView.KeySource.
+const (
+	keySourceGenerate = "generate"
+	keySourceImport   = "import"
+	keySourceGPG      = "gpg"
+)
+
 type IdentityFormView struct {
 	manager ViewManager
 	sprigWidget.TextForm
-	CreateButton widget.Clickable
+	// Passphrase and Confirm hold the passphrase protecting the new
+	// identity's private key
+	Passphrase, Confirm materials.TextField
+	CreateButton        widget.Clickable
+	Error               string
+	// KeySource chooses whether the new identity generates a key, imports
+	// the armored secret key in SecretKey, or signs through gpg with the
+	// key named in GPGKey
+	KeySource         widget.Enum
+	SecretKey, GPGKey materials.TextField
+	// Algorithm chooses the kind of key generated for the new identity
+	Algorithm widget.Enum
+	// Backup holds the path to an identity backup or its pasted contents,
+	// and BackupPassphrase decrypts it
+	Backup, BackupPassphrase materials.TextField
+	ImportButton             widget.Clickable
+	ImportError              string
 
+	widget.List
 	core.App
 }
 
@@ -25,6 +53,15 @@ func NewIdentityFormView(app core.App) View {
 		App: app,
 	}
 	c.TextForm.TextField.Editor.SingleLine = true
+	c.List.Axis = layout.Vertical
+	c.KeySource.Value = keySourceGenerate
+	c.Algorithm.Value = string(core.DefaultKeyAlgorithm)
+	c.GPGKey.SingleLine = true
+	c.BackupPassphrase.SingleLine = true
+	for _, field := range []*materials.TextField{&c.Passphrase, &c.Confirm, &c.BackupPassphrase} {
+		field.SingleLine = true
+		field.Mask = '•'
+	}
 
 	return c
 }
@@ -47,44 +84,177 @@ func (c *IdentityFormView) HandleClipboard(contents string) {
 
 func (c *IdentityFormView) Update(gtx layout.Context) {
 	if c.CreateButton.Clicked(gtx) {
-		c.Settings().CreateIdentity(c.TextField.Text())
-		c.manager.RequestViewSwitch(SubscriptionSetupFormViewID)
+		c.createIdentity()
+	}
+	if c.ImportButton.Clicked(gtx) {
+		c.importIdentity()
+	}
+}
+
+// importIdentity restores the identity backup named or pasted into the
+// form and moves on to choosing subscriptions.
+func (c *IdentityFormView) importIdentity() {
+	backup := strings.TrimSpace(c.Backup.Text())
+	if backup == "" {
+		c.ImportError = "Enter the path of a backup file or paste a backup."
+		return
+	}
+	if c.BackupPassphrase.Text() == "" {
+		c.ImportError = "Enter the passphrase of the backup, or a new passphrase to protect an unencrypted backup."
+		return
+	}
+	bundle := []byte(backup)
+	if !strings.HasPrefix(backup, "-----BEGIN") {
+		data, err := ioutil.ReadFile(backup)
+		if err != nil {
+			c.ImportError = err.Error()
+			return
+		}
+		bundle = data
+	}
+	if _, err := c.Settings().ImportIdentity(bundle, c.BackupPassphrase.Text()); err != nil {
+		c.ImportError = err.Error()
+		return
+	}
+	c.ImportError = ""
+	c.Backup.Clear()
+	c.BackupPassphrase.Clear()
+	c.manager.RequestViewSwitch(SubscriptionSetupFormViewID)
+}
+
+// createIdentity creates an identity from the contents of the form and
+// moves on to choosing subscriptions.
+func (c *IdentityFormView) createIdentity() {
+	name := c.TextField.Text()
+	switch {
+	case name == "":
+		c.Error = "Choose a username."
+		return
+	case c.KeySource.Value == keySourceGPG:
+		if strings.TrimSpace(c.GPGKey.Text()) == "" {
+			c.Error = "Enter the gpg key to sign with."
+			return
+		}
+	case c.Passphrase.Text() == "":
+		c.Error = "Choose a passphrase to protect your private key."
+		return
+	case c.Passphrase.Text() != c.Confirm.Text():
+		c.Error = "The passphrases do not match."
+		return
+	}
+	var err error
+	switch c.KeySource.Value {
+	case keySourceImport:
+		err = c.importSecretKey(name)
+	case keySourceGPG:
+		err = c.Settings().CreateGPGIdentity(name, strings.TrimSpace(c.GPGKey.Text()))
+	default:
+		err = c.Settings().CreateIdentity(name, c.Passphrase.Text(), core.KeyAlgorithm(c.Algorithm.Value))
+	}
+	if err != nil {
+		c.Error = err.Error()
+		return
+	}
+	c.Error = ""
+	c.Passphrase.Clear()
+	c.Confirm.Clear()
+	c.SecretKey.Clear()
+	c.manager.RequestViewSwitch(SubscriptionSetupFormViewID)
+}
+
+// importSecretKey creates an identity from the secret key named or pasted
+// into the form.
+func (c *IdentityFormView) importSecretKey(name string) error {
+	key := strings.TrimSpace(c.SecretKey.Text())
+	if key == "" {
+		return fmt.Errorf("enter the path of a secret key file or paste a key")
+	}
+	armored := []byte(key)
+	if !strings.HasPrefix(key, "-----BEGIN") {
+		data, err := ioutil.ReadFile(key)
+		if err != nil {
+			return err
+		}
+		armored = data
 	}
+	return c.Settings().ImportSecretKey(name, armored, c.Passphrase.Text())
 }
 
 func (c *IdentityFormView) Layout(gtx layout.Context) layout.Dimensions {
 	theme := c.Theme().Current().Theme
-	return layout.Center.Layout(gtx, func(gtx layout.Context) layout.Dimensions {
-		return layout.Flex{Axis: layout.Vertical}.Layout(gtx,
-			layout.Rigid(func(gtx layout.Context) layout.Dimensions {
-				return layout.Center.Layout(gtx, func(gtx layout.Context) layout.Dimensions {
-					return layout.UniformInset(unit.Dp(4)).Layout(gtx,
-						material.Body1(theme, "Your Arbor Username:").Layout,
-					)
-				})
-			}),
-			layout.Rigid(func(gtx layout.Context) layout.Dimensions {
-				return layout.Center.Layout(gtx, func(gtx layout.Context) layout.Dimensions {
-					return layout.UniformInset(unit.Dp(4)).Layout(gtx, func(gtx C) D {
-						return c.TextField.Layout(gtx, theme, "Username")
-					})
-				})
-			}),
-			layout.Rigid(func(gtx layout.Context) layout.Dimensions {
-				return layout.Center.Layout(gtx, func(gtx layout.Context) layout.Dimensions {
-					return layout.UniformInset(unit.Dp(4)).Layout(gtx,
-						material.Body2(theme, "Your username is public, and cannot currently be changed once it is chosen.").Layout,
-					)
-				})
-			}),
-			layout.Rigid(func(gtx layout.Context) layout.Dimensions {
-				return layout.Center.Layout(gtx, func(gtx layout.Context) layout.Dimensions {
-					return layout.UniformInset(unit.Dp(4)).Layout(gtx,
-						material.Button(theme, &(c.CreateButton), "Create").Layout,
-					)
-				})
+	inset := layout.UniformInset(unit.Dp(4))
+	centered := func(w layout.Widget) layout.Widget {
+		return func(gtx C) D {
+			return layout.Center.Layout(gtx, func(gtx C) D {
+				return inset.Layout(gtx, w)
+			})
+		}
+	}
+	text := func(style func(*material.Theme, string) material.LabelStyle, txt string) layout.Widget {
+		return centered(style(theme, txt).Layout)
+	}
+	field := func(f *materials.TextField, hint string) layout.Widget {
+		return centered(func(gtx C) D {
+			return f.Layout(gtx, theme, hint)
+		})
+	}
+	items := []layout.Widget{
+		text(material.Body1, "Your Arbor Username:"),
+		field(&c.TextField, "Username"),
+		text(material.Body2, "Your username is public, and cannot currently be changed once it is chosen."),
+		centered(func(gtx C) D {
+			return layout.Flex{Alignment: layout.Middle}.Layout(gtx,
+				layout.Rigid(material.RadioButton(theme, &c.KeySource, keySourceGenerate, "New key").Layout),
+				layout.Rigid(material.RadioButton(theme, &c.KeySource, keySourceImport, "OpenPGP key").Layout),
+				layout.Rigid(material.RadioButton(theme, &c.KeySource, keySourceGPG, "gpg agent").Layout),
+			)
+		}),
+	}
+	switch c.KeySource.Value {
+	case keySourceGenerate:
+		items = append(items,
+			centered(func(gtx C) D {
+				var choices []layout.FlexChild
+				for _, algorithm := range core.KeyAlgorithms {
+					choices = append(choices, layout.Rigid(material.RadioButton(theme, &c.Algorithm, string(algorithm), algorithm.String()).Layout))
+				}
+				return layout.Flex{Alignment: layout.Middle}.Layout(gtx, choices...)
 			}),
+			text(material.Body2, "Larger keys are harder to break, but slower to generate and to sign with."),
+		)
+	case keySourceImport:
+		items = append(items,
+			field(&c.SecretKey, "Secret key file or pasted key"),
+			text(material.Body2, "Export an existing key with gpg --export-secret-keys --armor. Enter its passphrase below, or choose one to protect a key that has none."),
+		)
+	case keySourceGPG:
+		items = append(items,
+			field(&c.GPGKey, "gpg key ID, fingerprint, or email"),
+			text(material.Body2, "Messages are signed by running gpg, and your gpg agent asks for the key's passphrase. The private key never leaves gpg."),
+		)
+	}
+	if c.KeySource.Value != keySourceGPG {
+		items = append(items,
+			field(&c.Passphrase, "Passphrase"),
+			field(&c.Confirm, "Confirm passphrase"),
+			text(material.Body2, "Your private key is encrypted with this passphrase. You will need it every time sprig starts, and it cannot be recovered if you forget it."),
 		)
+	}
+	if c.Error != "" {
+		items = append(items, text(material.Body2, c.Error))
+	}
+	items = append(items,
+		centered(material.Button(theme, &(c.CreateButton), "Create").Layout),
+		text(material.Body1, "Or restore an identity from a backup:"),
+		field(&c.Backup, "Backup file or pasted backup"),
+		field(&c.BackupPassphrase, "Backup passphrase"),
+	)
+	if c.ImportError != "" {
+		items = append(items, text(material.Body2, c.ImportError))
+	}
+	items = append(items, centered(material.Button(theme, &(c.ImportButton), "Import").Layout))
+	return material.List(theme, &c.List).Layout(gtx, len(items), func(gtx C, index int) D {
+		return items[index](gtx)
 	})
 }
 
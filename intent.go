@@ -9,8 +9,15 @@ type IntentID = string
 
 const (
 	ViewReplyWithID IntentID = "view-reply-with-id"
+	ExportReplies   IntentID = "export-replies"
 )
 
 type ViewReplyWithIDDetails struct {
 	NodeID string
 }
+
+// ExportRepliesDetails chooses the conversation to export. An empty RootID
+// selects every community.
+type ExportRepliesDetails struct {
+	RootID string
+}
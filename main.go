@@ -42,6 +42,7 @@ func eventLoop(w *app.Window) error {
 		dataDir    string
 		invalidate bool
 		profileOpt string
+		incognito  bool
 	)
 
 	dataDir, err := getDataDir("sprig")
@@ -52,13 +53,18 @@ func eventLoop(w *app.Window) error {
 	flag.StringVar(&profileOpt, "profile", "none", "create the provided kind of profile. Use one of [none, cpu, mem, block, goroutine, mutex, trace, gio]")
 	flag.BoolVar(&invalidate, "invalidate", false, "invalidate every single frame, only useful for profiling")
 	flag.StringVar(&dataDir, "data-dir", dataDir, "application state directory")
+	flag.BoolVar(&incognito, "incognito", false, "keep messages in memory only for this session")
 	flag.Parse()
 
 	profiler := ProfileOpt(profileOpt).NewProfiler()
 	profiler.Start()
 	defer profiler.Stop()
 
-	app, err := core.NewApp(w, dataDir)
+	var options []core.AppOption
+	if incognito {
+		options = append(options, core.Incognito())
+	}
+	app, err := core.NewApp(dataDir, newWindowFrontend(w), options...)
 	if err != nil {
 		log.Fatalf("Failed initializing application: %v", err)
 	}
@@ -79,13 +85,27 @@ func eventLoop(w *app.Window) error {
 	vm.RegisterView(ConsentViewID, NewConsentView(app))
 	vm.RegisterView(SubscriptionSetupFormViewID, NewSubSetupFormView(app))
 	vm.RegisterView(DynamicChatViewID, NewDynamicChatView(app))
+	vm.RegisterView(DiagnosticsViewID, NewDiagnosticsView(app))
+	vm.RegisterView(ProtocolInspectorViewID, NewProtocolInspectorView(app))
+	vm.RegisterView(UnlockViewID, NewUnlockView(app))
+	vm.RegisterView(IdentityExportViewID, NewIdentityExportView(app))
+	vm.RegisterView(AuditViewID, NewAuditView(app))
+	vm.RegisterView(DataDirViewID, NewDataDirView(app))
+	vm.RegisterView(SearchViewID, NewSearchView(app))
+	vm.RegisterIntentHandler(ReplyViewID, ViewReplyWithID)
+	vm.RegisterView(ExportViewID, NewExportView(app))
+	vm.RegisterIntentHandler(ExportViewID, ExportReplies)
+	vm.RegisterView(BundleViewID, NewBundleView(app))
+	reportStoreError(app, vm)
 
 	if app.Settings().AcknowledgedNoticeVersion() < NoticeVersion {
 		vm.SetView(ConsentViewID)
-	} else if app.Settings().Address() == "" {
+	} else if len(app.Settings().Addresses()) < 1 {
 		vm.SetView(ConnectFormID)
 	} else if app.Settings().ActiveArborIdentityID() == nil {
 		vm.SetView(IdentityFormID)
+	} else if app.Settings().KeyLocked() {
+		vm.SetView(UnlockViewID)
 	} else if len(app.Settings().Subscriptions()) < 1 {
 		vm.SetView(SubscriptionSetupFormViewID)
 	} else {
@@ -166,6 +186,15 @@ const (
 	SubscriptionViewID
 	SubscriptionSetupFormViewID
 	DynamicChatViewID
+	DiagnosticsViewID
+	ProtocolInspectorViewID
+	UnlockViewID
+	IdentityExportViewID
+	AuditViewID
+	DataDirViewID
+	SearchViewID
+	ExportViewID
+	BundleViewID
 )
 
 // getDataDir returns application specific file directory to use for storage.
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gioui.org/layout"
+	"gioui.org/op"
+	"gioui.org/unit"
+	"gioui.org/widget"
+	"gioui.org/widget/material"
+	materials "gioui.org/x/component"
+	"git.sr.ht/~whereswaldon/sprig/core"
+	"git.sr.ht/~whereswaldon/sprig/icons"
+	sprigWidget "git.sr.ht/~whereswaldon/sprig/widget"
+	sprigTheme "git.sr.ht/~whereswaldon/sprig/widget/theme"
+)
+
+// ProtocolInspectorView displays the raw sprout protocol messages exchanged
+// with relays while protocol capture is enabled.
+type ProtocolInspectorView struct {
+	manager ViewManager
+
+	core.App
+
+	CaptureSwitch widget.Bool
+	ClearButton   widget.Clickable
+	RelayFilter   widget.Enum
+	VerbFilter    widget.Enum
+	ExportForm    sprigWidget.TextForm
+	// ExportStatus describes the result of the last export.
+	ExportStatus string
+
+	widget.List
+	// expanded tracks which messages (by sequence number) have their
+	// payload visible.
+	expanded map[uint64]*widget.Clickable
+	open     map[uint64]bool
+}
+
+var _ View = &ProtocolInspectorView{}
+
+// allFilter is the filter value that matches every message.
+const allFilter = ""
+
+// protocolRefreshInterval is how often the message list is redrawn while
+// capture is enabled.
+const protocolRefreshInterval = time.Second
+
+func NewProtocolInspectorView(app core.App) View {
+	c := &ProtocolInspectorView{
+		App:      app,
+		expanded: make(map[uint64]*widget.Clickable),
+		open:     make(map[uint64]bool),
+	}
+	c.List.Axis = layout.Vertical
+	c.ExportForm.TextField.SingleLine = true
+	c.ExportForm.TextField.Submit = true
+	return c
+}
+
+func (c *ProtocolInspectorView) HandleIntent(intent Intent) {}
+
+func (c *ProtocolInspectorView) AppBarData() (bool, string, []materials.AppBarAction, []materials.OverflowAction) {
+	return true, "Protocol Inspector", []materials.AppBarAction{}, []materials.OverflowAction{}
+}
+
+func (c *ProtocolInspectorView) NavItem() *materials.NavItem {
+	return &materials.NavItem{
+		Name: "Protocol Inspector",
+		Icon: icons.ProtocolIcon,
+	}
+}
+
+func (c *ProtocolInspectorView) BecomeVisible() {
+	c.CaptureSwitch.Value = c.Sprout().Capture().Enabled()
+	if c.ExportForm.TextField.Text() == "" {
+		c.ExportForm.TextField.SetText(filepath.Join(filepath.Dir(c.Settings().DataPath()), "sprout-capture.txt"))
+	}
+}
+
+func (c *ProtocolInspectorView) Update(gtx layout.Context) {
+	capture := c.Sprout().Capture()
+	if c.CaptureSwitch.Update(gtx) {
+		capture.SetEnabled(c.CaptureSwitch.Value)
+	}
+	if c.ClearButton.Clicked(gtx) {
+		capture.Clear()
+		c.expanded = make(map[uint64]*widget.Clickable)
+		c.open = make(map[uint64]bool)
+	}
+	c.RelayFilter.Update(gtx)
+	c.VerbFilter.Update(gtx)
+	for seq, toggle := range c.expanded {
+		if toggle.Clicked(gtx) {
+			c.open[seq] = !c.open[seq]
+		}
+	}
+	if c.ExportForm.Submitted() {
+		if path := c.ExportForm.TextField.Text(); path != "" {
+			c.ExportStatus = c.export(path)
+		}
+	}
+}
+
+// export writes the messages matching the current filters to path and
+// returns a description of the outcome.
+func (c *ProtocolInspectorView) export(path string) string {
+	messages := c.filtered(c.Sprout().Capture().Messages())
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Sprintf("Export failed: %v", err)
+	}
+	if err := core.WriteCapture(file, messages); err != nil {
+		file.Close()
+		return fmt.Sprintf("Export failed: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Sprintf("Export failed: %v", err)
+	}
+	return fmt.Sprintf("Exported %d messages to %s", len(messages), path)
+}
+
+// filtered returns the messages matching the relay and verb filters.
+func (c *ProtocolInspectorView) filtered(messages []core.CapturedMessage) []core.CapturedMessage {
+	out := make([]core.CapturedMessage, 0, len(messages))
+	for _, msg := range messages {
+		if c.RelayFilter.Value != allFilter && msg.Relay != c.RelayFilter.Value {
+			continue
+		}
+		if c.VerbFilter.Value != allFilter && msg.Verb != c.VerbFilter.Value {
+			continue
+		}
+		out = append(out, msg)
+	}
+	return out
+}
+
+// filterValues returns the sorted, distinct values of field across messages.
+func filterValues(messages []core.CapturedMessage, field func(core.CapturedMessage) string) []string {
+	seen := map[string]bool{}
+	var out []string
+	for _, msg := range messages {
+		if value := field(msg); !seen[value] {
+			seen[value] = true
+			out = append(out, value)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+func (c *ProtocolInspectorView) SetManager(mgr ViewManager) {
+	c.manager = mgr
+}
+
+func (c *ProtocolInspectorView) Layout(gtx layout.Context) layout.Dimensions {
+	sTheme := c.Theme().Current()
+	theme := sTheme.Theme
+	capture := c.Sprout().Capture()
+	if capture.Enabled() {
+		op.InvalidateOp{At: gtx.Now.Add(protocolRefreshInterval)}.Add(gtx.Ops)
+	}
+	all := capture.Messages()
+	if len(all) > 0 {
+		// forget the state of messages evicted from the capture
+		for seq := range c.expanded {
+			if seq < all[0].Seq {
+				delete(c.expanded, seq)
+				delete(c.open, seq)
+			}
+		}
+	}
+	relays := filterValues(all, func(m core.CapturedMessage) string { return m.Relay })
+	verbs := filterValues(all, func(m core.CapturedMessage) string { return m.Verb })
+	messages := c.filtered(all)
+
+	controls := []layout.Widget{
+		SimpleSectionItem{
+			Theme: theme,
+			Control: func(gtx C) D {
+				return layout.Flex{Alignment: layout.Middle}.Layout(gtx,
+					layout.Flexed(1, func(gtx C) D {
+						return itemInset.Layout(gtx, material.Switch(theme, &c.CaptureSwitch, "Capture protocol messages").Layout)
+					}),
+					layout.Rigid(func(gtx C) D {
+						return itemInset.Layout(gtx, material.Button(theme, &c.ClearButton, "Clear").Layout)
+					}),
+				)
+			},
+			Context: fmt.Sprintf("Records up to %d of the most recent messages exchanged with every relay. Capturing retains message contents in memory, so leave it off when not debugging.", core.DefaultCaptureSize),
+		}.Layout,
+		func(gtx C) D {
+			return c.layoutFilter(gtx, theme, "Relay", &c.RelayFilter, relays)
+		},
+		func(gtx C) D {
+			return c.layoutFilter(gtx, theme, "Type", &c.VerbFilter, verbs)
+		},
+		func(gtx C) D {
+			return itemInset.Layout(gtx, sprigTheme.TextForm(sTheme, &c.ExportForm, "Export", "Export file").Layout)
+		},
+		func(gtx C) D {
+			status := c.ExportStatus
+			if status == "" {
+				status = fmt.Sprintf("Showing %d of %d captured messages", len(messages), len(all))
+			}
+			return itemInset.Layout(gtx, material.Caption(theme, status).Layout)
+		},
+	}
+	return material.List(theme, &c.List).Layout(gtx, len(controls)+len(messages), func(gtx C, index int) D {
+		return layout.Inset{Left: unit.Dp(8), Right: unit.Dp(8)}.Layout(gtx, func(gtx C) D {
+			if index < len(controls) {
+				return controls[index](gtx)
+			}
+			// newest messages first
+			return c.layoutMessage(gtx, theme, messages[len(messages)-1-(index-len(controls))])
+		})
+	})
+}
+
+// layoutFilter displays a row of radio buttons selecting one of values (or
+// all of them).
+func (c *ProtocolInspectorView) layoutFilter(gtx C, theme *material.Theme, label string, enum *widget.Enum, values []string) D {
+	children := []layout.FlexChild{
+		layout.Rigid(func(gtx C) D {
+			return itemInset.Layout(gtx, material.Body2(theme, label).Layout)
+		}),
+		layout.Rigid(material.RadioButton(theme, enum, allFilter, "All").Layout),
+	}
+	for _, value := range values {
+		value := value
+		children = append(children, layout.Rigid(material.RadioButton(theme, enum, value, value).Layout))
+	}
+	return layout.Flex{Alignment: layout.Middle}.Layout(gtx, children...)
+}
+
+// layoutMessage displays a single captured message. Clicking it toggles
+// the display of its payload.
+func (c *ProtocolInspectorView) layoutMessage(gtx C, theme *material.Theme, msg core.CapturedMessage) D {
+	toggle, ok := c.expanded[msg.Seq]
+	if !ok {
+		toggle = new(widget.Clickable)
+		c.expanded[msg.Seq] = toggle
+	}
+	header := fmt.Sprintf("%s %s %s %s", msg.At.Local().Format("15:04:05.000"), msg.Relay, msg.Direction(), msg.Header)
+	return material.Clickable(gtx, toggle, func(gtx C) D {
+		return itemInset.Layout(gtx, func(gtx C) D {
+			return layout.Flex{Axis: layout.Vertical}.Layout(gtx,
+				layout.Rigid(material.Body2(theme, header).Layout),
+				layout.Rigid(func(gtx C) D {
+					if !c.open[msg.Seq] || len(msg.Payload) < 1 {
+						return D{}
+					}
+					return layout.Inset{Left: unit.Dp(16)}.Layout(gtx,
+						material.Caption(theme, strings.Join(msg.Payload, "\n")).Layout)
+				}),
+			)
+		})
+	})
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"image"
 	"image/color"
 	"log"
@@ -22,7 +23,6 @@ import (
 	"git.sr.ht/~athorp96/forest-ex/expiration"
 	forest "git.sr.ht/~whereswaldon/forest-go"
 	"git.sr.ht/~whereswaldon/forest-go/fields"
-	"git.sr.ht/~whereswaldon/forest-go/store"
 	"git.sr.ht/~whereswaldon/forest-go/twig"
 
 	materials "gioui.org/x/component"
@@ -45,88 +45,6 @@ const (
 
 const replyCoverAnimationTime = 100 * time.Millisecond
 
-// FocusTracker keeps track of which message (if any) is focused and the status
-// of ancestor/descendant messages relative to that message.
-type FocusTracker struct {
-	Pending     *ds.ReplyData
-	Focused     *ds.ReplyData
-	Ancestry    []*fields.QualifiedHash
-	Descendants []*fields.QualifiedHash
-	// Whether the Ancestry and Descendants need to be regenerated because the
-	// contents of the replylist changed
-	stateRefreshNeeded bool
-}
-
-// SetFocus requests that the provided ReplyData become the focused message.
-func (f *FocusTracker) SetFocus(focused *ds.ReplyData) {
-	f.stateRefreshNeeded = true
-	f.Focused = focused
-}
-
-// SetFocusDeferred requests that the provided ReplyData become the focused message
-// at the next state refresh.
-func (f *FocusTracker) SetFocusDeferred(focused *ds.ReplyData) {
-	f.stateRefreshNeeded = true
-	f.Pending = focused
-}
-
-// Invalidate notifies the FocusTracker that its Ancestry and Descendants lists
-// are possibly incorrect as a result of a state change elsewhere.
-func (f *FocusTracker) Invalidate() {
-	f.stateRefreshNeeded = true
-}
-
-// RefreshNodeStatus updates the Ancestry and Descendants of the FocusTracker
-// using the provided store to look them up. If the FocusTracker has not been
-// invalidated since this method was last invoked, this method will return
-// false and do nothing.
-func (f *FocusTracker) RefreshNodeStatus(s store.ExtendedStore) bool {
-	if f.stateRefreshNeeded {
-		f.stateRefreshNeeded = false
-		if f.Pending != nil {
-			f.Focused, f.Pending = f.Pending, nil
-		}
-		if f.Focused == nil {
-			f.Ancestry = nil
-			f.Descendants = nil
-			return true
-		}
-		f.Ancestry, _ = s.AncestryOf(f.Focused.ID)
-		f.Descendants, _ = s.DescendantsOf(f.Focused.ID)
-		return true
-	}
-	return false
-}
-
-// StatusFor returns one of these statuses for a ReplyData, depending on
-// what is currently focused:
-// - Selected
-// - Ancestor
-// - Descendant
-func (f *FocusTracker) StatusFor(rd ds.ReplyData) (status sprigWidget.ReplyStatus) {
-	if f.Focused == nil || f.Focused.ID == nil {
-		return
-	}
-	if rd.ID.Equals(f.Focused.ID) {
-		return sprigWidget.Selected
-	}
-	for _, id := range f.Ancestry {
-		if id.Equals(rd.ID) {
-			return sprigWidget.Ancestor
-		}
-	}
-	for _, id := range f.Descendants {
-		if id.Equals(rd.ID) {
-			return sprigWidget.Descendant
-		}
-	}
-	if f.Focused.ConversationID != nil &&
-		f.Focused.ConversationID.Equals(rd.ConversationID) {
-		return sprigWidget.Sibling
-	}
-	return
-}
-
 // ReplyListView manages the state and layout of the reply list view in
 // Sprig's UI.
 type ReplyListView struct {
@@ -140,7 +58,7 @@ type ReplyListView struct {
 
 	ds.AlphaReplyList
 
-	FocusTracker
+	ds.FocusTracker
 
 	sprigWidget.Composer
 
@@ -152,6 +70,10 @@ type ReplyListView struct {
 	JumpToBottomButton, JumpToTopButton widget.Clickable
 	HideDescendantsButton               widget.Clickable
 
+	// ExportConversationButton exports the focused conversation, while
+	// ExportButton opens the export view without one chosen
+	ExportConversationButton, ExportButton widget.Clickable
+
 	LoadMoreHistoryButton widget.Clickable
 	// how many nodes of history does the view want
 	HistoryRequestCount int
@@ -193,6 +115,9 @@ func NewReplyListView(app core.App) View {
 	c.MessageList.HiddenChildren = func(r ds.ReplyData) int {
 		return c.HiddenTracker.NumDescendants(r.ID)
 	}
+	c.MessageList.DeliveryOf = func(r ds.ReplyData) (string, bool) {
+		return deliveryOf(c.Outbox(), r)
+	}
 
 	c.replyListCover = materials.ScrimState{
 		VisibilityAnimation: materials.VisibilityAnimation{
@@ -218,6 +143,11 @@ func NewReplyListView(app core.App) View {
 		// ensure that we are notified when we need to refresh the state of visible nodes
 		c.Arbor().Store().SubscribeToNewMessages(func(node forest.Node) {
 			go func() {
+				if _, ok := node.(*forest.Identity); ok {
+					c.AlphaReplyList.RecheckAuthor(node.ID(), c.Arbor().Store())
+					c.manager.RequestInvalidate()
+					return
+				}
 				var rd ds.ReplyData
 				if !rd.Populate(node, c.Arbor().Store()) {
 					return
@@ -242,7 +172,62 @@ func (c *ReplyListView) Filtered() bool {
 }
 
 // HandleIntent processes requests from other views in the application.
-func (c *ReplyListView) HandleIntent(intent Intent) {}
+func (c *ReplyListView) HandleIntent(intent Intent) {
+	switch intent.ID {
+	case ViewReplyWithID:
+		details, ok := intent.Details.(ViewReplyWithIDDetails)
+		if !ok {
+			return
+		}
+		c.showReply(details.NodeID)
+	}
+}
+
+// showReply focuses the reply with the given ID so that its ancestry is
+// highlighted, loading it and its ancestors into the list if they are
+// older than the history loaded so far.
+func (c *ReplyListView) showReply(nodeID string) {
+	id := &fields.QualifiedHash{}
+	if err := id.UnmarshalText([]byte(nodeID)); err != nil {
+		log.Printf("cannot show reply %q: %v", nodeID, err)
+		return
+	}
+	s := c.Arbor().Store()
+	ancestry, err := s.AncestryOf(id)
+	if err != nil {
+		log.Printf("failed loading ancestry of %s: %v", id, err)
+	}
+	var populated []ds.ReplyData
+	for _, ancestor := range append(ancestry, id) {
+		if c.HiddenTracker.IsAnchor(ancestor) {
+			c.HiddenTracker.Reveal(ancestor)
+		}
+		node, has, err := s.Get(ancestor)
+		if err != nil || !has {
+			continue
+		}
+		var rd ds.ReplyData
+		if rd.Populate(node, s) {
+			populated = append(populated, rd)
+		}
+	}
+	c.AlphaReplyList.Insert(populated...)
+	index := -1
+	c.AlphaReplyList.WithReplies(func(replies []ds.ReplyData) {
+		for i := range replies {
+			if replies[i].ID.Equals(id) {
+				index = i
+				c.FocusTracker.SetFocus(&replies[i])
+				break
+			}
+		}
+	})
+	if index < 0 {
+		return
+	}
+	c.ensureFocusedVisible(index)
+	c.requestKeyboardFocus()
+}
 
 // BecomeVisible handles setup for when this view becomes the visible
 // view in the application.
@@ -329,6 +314,10 @@ func (c *ReplyListView) AppBarData() (bool, string, []materials.AppBarAction, []
 				Name: "Load more history",
 				Tag:  &c.LoadMoreHistoryButton,
 			},
+			{
+				Name: "Export messages",
+				Tag:  &c.ExportButton,
+			},
 		}
 }
 
@@ -370,7 +359,12 @@ func (c *ReplyListView) getContextualActions() ([]materials.AppBarAction, []mate
 				return btn.Layout(gtx)
 			},
 		},
-	}, []materials.OverflowAction{}
+	}, []materials.OverflowAction{
+		{
+			Name: "Export conversation",
+			Tag:  &c.ExportConversationButton,
+		},
+	}
 }
 
 // triggerReplyContextMenu changes the app bar to contextual mode and
@@ -477,6 +471,20 @@ func (c *ReplyListView) refreshNodeStatus(gtx C) {
 	}
 }
 
+// exportConversation opens the export view with the conversation
+// containing the focused reply chosen.
+func (c *ReplyListView) exportConversation() {
+	root := c.Focused.ConversationID
+	if root == nil || root.Equals(fields.NullHash()) {
+		// the focused reply starts the conversation
+		root = c.Focused.ID
+	}
+	c.manager.ExecuteIntent(Intent{
+		ID:      ExportReplies,
+		Details: ExportRepliesDetails{RootID: root.String()},
+	})
+}
+
 // toggleFilter cycles between filter states.
 func (c *ReplyListView) toggleFilter() {
 	switch c.FilterState {
@@ -524,8 +532,12 @@ func (c *ReplyListView) sendReply() {
 	replyText = strings.TrimSpace(replyText)
 
 	nodeBuilder, err := c.Settings().Builder()
-	if err != nil {
+	if errors.Is(err, core.ErrKeyLocked) {
+		c.manager.RequestViewSwitch(UnlockViewID)
+		return
+	} else if err != nil {
 		log.Printf("failed acquiring node builder: %v", err)
+		return
 	}
 	author = nodeBuilder.User
 	if c.Composer.ComposingConversation() {
@@ -567,24 +579,27 @@ func (c *ReplyListView) sendReply() {
 	c.resetReplyState()
 }
 
-// postReplies actually adds the replies to the store of history (and
-// causes them to be sent because the sprout working is watching the
-// store for updates).
+// postReplies hands the replies to the outbox, which adds them to the
+// store of history and tracks their delivery to relays.
 func (c *ReplyListView) postReplies(author *forest.Identity, replies []*forest.Reply) {
 	go func() {
-		for _, reply := range replies {
-			if err := c.Arbor().Store().Add(author); err != nil {
-				log.Printf("failed adding replying identity to store: %v", err)
-				return
-			}
-			if err := c.Arbor().Store().Add(reply); err != nil {
-				log.Printf("failed adding reply to store: %v", err)
-				return
-			}
+		if err := c.Outbox().Post(author, replies...); err != nil {
+			log.Printf("failed posting replies: %v", err)
 		}
 	}()
 }
 
+// deliveryOf describes the delivery status of a reply for display, and
+// reports whether its delivery can be retried. Replies that were not
+// authored locally have no description.
+func deliveryOf(outbox core.OutboxService, r ds.ReplyData) (string, bool) {
+	delivery, ok := outbox.Delivery(r.ID)
+	if !ok {
+		return "", false
+	}
+	return delivery.Description(), delivery.State == core.Failed
+}
+
 // processMessagePointerEvents checks for specific pointer interactions
 // with messages in the list and handles them.
 func (c *ReplyListView) processMessagePointerEvents(gtx C) {
@@ -763,12 +778,28 @@ func (c *ReplyListView) Update(gtx layout.Context) {
 	if c.LoadMoreHistoryButton.Clicked(gtx) || overflowTag == &c.LoadMoreHistoryButton {
 		go c.loadMoreHistory()
 	}
+	if c.ExportButton.Clicked(gtx) || overflowTag == &c.ExportButton {
+		c.manager.ExecuteIntent(Intent{
+			ID:      ExportReplies,
+			Details: ExportRepliesDetails{},
+		})
+	}
+	if c.Focused != nil && (c.ExportConversationButton.Clicked(gtx) || overflowTag == &c.ExportConversationButton) {
+		c.exportConversation()
+	}
 	for _, event := range c.MessageList.Events() {
 		switch event.Type {
 		case sprigWidget.LinkLongPress:
 			c.Haptic().Buzz()
 		case sprigWidget.LinkOpen:
 			giohyperlink.Open(event.Data)
+		case sprigWidget.RetryDelivery:
+			var id fields.QualifiedHash
+			if err := id.UnmarshalText([]byte(event.Data)); err != nil {
+				log.Printf("failed parsing ID of reply to retry: %v", err)
+				continue
+			}
+			c.Outbox().Retry(&id)
 		}
 	}
 }
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"gioui.org/layout"
+	"gioui.org/unit"
+	"gioui.org/widget"
+	"gioui.org/widget/material"
+	materials "gioui.org/x/component"
+	"git.sr.ht/~whereswaldon/sprig/core"
+	"git.sr.ht/~whereswaldon/sprig/icons"
+)
+
+// searchDateLayout is the format of the date range fields.
+const searchDateLayout = "2006-01-02"
+
+// SearchView finds stored replies by their content and opens the chosen
+// reply in the message list.
+type SearchView struct {
+	manager ViewManager
+
+	core.App
+
+	widget.List
+	Text, Author, Community, Since, Until materials.TextField
+	SearchButton                          widget.Clickable
+
+	// resultsLock guards the fields below, which are set when a search
+	// finishes
+	resultsLock sync.Mutex
+	Results     []core.SearchResult
+	ResultLinks []widget.Clickable
+	Status      string
+}
+
+var _ View = &SearchView{}
+
+func NewSearchView(app core.App) View {
+	c := &SearchView{
+		App: app,
+	}
+	c.List.Axis = layout.Vertical
+	for _, field := range []*materials.TextField{&c.Text, &c.Author, &c.Community, &c.Since, &c.Until} {
+		field.SingleLine = true
+		field.Submit = true
+	}
+	return c
+}
+
+func (c *SearchView) HandleIntent(intent Intent) {}
+
+func (c *SearchView) BecomeVisible() {}
+
+func (c *SearchView) NavItem() *materials.NavItem {
+	return &materials.NavItem{
+		Name: "Search",
+		Icon: icons.SearchIcon,
+	}
+}
+
+func (c *SearchView) AppBarData() (bool, string, []materials.AppBarAction, []materials.OverflowAction) {
+	return true, "Search", nil, nil
+}
+
+func (c *SearchView) SetManager(mgr ViewManager) {
+	c.manager = mgr
+}
+
+// parseSearchDate parses the contents of a date field, which may be empty.
+// If end is set, the date includes the whole of the given day.
+func parseSearchDate(text string, end bool) (time.Time, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return time.Time{}, nil
+	}
+	date, err := time.ParseInLocation(searchDateLayout, text, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("dates must look like %s", searchDateLayout)
+	}
+	if end {
+		date = date.AddDate(0, 0, 1).Add(-time.Millisecond)
+	}
+	return date, nil
+}
+
+// search runs the query described by the fields in the background.
+func (c *SearchView) search() {
+	query := core.SearchQuery{
+		Text:      c.Text.Text(),
+		Author:    strings.TrimSpace(c.Author.Text()),
+		Community: strings.TrimSpace(c.Community.Text()),
+	}
+	var err error
+	if query.Since, err = parseSearchDate(c.Since.Text(), false); err == nil {
+		query.Until, err = parseSearchDate(c.Until.Text(), true)
+	}
+	if err != nil {
+		c.setResults(nil, "Invalid date: "+err.Error())
+		return
+	}
+	c.setResults(nil, "Searching...")
+	go func() {
+		results, err := c.Search().Search(query)
+		status := ""
+		switch {
+		case err != nil:
+			status = err.Error()
+		case len(results) == 0:
+			status = "No messages found."
+		case len(results) == core.DefaultSearchLimit:
+			status = fmt.Sprintf("Showing the newest %d matching messages.", len(results))
+		}
+		if c.Search().Indexing() {
+			status = strings.TrimSpace(status + " Older messages are still being indexed, so some may be missing.")
+		}
+		c.setResults(results, status)
+		c.Invalidate()
+	}()
+}
+
+func (c *SearchView) setResults(results []core.SearchResult, status string) {
+	c.resultsLock.Lock()
+	defer c.resultsLock.Unlock()
+	c.Results = results
+	c.ResultLinks = make([]widget.Clickable, len(results))
+	c.Status = status
+}
+
+func (c *SearchView) Update(gtx layout.Context) {
+	for _, field := range []*materials.TextField{&c.Text, &c.Author, &c.Community, &c.Since, &c.Until} {
+		for _, e := range field.Events() {
+			if _, ok := e.(widget.SubmitEvent); ok {
+				c.search()
+			}
+		}
+	}
+	if c.SearchButton.Clicked(gtx) {
+		c.search()
+	}
+	c.resultsLock.Lock()
+	var chosen *core.SearchResult
+	for i := range c.ResultLinks {
+		if c.ResultLinks[i].Clicked(gtx) {
+			chosen = &c.Results[i]
+		}
+	}
+	c.resultsLock.Unlock()
+	if chosen != nil {
+		c.manager.ExecuteIntent(Intent{
+			ID:      ViewReplyWithID,
+			Details: ViewReplyWithIDDetails{NodeID: chosen.ID.String()},
+		})
+	}
+}
+
+func (c *SearchView) Layout(gtx layout.Context) layout.Dimensions {
+	theme := c.Theme().Current().Theme
+	field := func(f *materials.TextField, hint string) layout.Widget {
+		return func(gtx C) D {
+			return itemInset.Layout(gtx, func(gtx C) D {
+				return f.Layout(gtx, theme, hint)
+			})
+		}
+	}
+	row := func(widgets ...layout.Widget) layout.Widget {
+		return func(gtx C) D {
+			children := make([]layout.FlexChild, len(widgets))
+			for i, w := range widgets {
+				children[i] = layout.Flexed(1, w)
+			}
+			return layout.Flex{}.Layout(gtx, children...)
+		}
+	}
+	c.resultsLock.Lock()
+	results, links, status := c.Results, c.ResultLinks, c.Status
+	c.resultsLock.Unlock()
+	items := []layout.Widget{
+		field(&c.Text, "Words to find"),
+		row(field(&c.Author, "Author"), field(&c.Community, "Community")),
+		row(field(&c.Since, "From ("+searchDateLayout+")"), field(&c.Until, "Until ("+searchDateLayout+")")),
+		func(gtx C) D {
+			return itemInset.Layout(gtx, material.Button(theme, &c.SearchButton, "Search").Layout)
+		},
+		func(gtx C) D {
+			if status == "" {
+				return D{}
+			}
+			return itemInset.Layout(gtx, material.Body2(theme, status).Layout)
+		},
+	}
+	for i := range results {
+		result, link := results[i], &links[i]
+		items = append(items, func(gtx C) D {
+			return material.Clickable(gtx, link, func(gtx C) D {
+				return itemInset.Layout(gtx, func(gtx C) D {
+					return layout.Flex{Axis: layout.Vertical}.Layout(gtx,
+						layout.Rigid(material.Caption(theme, describeSearchResult(result)).Layout),
+						layout.Rigid(material.Body1(theme, result.Snippet).Layout),
+					)
+				})
+			})
+		})
+	}
+	return material.List(theme, &c.List).Layout(gtx, len(items), func(gtx C, index int) D {
+		return layout.UniformInset(unit.Dp(4)).Layout(gtx, items[index])
+	})
+}
+
+// describeSearchResult summarizes where and when a reply was written.
+func describeSearchResult(result core.SearchResult) string {
+	author := result.Author
+	if author == "" {
+		author = "unknown author"
+	}
+	return fmt.Sprintf("%s in %s, %s", author, result.Community, result.Created.Local().Format("2006/01/02 15:04"))
+}
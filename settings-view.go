@@ -1,9 +1,13 @@
 package main
 
 import (
+	"fmt"
 	"log"
+	"strconv"
+	"time"
 
 	"gioui.org/layout"
+	"gioui.org/op"
 	"gioui.org/unit"
 	"gioui.org/widget"
 	"gioui.org/widget/material"
@@ -22,7 +26,12 @@ type SettingsView struct {
 
 	widget.List
 	ConnectionForm          sprigWidget.TextForm
+	DiscoveredRelays        DiscoveredRelayList
+	Relays                  []RelayControls
 	IdentityButton          widget.Clickable
+	ExportIdentityButton    widget.Clickable
+	Identities              []IdentityControls
+	IdentityError           string
 	CommunityList           layout.List
 	CommunityBoxes          []widget.Bool
 	ProfilingSwitch         widget.Bool
@@ -34,6 +43,24 @@ type SettingsView struct {
 	DockNavSwitch           widget.Bool
 	DarkModeSwitch          widget.Bool
 	UseOrchardStoreSwitch   widget.Bool
+	// controls for the embedded relay serving local peers
+	LocalRelaySwitch widget.Bool
+	LocalRelayForm   sprigWidget.TextForm
+	AllowlistForm    sprigWidget.TextForm
+	AllowedPeers     []AllowedPeerControls
+	LocalRelayError  string
+	// controls for the local bot API
+	APISwitch widget.Bool
+	APIError  string
+	// controls for protecting the active identity's private key
+	OldPassphrase, NewPassphrase, ConfirmPassphrase materials.TextField
+	ChangePassphraseButton, LockButton              widget.Clickable
+	AutoLock                                        widget.Enum
+	PassphraseStatus                                string
+	// opens the store integrity audit
+	AuditButton widget.Clickable
+	// opens the offline node bundle view
+	BundleButton widget.Clickable
 }
 
 type Section struct {
@@ -84,6 +111,33 @@ func (s SimpleSectionItem) Layout(gtx C) D {
 	})
 }
 
+// RelayControls holds the UI state for managing a single configured relay.
+type RelayControls struct {
+	Address   string
+	Reconnect widget.Clickable
+	Resync    widget.Clickable
+	Remove    widget.Clickable
+	// controls for how the relay's TLS certificate is verified
+	ForgetCertificate widget.Clickable
+	ClearCABundle     widget.Clickable
+	CABundleForm      sprigWidget.TextForm
+	TrustError        string
+}
+
+// IdentityControls holds the UI state for a single locally stored
+// identity.
+type IdentityControls struct {
+	core.IdentityInfo
+	Use, Archive, Restore, Delete widget.Clickable
+}
+
+// AllowedPeerControls holds the UI state for a single local relay
+// allowlist entry.
+type AllowedPeerControls struct {
+	Entry  string
+	Remove widget.Clickable
+}
+
 var _ View = &SettingsView{}
 
 func NewCommunityMenuView(app core.App) View {
@@ -91,9 +145,16 @@ func NewCommunityMenuView(app core.App) View {
 		App: app,
 	}
 	c.List.Axis = layout.Vertical
-	c.ConnectionForm.TextField.SetText(c.Settings().Address())
 	c.ConnectionForm.TextField.SingleLine = true
 	c.ConnectionForm.TextField.Submit = true
+	c.LocalRelayForm.TextField.SingleLine = true
+	c.LocalRelayForm.TextField.Submit = true
+	c.AllowlistForm.TextField.SingleLine = true
+	c.AllowlistForm.TextField.Submit = true
+	for _, field := range []*materials.TextField{&c.OldPassphrase, &c.NewPassphrase, &c.ConfirmPassphrase} {
+		field.SingleLine = true
+		field.Mask = '•'
+	}
 	return c
 }
 
@@ -121,16 +182,79 @@ func (c *SettingsView) Update(gtx layout.Context) {
 	if c.IdentityButton.Clicked(gtx) {
 		c.manager.RequestViewSwitch(IdentityFormID)
 	}
+	if c.ExportIdentityButton.Clicked(gtx) {
+		c.manager.RequestViewSwitch(IdentityExportViewID)
+	}
+	c.updateIdentities(gtx)
+	if c.updateKeySecurity(gtx) {
+		settingsChanged = true
+	}
 	if c.ProfilingSwitch.Update(gtx) {
 		c.manager.SetProfiling(c.ProfilingSwitch.Value)
 	}
 	if c.ThemeingSwitch.Update(gtx) {
 		c.manager.SetThemeing(c.ThemeingSwitch.Value)
 	}
+	if addr, chosen := c.DiscoveredRelays.Update(gtx, c.Discovery()); chosen {
+		c.Settings().AddAddress(addr)
+		settingsChanged = true
+		c.Sprout().ConnectTo(addr)
+		c.refreshRelays()
+	}
 	if c.ConnectionForm.Submitted() {
-		c.Settings().SetAddress(c.ConnectionForm.TextField.Text())
+		addr := c.ConnectionForm.TextField.Text()
+		if addr != "" {
+			c.Settings().AddAddress(addr)
+			settingsChanged = true
+			c.Sprout().ConnectTo(addr)
+			c.ConnectionForm.TextField.Clear()
+			c.refreshRelays()
+		}
+	}
+	for i := range c.Relays {
+		relay := &c.Relays[i]
+		if relay.Reconnect.Clicked(gtx) {
+			if c.Sprout().State(relay.Address).State == core.BackingOff {
+				c.Sprout().RetryNow(relay.Address)
+			} else {
+				c.Sprout().ConnectTo(relay.Address)
+			}
+		}
+		if relay.Resync.Clicked(gtx) {
+			go func(addr string) {
+				if err := c.Sprout().Resync(addr); err != nil {
+					log.Printf("failed resyncing with %s: %v", addr, err)
+				}
+			}(relay.Address)
+		}
+		if relay.Remove.Clicked(gtx) {
+			c.Sprout().Disconnect(relay.Address)
+			c.Settings().RemoveAddress(relay.Address)
+			settingsChanged = true
+		}
+		if relay.ForgetCertificate.Clicked(gtx) {
+			relay.setTrustError(c.Trust().Forget(relay.Address))
+		}
+		if relay.ClearCABundle.Clicked(gtx) {
+			relay.setTrustError(c.Trust().ClearCABundle(relay.Address))
+		}
+		if relay.CABundleForm.Submitted() {
+			path := relay.CABundleForm.TextField.Text()
+			if path != "" {
+				err := c.Trust().SetCABundle(relay.Address, path)
+				relay.setTrustError(err)
+				if err == nil {
+					relay.CABundleForm.TextField.Clear()
+					c.Sprout().ConnectTo(relay.Address)
+				}
+			}
+		}
+	}
+	if settingsChanged {
+		c.refreshRelays()
+	}
+	if c.updateLocalRelay(gtx) {
 		settingsChanged = true
-		c.Sprout().ConnectTo(c.Settings().Address())
 	}
 	if c.NotificationsSwitch.Update(gtx) {
 		c.Settings().SetNotificationsGloballyAllowed(c.NotificationsSwitch.Value)
@@ -158,21 +282,471 @@ func (c *SettingsView) Update(gtx layout.Context) {
 	}
 	if c.UseOrchardStoreSwitch.Update(gtx) {
 		c.Settings().SetUseOrchardStore(c.UseOrchardStoreSwitch.Value)
+		c.Arbor().MigrateStore()
 		settingsChanged = true
 	}
+	if c.AuditButton.Clicked(gtx) {
+		c.manager.RequestViewSwitch(AuditViewID)
+	}
+	if c.BundleButton.Clicked(gtx) {
+		c.manager.RequestViewSwitch(BundleViewID)
+	}
+	if c.APISwitch.Update(gtx) {
+		c.Settings().SetAPIEnabled(c.APISwitch.Value)
+		settingsChanged = true
+		c.APIError = ""
+		if c.APISwitch.Value {
+			if err := c.API().Start(); err != nil {
+				c.APIError = err.Error()
+			}
+		} else {
+			c.API().Stop()
+		}
+	}
 	if settingsChanged {
 		c.manager.ApplySettings(c.Settings())
 		go c.Settings().Persist()
 	}
 }
 
+// refreshIdentities rebuilds the identity controls to match the identities
+// stored locally.
+func (c *SettingsView) refreshIdentities() {
+	identities, err := c.Settings().Identities()
+	if err != nil {
+		c.IdentityError = err.Error()
+	}
+	c.Identities = make([]IdentityControls, len(identities))
+	for i, info := range identities {
+		c.Identities[i].IdentityInfo = info
+	}
+}
+
+// updateIdentities processes events for the identity controls.
+func (c *SettingsView) updateIdentities(gtx C) {
+	changed := false
+	for i := range c.Identities {
+		identity := &c.Identities[i]
+		var err error
+		switch {
+		case identity.Use.Clicked(gtx):
+			err = c.Settings().SwitchIdentity(identity.ID)
+			if err == nil && c.Settings().KeyLocked() {
+				c.manager.RequestViewSwitch(UnlockViewID)
+			}
+		case identity.Archive.Clicked(gtx):
+			err = c.Settings().ArchiveIdentity(identity.ID)
+		case identity.Restore.Clicked(gtx):
+			err = c.Settings().RestoreIdentity(identity.ID)
+		case identity.Delete.Clicked(gtx):
+			err = c.Settings().DeleteIdentity(identity.ID)
+		default:
+			continue
+		}
+		changed = true
+		c.IdentityError = ""
+		if err != nil {
+			c.IdentityError = err.Error()
+		}
+	}
+	if changed {
+		c.refreshIdentities()
+	}
+}
+
+// identityItems returns the section items listing the local identities.
+func (c *SettingsView) identityItems(sTheme *sprigTheme.Theme) []layout.Widget {
+	theme := sTheme.Theme
+	items := make([]layout.Widget, 0, len(c.Identities)+2)
+	for i := range c.Identities {
+		identity := &c.Identities[i]
+		items = append(items, func(gtx C) D {
+			var actions []layout.FlexChild
+			switch {
+			case identity.Active:
+				actions = append(actions, layout.Rigid(func(gtx C) D {
+					return itemInset.Layout(gtx, material.Body2(theme, "Active").Layout)
+				}))
+			case identity.Archived:
+				actions = append(actions,
+					layout.Rigid(func(gtx C) D {
+						return itemInset.Layout(gtx, material.Button(theme, &identity.Restore, "Restore").Layout)
+					}),
+					layout.Rigid(func(gtx C) D {
+						return itemInset.Layout(gtx, material.Button(theme, &identity.Delete, "Delete").Layout)
+					}),
+				)
+			default:
+				actions = append(actions,
+					layout.Rigid(func(gtx C) D {
+						return itemInset.Layout(gtx, material.Button(theme, &identity.Use, "Use").Layout)
+					}),
+					layout.Rigid(func(gtx C) D {
+						return itemInset.Layout(gtx, material.Button(theme, &identity.Archive, "Archive").Layout)
+					}),
+				)
+			}
+			return layout.Flex{Alignment: layout.Middle}.Layout(gtx, append([]layout.FlexChild{
+				layout.Flexed(1, func(gtx C) D {
+					return layout.Flex{Axis: layout.Vertical}.Layout(gtx,
+						layout.Rigid(func(gtx C) D {
+							name := sprigTheme.AuthorName(sTheme, identity.Name, identity.ID, identity.Active)
+							return itemInset.Layout(gtx, name.Layout)
+						}),
+						layout.Rigid(func(gtx C) D {
+							fingerprint := identity.Fingerprint
+							if identity.Algorithm != "" {
+								fingerprint = identity.Algorithm + " · " + fingerprint
+							}
+							if identity.Archived {
+								fingerprint += " (archived)"
+							}
+							return itemInset.Layout(gtx, material.Caption(theme, fingerprint).Layout)
+						}),
+					)
+				}),
+			}, actions...)...)
+		})
+	}
+	if c.IdentityError != "" {
+		items = append(items, func(gtx C) D {
+			return itemInset.Layout(gtx, material.Body2(theme, c.IdentityError).Layout)
+		})
+	}
+	items = append(items, SimpleSectionItem{
+		Theme: theme,
+		Control: func(gtx C) D {
+			return layout.Flex{Alignment: layout.Middle}.Layout(gtx,
+				layout.Rigid(func(gtx C) D {
+					return itemInset.Layout(gtx, material.Button(theme, &c.IdentityButton, "Create or import Identity").Layout)
+				}),
+				layout.Rigid(func(gtx C) D {
+					return itemInset.Layout(gtx, material.Button(theme, &c.ExportIdentityButton, "Back up active Identity").Layout)
+				}),
+			)
+		},
+		Context: "Messages are signed by the active identity. Archived identities are kept on this device but cannot be used until they are restored. Deleting an archived identity removes its private key permanently, so back it up first if you may need it again.",
+	}.Layout)
+	return items
+}
+
+// autoLockChoices are the offered durations an unlocked private key may go
+// unused, keyed by their widget.Enum value.
+var autoLockChoices = []struct {
+	Value, Label string
+	Timeout      time.Duration
+}{
+	{"0", "Never", 0},
+	{"5", "5 minutes", 5 * time.Minute},
+	{"15", "15 minutes", 15 * time.Minute},
+	{"60", "1 hour", time.Hour},
+}
+
+// refreshKeySecurity resets the private key controls to match the settings.
+func (c *SettingsView) refreshKeySecurity() {
+	c.OldPassphrase.Clear()
+	c.NewPassphrase.Clear()
+	c.ConfirmPassphrase.Clear()
+	c.PassphraseStatus = ""
+	c.AutoLock.Value = strconv.Itoa(int(c.Settings().AutoLockTimeout() / time.Minute))
+}
+
+// updateKeySecurity processes events for the private key controls and
+// returns whether any settings changed.
+func (c *SettingsView) updateKeySecurity(gtx C) bool {
+	changed := false
+	if c.AutoLock.Update(gtx) {
+		for _, choice := range autoLockChoices {
+			if choice.Value == c.AutoLock.Value {
+				c.Settings().SetAutoLockTimeout(choice.Timeout)
+				changed = true
+			}
+		}
+	}
+	if c.LockButton.Clicked(gtx) {
+		c.Settings().LockKey()
+		c.manager.RequestViewSwitch(UnlockViewID)
+	}
+	if c.ChangePassphraseButton.Clicked(gtx) {
+		switch {
+		case c.NewPassphrase.Text() == "":
+			c.PassphraseStatus = "Choose a new passphrase."
+		case c.NewPassphrase.Text() != c.ConfirmPassphrase.Text():
+			c.PassphraseStatus = "The new passphrases do not match."
+		default:
+			err := c.Settings().ChangePassphrase(c.OldPassphrase.Text(), c.NewPassphrase.Text())
+			if err != nil {
+				c.PassphraseStatus = "Failed: " + err.Error()
+			} else {
+				c.refreshKeySecurity()
+				c.PassphraseStatus = "Passphrase changed."
+			}
+		}
+	}
+	return changed
+}
+
+// keySecurityItems returns the section items protecting the active
+// identity's private key.
+func (c *SettingsView) keySecurityItems(theme *material.Theme) []layout.Widget {
+	if c.Settings().UsesExternalKey() {
+		return []layout.Widget{func(gtx C) D {
+			return itemInset.Layout(gtx, material.Body1(theme, "The private key of the active identity is held by gpg. Its passphrase and locking are managed by your gpg agent.").Layout)
+		}}
+	}
+	encrypted := c.Settings().KeyEncrypted()
+	var items []layout.Widget
+	if !encrypted {
+		items = append(items, func(gtx C) D {
+			return itemInset.Layout(gtx, material.Body1(theme, "The private key of the active identity is stored without a passphrase. Anyone who can read sprig's data directory can sign messages as you.").Layout)
+		})
+	} else {
+		items = append(items, func(gtx C) D {
+			return itemInset.Layout(gtx, func(gtx C) D {
+				return c.OldPassphrase.Layout(gtx, theme, "Current passphrase")
+			})
+		})
+	}
+	items = append(items,
+		func(gtx C) D {
+			return itemInset.Layout(gtx, func(gtx C) D {
+				return c.NewPassphrase.Layout(gtx, theme, "New passphrase")
+			})
+		},
+		func(gtx C) D {
+			return itemInset.Layout(gtx, func(gtx C) D {
+				return c.ConfirmPassphrase.Layout(gtx, theme, "Confirm new passphrase")
+			})
+		},
+		func(gtx C) D {
+			label := "Change passphrase"
+			if !encrypted {
+				label = "Encrypt private key"
+			}
+			return layout.Flex{Alignment: layout.Middle}.Layout(gtx,
+				layout.Rigid(func(gtx C) D {
+					return itemInset.Layout(gtx, material.Button(theme, &c.ChangePassphraseButton, label).Layout)
+				}),
+				layout.Flexed(1, func(gtx C) D {
+					return itemInset.Layout(gtx, material.Body2(theme, c.PassphraseStatus).Layout)
+				}),
+			)
+		},
+	)
+	if !encrypted {
+		return items
+	}
+	return append(items, SimpleSectionItem{
+		Theme: theme,
+		Control: func(gtx C) D {
+			choices := []layout.FlexChild{
+				layout.Rigid(func(gtx C) D {
+					return itemInset.Layout(gtx, material.Body1(theme, "Lock after").Layout)
+				}),
+			}
+			for _, choice := range autoLockChoices {
+				choice := choice
+				choices = append(choices, layout.Rigid(func(gtx C) D {
+					return itemInset.Layout(gtx, material.RadioButton(theme, &c.AutoLock, choice.Value, choice.Label).Layout)
+				}))
+			}
+			choices = append(choices, layout.Rigid(func(gtx C) D {
+				return itemInset.Layout(gtx, material.Button(theme, &c.LockButton, "Lock now").Layout)
+			}))
+			return layout.Flex{Alignment: layout.Middle}.Layout(gtx, choices...)
+		},
+		Context: "The unlocked key is forgotten after it goes unused for the chosen time, and the passphrase is needed again to send messages.",
+	}.Layout)
+}
+
+// refreshRelays rebuilds the relay controls to match the configured relays.
+func (c *SettingsView) refreshRelays() {
+	addrs := c.Settings().Addresses()
+	if len(addrs) == len(c.Relays) {
+		same := true
+		for i := range addrs {
+			if addrs[i] != c.Relays[i].Address {
+				same = false
+				break
+			}
+		}
+		if same {
+			return
+		}
+	}
+	c.Relays = make([]RelayControls, len(addrs))
+	for i, addr := range addrs {
+		c.Relays[i].Address = addr
+		c.Relays[i].CABundleForm.TextField.SingleLine = true
+		c.Relays[i].CABundleForm.TextField.Submit = true
+	}
+}
+
+// refreshAllowedPeers rebuilds the allowlist controls to match the settings.
+func (c *SettingsView) refreshAllowedPeers() {
+	entries := c.Settings().LocalRelayAllowlist()
+	c.AllowedPeers = make([]AllowedPeerControls, len(entries))
+	for i, entry := range entries {
+		c.AllowedPeers[i].Entry = entry
+	}
+}
+
+// updateLocalRelay processes events for the embedded relay controls and
+// returns whether any settings changed.
+func (c *SettingsView) updateLocalRelay(gtx C) bool {
+	changed := false
+	restart := false
+	if c.LocalRelaySwitch.Update(gtx) {
+		c.Settings().SetLocalRelayEnabled(c.LocalRelaySwitch.Value)
+		changed = true
+		if c.LocalRelaySwitch.Value {
+			restart = true
+		} else {
+			c.LocalRelay().Stop()
+			c.LocalRelayError = ""
+		}
+	}
+	if c.LocalRelayForm.Submitted() {
+		if addr := c.LocalRelayForm.TextField.Text(); addr != "" {
+			c.Settings().SetLocalRelayAddress(addr)
+			changed = true
+			restart = c.Settings().LocalRelayEnabled()
+		}
+	}
+	allowlist := c.Settings().LocalRelayAllowlist()
+	allowlistChanged := false
+	if c.AllowlistForm.Submitted() {
+		if entry := c.AllowlistForm.TextField.Text(); entry != "" {
+			if _, err := core.ParseAllowlist([]string{entry}); err != nil {
+				c.LocalRelayError = err.Error()
+			} else {
+				allowlist = append(allowlist, entry)
+				allowlistChanged = true
+				c.AllowlistForm.TextField.Clear()
+			}
+		}
+	}
+	for i := range c.AllowedPeers {
+		if c.AllowedPeers[i].Remove.Clicked(gtx) {
+			for j, entry := range allowlist {
+				if entry == c.AllowedPeers[i].Entry {
+					allowlist = append(allowlist[:j], allowlist[j+1:]...)
+					allowlistChanged = true
+					break
+				}
+			}
+		}
+	}
+	if allowlistChanged {
+		c.Settings().SetLocalRelayAllowlist(allowlist)
+		if err := c.LocalRelay().SetAllowlist(allowlist); err != nil {
+			c.LocalRelayError = err.Error()
+		} else {
+			c.LocalRelayError = ""
+		}
+		c.refreshAllowedPeers()
+		changed = true
+	}
+	if restart {
+		if err := c.LocalRelay().SetAllowlist(c.Settings().LocalRelayAllowlist()); err != nil {
+			c.LocalRelayError = err.Error()
+		} else if err := c.LocalRelay().Start(c.Settings().LocalRelayAddress()); err != nil {
+			c.LocalRelayError = err.Error()
+		} else {
+			c.LocalRelayError = ""
+		}
+	}
+	return changed
+}
+
+// localRelayItems returns the section items controlling the embedded relay.
+func (c *SettingsView) localRelayItems(sTheme *sprigTheme.Theme) []layout.Widget {
+	theme := sTheme.Theme
+	status := c.LocalRelay().Status()
+	description := "Not listening"
+	if status.Listening {
+		description = fmt.Sprintf("Listening on %s, %d peers connected", status.Address, len(status.Peers))
+		if status.Rejected > 0 {
+			description += fmt.Sprintf(", %d refused", status.Rejected)
+		}
+	}
+	items := []layout.Widget{
+		SimpleSectionItem{
+			Theme: theme,
+			Control: func(gtx C) D {
+				return layout.Flex{Alignment: layout.Middle}.Layout(gtx,
+					layout.Rigid(func(gtx C) D {
+						return itemInset.Layout(gtx, material.Switch(theme, &c.LocalRelaySwitch, "Serve local peers").Layout)
+					}),
+					layout.Rigid(func(gtx C) D {
+						return itemInset.Layout(gtx, material.Body1(theme, "Serve local peers").Layout)
+					}),
+					layout.Flexed(1, func(gtx C) D {
+						return itemInset.Layout(gtx, material.Body2(theme, description).Layout)
+					}),
+				)
+			},
+			Context: "Lets other sprig instances on your network connect to this one as a relay and exchange messages without an external relay. Only peers on this device and peers listed below may connect. Connections are not encrypted.",
+		}.Layout,
+		func(gtx C) D {
+			return itemInset.Layout(gtx, sprigTheme.TextForm(sTheme, &c.LocalRelayForm, "Listen", "HOST:PORT (currently "+c.Settings().LocalRelayAddress()+")").Layout)
+		},
+	}
+	for _, peer := range status.Peers {
+		peer := peer
+		items = append(items, func(gtx C) D {
+			return itemInset.Layout(gtx, material.Caption(theme, "Connected: "+peer).Layout)
+		})
+	}
+	for i := range c.AllowedPeers {
+		allowed := &c.AllowedPeers[i]
+		items = append(items, func(gtx C) D {
+			return layout.Flex{Alignment: layout.Middle}.Layout(gtx,
+				layout.Flexed(1, func(gtx C) D {
+					return itemInset.Layout(gtx, material.Body1(theme, allowed.Entry).Layout)
+				}),
+				layout.Rigid(func(gtx C) D {
+					return itemInset.Layout(gtx, material.IconButton(theme, &allowed.Remove, icons.ClearIcon, "Remove").Layout)
+				}),
+			)
+		})
+	}
+	items = append(items, func(gtx C) D {
+		return itemInset.Layout(gtx, sprigTheme.TextForm(sTheme, &c.AllowlistForm, "Allow", "IP address or CIDR range").Layout)
+	})
+	errText := c.LocalRelayError
+	if errText == "" && status.LastError != nil {
+		errText = status.LastError.Error()
+	}
+	if errText != "" {
+		items = append(items, func(gtx C) D {
+			return itemInset.Layout(gtx, material.Caption(theme, errText).Layout)
+		})
+	}
+	return items
+}
+
+// setTrustError records the result of changing how the relay is verified.
+func (r *RelayControls) setTrustError(err error) {
+	if err != nil {
+		r.TrustError = err.Error()
+	} else {
+		r.TrustError = ""
+	}
+}
+
 func (c *SettingsView) BecomeVisible() {
-	c.ConnectionForm.TextField.SetText(c.Settings().Address())
+	c.refreshRelays()
+	c.refreshIdentities()
+	c.refreshKeySecurity()
 	c.NotificationsSwitch.Value = c.Settings().NotificationsGloballyAllowed()
 	c.BottomBarSwitch.Value = c.Settings().BottomAppBar()
 	c.DockNavSwitch.Value = c.Settings().DockNavDrawer()
 	c.DarkModeSwitch.Value = c.Settings().DarkMode()
 	c.UseOrchardStoreSwitch.Value = c.Settings().UseOrchardStore()
+	c.LocalRelaySwitch.Value = c.Settings().LocalRelayEnabled()
+	c.APISwitch.Value = c.Settings().APIEnabled()
+	c.refreshAllowedPeers()
 }
 
 func (c *SettingsView) Layout(gtx layout.Context) layout.Dimensions {
@@ -180,31 +754,20 @@ func (c *SettingsView) Layout(gtx layout.Context) layout.Dimensions {
 	theme := sTheme.Theme
 	sections := []Section{
 		{
-			Heading: "Identity",
-			Items: []layout.Widget{
-				func(gtx C) D {
-					if c.Settings().ActiveArborIdentityID() != nil {
-						id, _ := c.Settings().Identity()
-						return itemInset.Layout(gtx, sprigTheme.AuthorName(sTheme, string(id.Name.Blob), id.ID(), true).Layout)
-					}
-					return itemInset.Layout(gtx, material.Button(theme, &c.IdentityButton, "Create new Identity").Layout)
-				},
-			},
+			Heading: "Identities",
+			Items:   c.identityItems(sTheme),
+		},
+		{
+			Heading: "Private Key",
+			Items:   c.keySecurityItems(theme),
 		},
 		{
 			Heading: "Connection",
-			Items: []layout.Widget{
-				SimpleSectionItem{
-					Theme: theme,
-					Control: func(gtx C) D {
-						return itemInset.Layout(gtx, func(gtx C) D {
-							form := sprigTheme.TextForm(sTheme, &c.ConnectionForm, "Connect", "HOST:PORT")
-							return form.Layout(gtx)
-						})
-					},
-					Context: "You can restart your connection to a relay by hitting the Connect button above without changing the address.",
-				}.Layout,
-			},
+			Items:   c.relayItems(sTheme),
+		},
+		{
+			Heading: "Local Relay",
+			Items:   c.localRelayItems(sTheme),
 		},
 		{
 			Heading: "Notifications",
@@ -246,7 +809,21 @@ func (c *SettingsView) Layout(gtx layout.Context) layout.Dimensions {
 							}),
 						)
 					},
-					Context: "Orchard is a single-file read-oriented database for storing nodes.",
+					Context: "Orchard is a single-file read-oriented database for storing nodes. Switching stores copies your messages into the new one, which is used once sprig restarts.",
+				}.Layout,
+				SimpleSectionItem{
+					Theme: theme,
+					Control: func(gtx C) D {
+						return itemInset.Layout(gtx, material.Button(theme, &c.AuditButton, "Store audit").Layout)
+					},
+					Context: "Check every stored message for corruption, forged signatures, and missing references.",
+				}.Layout,
+				SimpleSectionItem{
+					Theme: theme,
+					Control: func(gtx C) D {
+						return itemInset.Layout(gtx, material.Button(theme, &c.BundleButton, "Offline sync").Layout)
+					},
+					Context: "Carry messages between machines that cannot reach a relay by writing them to a bundle file and importing it on the other machine.",
 				}.Layout,
 			},
 		},
@@ -325,6 +902,7 @@ func (c *SettingsView) Layout(gtx layout.Context) layout.Dimensions {
 						)
 					},
 				}.Layout,
+				c.apiItem(theme),
 				func(gtx C) D {
 					return itemInset.Layout(gtx, material.Body1(theme, VersionString).Layout)
 				},
@@ -344,6 +922,157 @@ func (c *SettingsView) Layout(gtx layout.Context) layout.Dimensions {
 	})
 }
 
+// apiItem returns the section item controlling the local bot API.
+func (c *SettingsView) apiItem(theme *material.Theme) layout.Widget {
+	description := "Not running"
+	if c.API().Running() {
+		description = "Listening on " + c.API().SocketPath()
+	}
+	if c.APIError != "" {
+		description = "Failed: " + c.APIError
+	}
+	return SimpleSectionItem{
+		Theme: theme,
+		Control: func(gtx C) D {
+			return layout.Flex{Alignment: layout.Middle}.Layout(gtx,
+				layout.Rigid(func(gtx C) D {
+					return itemInset.Layout(gtx, material.Switch(theme, &c.APISwitch, "Enable Bot API").Layout)
+				}),
+				layout.Rigid(func(gtx C) D {
+					return itemInset.Layout(gtx, material.Body1(theme, "Enable bot API").Layout)
+				}),
+				layout.Flexed(1, func(gtx C) D {
+					return itemInset.Layout(gtx, material.Body2(theme, description).Layout)
+				}),
+			)
+		},
+		Context: "Serves JSON-RPC on a Unix domain socket so that local bots and scripts can read and post messages as your identity. Clients must authenticate with the token stored in " + c.API().TokenPath() + ".",
+	}.Layout
+}
+
+// relayStatusText describes the connection status of a relay for display.
+// While backing off, it requests a redraw so that the countdown stays
+// accurate.
+func relayStatusText(gtx C, status core.RelayStatus) string {
+	if status.State != core.BackingOff {
+		return status.State.String()
+	}
+	op.InvalidateOp{At: gtx.Now.Add(time.Second)}.Add(gtx.Ops)
+	remaining := status.RetryAt.Sub(gtx.Now).Round(time.Second)
+	if remaining < 0 {
+		remaining = 0
+	}
+	return fmt.Sprintf("retrying in %v (attempt %d)", remaining, status.Attempts)
+}
+
+// relayItems returns a section item for each configured relay followed by
+// a form for adding new relays.
+func (c *SettingsView) relayItems(sTheme *sprigTheme.Theme) []layout.Widget {
+	theme := sTheme.Theme
+	items := make([]layout.Widget, 0, len(c.Relays)+1)
+	for i := range c.Relays {
+		relay := &c.Relays[i]
+		items = append(items, func(gtx C) D {
+			status := c.Sprout().State(relay.Address)
+			return layout.Flex{Alignment: layout.Middle}.Layout(gtx,
+				layout.Flexed(1, func(gtx C) D {
+					return layout.Flex{Axis: layout.Vertical}.Layout(gtx,
+						layout.Rigid(func(gtx C) D {
+							return itemInset.Layout(gtx, material.Body1(theme, relay.Address).Layout)
+						}),
+						layout.Rigid(func(gtx C) D {
+							if status.LastError == nil {
+								return D{}
+							}
+							return itemInset.Layout(gtx, material.Caption(theme, "Last error: "+status.LastError.Error()).Layout)
+						}),
+					)
+				}),
+				layout.Rigid(func(gtx C) D {
+					return itemInset.Layout(gtx, material.Body2(theme, relayStatusText(gtx, status)).Layout)
+				}),
+				layout.Rigid(func(gtx C) D {
+					description := "Reconnect"
+					if status.State == core.BackingOff {
+						description = "Retry now"
+					}
+					return itemInset.Layout(gtx, material.IconButton(theme, &relay.Reconnect, icons.RefreshIcon, description).Layout)
+				}),
+				layout.Rigid(func(gtx C) D {
+					if status.State != core.Connected {
+						return D{}
+					}
+					return itemInset.Layout(gtx, material.IconButton(theme, &relay.Resync, icons.SyncIcon, "Full resync").Layout)
+				}),
+				layout.Rigid(func(gtx C) D {
+					return itemInset.Layout(gtx, material.IconButton(theme, &relay.Remove, icons.ClearIcon, "Remove").Layout)
+				}),
+			)
+		})
+		if core.UsesTLS(relay.Address) {
+			items = append(items, func(gtx C) D {
+				return c.layoutRelayTrust(gtx, sTheme, relay)
+			})
+		}
+	}
+	items = append(items, SimpleSectionItem{
+		Theme: theme,
+		Control: func(gtx C) D {
+			return itemInset.Layout(gtx, func(gtx C) D {
+				form := sprigTheme.TextForm(sTheme, &c.ConnectionForm, "Add", "HOST:PORT or URL")
+				return form.Layout(gtx)
+			})
+		},
+		Context: "Sprig connects to every relay listed above at once. Use the refresh button to restart a single connection or to retry a failed one immediately. Reconnecting only fetches history added since the last sync; use the sync button to fetch the full history of your subscriptions again. The certificate of each TLS relay is pinned when sprig first connects, and connections presenting a different certificate are blocked. Relays with self-signed certificates issued by your own CA can be verified with a CA bundle instead.",
+	}.Layout)
+	items = append(items, func(gtx C) D {
+		return itemInset.Layout(gtx, material.Body2(theme, "Relays on your local network:").Layout)
+	})
+	items = append(items, c.DiscoveredRelays.Items(theme, c.Discovery().Relays(), c.Settings().Addresses())...)
+	return items
+}
+
+// layoutRelayTrust displays how a relay's certificate is verified along with
+// controls to change it.
+func (c *SettingsView) layoutRelayTrust(gtx C, sTheme *sprigTheme.Theme, relay *RelayControls) D {
+	theme := sTheme.Theme
+	var description string
+	var reset layout.Widget
+	if c.Trust().HasCABundle(relay.Address) {
+		description = "Certificate verified with a custom CA bundle"
+		reset = material.Button(theme, &relay.ClearCABundle, "Use pinning").Layout
+	} else if fingerprint, pinned := c.Trust().Fingerprint(relay.Address); pinned {
+		description = "Pinned certificate " + core.FormatFingerprint(fingerprint)
+		reset = material.Button(theme, &relay.ForgetCertificate, "Forget").Layout
+	} else {
+		description = "The certificate will be pinned when first presented"
+	}
+	return layout.Flex{Axis: layout.Vertical}.Layout(gtx,
+		layout.Rigid(func(gtx C) D {
+			return layout.Flex{Alignment: layout.Middle}.Layout(gtx,
+				layout.Flexed(1, func(gtx C) D {
+					return itemInset.Layout(gtx, material.Caption(theme, description).Layout)
+				}),
+				layout.Rigid(func(gtx C) D {
+					if reset == nil {
+						return D{}
+					}
+					return itemInset.Layout(gtx, reset)
+				}),
+			)
+		}),
+		layout.Rigid(func(gtx C) D {
+			return itemInset.Layout(gtx, sprigTheme.TextForm(sTheme, &relay.CABundleForm, "Use CA", "CA bundle file (PEM)").Layout)
+		}),
+		layout.Rigid(func(gtx C) D {
+			if relay.TrustError == "" {
+				return D{}
+			}
+			return itemInset.Layout(gtx, material.Caption(theme, relay.TrustError).Layout)
+		}),
+	)
+}
+
 func (c *SettingsView) SetManager(mgr ViewManager) {
 	c.manager = mgr
 }
@@ -217,20 +217,28 @@ func (c *SubStateManager) Refresh() {
 
 func (c *SubStateManager) reconcileSubscriptions(changes []Sub) []Sub {
 	for _, sub := range changes {
+		if !sub.Subbed.Value {
+			c.Settings().RemoveSubscription(sub.Community.ID().String())
+		} else {
+			c.Settings().AddSubscription(sub.Community.ID().String())
+		}
+		go c.Settings().Persist()
 		for _, addr := range sub.ActiveHostingRelays {
-			timeout := time.NewTicker(time.Second * 5)
 			worker := c.Sprout().WorkerFor(addr)
+			if worker == nil {
+				log.Printf("Cannot change sub for %s on relay %s: not connected", sub.ID(), addr)
+				continue
+			}
+			timeout := time.NewTicker(time.Second * 5)
 			var subFunc func(*forest.Community, <-chan time.Time) error
 			var sessionFunc func(*fields.QualifiedHash)
 			if !sub.Subbed.Value {
 				subFunc = worker.SendUnsubscribe
 				sessionFunc = worker.Unsubscribe
-				c.Settings().RemoveSubscription(sub.Community.ID().String())
 			} else {
 				subFunc = worker.SendSubscribe
 				sessionFunc = worker.Subscribe
-				c.Settings().AddSubscription(sub.Community.ID().String())
-				go core.BootstrapSubscribed(worker, []string{sub.Community.ID().String()})
+				go c.Sprout().Synchronize(addr, []string{sub.Community.ID().String()})
 			}
 			if err := subFunc(sub.Community, timeout.C); err != nil {
 				log.Printf("Failed changing sub for %s to %v on relay %s", sub.ID(), sub.Subbed.Value, addr)
@@ -238,7 +246,6 @@ func (c *SubStateManager) reconcileSubscriptions(changes []Sub) []Sub {
 				sessionFunc(sub.Community.ID())
 				log.Printf("Changed subscription for %s to %v on relay %s", sub.ID(), sub.Subbed.Value, addr)
 			}
-			go c.Settings().Persist()
 		}
 	}
 	subs := c.refreshSubs()
@@ -252,6 +259,9 @@ func (c *SubStateManager) refreshSubs() []Sub {
 	for _, conn := range c.Sprout().Connections() {
 		func() {
 			worker := c.Sprout().WorkerFor(conn)
+			if worker == nil {
+				return
+			}
 			worker.Session.RLock()
 			defer worker.Session.RUnlock()
 			response, err := worker.SendList(fields.NodeTypeCommunity, 1024, time.NewTicker(time.Second*5).C)
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"gioui.org/layout"
+	"gioui.org/unit"
+	"gioui.org/widget"
+	"gioui.org/widget/material"
+	materials "gioui.org/x/component"
+	"git.sr.ht/~whereswaldon/sprig/core"
+)
+
+// UnlockView asks for the passphrase protecting the active identity's
+// private key.
+type UnlockView struct {
+	manager      ViewManager
+	Passphrase   materials.TextField
+	UnlockButton widget.Clickable
+	Error        string
+
+	core.App
+}
+
+var _ View = &UnlockView{}
+
+func NewUnlockView(app core.App) View {
+	c := &UnlockView{
+		App: app,
+	}
+	c.Passphrase.SingleLine = true
+	c.Passphrase.Submit = true
+	c.Passphrase.Mask = '•'
+	return c
+}
+
+func (c *UnlockView) HandleIntent(intent Intent) {}
+
+func (c *UnlockView) BecomeVisible() {
+	c.Passphrase.Clear()
+	c.Error = ""
+}
+
+func (c *UnlockView) NavItem() *materials.NavItem {
+	return nil
+}
+
+func (c *UnlockView) AppBarData() (bool, string, []materials.AppBarAction, []materials.OverflowAction) {
+	return false, "", nil, nil
+}
+
+func (c *UnlockView) Update(gtx layout.Context) {
+	submitted := c.UnlockButton.Clicked(gtx)
+	for _, e := range c.Passphrase.Events() {
+		if _, ok := e.(widget.SubmitEvent); ok {
+			submitted = true
+		}
+	}
+	if !submitted {
+		return
+	}
+	if err := c.Settings().UnlockKey(c.Passphrase.Text()); err != nil {
+		c.Error = err.Error()
+		c.Passphrase.Clear()
+		return
+	}
+	if len(c.Settings().Subscriptions()) < 1 {
+		c.manager.SetView(SubscriptionSetupFormViewID)
+	} else {
+		c.manager.SetView(ReplyViewID)
+	}
+}
+
+func (c *UnlockView) Layout(gtx layout.Context) layout.Dimensions {
+	theme := c.Theme().Current().Theme
+	inset := layout.UniformInset(unit.Dp(4))
+	name := "your identity"
+	if identity, err := c.Settings().Identity(); err == nil {
+		name = string(identity.Name.Blob)
+	}
+	return layout.Center.Layout(gtx, func(gtx C) D {
+		return layout.Flex{Axis: layout.Vertical, Alignment: layout.Middle}.Layout(gtx,
+			layout.Rigid(func(gtx C) D {
+				return inset.Layout(gtx, material.Body1(theme, "Enter the passphrase for "+name+":").Layout)
+			}),
+			layout.Rigid(func(gtx C) D {
+				return inset.Layout(gtx, func(gtx C) D {
+					return c.Passphrase.Layout(gtx, theme, "Passphrase")
+				})
+			}),
+			layout.Rigid(func(gtx C) D {
+				if c.Error == "" {
+					return D{}
+				}
+				return inset.Layout(gtx, material.Body2(theme, c.Error).Layout)
+			}),
+			layout.Rigid(func(gtx C) D {
+				return inset.Layout(gtx, material.Button(theme, &c.UnlockButton, "Unlock").Layout)
+			}),
+		)
+	})
+}
+
+func (c *UnlockView) SetManager(mgr ViewManager) {
+	c.manager = mgr
+}
@@ -13,6 +13,7 @@ import (
 	"gioui.org/op/clip"
 	"gioui.org/op/paint"
 	"gioui.org/unit"
+	"gioui.org/widget"
 	"gioui.org/widget/material"
 	materials "gioui.org/x/component"
 
@@ -88,6 +89,9 @@ type viewManager struct {
 	// runtime themeing state
 	themeing  bool
 	themeView View
+
+	// buttons for the actions of the current ActionBanner
+	bannerActions []widget.Clickable
 }
 
 func NewViewManager(window *app.Window, app core.App) ViewManager {
@@ -260,6 +264,52 @@ func (vm *viewManager) Layout(gtx layout.Context) layout.Dimensions {
 	)
 }
 
+// layoutActionBanner displays the banner's text alongside a button for each of
+// its actions.
+func (vm *viewManager) layoutActionBanner(gtx C, th *sprigTheme.Theme, banner *core.ActionBanner) D {
+	if len(vm.bannerActions) < len(banner.Actions) {
+		vm.bannerActions = make([]widget.Clickable, len(banner.Actions))
+	}
+	for i, action := range banner.Actions {
+		if vm.bannerActions[i].Clicked(gtx) {
+			banner.Cancel()
+			if action.Do != nil {
+				action.Do()
+			}
+			vm.RequestInvalidate()
+		}
+	}
+	theme := *(th.Theme)
+	theme.Palette = sprigTheme.ApplyAsNormal(theme.Palette, th.Secondary.Light)
+	return layout.Stack{}.Layout(gtx,
+		layout.Expanded(func(gtx C) D {
+			paint.FillShape(gtx.Ops, theme.Bg, clip.Rect(image.Rectangle{Max: gtx.Constraints.Min}).Op())
+			return D{Size: gtx.Constraints.Min}
+		}),
+		layout.Stacked(func(gtx C) D {
+			return layout.UniformInset(unit.Dp(4)).Layout(gtx, func(gtx C) D {
+				gtx.Constraints.Min.X = gtx.Constraints.Max.X
+				buttons := make([]layout.FlexChild, 0, len(banner.Actions))
+				for i, action := range banner.Actions {
+					btn := &vm.bannerActions[i]
+					label := action.Label
+					buttons = append(buttons, layout.Rigid(func(gtx C) D {
+						return layout.UniformInset(unit.Dp(4)).Layout(gtx, material.Button(&theme, btn, label).Layout)
+					}))
+				}
+				return layout.Flex{Axis: layout.Vertical}.Layout(gtx,
+					layout.Rigid(func(gtx C) D {
+						return layout.UniformInset(unit.Dp(4)).Layout(gtx, material.Body1(&theme, banner.Text).Layout)
+					}),
+					layout.Rigid(func(gtx C) D {
+						return layout.Flex{Spacing: layout.SpaceStart}.Layout(gtx, buttons...)
+					}),
+				)
+			})
+		}),
+	)
+}
+
 func (vm *viewManager) layoutCurrentView(gtx layout.Context) layout.Dimensions {
 	view := vm.views[vm.current]
 	view.Update(gtx)
@@ -288,6 +338,8 @@ func (vm *viewManager) layoutCurrentView(gtx layout.Context) layout.Dimensions {
 					})
 				}),
 			)
+		case *core.ActionBanner:
+			return vm.layoutActionBanner(gtx, th, bannerConfig)
 		default:
 			return D{}
 		}
@@ -307,6 +359,9 @@ func (vm *viewManager) layoutCurrentView(gtx layout.Context) layout.Dimensions {
 			}),
 			layout.Flexed(1, func(gtx C) D {
 				return layout.Flex{Axis: layout.Vertical}.Layout(gtx,
+					layout.Rigid(func(gtx C) D {
+						return vm.layoutUnsavedIndicator(gtx, th)
+					}),
 					layout.Rigid(banner),
 					layout.Flexed(1.0, view.Layout),
 				)
@@ -332,6 +387,38 @@ func (vm *viewManager) layoutCurrentView(gtx layout.Context) layout.Dimensions {
 	return dimensions
 }
 
+// layoutUnsavedIndicator displays a strip warning that messages are not
+// being saved, either because the session is incognito or because the
+// store could not be opened.
+func (vm *viewManager) layoutUnsavedIndicator(gtx C, th *sprigTheme.Theme) D {
+	var text string
+	if vm.App.Arbor().Incognito() {
+		text = "Incognito: messages are not saved"
+	} else if vm.App.Arbor().StoreError() != nil {
+		text = "Not saving messages"
+	} else {
+		return D{}
+	}
+	theme := *(th.Theme)
+	theme.Palette = sprigTheme.ApplyAsContrast(theme.Palette, th.Primary.Dark)
+	return layout.Stack{}.Layout(gtx,
+		layout.Expanded(func(gtx C) D {
+			paint.FillShape(gtx.Ops, theme.ContrastBg, clip.Rect(image.Rectangle{Max: gtx.Constraints.Min}).Op())
+			return D{Size: gtx.Constraints.Min}
+		}),
+		layout.Stacked(func(gtx C) D {
+			gtx.Constraints.Min.X = gtx.Constraints.Max.X
+			return layout.UniformInset(unit.Dp(2)).Layout(gtx, func(gtx C) D {
+				return layout.Center.Layout(gtx, func(gtx C) D {
+					label := material.Body2(&theme, text)
+					label.Color = theme.ContrastFg
+					return label.Layout(gtx)
+				})
+			})
+		}),
+	)
+}
+
 func (vm *viewManager) layoutProfileTimings(gtx layout.Context) layout.Dimensions {
 	if !vm.profiling {
 		return D{}
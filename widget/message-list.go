@@ -1,8 +1,6 @@
 package widget
 
 import (
-	"strings"
-
 	"gioui.org/layout"
 	"gioui.org/widget"
 	"gioui.org/x/markdown"
@@ -18,6 +16,7 @@ type MessageListEventType uint8
 const (
 	LinkOpen MessageListEventType = iota
 	LinkLongPress
+	RetryDelivery
 )
 
 // MessageListEvent describes a user interaction with the message list.
@@ -26,6 +25,7 @@ type MessageListEvent struct {
 	// Data contains event-specific content:
 	// - LinkOpened: the hyperlink being opened
 	// - LinkLongPressed: the hyperlink that was longpressed
+	// - RetryDelivery: the ID of the reply whose delivery should be retried
 	Data string
 }
 
@@ -37,6 +37,9 @@ type MessageList struct {
 	StatusOf       func(reply ds.ReplyData) ReplyStatus
 	HiddenChildren func(reply ds.ReplyData) int
 	UserIsActive   func(identity *fields.QualifiedHash) bool
+	// DeliveryOf describes the delivery status of a locally authored reply.
+	// An empty description indicates that there is nothing to display.
+	DeliveryOf func(reply ds.ReplyData) (description string, retryable bool)
 	Animation
 	events []MessageListEvent
 }
@@ -77,6 +80,12 @@ func (m *MessageList) Layout(gtx layout.Context) layout.Dimensions {
 	return layout.Dimensions{}
 }
 
+// RequestRetry records that the user asked to retry delivering the reply with
+// the given ID.
+func (m *MessageList) RequestRetry(id *fields.QualifiedHash) {
+	m.events = append(m.events, MessageListEvent{Type: RetryDelivery, Data: id.String()})
+}
+
 // Events returns user interactions with the message list that have occurred
 // since the last call to Events().
 func (m *MessageList) Events() []MessageListEvent {
@@ -151,55 +160,20 @@ func (a *Animation) Update(gtx layout.Context, replyID *fields.QualifiedHash, s
 	return anim
 }
 
-type ReplyStatus int
+// ReplyStatus describes the relationship of a reply to the focused reply.
+type ReplyStatus = ds.ReplyStatus
 
 const (
-	None ReplyStatus = 1 << iota
-	Sibling
-	Selected
-	Ancestor
-	Descendant
-	ConversationRoot
-	// Anchor indicates that this node is visible, but its descendants have been
-	// hidden.
-	Anchor
-	// Hidden indicates that this node is not currently visible.
-	Hidden
+	None             = ds.None
+	Sibling          = ds.Sibling
+	Selected         = ds.Selected
+	Ancestor         = ds.Ancestor
+	Descendant       = ds.Descendant
+	ConversationRoot = ds.ConversationRoot
+	Anchor           = ds.Anchor
+	Hidden           = ds.Hidden
 )
 
-func (r ReplyStatus) Contains(other ReplyStatus) bool {
-	return r&other > 0
-}
-
-func (r ReplyStatus) String() string {
-	var out []string
-	if r.Contains(None) {
-		out = append(out, "None")
-	}
-	if r.Contains(Sibling) {
-		out = append(out, "Sibling")
-	}
-	if r.Contains(Selected) {
-		out = append(out, "Selected")
-	}
-	if r.Contains(Ancestor) {
-		out = append(out, "Ancestor")
-	}
-	if r.Contains(Descendant) {
-		out = append(out, "Descendant")
-	}
-	if r.Contains(ConversationRoot) {
-		out = append(out, "ConversationRoot")
-	}
-	if r.Contains(Anchor) {
-		out = append(out, "Anchor")
-	}
-	if r.Contains(Hidden) {
-		out = append(out, "Hidden")
-	}
-	return strings.Join(out, "|")
-}
-
 // ReplyAnimationState holds the state of an in-progress animation for a reply.
 // The anim.Normal field defines how far through the animation the node is, and
 // the Begin and End fields define the two states that the node is transitioning
@@ -5,6 +5,7 @@ import (
 	"gioui.org/io/pointer"
 	"gioui.org/layout"
 	"gioui.org/op"
+	"gioui.org/widget"
 	"gioui.org/x/richtext"
 	"git.sr.ht/~whereswaldon/forest-go/fields"
 )
@@ -16,6 +17,8 @@ type Reply struct {
 	Polyclick
 	richtext.InteractiveText
 	ReplyStatus
+	// Retry is clicked to request that a failed delivery be attempted again.
+	Retry widget.Clickable
 	gesture.Drag
 	dragStart, dragOffset float32
 	dragFinished          bool
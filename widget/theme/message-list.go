@@ -162,6 +162,10 @@ func (m MessageListStyle) Layout(gtx C) D {
 								if anim.Begin&sprigWidget.Anchor > 0 {
 									rs = rs.Anchoring(th.Theme, m.State.HiddenChildren(reply))
 								}
+								if m.State.DeliveryOf != nil {
+									description, _ := m.State.DeliveryOf(reply)
+									rs = rs.Delivering(th.Theme, description)
+								}
 
 								return rs.Layout(gtx)
 							})
@@ -173,6 +177,18 @@ func (m MessageListStyle) Layout(gtx C) D {
 								Polyclick.
 								Layout(gtx)
 						}),
+						layout.Expanded(func(gtx C) D {
+							if m.State.DeliveryOf == nil {
+								return D{}
+							}
+							if _, retryable := m.State.DeliveryOf(reply); !retryable {
+								return D{}
+							}
+							if state.Retry.Clicked(gtx) {
+								m.State.RequestRetry(reply.ID)
+							}
+							return RetryButton(th.Theme, &state.Retry)(gtx)
+						}),
 					)
 					return D{
 						Size: image.Point{
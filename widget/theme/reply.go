@@ -151,6 +151,10 @@ type ReplyStyle struct {
 	// Whether or not to render the user as active
 	ShowActive bool
 
+	// DeliveryText describes the delivery status of a locally authored
+	// message. It is only displayed if set.
+	DeliveryText material.LabelStyle
+
 	// Special text to overlay atop the message contents. Used for displaying
 	// messages on anchor nodes with hidden children.
 	AnchorText material.LabelStyle
@@ -158,6 +162,9 @@ type ReplyStyle struct {
 	Content richtext.TextStyle
 
 	AuthorNameStyle
+	// SignatureBadge reports whether the reply's signature was verified
+	// against its author.
+	SignatureBadge     material.LabelStyle
 	CommunityNameStyle ForestRefStyle
 	DateStyle          material.LabelStyle
 
@@ -199,6 +206,7 @@ func Reply(th *Theme, status *sprigWidget.ReplyAnimationState, nodes ds.ReplyDat
 		theme.Palette = ApplyAsNormal(th.Palette, th.Primary.Dark)
 		rs.BadgeText = material.Body2(&theme, "Root")
 	}
+	rs.SignatureBadge = SignatureBadge(th, nodes.Signature)
 	rs.DateStyle = material.Body2(th.Theme, nodes.CreatedAt.Local().Format("2006/01/02 15:04"))
 	rs.DateStyle.MaxLines = 1
 	rs.DateStyle.Color.A = 200
@@ -206,6 +214,28 @@ func Reply(th *Theme, status *sprigWidget.ReplyAnimationState, nodes ds.ReplyDat
 	return rs
 }
 
+// SignatureBadge returns a label describing the outcome of checking a
+// reply's signature.
+func SignatureBadge(th *Theme, status ds.SignatureStatus) material.LabelStyle {
+	var badge material.LabelStyle
+	switch status {
+	case ds.SignatureUnchecked:
+		badge = material.Caption(th.Theme, "")
+	case ds.SignatureVerified:
+		badge = material.Caption(th.Theme, "verified")
+		badge.Color = th.Primary.Default.Bg
+	case ds.SignatureUnverifiable:
+		badge = material.Caption(th.Theme, "unknown author")
+		badge.Color = th.Secondary.Dark.Bg
+	default:
+		badge = material.Caption(th.Theme, "invalid signature")
+		badge.Color = th.Secondary.Dark.Bg
+		badge.Font.Weight = font.Bold
+	}
+	badge.MaxLines = 1
+	return badge
+}
+
 // Anchoring modifies the ReplyStyle to indicate that it is hiding some number
 // of other nodes.
 func (r ReplyStyle) Anchoring(th *material.Theme, numNodes int) ReplyStyle {
@@ -213,6 +243,30 @@ func (r ReplyStyle) Anchoring(th *material.Theme, numNodes int) ReplyStyle {
 	return r
 }
 
+// Delivering modifies the ReplyStyle to display the delivery status of a
+// locally authored message.
+func (r ReplyStyle) Delivering(th *material.Theme, description string) ReplyStyle {
+	if description != "" {
+		r.DeliveryText = material.Caption(th, description)
+		r.DeliveryText.MaxLines = 2
+	}
+	return r
+}
+
+// RetryButton lays out a button requesting that a failed message delivery be
+// attempted again. It is meant to be stacked atop a reply.
+func RetryButton(th *material.Theme, btn *widget.Clickable) layout.Widget {
+	return func(gtx C) D {
+		return layout.SE.Layout(gtx, func(gtx C) D {
+			return layout.UniformInset(unit.Dp(4)).Layout(gtx, func(gtx C) D {
+				button := material.Button(th, btn, "Retry")
+				button.Inset = layout.UniformInset(unit.Dp(6))
+				return button.Layout(gtx)
+			})
+		})
+	}
+}
+
 // Layout renders the ReplyStyle.
 func (r ReplyStyle) Layout(gtx layout.Context) layout.Dimensions {
 	var progress float32
@@ -251,6 +305,20 @@ func (r ReplyStyle) Layout(gtx layout.Context) layout.Dimensions {
 							layout.Rigid(func(gtx C) D {
 								return r.Padding.Layout(gtx, r.layoutContents)
 							}),
+							layout.Rigid(func(gtx C) D {
+								if r.DeliveryText == (material.LabelStyle{}) {
+									return D{}
+								}
+								return layout.Inset{
+									Left:   r.Padding.Left,
+									Right:  r.Padding.Right,
+									Bottom: r.Padding.Bottom,
+								}.Layout(gtx, func(gtx C) D {
+									text := r.DeliveryText
+									text.Color = r.finalConfig.TextColor
+									return text.Layout(gtx)
+								})
+							}),
 							layout.Rigid(func(gtx C) D {
 								if isConversationRoot {
 									gtx.Constraints.Min.X = gtx.Constraints.Max.X
@@ -317,7 +385,19 @@ func (r ReplyStyle) layoutMetadata(gtx layout.Context) layout.Dimensions {
 	author.NameStyle.Color = r.finalConfig.TextColor
 	author.SuffixStyle.Color = r.finalConfig.TextColor
 	author.ActivityIndicatorStyle.Color.A = r.finalConfig.TextColor.A
-	nameDim := inset.Layout(gtx, author.Layout)
+	badge := r.SignatureBadge
+	badge.Color.A = r.finalConfig.TextColor.A
+	nameDim := inset.Layout(gtx, func(gtx C) D {
+		return layout.Flex{Alignment: layout.Baseline}.Layout(gtx,
+			layout.Rigid(author.Layout),
+			layout.Rigid(func(gtx C) D {
+				if badge.Text == "" {
+					return D{}
+				}
+				return layout.Inset{Left: unit.Dp(4)}.Layout(gtx, badge.Layout)
+			}),
+		)
+	})
 	nameWidget := nameMacro.Stop()
 
 	communityMacro := op.Record(gtx.Ops)
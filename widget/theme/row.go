@@ -25,6 +25,8 @@ type ReplyRowStyle struct {
 	MaxWidth unit.Dp
 	ReplyStyle
 	*sprigwidget.Reply
+	// retry is displayed atop the message if set.
+	retry layout.Widget
 }
 
 var DefaultMaxWidth = unit.Dp(600)
@@ -39,6 +41,16 @@ func ReplyRow(th *Theme, state *sprigwidget.Reply, anim *sprigwidget.ReplyAnimat
 	}
 }
 
+// Delivering configures the row to display the delivery status of a locally
+// authored message, optionally with a button to retry a failed delivery.
+func (r ReplyRowStyle) Delivering(th *Theme, description string, retryable bool) ReplyRowStyle {
+	r.ReplyStyle = r.ReplyStyle.Delivering(th.Theme, description)
+	if retryable {
+		r.retry = RetryButton(th.Theme, &r.Reply.Retry)
+	}
+	return r
+}
+
 // Layout the row.
 func (r ReplyRowStyle) Layout(gtx C) D {
 	return r.VerticalMarginStyle.Layout(gtx, func(gtx C) D {
@@ -54,6 +66,12 @@ func (r ReplyRowStyle) Layout(gtx C) D {
 			return layout.Stack{}.Layout(gtx,
 				layout.Stacked(r.ReplyStyle.Layout),
 				layout.Expanded(r.Reply.Polyclick.Layout),
+				layout.Expanded(func(gtx C) D {
+					if r.retry == nil {
+						return D{}
+					}
+					return r.retry(gtx)
+				}),
 			)
 		})
 		call := macro.Stop()